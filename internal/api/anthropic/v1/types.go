@@ -0,0 +1,177 @@
+package anthropic
+
+import "encoding/json"
+
+// Types of content blocks
+const (
+	BlockText       = "text"
+	BlockImage      = "image"
+	BlockToolUse    = "tool_use"
+	BlockToolResult = "tool_result"
+	BlockThinking   = "thinking"
+)
+
+// Reasons a message stopped
+const (
+	StopEndTurn   = "end_turn"
+	StopMaxTokens = "max_tokens"
+	StopToolUse   = "tool_use"
+	StopRefusal   = "refusal"
+)
+
+// Request represents a request to the Anthropic Messages API
+type Request struct {
+	Model     string    `json:"model"`
+	MaxTokens int       `json:"max_tokens"`
+	Messages  []Message `json:"messages"`
+	// System is either a single string or an array of text blocks
+	System        Content     `json:"system,omitempty"`
+	StopSequences []string    `json:"stop_sequences,omitempty"`
+	Stream        bool        `json:"stream"`
+	Temperature   *float64    `json:"temperature,omitempty"`
+	TopP          *float64    `json:"top_p,omitempty"`
+	TopK          *int        `json:"top_k,omitempty"`
+	Tools         []Tool      `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice `json:"tool_choice,omitempty"`
+	Metadata      any         `json:"metadata,omitempty"`
+}
+
+// Message is a single turn of the conversation
+type Message struct {
+	Role string `json:"role"`
+	// Content is either a single string or an array of content blocks
+	Content Content `json:"content"`
+}
+
+// Content holds content blocks. On the wire it may be either a single string,
+// which is a text block, or an array of blocks.
+type Content []Block
+
+func (c *Content) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = Content{{Type: BlockText, Text: text}}
+		return nil
+	}
+	var blocks []Block
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// Block is a content block. Which fields are set depends on its type.
+type Block struct {
+	Type string `json:"type"`
+	// Text is set on text blocks
+	Text string `json:"text,omitempty"`
+	// ID, Name and Input are set on tool_use blocks
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+	// ToolUseID, Content and IsError are set on tool_result blocks
+	ToolUseID string  `json:"tool_use_id,omitempty"`
+	Content   Content `json:"content,omitempty"`
+	IsError   bool    `json:"is_error,omitempty"`
+	// Thinking and Signature are set on thinking blocks
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// MarshalJSON writes only the fields of the block's type, including empty
+// ones such as the text of a text block which is still being streamed
+func (b Block) MarshalJSON() ([]byte, error) {
+	switch b.Type {
+	case BlockText:
+		return json.Marshal(struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}{b.Type, b.Text})
+	case BlockToolUse:
+		return json.Marshal(struct {
+			Type  string `json:"type"`
+			ID    string `json:"id"`
+			Name  string `json:"name"`
+			Input any    `json:"input"`
+		}{b.Type, b.ID, b.Name, b.Input})
+	case BlockThinking:
+		return json.Marshal(struct {
+			Type      string `json:"type"`
+			Thinking  string `json:"thinking"`
+			Signature string `json:"signature"`
+		}{b.Type, b.Thinking, b.Signature})
+	}
+	type block Block
+	return json.Marshal(block(b))
+}
+
+// Tool is a tool the model may use
+type Tool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+// ToolChoice controls how the model uses tools
+type ToolChoice struct {
+	// Type is one of "auto", "any", "tool" or "none"
+	Type string `json:"type"`
+	// Name is the tool to use when Type is "tool"
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// Response represents a response from the Messages API
+type Response struct {
+	ID           string  `json:"id"`
+	Type         string  `json:"type"`
+	Role         string  `json:"role"`
+	Model        string  `json:"model"`
+	Content      []Block `json:"content"`
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+	Usage        Usage   `json:"usage"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// StreamEvent is an event of a streamed message. Which fields are set depends
+// on the type of the event.
+type StreamEvent struct {
+	Type         string    `json:"type"`
+	Message      *Response `json:"message,omitempty"`
+	Index        *int      `json:"index,omitempty"`
+	ContentBlock *Block    `json:"content_block,omitempty"`
+	Delta        any       `json:"delta,omitempty"`
+	Usage        *Usage    `json:"usage,omitempty"`
+	Error        *Error    `json:"error,omitempty"`
+}
+
+// BlockDelta is the delta of a content_block_delta event
+type BlockDelta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+	Thinking    string `json:"thinking,omitempty"`
+}
+
+// MessageDelta is the delta of a message_delta event
+type MessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+// ErrorResponse is the body of an Anthropic-format error response
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
@@ -5,10 +5,54 @@ type Request struct {
 	Model       string    `json:"model"`
 	Messages    []Message `json:"messages"`
 	Stream      bool      `json:"stream"`
+	N           *int      `json:"n,omitempty"`
 	Temperature float64   `json:"temperature,omitempty"`
 	MaxTokens   int       `json:"max_tokens,omitempty"`
 	Tools       []Tool    `json:"tools,omitempty"`
 	ToolChoice  string    `json:"tool_choice,omitempty"`
+	// ParallelToolCalls is only supported by OpenRouter
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+	StreamOptions     *StreamOptions  `json:"stream_options,omitempty"`
+	TopP              *float64        `json:"top_p,omitempty"`
+	Stop              []string        `json:"stop,omitempty"`
+	Seed              *int            `json:"seed,omitempty"`
+	FrequencyPenalty  *float64        `json:"frequency_penalty,omitempty"`
+	PresencePenalty   *float64        `json:"presence_penalty,omitempty"`
+	ResponseFormat    *ResponseFormat `json:"response_format,omitempty"`
+	// LogitBias is only supported by OpenRouter
+	LogitBias   map[string]int `json:"logit_bias,omitempty"`
+	Logprobs    *bool          `json:"logprobs,omitempty"`
+	TopLogprobs *int           `json:"top_logprobs,omitempty"`
+	// Reasoning and Usage are only supported by OpenRouter
+	Reasoning *Reasoning    `json:"reasoning,omitempty"`
+	Usage     *UsageOptions `json:"usage,omitempty"`
+}
+
+// UsageOptions configures the usage OpenRouter reports
+type UsageOptions struct {
+	// Include reports the cost of the request in its usage
+	Include bool `json:"include"`
+}
+
+// Reasoning configures the reasoning tokens of OpenRouter's reasoning models
+type Reasoning struct {
+	Effort    string `json:"effort,omitempty"`
+	MaxTokens *int   `json:"max_tokens,omitempty"`
+	Exclude   *bool  `json:"exclude,omitempty"`
+	Enabled   *bool  `json:"enabled,omitempty"`
+}
+
+// ResponseFormat constrains the format of the model output. DeepSeek only
+// supports the "text" and "json_object" types, but OpenRouter, which shares
+// these types, also accepts "json_schema".
+type ResponseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema any    `json:"json_schema,omitempty"`
+}
+
+// StreamOptions configures a streaming response
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 // Message represents a chat message in DeepSeek format
@@ -18,6 +62,11 @@ type Message struct {
 	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string     `json:"tool_call_id,omitempty"`
 	Name       string     `json:"name,omitempty"`
+	// ReasoningContent is only set on responses from deepseek-reasoner. It
+	// must not be sent back upstream in subsequent requests.
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	// Reasoning is OpenRouter's name for ReasoningContent
+	Reasoning string `json:"reasoning,omitempty"`
 }
 
 // This is duplicate of openai.Function, but we should keep it here to avoid circular dependency
@@ -54,13 +103,54 @@ type Response struct {
 }
 
 type Usage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens            int                      `json:"prompt_tokens"`
+	CompletionTokens        int                      `json:"completion_tokens"`
+	TotalTokens             int                      `json:"total_tokens"`
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+	// Cost is only reported by OpenRouter
+	Cost *float64 `json:"cost,omitempty"`
+}
+
+type CompletionTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 type Choice struct {
 	Index        int     `json:"index"`
 	Message      Message `json:"message"`
 	FinishReason string  `json:"finish_reason"`
+	Logprobs     any     `json:"logprobs,omitempty"`
+}
+
+// CompletionRequest is a request to the fill-in-the-middle completions API of
+// the DeepSeek beta
+type CompletionRequest struct {
+	Model            string         `json:"model"`
+	Prompt           string         `json:"prompt"`
+	Suffix           string         `json:"suffix,omitempty"`
+	Stream           bool           `json:"stream"`
+	StreamOptions    *StreamOptions `json:"stream_options,omitempty"`
+	MaxTokens        int            `json:"max_tokens,omitempty"`
+	Temperature      *float64       `json:"temperature,omitempty"`
+	TopP             *float64       `json:"top_p,omitempty"`
+	Stop             []string       `json:"stop,omitempty"`
+	FrequencyPenalty *float64       `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64       `json:"presence_penalty,omitempty"`
+}
+
+// CompletionResponse is a response from the completions API. Stream chunks
+// share the same shape, with usage only set on the last chunk.
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Index        int    `json:"index"`
+	Text         string `json:"text"`
+	FinishReason string `json:"finish_reason"`
 }
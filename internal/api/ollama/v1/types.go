@@ -2,11 +2,29 @@ package ollama
 
 // Request represents a request to the Ollama API
 type Request struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+	Options  *Options  `json:"options,omitempty"`
+	Tools    []Tool    `json:"tools,omitempty"`
+	// Format is either "json" or a JSON schema object
+	Format any `json:"format,omitempty"`
+}
+
+// Options are the model parameters of an Ollama request
+type Options struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	// NumPredict is the maximum number of tokens to generate
+	NumPredict *int `json:"num_predict,omitempty"`
+	// NumCtx is the size of the context window
+	NumCtx           *int     `json:"num_ctx,omitempty"`
+	TopK             *int     `json:"top_k,omitempty"`
+	RepeatPenalty    *float64 `json:"repeat_penalty,omitempty"`
+	TopP             *float64 `json:"top_p,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
 }
 
 // Response represents a response from the Ollama API
@@ -15,10 +33,91 @@ type Response struct {
 	CreatedAt string  `json:"created_at"`
 	Message   Message `json:"message"`
 	Done      bool    `json:"done"`
+	// DoneReason is why generation stopped, such as "stop" or "length"
+	DoneReason string `json:"done_reason,omitempty"`
+	// Token counts and durations, in nanoseconds, are only set on the final
+	// message
+	PromptEvalCount    int   `json:"prompt_eval_count,omitempty"`
+	EvalCount          int   `json:"eval_count,omitempty"`
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
 }
 
 // Message represents a chat message in Ollama format
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Thinking is the reasoning of thinking models when thinking is enabled
+	Thinking  string     `json:"thinking,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolName is the name of the tool whose result a tool message carries
+	ToolName string `json:"tool_name,omitempty"`
+}
+
+// Tool represents an available tool
+type Tool struct {
+	Type     string   `json:"type"`
+	Function Function `json:"function"`
+}
+
+// Function represents a callable function
+type Function struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters"`
+}
+
+// ToolCall represents a call to a tool. Ollama only returns IDs since 0.12.
+type ToolCall struct {
+	ID       string           `json:"id,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction holds the called function. Unlike OpenAI, the arguments
+// are a JSON object rather than a string.
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments any    `json:"arguments"`
+}
+
+// TagsResponse is the response of the model listing endpoint, /api/tags
+type TagsResponse struct {
+	Models []ModelTag `json:"models"`
+}
+
+// ModelTag describes a locally available model
+type ModelTag struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model"`
+	ModifiedAt string       `json:"modified_at"`
+	Size       int64        `json:"size"`
+	Digest     string       `json:"digest"`
+	Details    ModelDetails `json:"details"`
+}
+
+// ModelDetails describes the format and family of a model
+type ModelDetails struct {
+	Format            string `json:"format,omitempty"`
+	Family            string `json:"family,omitempty"`
+	ParameterSize     string `json:"parameter_size,omitempty"`
+	QuantizationLevel string `json:"quantization_level,omitempty"`
+}
+
+// ErrorResponse is the body of an Ollama error response
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// EmbedRequest is a request to the embed route of the Ollama API
+type EmbedRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+// EmbedResponse holds the embedding of each input of an EmbedRequest
+type EmbedResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float64 `json:"embeddings"`
 }
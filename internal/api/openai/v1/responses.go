@@ -0,0 +1,178 @@
+package openai
+
+import "encoding/json"
+
+// Types of the items in the input and output of the Responses API
+const (
+	ResponseItemMessage            = "message"
+	ResponseItemFunctionCall       = "function_call"
+	ResponseItemFunctionCallOutput = "function_call_output"
+	ResponseItemReasoning          = "reasoning"
+)
+
+// Statuses of a response and of its output items
+const (
+	ResponseStatusInProgress = "in_progress"
+	ResponseStatusCompleted  = "completed"
+	ResponseStatusIncomplete = "incomplete"
+	ResponseStatusFailed     = "failed"
+)
+
+// ResponseRequest is a request to the Responses API
+type ResponseRequest struct {
+	Model string `json:"model"`
+	// Input is either a single string or an array of items
+	Input             ResponseInput  `json:"input"`
+	Instructions      string         `json:"instructions,omitempty"`
+	Tools             []ResponseTool `json:"tools,omitempty"`
+	ToolChoice        any            `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool          `json:"parallel_tool_calls,omitempty"`
+	Stream            bool           `json:"stream"`
+	Temperature       *float64       `json:"temperature,omitempty"`
+	TopP              *float64       `json:"top_p,omitempty"`
+	MaxOutputTokens   *int           `json:"max_output_tokens,omitempty"`
+	Text              *ResponseText  `json:"text,omitempty"`
+	// PreviousResponseID is not supported since responses are not stored
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Store              *bool             `json:"store,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	User               string            `json:"user,omitempty"`
+}
+
+// ResponseInput holds the input items of a request. On the wire it may be
+// either a single string, which is a user message, or an array of items.
+type ResponseInput []ResponseItem
+
+func (in *ResponseInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = ResponseInput{{
+			Type:    ResponseItemMessage,
+			Role:    "user",
+			Content: ResponseContent{{Type: "input_text", Text: text}},
+		}}
+		return nil
+	}
+	var items []ResponseItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	*in = items
+	return nil
+}
+
+// ResponseItem is an input or output item. Which fields are set depends on
+// the type of the item.
+type ResponseItem struct {
+	Type   string `json:"type,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+	// Role and Content are set on messages
+	Role    string          `json:"role,omitempty"`
+	Content ResponseContent `json:"content,omitempty"`
+	// CallID, Name and Arguments are set on function calls, and CallID and
+	// Output on their outputs
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	Output    any    `json:"output,omitempty"`
+	// Summary is set on reasoning items
+	Summary []ResponseContentPart `json:"summary,omitempty"`
+}
+
+// ResponseContent holds the content parts of a message. On the wire it may be
+// either a single string or an array of parts.
+type ResponseContent []ResponseContentPart
+
+func (c *ResponseContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ResponseContent{{Type: "input_text", Text: text}}
+		return nil
+	}
+	var parts []ResponseContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	*c = parts
+	return nil
+}
+
+// ResponseContentPart is a part of a message, such as input_text or
+// output_text, or of a reasoning summary
+type ResponseContentPart struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// ResponseTool is a tool the model may call. Only function tools are
+// supported.
+type ResponseTool struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+	Strict      *bool  `json:"strict,omitempty"`
+}
+
+// ResponseText configures the text output of the model
+type ResponseText struct {
+	Format *ResponseTextFormat `json:"format,omitempty"`
+}
+
+// ResponseTextFormat is the format of the text output, one of "text",
+// "json_object" or "json_schema"
+type ResponseTextFormat struct {
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Schema      any    `json:"schema,omitempty"`
+	Strict      *bool  `json:"strict,omitempty"`
+}
+
+// Response is a response from the Responses API
+type Response struct {
+	ID                string                     `json:"id"`
+	Object            string                     `json:"object"`
+	CreatedAt         int64                      `json:"created_at"`
+	Status            string                     `json:"status"`
+	Model             string                     `json:"model"`
+	Output            []ResponseItem             `json:"output"`
+	Usage             *ResponseUsage             `json:"usage,omitempty"`
+	IncompleteDetails *ResponseIncompleteDetails `json:"incomplete_details"`
+	Error             *Error                     `json:"error"`
+	Instructions      string                     `json:"instructions,omitempty"`
+	Metadata          map[string]string          `json:"metadata,omitempty"`
+}
+
+// ResponseUsage is the token usage of a response
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ResponseIncompleteDetails explains why a response is incomplete
+type ResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// ResponseStreamEvent is an event of a streamed response. Which fields are set
+// depends on the type of the event.
+type ResponseStreamEvent struct {
+	Type           string               `json:"type"`
+	SequenceNumber int                  `json:"sequence_number"`
+	Response       *Response            `json:"response,omitempty"`
+	OutputIndex    *int                 `json:"output_index,omitempty"`
+	ContentIndex   *int                 `json:"content_index,omitempty"`
+	SummaryIndex   *int                 `json:"summary_index,omitempty"`
+	ItemID         string               `json:"item_id,omitempty"`
+	Item           *ResponseItem        `json:"item,omitempty"`
+	Part           *ResponseContentPart `json:"part,omitempty"`
+	Delta          string               `json:"delta,omitempty"`
+	Text           *string              `json:"text,omitempty"`
+	Arguments      *string              `json:"arguments,omitempty"`
+	// Code and Message are set on error events
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
@@ -3,20 +3,197 @@ package openai
 import (
 	"context"
 	"encoding/json"
+	"reflect"
+	"strings"
 
 	"github.com/danilofalcao/cursor-deepseek/internal/logger"
 )
 
 // ChatCompletionRequest represents an OpenAI-compatible chat completion request
 type ChatCompletionRequest struct {
-	Model       string     `json:"model"`
-	Messages    []Message  `json:"messages"`
-	Stream      bool       `json:"stream"`
-	Temperature *float64   `json:"temperature,omitempty"`
-	MaxTokens   *int       `json:"max_tokens,omitempty"`
-	Functions   []Function `json:"functions,omitempty"`
-	Tools       []Tool     `json:"tools,omitempty"`
-	ToolChoice  any        `json:"tool_choice,omitempty"`
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+	// N is the number of choices to generate
+	N           *int     `json:"n,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	// MaxCompletionTokens replaces MaxTokens in newer clients
+	MaxCompletionTokens *int       `json:"max_completion_tokens,omitempty"`
+	Functions           []Function `json:"functions,omitempty"`
+	Tools               []Tool     `json:"tools,omitempty"`
+	ToolChoice          any        `json:"tool_choice,omitempty"`
+	// ParallelToolCalls controls whether the model may call several tools at once
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// StreamOptions is only valid when Stream is true
+	StreamOptions    *StreamOptions  `json:"stream_options,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	Stop             Stop            `json:"stop,omitempty"`
+	Seed             *int            `json:"seed,omitempty"`
+	FrequencyPenalty *float64        `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64        `json:"presence_penalty,omitempty"`
+	ResponseFormat   *ResponseFormat `json:"response_format,omitempty"`
+	LogitBias        map[string]int  `json:"logit_bias,omitempty"`
+	Logprobs         *bool           `json:"logprobs,omitempty"`
+	TopLogprobs      *int            `json:"top_logprobs,omitempty"`
+	// ReasoningEffort is OpenAI's low, medium or high effort of reasoning
+	// models
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	// Reasoning is OpenRouter's reasoning option, which ReasoningEffort maps
+	// to unless it is set
+	Reasoning *Reasoning `json:"reasoning,omitempty"`
+
+	// Extra holds the fields the request has which aren't known here, such as
+	// provider-specific parameters, which are kept for backends forwarding
+	// requests as they are
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// chatCompletionRequestFields are the JSON names of the known fields of
+// ChatCompletionRequest
+var chatCompletionRequestFields = jsonFields(reflect.TypeFor[ChatCompletionRequest]())
+
+func (r *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
+	type plain ChatCompletionRequest
+	if err := json.Unmarshal(data, (*plain)(r)); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	r.Extra = nil
+	for name, value := range fields {
+		if chatCompletionRequestFields[name] {
+			continue
+		}
+		if r.Extra == nil {
+			r.Extra = make(map[string]json.RawMessage)
+		}
+		r.Extra[name] = value
+	}
+	return nil
+}
+
+func (r ChatCompletionRequest) MarshalJSON() ([]byte, error) {
+	type plain ChatCompletionRequest
+	data, err := json.Marshal(plain(r))
+	if err != nil || len(r.Extra) == 0 {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range r.Extra {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// jsonFields returns the JSON names of the fields of a struct type
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool, t.NumField())
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// Reasoning configures the reasoning tokens of reasoning models on OpenRouter
+type Reasoning struct {
+	// Effort is low, medium or high
+	Effort string `json:"effort,omitempty"`
+	// MaxTokens bounds the reasoning tokens, instead of Effort
+	MaxTokens *int `json:"max_tokens,omitempty"`
+	// Exclude uses reasoning without returning it
+	Exclude *bool `json:"exclude,omitempty"`
+	Enabled *bool `json:"enabled,omitempty"`
+}
+
+// ResponseFormat constrains the format of the model output
+type ResponseFormat struct {
+	// Type is one of "text", "json_object" or "json_schema"
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema describes the schema for structured outputs
+type JSONSchema struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Schema      any    `json:"schema,omitempty"`
+	Strict      *bool  `json:"strict,omitempty"`
+}
+
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// Stop holds up to 4 stop sequences. On the wire it may be either a single
+// string or an array of strings.
+type Stop []string
+
+func (s *Stop) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = Stop{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*s = multiple
+	return nil
+}
+
+// StreamOptions configures a streaming response
+type StreamOptions struct {
+	// IncludeUsage requests a final chunk, with an empty choices array,
+	// carrying the token usage of the whole request
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// IncludeUsage returns whether the client requested a final usage chunk
+func (r *ChatCompletionRequest) IncludeUsage() bool {
+	return r != nil && r.Stream && r.StreamOptions != nil && r.StreamOptions.IncludeUsage
+}
+
+// CompletionTokenLimit returns the maximum number of tokens to generate,
+// preferring max_completion_tokens over the deprecated max_tokens
+func (r *ChatCompletionRequest) CompletionTokenLimit() *int {
+	if r.MaxCompletionTokens != nil {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+const (
+	RoleSystem = "system"
+	// RoleDeveloper replaces RoleSystem in newer clients
+	RoleDeveloper = "developer"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+	// RoleFunction is the result of a deprecated function call
+	RoleFunction = "function"
+)
+
+// NormalizeRole maps roles which only newer OpenAI models understand onto
+// their older equivalents
+func NormalizeRole(role string) string {
+	if role == RoleDeveloper {
+		return RoleSystem
+	}
+	return role
 }
 
 // Function represents a callable function
@@ -44,6 +221,21 @@ type ToolCallFunction struct {
 	Arguments string `json:"arguments"`
 }
 
+// ToolCallDelta is a fragment of a tool call in a streaming response. The ID,
+// type and function name are only sent in the first fragment of each call, and
+// the arguments of every fragment with the same index are concatenated.
+type ToolCallDelta struct {
+	Index    int                   `json:"index"`
+	ID       string                `json:"id,omitempty"`
+	Type     string                `json:"type,omitempty"`
+	Function ToolCallFunctionDelta `json:"function"`
+}
+
+type ToolCallFunctionDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
 // ChatCompletionResponse represents a chat completion response
 type ChatCompletionResponse struct {
 	ID      string   `json:"id"`
@@ -61,12 +253,32 @@ type ChatCompletionStreamResponse struct {
 	Created int64          `json:"created"`
 	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
-	Usage   Usage          `json:"usage"`
+	Usage   *Usage         `json:"usage,omitempty"`
 }
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+	// CompletionTokensDetails breaks the completion tokens down
+	CompletionTokensDetails *CompletionTokensDetails `json:"completion_tokens_details,omitempty"`
+	// Cost is what the upstream charged for the request in USD, if it reports
+	// it, as OpenRouter does
+	Cost *float64 `json:"cost,omitempty"`
+}
+
+// CompletionTokensDetails breaks the completion tokens of a usage down
+type CompletionTokensDetails struct {
+	// ReasoningTokens are the completion tokens reasoning models spent
+	// thinking, which are counted in the completion tokens
+	ReasoningTokens int `json:"reasoning_tokens"`
+}
+
+// ReasoningTokens returns the reasoning tokens of the usage, if any
+func (u Usage) ReasoningTokens() int {
+	if u.CompletionTokensDetails == nil {
+		return 0
+	}
+	return u.CompletionTokensDetails.ReasoningTokens
 }
 
 // Choice represents a completion choice
@@ -74,6 +286,35 @@ type Choice struct {
 	Index        int     `json:"index"`
 	Message      Message `json:"message"`
 	FinishReason string  `json:"finish_reason"`
+	// Logprobs is passed through from the upstream as-is
+	Logprobs any `json:"logprobs,omitempty"`
+}
+
+const (
+	FinishReasonStop          = "stop"
+	FinishReasonLength        = "length"
+	FinishReasonToolCalls     = "tool_calls"
+	FinishReasonContentFilter = "content_filter"
+)
+
+// NormalizeFinishReason maps an upstream finish reason onto the reasons
+// OpenAI clients understand. toolCalls is whether the choice called any
+// tools, which some upstreams report as a normal stop.
+func NormalizeFinishReason(reason string, toolCalls bool) string {
+	switch reason {
+	case "":
+		return ""
+	case FinishReasonStop, FinishReasonToolCalls, "load", "unload":
+		if toolCalls {
+			return FinishReasonToolCalls
+		}
+		return FinishReasonStop
+	case "insufficient_system_resource":
+		// DeepSeek cut the generation short
+		return FinishReasonLength
+	default:
+		return reason
+	}
 }
 
 // StreamChoice represents a streaming completion choice
@@ -81,6 +322,8 @@ type StreamChoice struct {
 	Index        int    `json:"index"`
 	Delta        Delta  `json:"delta"`
 	FinishReason string `json:"finish_reason,omitempty"`
+	// Logprobs is passed through from the upstream as-is
+	Logprobs any `json:"logprobs,omitempty"`
 }
 
 // Delta represents a streaming response delta
@@ -92,12 +335,22 @@ type Delta struct {
 	// - *Content_String
 	// - *Content_Array
 	Content isContent `json:"content"`
+	// ReasoningContent is the chain of thought of reasoning models such as deepseek-reasoner
+	ReasoningContent string          `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCallDelta `json:"tool_calls,omitempty"`
 }
 
 func (d *Delta) MarshalJSON() ([]byte, error) {
 
-	msgMap := map[string]interface{}{
-		"role": d.Role,
+	msgMap := map[string]interface{}{}
+	if d.Role != "" {
+		msgMap["role"] = d.Role
+	}
+	if d.ReasoningContent != "" {
+		msgMap["reasoning_content"] = d.ReasoningContent
+	}
+	if len(d.ToolCalls) > 0 {
+		msgMap["tool_calls"] = d.ToolCalls
 	}
 
 	switch d.Content.(type) {
@@ -122,6 +375,23 @@ func (d *Delta) UnmarshalJSON(data []byte) error {
 		d.Role = msg["role"].(string)
 	}
 
+	if reasoning, ok := msg["reasoning_content"].(string); ok {
+		d.ReasoningContent = reasoning
+	} else if reasoning, ok := msg["reasoning"].(string); ok {
+		// OpenRouter names the reasoning of its models reasoning
+		d.ReasoningContent = reasoning
+	}
+
+	if msg["tool_calls"] != nil {
+		var toolCalls struct {
+			ToolCalls []ToolCallDelta `json:"tool_calls"`
+		}
+		if err = json.Unmarshal(data, &toolCalls); err != nil {
+			return err
+		}
+		d.ToolCalls = toolCalls.ToolCalls
+	}
+
 	if msg["content"] != nil {
 		switch msg["content"].(type) {
 		case string:
@@ -173,24 +443,26 @@ type Message struct {
 	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string     `json:"tool_call_id,omitempty"`
 	Name       string     `json:"name,omitempty"`
+	// ReasoningContent is the chain of thought of reasoning models such as deepseek-reasoner
+	ReasoningContent string `json:"reasoning_content,omitempty"`
 }
 
 func (m *Message) MarshalJSON() ([]byte, error) {
-	toolCallsBytes, err := json.Marshal(m.ToolCalls)
-	if err != nil {
-		return nil, err
+	msgMap := map[string]interface{}{
+		"role": m.Role,
 	}
-
-	toolCallsIface := []interface{}{}
-	if err := json.Unmarshal(toolCallsBytes, &toolCallsIface); err != nil {
-		return nil, err
+	// Empty fields are omitted, as upstreams such as OpenAI reject an empty name
+	if len(m.ToolCalls) > 0 {
+		msgMap["tool_calls"] = m.ToolCalls
 	}
-
-	msgMap := map[string]interface{}{
-		"role":         m.Role,
-		"tool_calls":   toolCallsIface,
-		"tool_call_id": m.ToolCallID,
-		"name":         m.Name,
+	if m.ToolCallID != "" {
+		msgMap["tool_call_id"] = m.ToolCallID
+	}
+	if m.Name != "" {
+		msgMap["name"] = m.Name
+	}
+	if m.ReasoningContent != "" {
+		msgMap["reasoning_content"] = m.ReasoningContent
 	}
 
 	switch m.Content.(type) {
@@ -260,6 +532,10 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 		m.Name = msg["name"].(string)
 	}
 
+	if reasoning, ok := msg["reasoning_content"].(string); ok {
+		m.ReasoningContent = reasoning
+	}
+
 	return nil
 }
 
@@ -330,3 +606,74 @@ func (a Content_Array) GetContentPartTextAtIndex(index int) *ContentPart_Text {
 	}
 	return nil
 }
+
+// ErrorResponse is the body of an OpenAI-format error response
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// Error describes an OpenAI-format error
+type Error struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Param   string `json:"param,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// CompletionRequest is a request to the legacy /v1/completions API
+type CompletionRequest struct {
+	Model string `json:"model"`
+	// Prompt is either a single string or an array of strings
+	Prompt           Prompt         `json:"prompt"`
+	Suffix           string         `json:"suffix,omitempty"`
+	Stream           bool           `json:"stream"`
+	StreamOptions    *StreamOptions `json:"stream_options,omitempty"`
+	N                *int           `json:"n,omitempty"`
+	Echo             bool           `json:"echo,omitempty"`
+	MaxTokens        *int           `json:"max_tokens,omitempty"`
+	Temperature      *float64       `json:"temperature,omitempty"`
+	TopP             *float64       `json:"top_p,omitempty"`
+	Stop             Stop           `json:"stop,omitempty"`
+	Seed             *int           `json:"seed,omitempty"`
+	FrequencyPenalty *float64       `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64       `json:"presence_penalty,omitempty"`
+	LogitBias        map[string]int `json:"logit_bias,omitempty"`
+	User             string         `json:"user,omitempty"`
+}
+
+// Prompt holds the prompts of a completion request. On the wire it may be
+// either a single string or an array of strings.
+type Prompt []string
+
+func (p *Prompt) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*p = Prompt{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*p = multiple
+	return nil
+}
+
+// CompletionResponse is a response from the legacy /v1/completions API. Stream
+// chunks share the same shape.
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+// CompletionChoice is a single generated completion
+type CompletionChoice struct {
+	Index        int    `json:"index"`
+	Text         string `json:"text"`
+	Logprobs     any    `json:"logprobs"`
+	FinishReason string `json:"finish_reason,omitempty"`
+}
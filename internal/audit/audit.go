@@ -0,0 +1,247 @@
+// Package audit records the requests served by the proxy and their responses,
+// with streamed responses reassembled, to a JSON lines file
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+// maxBodySize caps how much of each request and response body is recorded
+const maxBodySize = 10 << 20
+
+const redacted = "[REDACTED]"
+
+// Options configures the audit log
+type Options struct {
+	// Path is the file records are appended to
+	Path string
+	// Redact are regular expressions whose matches are masked in every string
+	// of the recorded bodies, such as email addresses
+	Redact []string
+}
+
+// Log appends a record of every request to a file
+type Log struct {
+	mu       sync.Mutex
+	file     *os.File
+	patterns []*regexp.Regexp
+}
+
+// Record is an entry of the audit log
+type Record struct {
+	Time       time.Time   `json:"time"`
+	RequestID  string      `json:"request_id,omitempty"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Status     int         `json:"status"`
+	DurationMs int64       `json:"duration_ms"`
+	Headers    http.Header `json:"headers"`
+	Request    any         `json:"request,omitempty"`
+	Response   any         `json:"response,omitempty"`
+	// Stream is whether the response was streamed, in which case Response
+	// is the reassembled stream
+	Stream bool `json:"stream,omitempty"`
+	// Truncated is whether a body exceeded the recorded size
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// New opens the audit log
+func New(opts Options) (*Log, error) {
+	patterns := make([]*regexp.Regexp, 0, len(opts.Redact))
+	for _, expr := range opts.Redact {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid redaction pattern %s", expr)
+		}
+		patterns = append(patterns, re)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0o755); err != nil {
+		return nil, errors.Wrap(err, "error creating audit log directory")
+	}
+	file, err := os.OpenFile(opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening audit log")
+	}
+	return &Log{
+		file:     file,
+		patterns: patterns,
+	}, nil
+}
+
+// Close closes the audit log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Middleware records every request served by next
+func (l *Log) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := Record{
+			Time:      start.UTC(),
+			RequestID: contextutils.GetRequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Headers:   logger.RedactHeaders(r.Header),
+		}
+
+		// Uploads are left to stream through rather than buffered
+		if r.Body != nil && !isMediaType(r.Header.Get("Content-Type"), "multipart/form-data") {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if err == nil {
+				if len(body) > maxBodySize {
+					body = body[:maxBodySize]
+					record.Truncated = true
+				}
+				record.Request = l.decode(body)
+			}
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		record.Status = rec.status
+		record.DurationMs = time.Since(start).Milliseconds()
+		record.Truncated = record.Truncated || rec.truncated
+		switch contentType := w.Header().Get("Content-Type"); {
+		case isMediaType(contentType, "text/event-stream"):
+			record.Stream = true
+			record.Response = l.reassembleSSE(rec.body.Bytes())
+		case isMediaType(contentType, "application/x-ndjson"):
+			record.Stream = true
+			record.Response = l.decodeLines(rec.body.Bytes())
+		default:
+			record.Response = l.decode(rec.body.Bytes())
+		}
+
+		if err := l.write(record); err != nil {
+			ctx := r.Context()
+			logutils.FromContext(ctx).Error(ctx, err.Error())
+		}
+	})
+}
+
+func (l *Log) write(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "error encoding audit record")
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(data)
+	return errors.Wrap(err, "error writing audit record")
+}
+
+// decode parses a JSON body and scrubs its strings, falling back to the body
+// as a string if it isn't JSON
+func (l *Log) decode(body []byte) any {
+	if len(body) == 0 {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return l.scrubString(string(body))
+	}
+	return l.scrub(v)
+}
+
+// decodeLines decodes each line of a newline-delimited JSON stream
+func (l *Log) decodeLines(body []byte) []any {
+	var lines []any
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, l.decode(line))
+		}
+	}
+	return lines
+}
+
+// scrub masks secrets and the matches of the redaction patterns in every
+// string of v
+func (l *Log) scrub(v any) any {
+	switch v := v.(type) {
+	case string:
+		return l.scrubString(v)
+	case []any:
+		for i := range v {
+			v[i] = l.scrub(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = l.scrub(v[k])
+		}
+	}
+	return v
+}
+
+func (l *Log) scrubString(s string) string {
+	s = logger.Redact(s)
+	for _, re := range l.patterns {
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+func isMediaType(contentType, mediaType string) bool {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	return err == nil && parsed == mediaType
+}
+
+// recorder captures the status and body of a response as it is written
+type recorder struct {
+	http.ResponseWriter
+	status        int
+	headerWritten bool
+	body          bytes.Buffer
+	truncated     bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.headerWritten {
+		r.status = status
+		r.headerWritten = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.headerWritten = true
+	if room := maxBodySize - r.body.Len(); room < len(b) {
+		r.body.Write(b[:max(room, 0)])
+		r.truncated = true
+	} else {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
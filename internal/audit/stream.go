@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/sse"
+)
+
+const chunkObject = "chat.completion.chunk"
+
+// StreamedChoice is a choice of a streamed chat completion, reassembled from
+// its deltas
+type StreamedChoice struct {
+	Index            int               `json:"index"`
+	Content          string            `json:"content,omitempty"`
+	ReasoningContent string            `json:"reasoning_content,omitempty"`
+	ToolCalls        []openai.ToolCall `json:"tool_calls,omitempty"`
+	FinishReason     string            `json:"finish_reason,omitempty"`
+}
+
+// StreamedCompletion is a streamed chat completion, reassembled from its
+// chunks
+type StreamedCompletion struct {
+	ID      string           `json:"id,omitempty"`
+	Model   string           `json:"model,omitempty"`
+	Choices []StreamedChoice `json:"choices"`
+	Usage   *openai.Usage    `json:"usage,omitempty"`
+	// Events are the data events which aren't chat completion chunks, such as
+	// errors and the events of other APIs
+	Events []any `json:"events,omitempty"`
+}
+
+// reassembleSSE reassembles the chat completion chunks of a server-sent event
+// stream, keeping any other events as they are
+func (l *Log) reassembleSSE(body []byte) *StreamedCompletion {
+	completion := &StreamedCompletion{}
+	choices := map[int]*StreamedChoice{}
+	var order []int
+
+	reader := sse.NewReader(bytes.NewReader(body))
+	defer reader.Close()
+	for {
+		event, err := reader.Next()
+		if err != nil {
+			break
+		}
+		if event.IsComment() || event.Data == "" || event.Data == "[DONE]" {
+			continue
+		}
+
+		var chunk openai.ChatCompletionStreamResponse
+		if json.Unmarshal([]byte(event.Data), &chunk) != nil || chunk.Object != chunkObject {
+			completion.Events = append(completion.Events, l.decode([]byte(event.Data)))
+			continue
+		}
+
+		completion.ID = chunk.ID
+		completion.Model = chunk.Model
+		if chunk.Usage != nil {
+			completion.Usage = chunk.Usage
+		}
+		for _, c := range chunk.Choices {
+			choice, ok := choices[c.Index]
+			if !ok {
+				choice = &StreamedChoice{Index: c.Index}
+				choices[c.Index] = choice
+				order = append(order, c.Index)
+			}
+			if content, ok := c.Delta.Content.(openai.Content_String); ok {
+				choice.Content += content.Content
+			}
+			choice.ReasoningContent += c.Delta.ReasoningContent
+			for _, tc := range c.Delta.ToolCalls {
+				for len(choice.ToolCalls) <= tc.Index {
+					choice.ToolCalls = append(choice.ToolCalls, openai.ToolCall{})
+				}
+				call := &choice.ToolCalls[tc.Index]
+				if tc.ID != "" {
+					call.ID = tc.ID
+				}
+				if tc.Type != "" {
+					call.Type = tc.Type
+				}
+				call.Function.Name += tc.Function.Name
+				call.Function.Arguments += tc.Function.Arguments
+			}
+			if c.FinishReason != "" {
+				choice.FinishReason = c.FinishReason
+			}
+		}
+	}
+
+	for _, index := range order {
+		choice := choices[index]
+		choice.Content = l.scrubString(choice.Content)
+		choice.ReasoningContent = l.scrubString(choice.ReasoningContent)
+		for i := range choice.ToolCalls {
+			choice.ToolCalls[i].Function.Arguments = l.scrubString(choice.ToolCalls[i].Function.Arguments)
+		}
+		completion.Choices = append(completion.Choices, *choice)
+	}
+	return completion
+}
@@ -0,0 +1,32 @@
+package backend
+
+import "sync/atomic"
+
+// APIKeySetter is implemented by backends whose upstream API key can be
+// replaced while serving, such as when it is rotated
+type APIKeySetter interface {
+	SetAPIKey(apiKey string)
+}
+
+// APIKey is an upstream API key which may be replaced concurrently with its
+// use
+type APIKey struct {
+	key atomic.Pointer[string]
+}
+
+// NewAPIKey creates an API key holding key
+func NewAPIKey(key string) *APIKey {
+	k := &APIKey{}
+	k.Set(key)
+	return k
+}
+
+// Get returns the current key
+func (k *APIKey) Get() string {
+	return *k.key.Load()
+}
+
+// Set replaces the key
+func (k *APIKey) Set(key string) {
+	k.key.Store(&key)
+}
@@ -21,4 +21,36 @@ type Backend interface {
 
 	// ValidateAPIKey validates the provided API key
 	ValidateAPIKey(apiKey string) bool
+
+	// HealthCheck actively probes the upstream, returning an error if it is
+	// unable to serve requests
+	HealthCheck(ctx context.Context) error
+}
+
+// StatsProvider is implemented by backends which can report live statistics
+// about the traffic they serve
+type StatsProvider interface {
+	Stats() any
+}
+
+// Embedder is implemented by backends which can embed text, such as for the
+// semantic cache
+type Embedder interface {
+	// Embed returns the embedding of each input with the model
+	Embed(ctx context.Context, model string, input []string) ([][]float64, error)
+}
+
+// Switcher is implemented by backends which can be switched to another
+// backend or default model while requests are served, such as when a provider
+// has an outage
+type Switcher interface {
+	// Switch sends new requests to the named backend, or the configured one
+	// if name is empty, serving the models it doesn't map with defaultModel,
+	// or its configured default model if empty
+	Switch(name, defaultModel string) error
+	// Switched returns the backend and default model switched to, empty if
+	// the configured ones are used
+	Switched() (name, defaultModel string)
+	// Backends returns the names of the backends which may be switched to
+	Backends() []string
 }
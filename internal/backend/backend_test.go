@@ -0,0 +1,65 @@
+package backend_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend/backendtest"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend/deepseek"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend/ollama"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend/openrouter"
+)
+
+func TestHandleChatCompletionCancelsUpstream(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		new  func(endpoint string) backend.Backend
+		// streamType is the content type of the backend's streams
+		streamType string
+	}{
+		{
+			name: "deepseek",
+			new: func(endpoint string) backend.Backend {
+				return deepseek.NewDeepseekBackend(deepseek.Options{Endpoint: endpoint, DefaultModel: "model"})
+			},
+			streamType: "text/event-stream",
+		},
+		{
+			name: "openrouter",
+			new: func(endpoint string) backend.Backend {
+				return openrouter.NewOpenrouterBackend(openrouter.Options{Endpoint: endpoint, DefaultModel: "model"})
+			},
+			streamType: "text/event-stream",
+		},
+		{
+			name: "ollama",
+			new: func(endpoint string) backend.Backend {
+				return ollama.NewOllamaBackend(ollama.Options{Endpoint: endpoint, DefaultModel: "model"})
+			},
+			streamType: "application/x-ndjson",
+		},
+	} {
+		for _, stream := range []bool{false, true} {
+			name := tc.name + "/regular"
+			contentType := ""
+			if stream {
+				name = tc.name + "/streaming"
+				contentType = tc.streamType
+			}
+			t.Run(name, func(t *testing.T) {
+				upstream := backendtest.NewBlockingUpstream(t, contentType)
+				b := tc.new(upstream.URL)
+				backendtest.ServeAndCancel(t, upstream, func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+					b.HandleChatCompletion(ctx, w, r, &openai.ChatCompletionRequest{
+						Model:    "model",
+						Messages: []openai.Message{{Role: "user", Content: openai.Content_String{Content: "Hello"}}},
+						Stream:   stream,
+					})
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Package backendtest provides fake upstreams for testing the backends
+package backendtest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/logger/loggertest"
+)
+
+// timeout bounds how long the tests wait for requests to be torn down
+const timeout = 5 * time.Second
+
+// BlockingUpstream is an upstream whose requests block until they are
+// cancelled
+type BlockingUpstream struct {
+	*httptest.Server
+	// Started receives a value once a request is being served, and Cancelled
+	// once its context is cancelled
+	Started   chan struct{}
+	Cancelled chan struct{}
+}
+
+// NewBlockingUpstream starts an upstream which is closed with the test. With
+// a content type, requests are answered with its headers before blocking, as
+// streams are, and otherwise they block before anything is sent.
+func NewBlockingUpstream(t *testing.T, contentType string) *BlockingUpstream {
+	t.Helper()
+	u := &BlockingUpstream{
+		Started:   make(chan struct{}, 1),
+		Cancelled: make(chan struct{}, 1),
+	}
+	// Requests still blocked once the test ends are released, so that the
+	// upstream can be closed
+	released := make(chan struct{})
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+		}
+		u.Started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			u.Cancelled <- struct{}{}
+		case <-released:
+		}
+	}))
+	t.Cleanup(func() {
+		close(released)
+		u.Close()
+	})
+	return u
+}
+
+// ServeAndCancel serves a request with serve, cancels the request once the
+// upstream is serving it, and fails t unless the upstream's request is torn
+// down and serve returns
+func ServeAndCancel(t *testing.T, u *BlockingUpstream, serve func(ctx context.Context, w http.ResponseWriter, r *http.Request)) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(loggertest.Context())
+	defer cancel()
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, httptest.NewRecorder(), r)
+	}()
+
+	select {
+	case <-u.Started:
+	case <-done:
+		t.Fatal("request returned before reaching the upstream")
+	case <-time.After(timeout):
+		t.Fatal("upstream never received the request")
+	}
+	cancel()
+
+	select {
+	case <-u.Cancelled:
+	case <-time.After(timeout):
+		t.Fatal("upstream request wasn't cancelled with the client's")
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("request wasn't abandoned once cancelled")
+	}
+}
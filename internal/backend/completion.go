@@ -0,0 +1,25 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/constants"
+)
+
+// GetCompletion retrieves the legacy completion request, if any, which a chat
+// completion request was translated from
+func GetCompletion(ctx context.Context) *openai.CompletionRequest {
+	if req, ok := ctx.Value(constants.CompletionKey).(*openai.CompletionRequest); ok {
+		return req
+	}
+	return nil
+}
+
+// WithCompletion adds the legacy completion request a chat completion request
+// was translated from to the context, so that backends with a native
+// completions API can serve it directly. The response must still be a chat
+// completion.
+func WithCompletion(ctx context.Context, req *openai.CompletionRequest) context.Context {
+	return context.WithValue(ctx, constants.CompletionKey, req)
+}
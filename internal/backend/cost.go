@@ -0,0 +1,29 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// UpstreamCostHeader reports what the upstream provider charged for a request,
+// in USD, to the client
+const UpstreamCostHeader = "X-Upstream-Cost"
+
+// ReportUpstreamCost logs what the provider charged for a request and records
+// it on the request's span. Unless w is nil, because the response headers have
+// already been written, it's also reported in the X-Upstream-Cost header.
+func ReportUpstreamCost(ctx context.Context, w http.ResponseWriter, cost *float64) {
+	if cost == nil {
+		return
+	}
+	logutils.FromContext(ctx).With("upstream_cost", *cost).Infof(ctx, "Upstream cost: $%.6f", *cost)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Float64("upstream.cost", *cost))
+	if w != nil {
+		w.Header().Set(UpstreamCostHeader, strconv.FormatFloat(*cost, 'f', -1, 64))
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/danilofalcao/cursor-deepseek/internal/api/deepseek/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
 	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
 )
 
@@ -46,6 +47,20 @@ func convertToolChoice(choice interface{}) string {
 	return ""
 }
 
+// convertResponseFormat maps the OpenAI response format onto DeepSeek, which
+// only supports JSON mode. Structured outputs degrade to JSON mode.
+func convertResponseFormat(format *openai.ResponseFormat) *deepseek.ResponseFormat {
+	if format == nil {
+		return nil
+	}
+	switch format.Type {
+	case openai.ResponseFormatJSONObject, openai.ResponseFormatJSONSchema:
+		return &deepseek.ResponseFormat{Type: openai.ResponseFormatJSONObject}
+	default:
+		return &deepseek.ResponseFormat{Type: openai.ResponseFormatText}
+	}
+}
+
 func convertMessages(ctx context.Context, messages []openai.Message) []deepseek.Message {
 	lgr := logutils.FromContext(ctx)
 	converted := make([]deepseek.Message, len(messages))
@@ -65,7 +80,7 @@ func convertMessages(ctx context.Context, messages []openai.Message) []deepseek.
 			}
 		}
 		converted[i] = deepseek.Message{
-			Role:       msg.Role,
+			Role:       openai.NormalizeRole(msg.Role),
 			Content:    content,
 			ToolCallID: msg.ToolCallID,
 			Name:       msg.Name,
@@ -109,28 +124,78 @@ func convertMessages(ctx context.Context, messages []openai.Message) []deepseek.
 	return converted
 }
 
-func convertResponseChoices(ctx context.Context, choices []deepseek.Choice) []openai.Choice {
+func convertResponseChoices(ctx context.Context, choices []deepseek.Choice, inlineReasoning bool) []openai.Choice {
 	openaiChoices := make([]openai.Choice, len(choices))
 	for i, choice := range choices {
 		openaiChoices[i] = openai.Choice{
 			Index:        choice.Index,
-			Message:      convertResponseMessage(ctx, choice.Message),
-			FinishReason: choice.FinishReason,
+			Message:      convertResponseMessage(ctx, choice.Message, inlineReasoning),
+			FinishReason: openai.NormalizeFinishReason(choice.FinishReason, len(choice.Message.ToolCalls) > 0),
+			Logprobs:     choice.Logprobs,
 		}
 	}
 	return openaiChoices
 }
 
-func convertResponseMessage(ctx context.Context, message deepseek.Message) openai.Message {
-	return openai.Message{
+func convertResponseMessage(ctx context.Context, message deepseek.Message, inlineReasoning bool) openai.Message {
+	converted := openai.Message{
 		Role: message.Role,
 		Content: openai.Content_String{
 			Content: message.Content,
 		},
-		ToolCalls:  convertResponseToolCalls(ctx, message.ToolCalls),
-		ToolCallID: message.ToolCallID,
-		Name:       message.Name,
+		ToolCalls:        convertResponseToolCalls(ctx, message.ToolCalls),
+		ToolCallID:       message.ToolCallID,
+		Name:             message.Name,
+		ReasoningContent: message.ReasoningContent,
+	}
+
+	// Inline the reasoning for clients which don't understand reasoning_content
+	if inlineReasoning && message.ReasoningContent != "" {
+		converted.Content = openai.Content_String{
+			Content: thinkOpenTag + message.ReasoningContent + thinkCloseTag + message.Content,
+		}
+		converted.ReasoningContent = ""
 	}
+	return converted
+}
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// inlineReasoningChunks moves the reasoning_content of each streamed delta
+// into its content, wrapped in <think></think> tags.
+func inlineReasoningChunks(ctx context.Context, in <-chan openai.ChatCompletionStreamResponse) <-chan openai.ChatCompletionStreamResponse {
+	// tracks, per choice index, whether a <think> tag is currently open
+	thinking := make(map[int]bool)
+	return stream.Transform(ctx, in, func(chunk *openai.ChatCompletionStreamResponse) {
+		for i := range chunk.Choices {
+			choice := &chunk.Choices[i]
+			var content string
+			if c, ok := choice.Delta.Content.(openai.Content_String); ok {
+				content = c.Content
+			}
+
+			var prefix string
+			if reasoning := choice.Delta.ReasoningContent; reasoning != "" {
+				if !thinking[choice.Index] {
+					prefix = thinkOpenTag
+					thinking[choice.Index] = true
+				}
+				prefix += reasoning
+			}
+			if thinking[choice.Index] && (content != "" || choice.FinishReason != "") {
+				prefix += thinkCloseTag
+				thinking[choice.Index] = false
+			}
+
+			if prefix != "" {
+				choice.Delta.Content = openai.Content_String{Content: prefix + content}
+				choice.Delta.ReasoningContent = ""
+			}
+		}
+	})
 }
 
 func convertResponseToolCalls(ctx context.Context, toolCalls []deepseek.ToolCall) []openai.ToolCall {
@@ -154,3 +219,17 @@ func convertResponseToolCalls(ctx context.Context, toolCalls []deepseek.ToolCall
 	}
 	return openaiToolCalls
 }
+
+// convertUsage converts a usage, along with the reasoning tokens of
+// deepseek-reasoner
+func convertUsage(usage deepseek.Usage) openai.Usage {
+	converted := openai.Usage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+	if details := usage.CompletionTokensDetails; details != nil {
+		converted.CompletionTokensDetails = &openai.CompletionTokensDetails{ReasoningTokens: details.ReasoningTokens}
+	}
+	return converted
+}
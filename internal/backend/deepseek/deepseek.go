@@ -1,50 +1,142 @@
 package deepseek
 
 import (
-	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"time"
 
-	"maps"
-
 	"github.com/danilofalcao/cursor-deepseek/internal/api/deepseek/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/balancer"
+	deepseekconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/deepseek"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
 	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
 	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
 	"github.com/pkg/errors"
-	"golang.org/x/net/http2"
 )
 
 var _ backend.Backend = &deepseekBackend{}
+var _ backend.APIKeySetter = &deepseekBackend{}
 
 type deepseekBackend struct {
-	endpoint     string
+	pool         *balancer.Pool
 	models       map[string]string
 	defaultModel string
-	apikey       string
-	timeout      time.Duration
+	apikey       *backend.APIKey
+	client       *http.Client
+	// probeClient sends the health probes and model listings, untraced
+	probeClient *http.Client
+	timeouts    backend.Timeouts
+	modelFilter backend.ModelFilter
+	params      backend.ParamStripper
+	// resolver applies the default parameters and caps of the models
+	resolver backend.ParamResolver
+	// passthrough forwards requests with the model and parameters the client
+	// sent
+	passthrough bool
+	// catalog caches the models discovered upstream
+	catalog *backend.ModelCatalog
+	// streaming configures the heartbeats and idle timeouts of streams
+	streaming stream.Options
+	retry     backend.Retry
+	// inlineReasoning moves reasoning_content into content as <think></think>
+	inlineReasoning bool
+	// fim serves legacy completions with the fill-in-the-middle API
+	fim bool
+	// streamPassthrough relays streams which need no rewriting as they are
+	streamPassthrough bool
 }
 
 type Options struct {
 	Endpoint     string
+	Endpoints    []balancer.Target
 	Models       map[string]string
 	DefaultModel string
 	ApiKey       string
-	Timeout      time.Duration
+	// Timeout bounds non-streaming requests, unless Timeouts sets it
+	Timeout time.Duration
+	// Timeouts bound requests by whether they stream
+	Timeouts    backend.Timeouts
+	ModelFilter backend.ModelFilter
+	// Transport configures the connections to the upstream
+	Transport backend.Transport
+	// Retry configures how requests failing transiently are retried
+	Retry backend.Retry
+	// Heartbeat is the interval between the heartbeat comments sent while a
+	// stream is idle. Zero means stream.DefaultHeartbeatInterval, and a
+	// negative interval disables heartbeats.
+	Heartbeat time.Duration
+	// IdleTimeout aborts streams whose upstream sends no chunk for this long.
+	// Zero disables the timeout.
+	IdleTimeout time.Duration
+	// ModelsTTL is how long the models listed upstream are cached. Zero
+	// disables discovery.
+	ModelsTTL time.Duration
+	// Passthrough forwards requests with the model and parameters the client
+	// sent, including those unknown to the proxy, and relays the responses as
+	// DeepSeek sent them. Models aren't mapped, and parameters aren't defaulted
+	// or stripped.
+	Passthrough bool
+	// ModelParams maps upstream models to their default parameters and caps
+	ModelParams map[string]backend.ModelParams
+	// UnsupportedParams maps upstream models to the request parameters which
+	// are stripped before forwarding, in addition to the built-in defaults
+	UnsupportedParams map[string][]string
+	// StrippedParamsHeader reports stripped parameters in a response header
+	StrippedParamsHeader bool
+	// InlineReasoning inlines the reasoning_content of deepseek-reasoner into
+	// the content as <think>...</think> for clients which don't understand the field
+	InlineReasoning bool
+	// FIM serves requests to the legacy completions endpoint, including their
+	// suffix, with DeepSeek's fill-in-the-middle completions API
+	FIM bool
+	// StreamPassthrough copies streamed responses to the client without
+	// decoding them when they need no rewriting, which is when the requested
+	// model isn't mapped to another and reasoning isn't inlined
+	StreamPassthrough bool
 }
 
 func NewDeepseekBackend(opts Options) backend.Backend {
-	return &deepseekBackend{
-		endpoint: opts.Endpoint,
-		models:   opts.Models,
-		apikey:   opts.ApiKey,
-		timeout:  opts.Timeout,
+	rt := backend.NewRoundTripper(opts.Transport)
+	timeouts := opts.Timeouts
+	if timeouts.Total <= 0 {
+		timeouts.Total = opts.Timeout
+	}
+	b := &deepseekBackend{
+		pool:         balancer.New(balancer.Options{Targets: balancer.Targets(opts.Endpoint, opts.Endpoints)}),
+		models:       opts.Models,
+		defaultModel: opts.DefaultModel,
+		apikey:       backend.NewAPIKey(opts.ApiKey),
+		client:       backend.NewHTTPClient(rt, 0),
+		probeClient:  &http.Client{Transport: rt},
+		timeouts:     timeouts,
+		modelFilter:  opts.ModelFilter,
+		streaming: stream.Options{
+			Heartbeat:         stream.HeartbeatInterval(opts.Heartbeat),
+			IdleTimeout:       opts.IdleTimeout,
+			FirstTokenTimeout: opts.Timeouts.FirstToken,
+		},
+		retry:       opts.Retry,
+		resolver:    backend.ParamResolver{Models: opts.ModelParams},
+		passthrough: opts.Passthrough,
+		params: backend.ParamStripper{
+			Unsupported: backend.MergeUnsupportedParams(deepseekconstants.UnsupportedParams, opts.UnsupportedParams),
+			Header:      opts.StrippedParamsHeader,
+		},
+		inlineReasoning:   opts.InlineReasoning,
+		fim:               opts.FIM,
+		streamPassthrough: opts.StreamPassthrough,
 	}
+	b.catalog = &backend.ModelCatalog{TTL: opts.ModelsTTL, Fetch: b.fetchModels}
+	return b
 }
 
 // Name returns the name of the backend
@@ -54,20 +146,62 @@ func (b *deepseekBackend) Name() string {
 
 // HandleChatCompletion handles a chat completion request
 func (b *deepseekBackend) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
-	lgr, ctx := logutils.FromContext(ctx).Clone(b.Name())
+	modelOverride := contextutils.GetModelOverride(ctx)
+	completion := backend.GetCompletion(ctx)
+	// The backend's logger joins the request's context, whose cancellation
+	// when the client goes away tears down the upstream request
+	lgr, _ := logutils.FromContext(ctx).Clone(b.Name())
+	ctx = logutils.ContextWithLogger(ctx, lgr)
 	lgr.Debugf(ctx, "Requested model: %s", req.Model)
 
 	// Store original model name for response
 	originalModel := req.Model
 
+	// Reject models which are not allowed on this backend
+	if !b.modelFilter.Allowed(originalModel) {
+		lgr.Infof(ctx, "Rejecting request for disallowed model %s", originalModel)
+		backend.WriteModelNotFound(w, originalModel)
+		return
+	}
+
+	// Forward the request untouched, rather than mapping its model
+	if b.passthrough {
+		b.handlePassthrough(ctx, w, r, req)
+		return
+	}
+
 	// Convert model internally
 	mappedModel, ok := b.models[originalModel]
 	if !ok {
-		mappedModel = b.defaultModel
+		mappedModel = cmp.Or(contextutils.GetDefaultModel(ctx), b.defaultModel)
+		// Models discovered upstream are served as they are
+		if b.catalog.Has(originalModel) {
+			mappedModel = originalModel
+		}
+	}
+	if modelOverride != "" {
+		mappedModel = modelOverride
 	}
 	req.Model = mappedModel
+	lgr = lgr.With("model", mappedModel)
+	ctx = logutils.ContextWithLogger(ctx, lgr)
 	lgr.Debugf(ctx, "Model converted to: %s (original: %s)", mappedModel, originalModel)
 
+	// Apply the model's default parameters and caps, then drop the parameters
+	// the upstream model would reject
+	b.resolver.Resolve(ctx, mappedModel, req)
+	b.params.Strip(ctx, w, mappedModel, req)
+
+	// Bound the request by its timeout, which depends on whether it streams
+	ctx, cancel := b.timeouts.Context(ctx, req.Stream)
+	defer cancel()
+
+	// Serve legacy completions natively, which deepseek-reasoner doesn't support
+	if completion != nil && b.fim && mappedModel != deepseekconstants.ReasonerModel {
+		b.handleFIM(ctx, w, r, completion, req, originalModel)
+		return
+	}
+
 	// Convert to DeepSeek request format
 	deepseekReq := deepseek.Request{
 		Model:    mappedModel,
@@ -79,8 +213,24 @@ func (b *deepseekBackend) HandleChatCompletion(ctx context.Context, w http.Respo
 	if req.Temperature != nil {
 		deepseekReq.Temperature = *req.Temperature
 	}
-	if req.MaxTokens != nil {
-		deepseekReq.MaxTokens = *req.MaxTokens
+	if limit := req.CompletionTokenLimit(); limit != nil {
+		deepseekReq.MaxTokens = *limit
+	}
+
+	// Copy sampling parameters
+	deepseekReq.N = req.N
+	deepseekReq.TopP = req.TopP
+	deepseekReq.Stop = req.Stop
+	deepseekReq.Seed = req.Seed
+	deepseekReq.FrequencyPenalty = req.FrequencyPenalty
+	deepseekReq.PresencePenalty = req.PresencePenalty
+	deepseekReq.ResponseFormat = convertResponseFormat(req.ResponseFormat)
+	deepseekReq.Logprobs = req.Logprobs
+	deepseekReq.TopLogprobs = req.TopLogprobs
+
+	// Ask for a final usage chunk when the client wants one
+	if req.IncludeUsage() {
+		deepseekReq.StreamOptions = &deepseek.StreamOptions{IncludeUsage: true}
 	}
 
 	// Handle tools/functions
@@ -115,210 +265,193 @@ func (b *deepseekBackend) HandleChatCompletion(ctx context.Context, w http.Respo
 	if err != nil {
 		err = errors.Wrap(err, "error creating modified request body")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error creating modified request")
 		return
 	}
 
 	lgr.Debugf(ctx, "Modified request body: %s", string(modifiedBody))
 
-	// Create the proxy request to DeepSeek
-	targetURL := b.endpoint + r.URL.Path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+	resp, ok := b.forward(ctx, w, r, r.URL.Path, modifiedBody, req.Stream)
+	if !ok {
+		return
 	}
+	defer resp.Body.Close()
 
-	lgr.Infof(ctx, "Forwarding to: %s", targetURL)
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
-	if err != nil {
-		err = errors.Wrap(err, "error creating proxy request")
-		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
+	// Handle streaming response
+	if req.Stream {
+		if b.streamPassthrough && !b.inlineReasoning && mappedModel == originalModel {
+			handlePassthroughResponse(ctx, w, resp, b.streaming)
+			return
+		}
+		handleStreamingResponse(ctx, w, resp, originalModel, req.IncludeUsage(), b.inlineReasoning, b.streaming)
 		return
 	}
 
-	// Copy headers
-	copyHeaders(proxyReq.Header, r.Header)
+	// Handle regular response
+	handleRegularResponse(ctx, w, resp, originalModel, b.inlineReasoning)
+}
 
-	// Set DeepSeek API key and content type
-	proxyReq.Header.Set("Authorization", "Bearer "+b.apikey)
-	proxyReq.Header.Set("Content-Type", "application/json")
-	if req.Stream {
-		proxyReq.Header.Set("Accept", "text/event-stream")
-	}
+// forward sends body to path on the next upstream endpoint. Error responses
+// are written to w, in which case ok is false.
+func (b *deepseekBackend) forward(ctx context.Context, w http.ResponseWriter, r *http.Request, path string, body []byte, streaming bool) (resp *http.Response, ok bool) {
+	lgr := logutils.FromContext(ctx)
 
-	lgr.Debugf(ctx, "Proxy request headers: %v", proxyReq.Header)
+	// Every attempt goes to the next upstream endpoint
+	send := func() (*http.Response, error) {
+		ep := b.pool.Next()
+		if ep == nil {
+			return nil, balancer.ErrNoEndpoints
+		}
+		targetURL := ep.URL + path
+		if r.URL.RawQuery != "" {
+			targetURL += "?" + r.URL.RawQuery
+		}
 
-	// Create a custom client with keepalive
-	client := &http.Client{
-		Transport: &http2.Transport{
-			AllowHTTP: true,
-			DialTLS:   nil,
-		},
-		Timeout: b.timeout,
+		lgr.Infof(ctx, "Forwarding to: %s", targetURL)
+		proxyReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating proxy request")
+		}
+
+		// Copy headers
+		copyHeaders(proxyReq.Header, r.Header)
+
+		// Set DeepSeek API key and content type
+		proxyReq.Header.Set("Authorization", "Bearer "+b.apikey.Get())
+		proxyReq.Header.Set("Content-Type", "application/json")
+		backend.SetRequestID(ctx, proxyReq.Header)
+		if streaming {
+			proxyReq.Header.Set("Accept", "text/event-stream")
+		}
+
+		lgr.Tracef(ctx, "Proxy request headers: %v", logger.RedactHeaders(proxyReq.Header))
+
+		// Send the request
+		resp, err := b.client.Do(proxyReq)
+		if err != nil {
+			b.pool.MarkFailure(ep)
+			return nil, errors.Wrap(err, "error forwarding request")
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			b.pool.MarkFailure(ep)
+		} else {
+			b.pool.MarkSuccess(ep)
+		}
+		return resp, nil
 	}
 
-	// Send the request
-	resp, err := client.Do(proxyReq)
+	resp, err := b.retry.Do(ctx, send)
 	if err != nil {
-		err = errors.Wrap(err, "error forwarding request")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error forwarding request", http.StatusBadGateway)
-		return
+		backend.WriteForwardError(ctx, w, err)
+		return nil, false
 	}
-	defer resp.Body.Close()
 
 	lgr.Debugf(ctx, "DeepSeek response status: %d", resp.StatusCode)
-	lgr.Debugf(ctx, "DeepSeek response headers: %v", resp.Header)
+	lgr.Tracef(ctx, "DeepSeek response headers: %v", logger.RedactHeaders(resp.Header))
+	backend.ReportUpstreamRequestID(ctx, w, backend.UpstreamRequestID(ctx, resp.Header))
 
 	// Handle error responses
 	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
 		respBody, err := io.ReadAll(resp.Body)
 		if err != nil {
 			err = errors.Wrap(err, "error reading error response")
 			lgr.Error(ctx, err.Error())
-			http.Error(w, "Error reading response", http.StatusInternalServerError)
-			return
+			response.WriteError(w, http.StatusInternalServerError, "Error reading response")
+			return nil, false
 		}
 		lgr.Infof(ctx, "DeepSeek error response: %s", string(respBody))
 
-		// Forward the error response
-		maps.Copy(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
-		return
+		// Translate the error into its OpenAI equivalent
+		response.WriteUpstreamError(w, resp, respBody)
+		return nil, false
 	}
 
-	// Handle streaming response
-	if req.Stream {
-		handleStreamingResponse(ctx, w, r, resp, originalModel)
-		return
-	}
-
-	// Handle regular response
-	handleRegularResponse(ctx, w, resp, originalModel)
+	return resp, true
 }
 
 // ListModels returns the list of available models
 func (b *deepseekBackend) ListModels(ctx context.Context) ([]openai.Model, error) {
-	openAiModels := make([]openai.Model, 0, len(b.models))
-	for servedModel := range b.models {
-		openAiModels = append(openAiModels, openai.Model{
-			ID:      servedModel,
-			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: "deepseek",
-		})
-	}
-	if len(openAiModels) == 0 {
-		openAiModels = append(openAiModels, openai.Model{
-			ID:      b.defaultModel,
-			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: "deepseek",
-		})
+	models := backend.MergeModels(b.models, b.defaultModel, "deepseek", b.catalog.Models(ctx))
+	return b.modelFilter.FilterModels(models), nil
+}
+
+// fetchModels lists the models of the DeepSeek API
+func (b *deepseekBackend) fetchModels(ctx context.Context) ([]openai.Model, error) {
+	ep := b.pool.Next()
+	if ep == nil {
+		return nil, balancer.ErrNoEndpoints
 	}
-	return openAiModels, nil
+	return backend.FetchOpenAIModels(ctx, b.probeClient, ep.URL+"/models", b.apikey.Get(), "deepseek")
 }
 
 // ValidateAPIKey validates the provided API key
 func (b *deepseekBackend) ValidateAPIKey(apiKey string) bool {
-	return utils.SecureCompareString(apiKey, b.apikey)
+	return utils.SecureCompareString(apiKey, b.apikey.Get())
+}
+
+// SetAPIKey replaces the upstream API key, such as when it is rotated
+func (b *deepseekBackend) SetAPIKey(apiKey string) {
+	b.apikey.Set(apiKey)
+}
+
+// HealthCheck probes every upstream endpoint's models route
+func (b *deepseekBackend) HealthCheck(ctx context.Context) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+b.apikey.Get())
+	return b.pool.Probe(ctx, balancer.HTTPProbe(b.probeClient, "/models", header))
+}
+
+// Stats returns the state of every upstream endpoint
+func (b *deepseekBackend) Stats() any {
+	return b.pool.Status()
 }
-func handleStreamingResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, resp *http.Response, originalModel string) {
+func handleStreamingResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, originalModel string, includeUsage, inlineReasoning bool, opts stream.Options) {
 	lgr := logutils.FromContext(ctx)
 	lgr.Debugf(ctx, "Starting streaming response handling with model: %s", originalModel)
 	lgr.Debugf(ctx, "Response status: %d", resp.StatusCode)
-	lgr.Debugf(ctx, "Response headers: %+v", resp.Header)
-
-	// Set headers for streaming response
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(resp.StatusCode)
-
-	// Create a buffered reader for the response body
-	reader := bufio.NewReader(resp.Body)
+	lgr.Tracef(ctx, "Response headers: %+v", logger.RedactHeaders(resp.Header))
 
-	// Create a context with cancel for cleanup
-	ctx, cancel := context.WithCancel(r.Context())
+	// Create a context with cancel for cleanup, tied to the client's request
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Start a goroutine to send heartbeats
-	go func() {
-		ticker := time.NewTicker(15 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				// Send a heartbeat comment
-				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
-					err = errors.Wrap(err, "error sending heartbeat")
-					lgr.Error(ctx, err.Error())
-					cancel()
-					return
-				}
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
-
-	for {
-		select {
-		case <-ctx.Done():
-			lgr.Info(ctx, "Context cancelled, ending stream")
-			return
-		default:
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					continue
-				}
-				err = errors.Wrap(err, "error reading stream")
-				lgr.Error(ctx, err.Error())
-				cancel()
-				return
-			}
+	chunks, errs := stream.ReadOpenAI(ctx, resp.Body, stream.ReadOptions{})
+	chunks = stream.Stabilize(ctx, chunks)
+	chunks = stream.RewriteModel(ctx, chunks, originalModel)
+	chunks = stream.Usage(ctx, chunks, includeUsage)
+	chunks = stream.FinishReasons(ctx, chunks)
+	if inlineReasoning {
+		chunks = inlineReasoningChunks(ctx, chunks)
+	}
+	stream.Write(ctx, w, chunks, errs, opts)
+}
 
-			// Skip empty lines
-			if len(bytes.TrimSpace(line)) == 0 {
-				continue
-			}
+// handlePassthroughResponse relays a stream which needs no rewriting as the
+// upstream sends it
+func handlePassthroughResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, opts stream.Options) {
+	lgr := logutils.FromContext(ctx)
+	lgr.Debugf(ctx, "Passing stream through, response status: %d", resp.StatusCode)
 
-			// Write the line to the response
-			if _, err := w.Write(line); err != nil {
-				err = errors.Wrap(err, "error writing response")
-				lgr.Error(ctx, err.Error())
-				cancel()
-				return
-			}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			// Flush the response writer
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			} else {
-				lgr.Warn(ctx, "ResponseWriter does not support Flush")
-			}
-		}
-	}
+	stream.Passthrough(ctx, w, resp.Body, opts)
 }
 
-func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, originalModel string) {
+func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, originalModel string, inlineReasoning bool) {
 	lgr := logutils.FromContext(ctx)
 	lgr.Infof(ctx, "Handling regular (non-streaming) response")
 	lgr.Debugf(ctx, "Response status: %d", resp.StatusCode)
-	lgr.Debugf(ctx, "Response headers: %+v", resp.Header)
+	lgr.Tracef(ctx, "Response headers: %+v", logger.RedactHeaders(resp.Header))
 
 	// Read and log response body
 	body, err := readResponse(resp)
 	if err != nil {
 		err = errors.Wrap(err, "error reading response")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error reading response from upstream")
 		return
 	}
 
@@ -330,7 +463,7 @@ func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *htt
 	if err := json.Unmarshal(body, &deepseekResp); err != nil {
 		err = errors.Wrap(err, "error parsing DeepSeek response")
 		lgr.Error(ctx, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error processing response from upstream")
 		return
 	}
 
@@ -340,12 +473,8 @@ func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *htt
 		Object:  "chat.completion",
 		Created: deepseekResp.Created,
 		Model:   originalModel,
-		Usage: openai.Usage{
-			PromptTokens:     deepseekResp.Usage.PromptTokens,
-			CompletionTokens: deepseekResp.Usage.CompletionTokens,
-			TotalTokens:      deepseekResp.Usage.TotalTokens,
-		},
-		Choices: convertResponseChoices(ctx, deepseekResp.Choices),
+		Usage:   convertUsage(deepseekResp.Usage),
+		Choices: convertResponseChoices(ctx, deepseekResp.Choices, inlineReasoning),
 	}
 
 	// Convert back to JSON
@@ -353,7 +482,7 @@ func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *htt
 	if err != nil {
 		err = errors.Wrap(err, "error creating modified response")
 		lgr.Error(ctx, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error processing response from upstream")
 		return
 	}
 
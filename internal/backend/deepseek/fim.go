@@ -0,0 +1,152 @@
+package deepseek
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/deepseek/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	deepseekconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/deepseek"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// handleFIM serves a legacy completion request with the fill-in-the-middle
+// completions API. The prompt and suffix come from the original completion
+// request and the sampling parameters from its translated chat request, which
+// has already been stripped of unsupported parameters. The response is written
+// as a chat completion, like every other response of the backend.
+func (b *deepseekBackend) handleFIM(ctx context.Context, w http.ResponseWriter, r *http.Request, completion *openai.CompletionRequest, req *openai.ChatCompletionRequest, originalModel string) {
+	lgr := logutils.FromContext(ctx)
+
+	fimReq := deepseek.CompletionRequest{
+		Model:            req.Model,
+		Prompt:           completion.Prompt[0],
+		Suffix:           completion.Suffix,
+		Stream:           req.Stream,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Stop:             req.Stop,
+		FrequencyPenalty: req.FrequencyPenalty,
+		PresencePenalty:  req.PresencePenalty,
+	}
+	if limit := req.CompletionTokenLimit(); limit != nil {
+		fimReq.MaxTokens = *limit
+	}
+	if req.IncludeUsage() {
+		fimReq.StreamOptions = &deepseek.StreamOptions{IncludeUsage: true}
+	}
+
+	body, err := json.Marshal(fimReq)
+	if err != nil {
+		err = errors.Wrap(err, "error creating FIM request body")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Error creating modified request")
+		return
+	}
+
+	lgr.Debugf(ctx, "FIM request body: %s", string(body))
+
+	resp, ok := b.forward(ctx, w, r, deepseekconstants.FIMPath, body, req.Stream)
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+
+	if req.Stream {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		fimChunks, errs := stream.ReadEvents[deepseek.CompletionResponse](ctx, resp.Body, stream.ReadOptions{})
+		chunks := make(chan openai.ChatCompletionStreamResponse)
+		go func() {
+			defer close(chunks)
+			for fimChunk := range fimChunks {
+				select {
+				case chunks <- convertFIMChunk(fimChunk):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		out := stream.Stabilize(ctx, chunks)
+		out = stream.RewriteModel(ctx, out, originalModel)
+		out = stream.Usage(ctx, out, req.IncludeUsage())
+		out = stream.FinishReasons(ctx, out)
+		stream.Write(ctx, w, out, errs, b.streaming)
+		return
+	}
+
+	respBody, err := readResponse(resp)
+	if err != nil {
+		err = errors.Wrap(err, "error reading response")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Error reading response from upstream")
+		return
+	}
+
+	var fimResp deepseek.CompletionResponse
+	if err := json.Unmarshal(respBody, &fimResp); err != nil {
+		err = errors.Wrap(err, "error parsing DeepSeek FIM response")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Error processing response from upstream")
+		return
+	}
+
+	chatResp := openai.ChatCompletionResponse{
+		ID:      fimResp.ID,
+		Object:  "chat.completion",
+		Created: fimResp.Created,
+		Model:   originalModel,
+		Choices: make([]openai.Choice, 0, len(fimResp.Choices)),
+	}
+	if fimResp.Usage != nil {
+		chatResp.Usage = convertUsage(*fimResp.Usage)
+	}
+	for _, choice := range fimResp.Choices {
+		chatResp.Choices = append(chatResp.Choices, openai.Choice{
+			Index: choice.Index,
+			Message: openai.Message{
+				Role:    "assistant",
+				Content: openai.Content_String{Content: choice.Text},
+			},
+			FinishReason: openai.NormalizeFinishReason(choice.FinishReason, false),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(chatResp); err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		lgr.Error(ctx, err.Error())
+	}
+}
+
+// convertFIMChunk converts a FIM stream chunk into a chat completion chunk
+func convertFIMChunk(chunk deepseek.CompletionResponse) openai.ChatCompletionStreamResponse {
+	out := openai.ChatCompletionStreamResponse{
+		ID:      chunk.ID,
+		Object:  "chat.completion.chunk",
+		Created: chunk.Created,
+		Model:   chunk.Model,
+		Choices: make([]openai.StreamChoice, 0, len(chunk.Choices)),
+	}
+	if chunk.Usage != nil {
+		usage := convertUsage(*chunk.Usage)
+		out.Usage = &usage
+	}
+	for _, choice := range chunk.Choices {
+		out.Choices = append(out.Choices, openai.StreamChoice{
+			Index: choice.Index,
+			Delta: openai.Delta{
+				Role:    "assistant",
+				Content: openai.Content_String{Content: choice.Text},
+			},
+			FinishReason: choice.FinishReason,
+		})
+	}
+	return out
+}
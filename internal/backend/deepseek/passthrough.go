@@ -0,0 +1,59 @@
+package deepseek
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// handlePassthrough forwards the request with the model and parameters the
+// client sent, including those unknown to the proxy, only adding the API key,
+// and relays the response as DeepSeek sent it
+func (b *deepseekBackend) handlePassthrough(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	if model := contextutils.GetModelOverride(ctx); model != "" {
+		req.Model = model
+	}
+	lgr := logutils.FromContext(ctx).With("model", req.Model)
+	ctx = logutils.ContextWithLogger(ctx, lgr)
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		err = errors.Wrap(err, "error creating passthrough request body")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Error creating modified request")
+		return
+	}
+	lgr.Debugf(ctx, "Passthrough request body: %s", string(body))
+
+	// Bound the request by its timeout, which depends on whether it streams
+	ctx, cancel := b.timeouts.Context(ctx, req.Stream)
+	defer cancel()
+
+	resp, ok := b.forward(ctx, w, r, r.URL.Path, body, req.Stream)
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+
+	if req.Stream {
+		handlePassthroughResponse(ctx, w, resp, b.streaming)
+		return
+	}
+
+	respBody, err := readResponse(resp)
+	if err != nil {
+		err = errors.Wrap(err, "error reading response")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Error reading response from upstream")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+}
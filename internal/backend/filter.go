@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+// ModelFilter restricts which requested models a backend will serve. Entries
+// may be exact model names or glob patterns such as "gpt-4*".
+type ModelFilter struct {
+	// Allow, if non-empty, lists the only models which may be requested
+	Allow []string
+	// Deny lists models which may never be requested
+	Deny []string
+}
+
+// Allowed returns whether the requested model passes the filter
+func (f ModelFilter) Allowed(model string) bool {
+	if matchAny(f.Deny, model) {
+		return false
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	return matchAny(f.Allow, model)
+}
+
+// FilterModels returns only the models which pass the filter
+func (f ModelFilter) FilterModels(models []openai.Model) []openai.Model {
+	filtered := make([]openai.Model, 0, len(models))
+	for _, m := range models {
+		if f.Allowed(m.ID) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func matchAny(patterns []string, model string) bool {
+	for _, p := range patterns {
+		if p == model {
+			return true
+		}
+		if ok, err := path.Match(p, model); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteModelNotFound writes an OpenAI-format model_not_found error
+func WriteModelNotFound(w http.ResponseWriter, model string) {
+	response.WriteErrorResponse(w, http.StatusNotFound, openai.Error{
+		Message: fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", model),
+		Type:    response.ErrorTypeInvalidRequest,
+		Param:   "model",
+		Code:    "model_not_found",
+	})
+}
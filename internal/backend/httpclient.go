@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/telemetry"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// Defaults of ConnPool
+const (
+	DefaultMaxIdleConns         = 100
+	DefaultMaxIdleConnsPerHost  = 32
+	DefaultIdleConnTimeout      = 90 * time.Second
+	DefaultHTTP2ReadIdleTimeout = 30 * time.Second
+	DefaultHTTP2PingTimeout     = 15 * time.Second
+)
+
+// Protocols of upstream connections
+const (
+	// ProtocolAuto negotiates HTTP/2 with TLS endpoints which support it, and
+	// uses HTTP/1.1 otherwise
+	ProtocolAuto = "auto"
+	// ProtocolHTTP1 only uses HTTP/1.1
+	ProtocolHTTP1 = "http1"
+	// ProtocolHTTP2 only uses HTTP/2, over TLS with https endpoints and in
+	// cleartext (h2c) with http endpoints
+	ProtocolHTTP2 = "http2"
+)
+
+// ConnPool configures the pool of connections a backend keeps to its
+// upstream, which is shared by all its requests. Zero values use the defaults.
+type ConnPool struct {
+	// MaxIdleConns and MaxIdleConnsPerHost bound the idle HTTP/1.1
+	// connections kept for reuse
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost, if set, bounds the connections to each endpoint
+	MaxConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept
+	IdleConnTimeout time.Duration
+	// HTTP2ReadIdleTimeout is how long an HTTP/2 connection may receive
+	// nothing before it is checked with a ping, which must be answered
+	// within HTTP2PingTimeout for the connection to be kept
+	HTTP2ReadIdleTimeout time.Duration
+	HTTP2PingTimeout     time.Duration
+}
+
+func (p ConnPool) withDefaults() ConnPool {
+	if p.MaxIdleConns <= 0 {
+		p.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if p.MaxIdleConnsPerHost <= 0 {
+		p.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if p.IdleConnTimeout <= 0 {
+		p.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if p.HTTP2ReadIdleTimeout <= 0 {
+		p.HTTP2ReadIdleTimeout = DefaultHTTP2ReadIdleTimeout
+	}
+	if p.HTTP2PingTimeout <= 0 {
+		p.HTTP2PingTimeout = DefaultHTTP2PingTimeout
+	}
+	return p
+}
+
+// Transport configures how a backend connects to its upstream
+type Transport struct {
+	Pool ConnPool
+	// Protocol is ProtocolAuto, the default, ProtocolHTTP1 or ProtocolHTTP2
+	Protocol string
+	// TLSConfig, if set, configures the TLS connections, such as to trust
+	// the CA of a self-hosted endpoint
+	TLSConfig *tls.Config
+	// Proxy is the URL of the HTTP, HTTPS or SOCKS5 proxy the connections go
+	// through, including its credentials. The proxies of the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are used if it isn't
+	// set, and none if it is ProxyDirect.
+	Proxy string
+	// ConnectTimeout bounds establishing a connection, the TLS handshake
+	// included. Zero keeps the defaults of net/http.
+	ConnectTimeout time.Duration
+	// HeaderTimeout bounds the wait for the response headers once a request
+	// is sent. Zero disables the timeout.
+	HeaderTimeout time.Duration
+	// Recording, if its mode is set, records the requests sent upstream and
+	// their responses, or replays them instead of sending requests upstream
+	Recording Recording
+}
+
+// ValidateProtocol returns an error if protocol isn't one of the protocols
+func ValidateProtocol(protocol string) error {
+	switch protocol {
+	case "", ProtocolAuto, ProtocolHTTP1, ProtocolHTTP2:
+		return nil
+	default:
+		return errors.Errorf("unknown protocol %q, which must be auto, http1 or http2", protocol)
+	}
+}
+
+// NewRoundTripper creates the round tripper of a backend's connections to its
+// upstream, which its requests, health probes and model listings share
+func NewRoundTripper(t Transport) http.RoundTripper {
+	return withRecording(newRoundTripper(t), t.Recording)
+}
+
+func newRoundTripper(t Transport) http.RoundTripper {
+	pool := t.Pool.withDefaults()
+
+	if t.Protocol == ProtocolHTTP2 {
+		dialer := newProxyDialer(t.Proxy)
+		return h2RoundTripper{
+			tls: &http2.Transport{
+				DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+					if t.ConnectTimeout > 0 {
+						var cancel context.CancelFunc
+						ctx, cancel = context.WithTimeout(ctx, t.ConnectTimeout)
+						defer cancel()
+					}
+					conn, err := dialer.dial(ctx, "https", addr)
+					if err != nil {
+						return nil, err
+					}
+					tlsConn := tls.Client(conn, cfg)
+					if err := tlsConn.HandshakeContext(ctx); err != nil {
+						conn.Close()
+						return nil, err
+					}
+					if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+						conn.Close()
+						return nil, errors.Errorf("%s doesn't support HTTP/2", addr)
+					}
+					return tlsConn, nil
+				},
+				TLSClientConfig: t.TLSConfig,
+				IdleConnTimeout: pool.IdleConnTimeout,
+				ReadIdleTimeout: pool.HTTP2ReadIdleTimeout,
+				PingTimeout:     pool.HTTP2PingTimeout,
+			},
+			cleartext: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					if t.ConnectTimeout > 0 {
+						var cancel context.CancelFunc
+						ctx, cancel = context.WithTimeout(ctx, t.ConnectTimeout)
+						defer cancel()
+					}
+					return dialer.dial(ctx, "http", addr)
+				},
+				IdleConnTimeout: pool.IdleConnTimeout,
+				ReadIdleTimeout: pool.HTTP2ReadIdleTimeout,
+				PingTimeout:     pool.HTTP2PingTimeout,
+			},
+			headerTimeout: t.HeaderTimeout,
+		}
+	}
+
+	rt := http.DefaultTransport.(*http.Transport).Clone()
+	rt.MaxIdleConns = pool.MaxIdleConns
+	rt.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	rt.MaxConnsPerHost = pool.MaxConnsPerHost
+	rt.IdleConnTimeout = pool.IdleConnTimeout
+	rt.Proxy = proxyFunc(t.Proxy)
+	if t.ConnectTimeout > 0 {
+		rt.DialContext = (&net.Dialer{Timeout: t.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		rt.TLSHandshakeTimeout = t.ConnectTimeout
+	}
+	// HTTP/2 connections negotiated with TLS honor it too
+	rt.ResponseHeaderTimeout = t.HeaderTimeout
+	if t.TLSConfig != nil {
+		rt.TLSClientConfig = t.TLSConfig.Clone()
+	}
+	if t.Protocol == ProtocolHTTP1 {
+		// A non-nil empty map disables HTTP/2
+		rt.ForceAttemptHTTP2 = false
+		rt.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return rt
+	}
+	if h2, err := http2.ConfigureTransports(rt); err == nil {
+		h2.ReadIdleTimeout = pool.HTTP2ReadIdleTimeout
+		h2.PingTimeout = pool.HTTP2PingTimeout
+	}
+	return rt
+}
+
+// h2RoundTripper speaks HTTP/2 over TLS to https endpoints, and in cleartext
+// to http endpoints
+type h2RoundTripper struct {
+	tls       *http2.Transport
+	cleartext *http2.Transport
+	// headerTimeout is enforced by the round tripper, as http2.Transport has
+	// no such setting of its own
+	headerTimeout time.Duration
+}
+
+func (t h2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.tls
+	if req.URL.Scheme == "http" {
+		rt = t.cleartext
+	}
+	if t.headerTimeout <= 0 {
+		return rt.RoundTrip(req)
+	}
+
+	// The request is cancelled unless its headers arrive in time, and
+	// otherwise once its body is closed
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.headerTimeout, func() {
+		cancel(errHeaderTimeout)
+	})
+	resp, err := rt.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel(nil)
+		return nil, errHeaderTimeout
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+	return resp, nil
+}
+
+// errHeaderTimeout is the error of requests whose headers didn't arrive within
+// the header timeout. Like that of net/http, it is a timeout.
+var errHeaderTimeout error = timeoutError("timeout awaiting response headers")
+
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// cancelOnClose cancels the context of a request once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// NewHTTPClient creates the long-lived client a backend sends the requests it
+// serves with, which are traced. timeout bounds whole requests, if set.
+func NewHTTPClient(rt http.RoundTripper, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: telemetry.Transport(rt),
+		Timeout:   timeout,
+	}
+}
+
+// NewTLSConfig creates the TLS config of upstream connections, trusting the
+// CA in caFile besides the system's and presenting the client certificate in
+// certFile and keyFile, if set. insecureSkipVerify disables the verification
+// of the upstream's certificate, which is only meant for testing.
+func NewTLSConfig(caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading CA")
+		}
+		cfg.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			cfg.RootCAs = x509.NewCertPool()
+		}
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in CA %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,148 @@
+package backend
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+// ParamMaxTokens names the completion token limit, max_tokens or
+// max_completion_tokens, which can be defaulted and capped but not stripped
+const ParamMaxTokens = "max_tokens"
+
+// ModelParams are the default parameters of a model, which are set on
+// requests which omit them, and the caps of its parameters, which bound the
+// values requested
+type ModelParams struct {
+	Temperature      *float64
+	TopP             *float64
+	MaxTokens        *int
+	FrequencyPenalty *float64
+	PresencePenalty  *float64
+
+	TemperatureCap *float64
+	TopPCap        *float64
+	// MaxTokensCap also bounds requests which don't set max_tokens, unless
+	// MaxTokens sets their default
+	MaxTokensCap *int
+}
+
+// ParamResolver applies the default parameters and caps of the upstream
+// models to requests
+type ParamResolver struct {
+	// Models maps upstream model names or glob patterns such as
+	// "deepseek-*" to their parameters. The parameters of every entry matching
+	// a model apply, with its name taking precedence over the patterns
+	// matching it, and longer patterns over shorter ones.
+	Models map[string]ModelParams
+}
+
+// Resolve sets the default parameters of model which req omits, and lowers
+// the parameters which exceed its caps, returning the names of the
+// parameters it changed
+func (p ParamResolver) Resolve(ctx context.Context, model string, req *openai.ChatCompletionRequest) []string {
+	params, ok := p.lookup(model)
+	if !ok {
+		return nil
+	}
+
+	var changed []string
+	setDefault := func(name string, value *float64, field **float64) {
+		if value != nil && *field == nil {
+			*field = ptr(*value)
+			changed = append(changed, name)
+		}
+	}
+	setDefault(ParamTemperature, params.Temperature, &req.Temperature)
+	setDefault(ParamTopP, params.TopP, &req.TopP)
+	setDefault(ParamFrequencyPenalty, params.FrequencyPenalty, &req.FrequencyPenalty)
+	setDefault(ParamPresencePenalty, params.PresencePenalty, &req.PresencePenalty)
+	if params.MaxTokens != nil && req.CompletionTokenLimit() == nil {
+		req.MaxTokens = ptr(*params.MaxTokens)
+		changed = append(changed, ParamMaxTokens)
+	}
+
+	capValue := func(name string, limit *float64, field *float64) {
+		if limit != nil && field != nil && *field > *limit {
+			*field = *limit
+			changed = append(changed, name)
+		}
+	}
+	capValue(ParamTemperature, params.TemperatureCap, req.Temperature)
+	capValue(ParamTopP, params.TopPCap, req.TopP)
+	if limit := params.MaxTokensCap; limit != nil {
+		capped := false
+		for _, field := range []*int{req.MaxTokens, req.MaxCompletionTokens} {
+			if field != nil && *field > *limit {
+				*field = *limit
+				capped = true
+			}
+		}
+		if req.CompletionTokenLimit() == nil {
+			req.MaxTokens = ptr(*limit)
+			capped = true
+		}
+		if capped {
+			changed = append(changed, ParamMaxTokens)
+		}
+	}
+
+	if len(changed) > 0 {
+		slices.Sort(changed)
+		changed = slices.Compact(changed)
+		logutils.FromContext(ctx).Debugf(ctx, "Applied model parameters model=%s params=%s", model, strings.Join(changed, ","))
+	}
+	return changed
+}
+
+// lookup merges the parameters of the patterns matching model, with those
+// of its name and longer patterns overriding those of shorter patterns
+func (p ParamResolver) lookup(model string) (ModelParams, bool) {
+	var patterns []string
+	for pattern := range p.Models {
+		// "*" also matches models with a slash, such as "deepseek/deepseek-chat"
+		if pattern == "*" || matchAny([]string{pattern}, model) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	slices.SortFunc(patterns, func(a, b string) int {
+		switch {
+		case a == model:
+			return 1
+		case b == model:
+			return -1
+		case len(a) != len(b):
+			return len(a) - len(b)
+		}
+		return strings.Compare(b, a)
+	})
+
+	var merged ModelParams
+	for _, pattern := range patterns {
+		params := p.Models[pattern]
+		merged.Temperature = or(params.Temperature, merged.Temperature)
+		merged.TopP = or(params.TopP, merged.TopP)
+		merged.MaxTokens = or(params.MaxTokens, merged.MaxTokens)
+		merged.FrequencyPenalty = or(params.FrequencyPenalty, merged.FrequencyPenalty)
+		merged.PresencePenalty = or(params.PresencePenalty, merged.PresencePenalty)
+		merged.TemperatureCap = or(params.TemperatureCap, merged.TemperatureCap)
+		merged.TopPCap = or(params.TopPCap, merged.TopPCap)
+		merged.MaxTokensCap = or(params.MaxTokensCap, merged.MaxTokensCap)
+	}
+	return merged, len(patterns) > 0
+}
+
+// or returns p, or fallback if p is nil
+func or[T any](p, fallback *T) *T {
+	if p != nil {
+		return p
+	}
+	return fallback
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
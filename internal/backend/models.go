@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+// DefaultModelsTTL is how long models discovered upstream are cached
+const DefaultModelsTTL = 5 * time.Minute
+
+// ModelCatalog caches the models available upstream
+type ModelCatalog struct {
+	// TTL is how long discovered models are cached. Zero disables discovery.
+	TTL time.Duration
+	// Fetch lists the models available upstream
+	Fetch func(ctx context.Context) ([]openai.Model, error)
+
+	// fetchMu serializes fetches, while mu guards the cached list so it can
+	// be read during a fetch
+	fetchMu sync.Mutex
+	mu      sync.Mutex
+	models  []openai.Model
+	fetched time.Time
+}
+
+// Models returns the models available upstream, fetching them if the cached
+// list has expired. If fetching fails, the stale list is returned.
+func (c *ModelCatalog) Models(ctx context.Context) []openai.Model {
+	if c == nil || c.TTL <= 0 || c.Fetch == nil {
+		return nil
+	}
+
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	c.mu.Lock()
+	models, fetched := c.models, c.fetched
+	c.mu.Unlock()
+	if models != nil && time.Since(fetched) < c.TTL {
+		return models
+	}
+
+	fresh, err := c.Fetch(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "error fetching upstream models")
+		logutils.FromContext(ctx).Warn(ctx, err.Error())
+		return models
+	}
+	if fresh == nil {
+		fresh = []openai.Model{}
+	}
+
+	c.mu.Lock()
+	c.models, c.fetched = fresh, time.Now()
+	c.mu.Unlock()
+	return fresh
+}
+
+// Has returns whether model was discovered upstream. Only the cached list is
+// consulted, so requests never wait on discovery.
+func (c *ModelCatalog) Has(model string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.models {
+		if m.ID == model {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeModels lists the configured model aliases, or the default model if
+// there are none, followed by the upstream models which aren't aliases
+func MergeModels(aliases map[string]string, defaultModel, ownedBy string, upstream []openai.Model) []openai.Model {
+	models := make([]openai.Model, 0, len(aliases)+len(upstream))
+	listed := make(map[string]bool, len(aliases)+len(upstream))
+	for alias := range aliases {
+		models = append(models, openai.Model{
+			ID:      alias,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: ownedBy,
+		})
+		listed[alias] = true
+	}
+	if len(models) == 0 {
+		models = append(models, openai.Model{
+			ID:      defaultModel,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: ownedBy,
+		})
+		listed[defaultModel] = true
+	}
+	for _, m := range upstream {
+		if listed[m.ID] {
+			continue
+		}
+		models = append(models, m)
+		listed[m.ID] = true
+	}
+	return models
+}
+
+// FetchOpenAIModels lists the models of an OpenAI-compatible models endpoint
+func FetchOpenAIModels(ctx context.Context, client *http.Client, url, apikey, ownedBy string) ([]openai.Model, error) {
+	body, err := GetJSON(ctx, client, url, apikey)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Data []openai.Model `json:"data"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, errors.Wrap(err, "error parsing models response")
+	}
+
+	for i := range list.Data {
+		list.Data[i].Object = "model"
+		if list.Data[i].Created == 0 {
+			list.Data[i].Created = time.Now().Unix()
+		}
+		if list.Data[i].OwnedBy == "" {
+			list.Data[i].OwnedBy = ownedBy
+		}
+	}
+	return list.Data, nil
+}
+
+// GetJSON issues a GET request to url with client, authenticated with apikey
+// if it is set, and returns the body of a successful response
+func GetJSON(ctx context.Context, client *http.Client, url, apikey string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if apikey != "" {
+		req.Header.Set("Authorization", "Bearer "+apikey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error sending request")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+	return body, nil
+}
@@ -1,11 +1,18 @@
 package ollama
 
 import (
+	"encoding/json"
+	"time"
+
 	ollama "github.com/danilofalcao/cursor-deepseek/internal/api/ollama/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
 )
 
 func convertMessages(messages []openai.Message) []ollama.Message {
+	// Ollama identifies tool results by name rather than by call ID
+	toolNames := map[string]string{}
+
 	ollamaMessages := make([]ollama.Message, len(messages))
 	for i, message := range messages {
 		var content string
@@ -22,9 +29,165 @@ func convertMessages(messages []openai.Message) []ollama.Message {
 			}
 		}
 		ollamaMessages[i] = ollama.Message{
-			Role:    message.Role,
+			Role:    openai.NormalizeRole(message.Role),
 			Content: content,
 		}
+
+		switch message.Role {
+		case "assistant":
+			for _, tc := range message.ToolCalls {
+				toolNames[tc.ID] = tc.Function.Name
+				ollamaMessages[i].ToolCalls = append(ollamaMessages[i].ToolCalls, ollama.ToolCall{
+					ID: tc.ID,
+					Function: ollama.ToolCallFunction{
+						Name:      tc.Function.Name,
+						Arguments: convertToolCallArguments(tc.Function.Arguments),
+					},
+				})
+			}
+		case "tool", "function":
+			ollamaMessages[i].Role = "tool"
+			ollamaMessages[i].ToolName = message.Name
+			if name, ok := toolNames[message.ToolCallID]; ok {
+				ollamaMessages[i].ToolName = name
+			}
+		}
 	}
 	return ollamaMessages
 }
+
+// convertTools converts the tools, or legacy functions, of a request. No tools
+// are sent when the client asked for none to be called, since Ollama doesn't
+// support tool_choice.
+func convertTools(req *openai.ChatCompletionRequest) []ollama.Tool {
+	if choice, ok := req.ToolChoice.(string); ok && choice == "none" {
+		return nil
+	}
+
+	functions := req.Functions
+	for _, tool := range req.Tools {
+		functions = append(functions, tool.Function)
+	}
+
+	var tools []ollama.Tool
+	for _, fn := range functions {
+		tools = append(tools, ollama.Tool{
+			Type: "function",
+			Function: ollama.Function{
+				Name:        fn.Name,
+				Description: fn.Description,
+				Parameters:  fn.Parameters,
+			},
+		})
+	}
+	return tools
+}
+
+// convertToolCallArguments decodes OpenAI's JSON string arguments into the
+// object Ollama expects, passing them through unchanged if they don't decode
+func convertToolCallArguments(arguments string) any {
+	if arguments == "" {
+		return map[string]any{}
+	}
+	var decoded any
+	if err := json.Unmarshal([]byte(arguments), &decoded); err != nil {
+		return arguments
+	}
+	return decoded
+}
+
+// convertResponseToolCalls converts the tool calls returned by Ollama, which
+// may not have IDs, into OpenAI tool calls
+func convertResponseToolCalls(toolCalls []ollama.ToolCall) []openai.ToolCall {
+	converted := make([]openai.ToolCall, 0, len(toolCalls))
+	for _, tc := range toolCalls {
+		converted = append(converted, openai.ToolCall{
+			ID:   toolCallID(tc.ID),
+			Type: "function",
+			Function: openai.ToolCallFunction{
+				Name:      tc.Function.Name,
+				Arguments: encodeToolCallArguments(tc.Function.Arguments),
+			},
+		})
+	}
+	return converted
+}
+
+// convertResponseToolCallDeltas converts tool calls streamed by Ollama, which
+// arrive whole rather than in fragments, into OpenAI tool call deltas. first is
+// the index of the first call in the stream.
+func convertResponseToolCallDeltas(toolCalls []ollama.ToolCall, first int) []openai.ToolCallDelta {
+	converted := make([]openai.ToolCallDelta, 0, len(toolCalls))
+	for i, tc := range toolCalls {
+		converted = append(converted, openai.ToolCallDelta{
+			Index: first + i,
+			ID:    toolCallID(tc.ID),
+			Type:  "function",
+			Function: openai.ToolCallFunctionDelta{
+				Name:      tc.Function.Name,
+				Arguments: encodeToolCallArguments(tc.Function.Arguments),
+			},
+		})
+	}
+	return converted
+}
+
+func encodeToolCallArguments(arguments any) string {
+	if s, ok := arguments.(string); ok {
+		return s
+	}
+	if arguments == nil {
+		return "{}"
+	}
+	b, err := json.Marshal(arguments)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// toolCallID returns id, or a new OpenAI-style call ID if it is empty
+func toolCallID(id string) string {
+	if id != "" {
+		return id
+	}
+	return utils.GenerateToolCallID()
+}
+
+// createdAt converts Ollama's created_at timestamp into Unix seconds, falling
+// back to the current time if it is missing or malformed
+func createdAt(timestamp string) int64 {
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return time.Now().Unix()
+	}
+	return t.Unix()
+}
+
+// finishReason maps Ollama's done_reason, which older versions don't send,
+// onto an OpenAI finish reason
+func finishReason(doneReason string, toolCalls bool) string {
+	if doneReason == "" {
+		doneReason = openai.FinishReasonStop
+	}
+	return openai.NormalizeFinishReason(doneReason, toolCalls)
+}
+
+// convertResponseFormat maps the OpenAI response format onto Ollama's format,
+// which is either "json" or the JSON schema itself
+func convertResponseFormat(format *openai.ResponseFormat) any {
+	if format == nil {
+		return nil
+	}
+	switch format.Type {
+	case openai.ResponseFormatJSONObject:
+		return "json"
+	case openai.ResponseFormatJSONSchema:
+		if format.JSONSchema != nil && format.JSONSchema.Schema != nil {
+			return format.JSONSchema.Schema
+		}
+		return "json"
+	default:
+		return nil
+	}
+}
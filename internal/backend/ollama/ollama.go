@@ -3,47 +3,128 @@ package ollama
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	ollama "github.com/danilofalcao/cursor-deepseek/internal/api/ollama/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/balancer"
+	ollamaconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/ollama"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
 	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
 	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
 	"github.com/pkg/errors"
 )
 
 var _ backend.Backend = &ollamaBackend{}
+var _ backend.APIKeySetter = &ollamaBackend{}
+var _ backend.Embedder = &ollamaBackend{}
 
 type ollamaBackend struct {
-	endpoint     string
+	pool         *balancer.Pool
 	models       map[string]string
 	defaultModel string
-	apikey       string
-	timeout      time.Duration
+	apikey       *backend.APIKey
+	client       *http.Client
+	// probeClient sends the health probes and model listings, untraced
+	probeClient *http.Client
+	timeouts    backend.Timeouts
+	modelFilter backend.ModelFilter
+	params      backend.ParamStripper
+	// resolver applies the default parameters and caps of the models
+	resolver backend.ParamResolver
+	// catalog caches the models discovered upstream
+	catalog *backend.ModelCatalog
+	// streaming configures the heartbeats and idle timeouts of streams
+	streaming stream.Options
+	retry     backend.Retry
+
+	defaultOptions ollama.Options
+	thinkTags      string
+	// throughput totals the throughput Ollama reports for each model
+	throughput throughput
 }
 
 type Options struct {
 	Endpoint     string
+	Endpoints    []balancer.Target
 	Models       map[string]string
 	DefaultModel string
 	ApiKey       string
-	Timeout      time.Duration
+	// Timeout bounds non-streaming requests, unless Timeouts sets it
+	Timeout time.Duration
+	// Timeouts bound requests by whether they stream
+	Timeouts    backend.Timeouts
+	ModelFilter backend.ModelFilter
+	// Transport configures the connections to the upstream
+	Transport backend.Transport
+	// Retry configures how requests failing transiently are retried
+	Retry backend.Retry
+	// Heartbeat is the interval between the heartbeat comments sent while a
+	// stream is idle. Zero means stream.DefaultHeartbeatInterval, and a
+	// negative interval disables heartbeats.
+	Heartbeat time.Duration
+	// IdleTimeout aborts streams whose upstream sends no chunk for this long.
+	// Zero disables the timeout.
+	IdleTimeout time.Duration
+	// ModelsTTL is how long the models listed upstream are cached. Zero
+	// disables discovery.
+	ModelsTTL time.Duration
+	// ModelParams maps upstream models to their default parameters and caps
+	ModelParams map[string]backend.ModelParams
+	// UnsupportedParams maps upstream models to the request parameters which
+	// are stripped before forwarding, in addition to the built-in defaults
+	UnsupportedParams map[string][]string
+	// StrippedParamsHeader reports stripped parameters in a response header
+	StrippedParamsHeader bool
+	// DefaultOptions are the model parameters, such as num_ctx and top_k, used
+	// unless a request sets them
+	DefaultOptions ollama.Options
+	// ThinkTags is how <think> segments in the output are returned, one of
+	// ThinkTagsReasoning, the default, ThinkTagsStrip or ThinkTagsKeep
+	ThinkTags string
 }
 
 func NewOllamaBackend(opts Options) backend.Backend {
-	return &ollamaBackend{
-		endpoint:     opts.Endpoint,
+	rt := backend.NewRoundTripper(opts.Transport)
+	timeouts := opts.Timeouts
+	if timeouts.Total <= 0 {
+		timeouts.Total = opts.Timeout
+	}
+	b := &ollamaBackend{
+		pool:         balancer.New(balancer.Options{Targets: balancer.Targets(opts.Endpoint, opts.Endpoints)}),
 		models:       opts.Models,
 		defaultModel: opts.DefaultModel,
-		apikey:       opts.ApiKey,
-		timeout:      opts.Timeout,
+		apikey:       backend.NewAPIKey(opts.ApiKey),
+		client:       backend.NewHTTPClient(rt, 0),
+		probeClient:  &http.Client{Transport: rt},
+		timeouts:     timeouts,
+		modelFilter:  opts.ModelFilter,
+		streaming: stream.Options{
+			Heartbeat:         stream.HeartbeatInterval(opts.Heartbeat),
+			IdleTimeout:       opts.IdleTimeout,
+			FirstTokenTimeout: opts.Timeouts.FirstToken,
+		},
+		retry:    opts.Retry,
+		resolver: backend.ParamResolver{Models: opts.ModelParams},
+		params: backend.ParamStripper{
+			Unsupported: backend.MergeUnsupportedParams(ollamaconstants.UnsupportedParams, opts.UnsupportedParams),
+			Header:      opts.StrippedParamsHeader,
+		},
+		defaultOptions: opts.DefaultOptions,
+		thinkTags:      opts.ThinkTags,
 	}
+	b.catalog = &backend.ModelCatalog{TTL: opts.ModelsTTL, Fetch: b.fetchModels}
+	return b
 }
 
 // Name returns the name of the backend
@@ -54,198 +135,474 @@ func (b *ollamaBackend) Name() string {
 // HandleChatCompletion handles a chat completion request. This method must capture and
 // return to the client all errors on the provided writer.
 func (b *ollamaBackend) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, _ *http.Request, req *openai.ChatCompletionRequest) {
-	lgr, ctx := logutils.FromContext(ctx).Clone(b.Name())
+	modelOverride := contextutils.GetModelOverride(ctx)
+	// The backend's logger joins the request's context, whose cancellation
+	// when the client goes away tears down the upstream request
+	lgr, _ := logutils.FromContext(ctx).Clone(b.Name())
+	ctx = logutils.ContextWithLogger(ctx, lgr)
 
 	// Store original model name for response
 	originalModel := req.Model
 
+	// Reject models which are not allowed on this backend
+	if !b.modelFilter.Allowed(originalModel) {
+		lgr.Infof(ctx, "Rejecting request for disallowed model %s", originalModel)
+		backend.WriteModelNotFound(w, originalModel)
+		return
+	}
+
 	// Convert model internally
 	mappedModel, ok := b.models[originalModel]
 	if !ok {
-		mappedModel = b.defaultModel
+		mappedModel = cmp.Or(contextutils.GetDefaultModel(ctx), b.defaultModel)
+		// Models discovered upstream are served as they are
+		if b.catalog.Has(originalModel) {
+			mappedModel = originalModel
+		}
+	}
+	if modelOverride != "" {
+		mappedModel = modelOverride
 	}
 	req.Model = mappedModel
+	lgr = lgr.With("model", mappedModel)
+	ctx = logutils.ContextWithLogger(ctx, lgr)
 	lgr.Debugf(ctx, "Model converted to: %s (original: %s)", mappedModel, originalModel)
 
+	// Apply the model's default parameters and caps, then drop the parameters
+	// the upstream model would reject
+	b.resolver.Resolve(ctx, mappedModel, req)
+	b.params.Strip(ctx, w, mappedModel, req)
+
+	// Bound the request by its timeout, which depends on whether it streams
+	ctx, cancel := b.timeouts.Context(ctx, req.Stream)
+	defer cancel()
+
 	// Convert to Ollama request format
 	ollamaReq := ollama.Request{
 		Model:    mappedModel,
 		Messages: convertMessages(req.Messages),
 		Stream:   req.Stream,
+		Tools:    convertTools(req),
+	}
+
+	ollamaReq.Format = convertResponseFormat(req.ResponseFormat)
+	ollamaReq.Options = b.options(req)
+
+	// Ollama can't generate several choices at once, so each is requested
+	// separately and the choices are merged
+	n := 1
+	if req.N != nil && *req.N > 1 {
+		n = *req.N
+	}
+	ollamaResps := make([]*http.Response, n)
+	respErrs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		generationReq := ollamaReq
+		if i > 0 && ollamaReq.Options.Seed != nil {
+			// A shared seed would produce identical choices
+			opts := *ollamaReq.Options
+			seed := *opts.Seed + i
+			opts.Seed = &seed
+			generationReq.Options = &opts
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ollamaResps[i], respErrs[i] = b.chat(ctx, generationReq)
+		}()
+	}
+	wg.Wait()
+
+	for _, resp := range ollamaResps {
+		if resp != nil {
+			defer resp.Body.Close()
+		}
 	}
+	for _, err := range respErrs {
+		if err != nil {
+			lgr.Error(ctx, err.Error())
+			backend.WriteForwardError(ctx, w, err)
+			return
+		}
+	}
+	for _, resp := range ollamaResps {
+		if resp.StatusCode < http.StatusBadRequest {
+			continue
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			err = errors.Wrap(err, "error reading error response")
+			lgr.Error(ctx, err.Error())
+			response.WriteError(w, http.StatusInternalServerError, "Error reading response")
+			return
+		}
+		lgr.Infof(ctx, "Ollama error response: %s", string(respBody))
+
+		// Translate the error into its OpenAI equivalent
+		response.WriteUpstreamError(w, resp, respBody)
+		return
+	}
+
+	if req.Stream {
+		handleStreamingResponse(ctx, w, ollamaResps, originalModel, req.IncludeUsage(), b.thinkTags, b.streaming, &b.throughput)
+	} else {
+		handleRegularResponse(ctx, w, ollamaResps, originalModel, b.thinkTags, &b.throughput)
+	}
+}
 
+// options builds the model parameters of a request, starting from the
+// configured defaults and overriding them with the request's parameters
+func (b *ollamaBackend) options(req *openai.ChatCompletionRequest) *ollama.Options {
+	opts := b.defaultOptions
 	if req.Temperature != nil {
-		ollamaReq.Temperature = *req.Temperature
+		opts.Temperature = req.Temperature
 	}
-	if req.MaxTokens != nil {
-		ollamaReq.MaxTokens = *req.MaxTokens
+	if limit := req.CompletionTokenLimit(); limit != nil {
+		opts.NumPredict = limit
 	}
+	if req.TopP != nil {
+		opts.TopP = req.TopP
+	}
+	if len(req.Stop) > 0 {
+		opts.Stop = req.Stop
+	}
+	if req.Seed != nil {
+		opts.Seed = req.Seed
+	}
+	if req.FrequencyPenalty != nil {
+		opts.FrequencyPenalty = req.FrequencyPenalty
+	}
+	if req.PresencePenalty != nil {
+		opts.PresencePenalty = req.PresencePenalty
+	}
+	return &opts
+}
+
+// chat sends a chat request to the next upstream endpoint
+func (b *ollamaBackend) chat(ctx context.Context, ollamaReq ollama.Request) (*http.Response, error) {
+	lgr := logutils.FromContext(ctx)
 
 	// Create Ollama request
 	ollamaReqBody, err := json.Marshal(ollamaReq)
 	if err != nil {
-		err = errors.Wrap(err, "error marshalling ollama request")
-		lgr.Error(ctx, err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, errors.Wrap(err, "error marshalling ollama request")
 	}
 
 	lgr.Debugf(ctx, "ollamaReqBody: %s", string(ollamaReqBody))
-	// Send request to Ollama
-	ollamaResp, err := http.Post(
-		fmt.Sprintf("%s/chat", b.endpoint),
-		"application/json",
-		bytes.NewBuffer(ollamaReqBody),
-	)
+	// Send request to Ollama, each attempt to the next endpoint
+	return b.retry.Do(ctx, func() (*http.Response, error) {
+		ep := b.pool.Next()
+		if ep == nil {
+			return nil, balancer.ErrNoEndpoints
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/chat", ep.URL), bytes.NewBuffer(ollamaReqBody))
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating ollama request")
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		backend.SetRequestID(ctx, httpReq.Header)
+		ollamaResp, err := b.client.Do(httpReq)
+		if err != nil {
+			b.pool.MarkFailure(ep)
+			return nil, errors.Wrap(err, "error POSTing ollama request")
+		}
+
+		if ollamaResp.StatusCode >= http.StatusInternalServerError {
+			b.pool.MarkFailure(ep)
+		} else {
+			b.pool.MarkSuccess(ep)
+		}
+		return ollamaResp, nil
+	})
+}
+
+// Embed returns the embedding of each input with the model, from the next
+// upstream endpoint
+func (b *ollamaBackend) Embed(ctx context.Context, model string, input []string) ([][]float64, error) {
+	if mapped, ok := b.models[model]; ok {
+		model = mapped
+	}
+	body, err := json.Marshal(ollama.EmbedRequest{Model: model, Input: input})
 	if err != nil {
-		err = errors.Wrap(err, "error POSTing ollama request")
-		lgr.Error(ctx, err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, errors.Wrap(err, "error marshalling embed request")
 	}
-	defer ollamaResp.Body.Close()
 
-	if req.Stream {
-		handleStreamingResponse(ctx, w, ollamaResp, originalModel)
-	} else {
-		handleRegularResponse(ctx, w, ollamaResp, originalModel)
+	resp, err := b.retry.Do(ctx, func() (*http.Response, error) {
+		ep := b.pool.Next()
+		if ep == nil {
+			return nil, balancer.ErrNoEndpoints
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL+"/embed", bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating embed request")
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		backend.SetRequestID(ctx, httpReq.Header)
+		resp, err := b.client.Do(httpReq)
+		if err != nil {
+			b.pool.MarkFailure(ep)
+			return nil, errors.Wrap(err, "error POSTing embed request")
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			b.pool.MarkFailure(ep)
+		} else {
+			b.pool.MarkSuccess(ep)
+		}
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("ollama returned status %d to embed request", resp.StatusCode)
+	}
+	var embedResp ollama.EmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&embedResp); err != nil {
+		return nil, errors.Wrap(err, "error decoding embed response")
+	}
+	if len(embedResp.Embeddings) != len(input) {
+		return nil, errors.Errorf("ollama returned %d embeddings for %d inputs", len(embedResp.Embeddings), len(input))
 	}
+	return embedResp.Embeddings, nil
 }
 
 // ListModels returns the list of available models
 func (b *ollamaBackend) ListModels(ctx context.Context) ([]openai.Model, error) {
-	openAiModels := make([]openai.Model, 0, len(b.models))
-	for servedModel := range b.models {
-		openAiModels = append(openAiModels, openai.Model{
-			ID:      servedModel,
-			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: "ollama",
-		})
+	models := backend.MergeModels(b.models, b.defaultModel, "ollama", b.catalog.Models(ctx))
+	return b.modelFilter.FilterModels(models), nil
+}
+
+// fetchModels lists the models pulled on the Ollama server. The API key of
+// the backend authenticates clients, so it isn't sent upstream.
+func (b *ollamaBackend) fetchModels(ctx context.Context) ([]openai.Model, error) {
+	ep := b.pool.Next()
+	if ep == nil {
+		return nil, balancer.ErrNoEndpoints
+	}
+	body, err := backend.GetJSON(ctx, b.probeClient, ep.URL+"/tags", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var tags ollama.TagsResponse
+	if err := json.Unmarshal(body, &tags); err != nil {
+		return nil, errors.Wrap(err, "error parsing tags response")
 	}
-	if len(openAiModels) == 0 {
-		openAiModels = append(openAiModels, openai.Model{
-			ID:      b.defaultModel,
+
+	models := make([]openai.Model, 0, len(tags.Models))
+	for _, tag := range tags.Models {
+		models = append(models, openai.Model{
+			ID:      tag.Name,
 			Object:  "model",
-			Created: time.Now().Unix(),
+			Created: createdAt(tag.ModifiedAt),
 			OwnedBy: "ollama",
 		})
 	}
-	return openAiModels, nil
+	return models, nil
 }
 
 // ValidateAPIKey validates the provided API key
 func (b *ollamaBackend) ValidateAPIKey(apiKey string) bool {
-	return utils.SecureCompareString(apiKey, b.apikey)
+	return utils.SecureCompareString(apiKey, b.apikey.Get())
 }
 
-func handleStreamingResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, originalModel string) {
-	lgr := logutils.FromContext(ctx)
+// SetAPIKey replaces the upstream API key, such as when it is rotated
+func (b *ollamaBackend) SetAPIKey(apiKey string) {
+	b.apikey.Set(apiKey)
+}
 
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+// HealthCheck probes every upstream endpoint's tags route
+func (b *ollamaBackend) HealthCheck(ctx context.Context) error {
+	return b.pool.Probe(ctx, balancer.HTTPProbe(b.probeClient, "/tags", nil))
+}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		lgr.Error(ctx, "streaming unsupported")
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		return
+// Stats describes the upstream endpoints and the throughput of each model
+type Stats struct {
+	Endpoints []balancer.Status          `json:"endpoints"`
+	Models    map[string]ModelThroughput `json:"models,omitempty"`
+}
+
+// Stats returns the state of every upstream endpoint and the throughput of
+// each model
+func (b *ollamaBackend) Stats() any {
+	return Stats{
+		Endpoints: b.pool.Status(),
+		Models:    b.throughput.stats(),
 	}
+}
 
-	reader := bufio.NewReader(resp.Body)
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err != io.EOF {
-				err = errors.Wrap(err, "error reading stream")
-				lgr.Error(ctx, err.Error())
-				return // the break below gets out of the loop and returns, but it's a long loop
-			}
-			break
-		}
+func handleStreamingResponse(ctx context.Context, w http.ResponseWriter, resps []*http.Response, originalModel string, includeUsage bool, thinkTags string, opts stream.Options, stats *throughput) {
+	// Create a context that will be cancelled once the stream has been relayed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		var ollamaResp ollama.Response
-		if err := json.Unmarshal(line, &ollamaResp); err != nil {
-			err = errors.Wrapf(err, "error unmarshaling response %s", string(line))
-			lgr.Error(ctx, err.Error())
-			continue
+	// Every chunk of every choice belongs to the same response
+	id := utils.GenerateResponseID()
+
+	streams := make([]<-chan openai.ChatCompletionStreamResponse, len(resps))
+	streamErrs := make([]<-chan error, len(resps))
+	for i, resp := range resps {
+		streams[i], streamErrs[i] = streamChunks(ctx, resp, id, originalModel, i, stats)
+		streams[i] = thinkingChunks(ctx, streams[i], thinkTags)
+	}
+	chunks, errs := stream.Merge(ctx, streams, streamErrs)
+	chunks = stream.Stabilize(ctx, chunks)
+
+	// Total the usage of every choice so that the last usage seen covers them all
+	var total openai.Usage
+	chunks = stream.Transform(ctx, chunks, func(chunk *openai.ChatCompletionStreamResponse) {
+		if chunk.Usage == nil {
+			return
 		}
+		// The prompt is the same for every choice, so it is only counted once
+		total.PromptTokens = max(total.PromptTokens, chunk.Usage.PromptTokens)
+		total.CompletionTokens += chunk.Usage.CompletionTokens
+		total.TotalTokens = total.PromptTokens + total.CompletionTokens
+		usage := total
+		chunk.Usage = &usage
+	})
+	chunks = stream.Usage(ctx, chunks, includeUsage)
+	stream.Write(ctx, w, chunks, errs, opts)
+}
+
+// streamChunks reads Ollama's newline-delimited JSON stream and converts each
+// message into an OpenAI chunk with the given ID for the choice at index. The token counts of
+// the final message are reported as the usage of its chunk, and its throughput
+// recorded in stats. Both returned
+// channels are closed once the final message is read, the stream ends, or the
+// context is done.
+func streamChunks(ctx context.Context, resp *http.Response, id, originalModel string, index int, stats *throughput) (<-chan openai.ChatCompletionStreamResponse, <-chan error) {
+	lgr := logutils.FromContext(ctx)
+	chunks := make(chan openai.ChatCompletionStreamResponse)
+	errs := make(chan error, 1)
 
-		openAIResp := openai.ChatCompletionStreamResponse{
-			ID:      "chatcmpl-" + time.Now().Format("20060102150405"),
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   originalModel,
-			Choices: []openai.StreamChoice{
-				{
-					Index: 0,
-					Delta: openai.Delta{
-						Content: openai.Content_String{Content: ollamaResp.Message.Content},
-						Role:    "assistant",
+	go func() {
+		defer close(chunks)
+		defer close(errs)
+
+		var toolCalls int
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				if err != io.EOF {
+					errs <- errors.Wrap(err, "error reading stream")
+				}
+				return
+			}
+
+			var ollamaResp ollama.Response
+			if err := json.Unmarshal(line, &ollamaResp); err != nil {
+				err = errors.Wrapf(err, "error unmarshaling response %s", string(line))
+				lgr.Error(ctx, err.Error())
+				continue
+			}
+
+			openAIResp := openai.ChatCompletionStreamResponse{
+				ID:      id,
+				Object:  "chat.completion.chunk",
+				Created: createdAt(ollamaResp.CreatedAt),
+				Model:   originalModel,
+				Choices: []openai.StreamChoice{
+					{
+						Index: index,
+						Delta: openai.Delta{
+							Content:          openai.Content_String{Content: ollamaResp.Message.Content},
+							Role:             "assistant",
+							ReasoningContent: ollamaResp.Message.Thinking,
+						},
 					},
 				},
-			},
-		}
+			}
 
-		if ollamaResp.Done {
-			openAIResp.Choices[0].FinishReason = "stop"
-		}
+			if len(ollamaResp.Message.ToolCalls) > 0 {
+				openAIResp.Choices[0].Delta.ToolCalls = convertResponseToolCallDeltas(ollamaResp.Message.ToolCalls, toolCalls)
+				toolCalls += len(ollamaResp.Message.ToolCalls)
+			}
 
-		data, err := json.Marshal(openAIResp)
-		if err != nil {
-			err = errors.Wrap(err, "error marshaling OpenAI response")
-			lgr.Error(ctx, err.Error())
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+			if ollamaResp.Done {
+				openAIResp.Choices[0].FinishReason = finishReason(ollamaResp.DoneReason, toolCalls > 0)
+				openAIResp.Usage = &openai.Usage{
+					PromptTokens:     ollamaResp.PromptEvalCount,
+					CompletionTokens: ollamaResp.EvalCount,
+					TotalTokens:      ollamaResp.PromptEvalCount + ollamaResp.EvalCount,
+				}
+				stats.record(ctx, ollamaResp)
+			}
 
-		lgr.Tracef(ctx, "data: %+v", string(data))
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+			select {
+			case chunks <- openAIResp:
+			case <-ctx.Done():
+				return
+			}
 
-		if ollamaResp.Done {
-			break
+			if ollamaResp.Done {
+				return
+			}
 		}
-	}
+	}()
+
+	return chunks, errs
 }
 
-func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, originalModel string) {
+func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resps []*http.Response, originalModel string, thinkTags string, stats *throughput) {
 	lgr := logutils.FromContext(ctx)
-	var ollamaResp ollama.Response
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		err = errors.Wrapf(err, "error reading response: %s", string(b))
-		lgr.Error(ctx, err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	err = json.Unmarshal(b, &ollamaResp)
-	if err != nil {
-		err = errors.Wrapf(err, "error unmarshaling response: %s", string(b))
-		lgr.Error(ctx, err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 
 	// Convert to OpenAI format
 	openAIResp := openai.ChatCompletionResponse{
-		ID:      "chatcmpl-" + time.Now().Format("20060102150405"),
+		ID:      utils.GenerateResponseID(),
 		Object:  "chat.completion",
-		Created: time.Now().Unix(),
 		Model:   originalModel,
-		Choices: []openai.Choice{
-			{
-				Index: 0,
-				Message: openai.Message{
-					Role:    "assistant",
-					Content: openai.Content_String{Content: ollamaResp.Message.Content},
-				},
-				FinishReason: "stop",
+		Choices: make([]openai.Choice, 0, len(resps)),
+	}
+
+	for i, resp := range resps {
+		var ollamaResp ollama.Response
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			err = errors.Wrapf(err, "error reading response: %s", string(b))
+			lgr.Error(ctx, err.Error())
+			response.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		err = json.Unmarshal(b, &ollamaResp)
+		if err != nil {
+			err = errors.Wrapf(err, "error unmarshaling response: %s", string(b))
+			lgr.Error(ctx, err.Error())
+			response.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if i == 0 {
+			openAIResp.Created = createdAt(ollamaResp.CreatedAt)
+		}
+		stats.record(ctx, ollamaResp)
+
+		content, reasoning := splitThinking(ollamaResp.Message.Content, ollamaResp.Message.Thinking, thinkTags)
+		choice := openai.Choice{
+			Index: i,
+			Message: openai.Message{
+				Role:             "assistant",
+				Content:          openai.Content_String{Content: content},
+				ReasoningContent: reasoning,
 			},
-		},
+			FinishReason: finishReason(ollamaResp.DoneReason, len(ollamaResp.Message.ToolCalls) > 0),
+		}
+		if len(ollamaResp.Message.ToolCalls) > 0 {
+			choice.Message.ToolCalls = convertResponseToolCalls(ollamaResp.Message.ToolCalls)
+		}
+		openAIResp.Choices = append(openAIResp.Choices, choice)
+
+		// The prompt is the same for every choice, so it is only counted once
+		openAIResp.Usage.PromptTokens = max(openAIResp.Usage.PromptTokens, ollamaResp.PromptEvalCount)
+		openAIResp.Usage.CompletionTokens += ollamaResp.EvalCount
 	}
+	openAIResp.Usage.TotalTokens = openAIResp.Usage.PromptTokens + openAIResp.Usage.CompletionTokens
 
 	lgr.Debugf(ctx, "openAIResp: %+v", openAIResp)
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,146 @@
+package ollama
+
+import (
+	"context"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+)
+
+// How <think>...</think> segments in the output of reasoning models such as
+// deepseek-r1 are returned to the client
+const (
+	// ThinkTagsReasoning moves the segments into reasoning_content
+	ThinkTagsReasoning = "reasoning"
+	// ThinkTagsStrip removes the segments, and any reasoning, entirely
+	ThinkTagsStrip = "strip"
+	// ThinkTagsKeep leaves the segments in the content
+	ThinkTagsKeep = "keep"
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+// thinkSplitter separates <think>...</think> segments from content which
+// arrives in pieces. A tag may be split across pieces, so the end of a piece
+// which could be the start of a tag is held back until the next piece.
+type thinkSplitter struct {
+	thinking bool
+	pending  string
+	// closed is set after a segment ends, until the newlines models put
+	// between their reasoning and their answer have been trimmed
+	closed bool
+}
+
+// split returns the content and reasoning of the next piece of text
+func (s *thinkSplitter) split(text string) (content, reasoning string) {
+	var contentBuf, reasoningBuf strings.Builder
+	text = s.pending + text
+	s.pending = ""
+	write := func(piece string) {
+		if s.thinking {
+			reasoningBuf.WriteString(piece)
+			return
+		}
+		if s.closed {
+			piece = strings.TrimLeft(piece, "\n")
+			s.closed = piece == ""
+		}
+		contentBuf.WriteString(piece)
+	}
+
+	for text != "" {
+		tag := thinkOpenTag
+		if s.thinking {
+			tag = thinkCloseTag
+		}
+
+		if i := strings.Index(text, tag); i >= 0 {
+			write(text[:i])
+			text = text[i+len(tag):]
+			s.closed = s.thinking
+			s.thinking = !s.thinking
+			continue
+		}
+
+		keep := partialTagSuffix(text, tag)
+		write(text[:len(text)-keep])
+		s.pending = text[len(text)-keep:]
+		break
+	}
+	return contentBuf.String(), reasoningBuf.String()
+}
+
+// flush returns any text held back at the end of the output
+func (s *thinkSplitter) flush() (content, reasoning string) {
+	text := s.pending
+	s.pending = ""
+	if s.thinking {
+		return "", text
+	}
+	return text, ""
+}
+
+// partialTagSuffix returns the length of the longest suffix of text which is
+// a prefix of tag
+func partialTagSuffix(text, tag string) int {
+	for n := min(len(text), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// splitThinking separates the <think>...</think> segments of a whole message
+// according to mode
+func splitThinking(content, reasoning, mode string) (string, string) {
+	switch mode {
+	case ThinkTagsKeep:
+		return content, reasoning
+	case ThinkTagsStrip:
+		content, _ = splitThinking(content, "", ThinkTagsReasoning)
+		return content, ""
+	default:
+		var s thinkSplitter
+		content, thought := s.split(content)
+		restContent, restThought := s.flush()
+		return content + restContent, reasoning + thought + restThought
+	}
+}
+
+// thinkingChunks separates the <think>...</think> segments of a single
+// choice's stream according to mode
+func thinkingChunks(ctx context.Context, in <-chan openai.ChatCompletionStreamResponse, mode string) <-chan openai.ChatCompletionStreamResponse {
+	if mode == ThinkTagsKeep {
+		return in
+	}
+
+	var s thinkSplitter
+	return stream.Transform(ctx, in, func(chunk *openai.ChatCompletionStreamResponse) {
+		for i := range chunk.Choices {
+			delta := &chunk.Choices[i].Delta
+			var text string
+			if c, ok := delta.Content.(openai.Content_String); ok {
+				text = c.Content
+			}
+
+			content, reasoning := s.split(text)
+			if chunk.Choices[i].FinishReason != "" {
+				restContent, restReasoning := s.flush()
+				content += restContent
+				reasoning += restReasoning
+			}
+
+			delta.Content = openai.Content_String{Content: content}
+			if mode == ThinkTagsStrip {
+				delta.ReasoningContent = ""
+			} else {
+				delta.ReasoningContent += reasoning
+			}
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package ollama
+
+import (
+	"strings"
+	"testing"
+)
+
+// splitPieces runs pieces through a thinkSplitter, returning all the content
+// and reasoning
+func splitPieces(pieces []string) (content, reasoning string) {
+	var s thinkSplitter
+	var contentBuf, reasoningBuf strings.Builder
+	for _, piece := range pieces {
+		c, r := s.split(piece)
+		contentBuf.WriteString(c)
+		reasoningBuf.WriteString(r)
+	}
+	c, r := s.flush()
+	contentBuf.WriteString(c)
+	reasoningBuf.WriteString(r)
+	return contentBuf.String(), reasoningBuf.String()
+}
+
+func TestThinkSplitter(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		pieces        []string
+		wantContent   string
+		wantReasoning string
+	}{
+		{
+			name:        "no tags",
+			pieces:      []string{"Hello, ", "world"},
+			wantContent: "Hello, world",
+		},
+		{
+			name:          "leading segment",
+			pieces:        []string{"<think>Let me see.</think>\n\nHello"},
+			wantContent:   "Hello",
+			wantReasoning: "Let me see.",
+		},
+		{
+			name:          "tags split across pieces",
+			pieces:        []string{"<thi", "nk>Let me", " see.</th", "ink>", "\n", "\nHello"},
+			wantContent:   "Hello",
+			wantReasoning: "Let me see.",
+		},
+		{
+			name:          "several segments",
+			pieces:        []string{"A<think>one</think>B<think>two</think>C"},
+			wantContent:   "ABC",
+			wantReasoning: "onetwo",
+		},
+		{
+			name:        "newlines kept within the answer",
+			pieces:      []string{"<think></think>\nHello\n\nworld"},
+			wantContent: "Hello\n\nworld",
+		},
+		{
+			name:        "partial tag at the end",
+			pieces:      []string{"1 <", " 2 <thin"},
+			wantContent: "1 < 2 <thin",
+		},
+		{
+			name:          "unterminated segment",
+			pieces:        []string{"<think>Let me see", "</thi"},
+			wantReasoning: "Let me see</thi",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content, reasoning := splitPieces(tc.pieces)
+			if content != tc.wantContent || reasoning != tc.wantReasoning {
+				t.Errorf("got content %q, reasoning %q, want %q, %q", content, reasoning, tc.wantContent, tc.wantReasoning)
+			}
+		})
+
+		t.Run(tc.name+"/bytes", func(t *testing.T) {
+			var pieces []string
+			for _, b := range []byte(strings.Join(tc.pieces, "")) {
+				pieces = append(pieces, string(b))
+			}
+			content, reasoning := splitPieces(pieces)
+			if content != tc.wantContent || reasoning != tc.wantReasoning {
+				t.Errorf("got content %q, reasoning %q, want %q, %q", content, reasoning, tc.wantContent, tc.wantReasoning)
+			}
+		})
+	}
+}
+
+func TestSplitThinking(t *testing.T) {
+	const text = "<think>Let me see.</think>\n\nHello"
+	for _, tc := range []struct {
+		mode          string
+		reasoning     string
+		wantContent   string
+		wantReasoning string
+	}{
+		{mode: ThinkTagsReasoning, wantContent: "Hello", wantReasoning: "Let me see."},
+		{mode: "", reasoning: "Before. ", wantContent: "Hello", wantReasoning: "Before. Let me see."},
+		{mode: ThinkTagsStrip, reasoning: "Before. ", wantContent: "Hello"},
+		{mode: ThinkTagsKeep, reasoning: "Before. ", wantContent: text, wantReasoning: "Before. "},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			content, reasoning := splitThinking(text, tc.reasoning, tc.mode)
+			if content != tc.wantContent || reasoning != tc.wantReasoning {
+				t.Errorf("got content %q, reasoning %q, want %q, %q", content, reasoning, tc.wantContent, tc.wantReasoning)
+			}
+		})
+	}
+}
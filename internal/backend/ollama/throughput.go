@@ -0,0 +1,99 @@
+package ollama
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ollama "github.com/danilofalcao/cursor-deepseek/internal/api/ollama/v1"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+// throughput totals the token counts and durations Ollama reports in the
+// final message of each generation, by model
+type throughput struct {
+	mu     sync.Mutex
+	models map[string]*ModelThroughput
+}
+
+// ModelThroughput is the throughput of a model across its generations
+type ModelThroughput struct {
+	Generations  int64 `json:"generations"`
+	PromptTokens int64 `json:"prompt_tokens"`
+	EvalTokens   int64 `json:"eval_tokens"`
+	// PromptTokensPerSecond is the rate prompts were evaluated at, and
+	// EvalTokensPerSecond the rate tokens were generated at
+	PromptTokensPerSecond float64 `json:"prompt_tokens_per_second"`
+	EvalTokensPerSecond   float64 `json:"eval_tokens_per_second"`
+	// LoadSeconds is the time spent loading the model
+	LoadSeconds float64 `json:"load_seconds"`
+
+	// The rates are of the tokens of the generations which reported their
+	// durations
+	timedPromptTokens  int64
+	timedEvalTokens    int64
+	promptEvalDuration time.Duration
+	evalDuration       time.Duration
+}
+
+// tokensPerSecond is the rate of tokens evaluated over d, zero if unknown
+func tokensPerSecond(tokens int64, d time.Duration) float64 {
+	if tokens == 0 || d <= 0 {
+		return 0
+	}
+	return float64(tokens) / d.Seconds()
+}
+
+// record logs the throughput of a generation's final message and adds it to
+// its model's
+func (t *throughput) record(ctx context.Context, resp ollama.Response) {
+	promptEval := time.Duration(resp.PromptEvalDuration)
+	eval := time.Duration(resp.EvalDuration)
+	load := time.Duration(resp.LoadDuration)
+	lgr := logutils.FromContext(ctx)
+	if resp.TotalDuration > 0 {
+		lgr.Debugf(ctx, "Ollama evaluated %d prompt tokens in %s (%.1f tokens/s) and generated %d tokens in %s (%.1f tokens/s), after loading the model for %s, in %s",
+			resp.PromptEvalCount, promptEval, tokensPerSecond(int64(resp.PromptEvalCount), promptEval),
+			resp.EvalCount, eval, tokensPerSecond(int64(resp.EvalCount), eval),
+			load, time.Duration(resp.TotalDuration))
+	} else {
+		lgr.Debugf(ctx, "Ollama evaluated %d prompt tokens and generated %d tokens, without reporting durations", resp.PromptEvalCount, resp.EvalCount)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.models == nil {
+		t.models = map[string]*ModelThroughput{}
+	}
+	m, ok := t.models[resp.Model]
+	if !ok {
+		m = &ModelThroughput{}
+		t.models[resp.Model] = m
+	}
+	m.Generations++
+	m.PromptTokens += int64(resp.PromptEvalCount)
+	m.EvalTokens += int64(resp.EvalCount)
+	m.LoadSeconds += load.Seconds()
+	if promptEval > 0 {
+		m.timedPromptTokens += int64(resp.PromptEvalCount)
+		m.promptEvalDuration += promptEval
+	}
+	if eval > 0 {
+		m.timedEvalTokens += int64(resp.EvalCount)
+		m.evalDuration += eval
+	}
+}
+
+// stats returns the throughput of each model
+func (t *throughput) stats() map[string]ModelThroughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make(map[string]ModelThroughput, len(t.models))
+	for model, m := range t.models {
+		s := *m
+		s.PromptTokensPerSecond = tokensPerSecond(m.timedPromptTokens, m.promptEvalDuration)
+		s.EvalTokensPerSecond = tokensPerSecond(m.timedEvalTokens, m.evalDuration)
+		stats[model] = s
+	}
+	return stats
+}
@@ -67,6 +67,36 @@ func convertToolCalls(toolCalls []openai.ToolCall, toolType string) []deepseek.T
 	return converted
 }
 
+// convertResponseFormat passes the OpenAI response format through to OpenRouter,
+// which supports both JSON mode and structured outputs
+func convertResponseFormat(format *openai.ResponseFormat) *deepseek.ResponseFormat {
+	if format == nil {
+		return nil
+	}
+	converted := &deepseek.ResponseFormat{Type: format.Type}
+	if format.JSONSchema != nil {
+		converted.JSONSchema = format.JSONSchema
+	}
+	return converted
+}
+
+// convertReasoning returns the reasoning option of a request, which OpenAI's
+// reasoning_effort maps to unless the request sets OpenRouter's
+func convertReasoning(req *openai.ChatCompletionRequest) *deepseek.Reasoning {
+	if r := req.Reasoning; r != nil {
+		return &deepseek.Reasoning{
+			Effort:    r.Effort,
+			MaxTokens: r.MaxTokens,
+			Exclude:   r.Exclude,
+			Enabled:   r.Enabled,
+		}
+	}
+	if req.ReasoningEffort != "" {
+		return &deepseek.Reasoning{Effort: req.ReasoningEffort}
+	}
+	return nil
+}
+
 func convertMessages(ctx context.Context, messages []openai.Message) []deepseek.Message {
 	lgr := logutils.FromContext(ctx)
 	converted := make([]deepseek.Message, len(messages))
@@ -86,7 +116,7 @@ func convertMessages(ctx context.Context, messages []openai.Message) []deepseek.
 			}
 		}
 		converted[i] = deepseek.Message{
-			Role:       msg.Role,
+			Role:       openai.NormalizeRole(msg.Role),
 			Content:    content,
 			ToolCallID: msg.ToolCallID,
 			Name:       msg.Name,
@@ -1,50 +1,143 @@
 package openrouter
 
 import (
-	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"io"
-	"maps"
 	"net/http"
 	"time"
 
 	deepseek "github.com/danilofalcao/cursor-deepseek/internal/api/deepseek/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/balancer"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
 	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
 	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
 	"github.com/pkg/errors"
-	"golang.org/x/net/http2"
 )
 
 var _ backend.Backend = &openrouterBackend{}
+var _ backend.APIKeySetter = &openrouterBackend{}
 
 type openrouterBackend struct {
-	endpoint     string
+	pool         *balancer.Pool
 	models       map[string]string
 	defaultModel string
-	apikey       string
-	timeout      time.Duration
+	apikey       *backend.APIKey
+	client       *http.Client
+	// probeClient sends the health probes and model listings, untraced
+	probeClient *http.Client
+	timeouts    backend.Timeouts
+	modelFilter backend.ModelFilter
+	params      backend.ParamStripper
+	// resolver applies the default parameters and caps of the models
+	resolver backend.ParamResolver
+	// passthrough forwards requests with the model and parameters the client
+	// sent
+	passthrough bool
+	// includeCost asks OpenRouter to report the cost of requests
+	includeCost bool
+	// catalog caches the models discovered upstream
+	catalog *backend.ModelCatalog
+	// streaming configures the heartbeats and idle timeouts of streams
+	streaming stream.Options
+	retry     backend.Retry
+
+	keepAliveComments string
 }
 
+// How the keep-alive comments OpenRouter sends while a request is queued,
+// such as ": OPENROUTER PROCESSING", are relayed to the client
+const (
+	// KeepAliveHeartbeat replaces them with the proxy's own heartbeat comments
+	KeepAliveHeartbeat = "heartbeat"
+	// KeepAliveDrop swallows them
+	KeepAliveDrop = "drop"
+)
+
 type Options struct {
 	Endpoint     string
+	Endpoints    []balancer.Target
 	Models       map[string]string
 	DefaultModel string
 	ApiKey       string
-	Timeout      time.Duration
+	// Timeout bounds non-streaming requests, unless Timeouts sets it
+	Timeout time.Duration
+	// Timeouts bound requests by whether they stream
+	Timeouts    backend.Timeouts
+	ModelFilter backend.ModelFilter
+	// Transport configures the connections to the upstream
+	Transport backend.Transport
+	// Retry configures how requests failing transiently are retried
+	Retry backend.Retry
+	// Heartbeat is the interval between the heartbeat comments sent while a
+	// stream is idle. Zero means stream.DefaultHeartbeatInterval, and a
+	// negative interval disables heartbeats.
+	Heartbeat time.Duration
+	// IdleTimeout aborts streams whose upstream sends no chunk for this long.
+	// Zero disables the timeout.
+	IdleTimeout time.Duration
+	// ModelsTTL is how long the models listed upstream are cached. Zero
+	// disables discovery.
+	ModelsTTL time.Duration
+	// Passthrough forwards requests with the model and parameters the client
+	// sent, including those unknown to the proxy, and relays the responses as
+	// OpenRouter sent them. Models aren't mapped, and parameters aren't defaulted
+	// or stripped.
+	Passthrough bool
+	// IncludeCost asks OpenRouter to report the cost of each request in its
+	// usage, which is reported in the X-Upstream-Cost header of non-streaming
+	// responses and recorded by usage accounting
+	IncludeCost bool
+	// ModelParams maps upstream models to their default parameters and caps
+	ModelParams map[string]backend.ModelParams
+	// UnsupportedParams maps upstream models to the request parameters which
+	// are stripped before forwarding, in addition to the built-in defaults
+	UnsupportedParams map[string][]string
+	// StrippedParamsHeader reports stripped parameters in a response header
+	StrippedParamsHeader bool
+	// KeepAliveComments is KeepAliveHeartbeat, the default, or KeepAliveDrop
+	KeepAliveComments string
 }
 
 func NewOpenrouterBackend(opts Options) backend.Backend {
-	return &openrouterBackend{
-		endpoint:     opts.Endpoint,
+	rt := backend.NewRoundTripper(opts.Transport)
+	timeouts := opts.Timeouts
+	if timeouts.Total <= 0 {
+		timeouts.Total = opts.Timeout
+	}
+	b := &openrouterBackend{
+		pool:         balancer.New(balancer.Options{Targets: balancer.Targets(opts.Endpoint, opts.Endpoints)}),
 		models:       opts.Models,
 		defaultModel: opts.DefaultModel,
-		apikey:       opts.ApiKey,
-		timeout:      opts.Timeout,
+		apikey:       backend.NewAPIKey(opts.ApiKey),
+		client:       backend.NewHTTPClient(rt, 0),
+		probeClient:  &http.Client{Transport: rt},
+		timeouts:     timeouts,
+		modelFilter:  opts.ModelFilter,
+		streaming: stream.Options{
+			Heartbeat:         stream.HeartbeatInterval(opts.Heartbeat),
+			IdleTimeout:       opts.IdleTimeout,
+			FirstTokenTimeout: opts.Timeouts.FirstToken,
+		},
+		retry:       opts.Retry,
+		resolver:    backend.ParamResolver{Models: opts.ModelParams},
+		passthrough: opts.Passthrough,
+		includeCost: opts.IncludeCost,
+		params: backend.ParamStripper{
+			Unsupported: backend.MergeUnsupportedParams(opts.UnsupportedParams),
+			Header:      opts.StrippedParamsHeader,
+		},
+		keepAliveComments: opts.KeepAliveComments,
 	}
+	b.catalog = &backend.ModelCatalog{TTL: opts.ModelsTTL, Fetch: b.fetchModels}
+	return b
 }
 
 // Name returns the name of the backend
@@ -55,21 +148,52 @@ func (b *openrouterBackend) Name() string {
 // HandleChatCompletion handles a chat completion request. This method must capture and
 // return to the client all errors on the provided writer.
 func (b *openrouterBackend) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
-	lgr, ctx := logutils.FromContext(ctx).Clone(b.Name())
+	modelOverride := contextutils.GetModelOverride(ctx)
+	// The backend's logger joins the request's context, whose cancellation
+	// when the client goes away tears down the upstream request
+	lgr, _ := logutils.FromContext(ctx).Clone(b.Name())
+	ctx = logutils.ContextWithLogger(ctx, lgr)
 
 	lgr.Debugf(ctx, "Requested model: %s", req.Model)
 
 	// Store original model name for response
 	originalModel := req.Model
 
+	// Reject models which are not allowed on this backend
+	if !b.modelFilter.Allowed(originalModel) {
+		lgr.Infof(ctx, "Rejecting request for disallowed model %s", originalModel)
+		backend.WriteModelNotFound(w, originalModel)
+		return
+	}
+
+	// Forward the request untouched, rather than mapping its model
+	if b.passthrough {
+		b.handlePassthrough(ctx, w, r, req)
+		return
+	}
+
 	// Convert model internally
 	mappedModel, ok := b.models[originalModel]
 	if !ok {
-		mappedModel = b.defaultModel
+		mappedModel = cmp.Or(contextutils.GetDefaultModel(ctx), b.defaultModel)
+		// Models discovered upstream are served as they are
+		if b.catalog.Has(originalModel) {
+			mappedModel = originalModel
+		}
+	}
+	if modelOverride != "" {
+		mappedModel = modelOverride
 	}
 	req.Model = mappedModel
+	lgr = lgr.With("model", mappedModel)
+	ctx = logutils.ContextWithLogger(ctx, lgr)
 	lgr.Debugf(ctx, "Model converted to: %s (original: %s)", mappedModel, originalModel)
 
+	// Apply the model's default parameters and caps, then drop the parameters
+	// the upstream model would reject
+	b.resolver.Resolve(ctx, mappedModel, req)
+	b.params.Strip(ctx, w, mappedModel, req)
+
 	// Convert to DeepSeek request format
 	deepseekReq := deepseek.Request{
 		Model:    mappedModel,
@@ -86,17 +210,39 @@ func (b *openrouterBackend) HandleChatCompletion(ctx context.Context, w http.Res
 	}
 
 	// Set default max tokens if not provided
-	if req.MaxTokens != nil {
-		deepseekReq.MaxTokens = *req.MaxTokens
+	if limit := req.CompletionTokenLimit(); limit != nil {
+		deepseekReq.MaxTokens = *limit
 	} else {
 		defaultMaxTokens := 4096
 		deepseekReq.MaxTokens = defaultMaxTokens
 	}
 
+	// Copy sampling parameters
+	deepseekReq.N = req.N
+	deepseekReq.TopP = req.TopP
+	deepseekReq.Stop = req.Stop
+	deepseekReq.Seed = req.Seed
+	deepseekReq.FrequencyPenalty = req.FrequencyPenalty
+	deepseekReq.PresencePenalty = req.PresencePenalty
+	deepseekReq.ResponseFormat = convertResponseFormat(req.ResponseFormat)
+	deepseekReq.Logprobs = req.Logprobs
+	deepseekReq.TopLogprobs = req.TopLogprobs
+	deepseekReq.LogitBias = req.LogitBias
+	deepseekReq.Reasoning = convertReasoning(req)
+	if b.includeCost {
+		deepseekReq.Usage = &deepseek.UsageOptions{Include: true}
+	}
+
+	// Ask for a final usage chunk when the client wants one
+	if req.IncludeUsage() {
+		deepseekReq.StreamOptions = &deepseek.StreamOptions{IncludeUsage: true}
+	}
+
 	// Handle tools and tool choice
 	if len(req.Tools) > 0 {
 		deepseekReq.Tools = convertTools(req.Tools)
 		deepseekReq.ToolChoice = convertToolChoice(req.ToolChoice)
+		deepseekReq.ParallelToolCalls = req.ParallelToolCalls
 	} else if len(req.Functions) > 0 {
 		// Convert legacy functions to tools
 		tools := make([]deepseek.Tool, len(req.Functions))
@@ -119,235 +265,205 @@ func (b *openrouterBackend) HandleChatCompletion(ctx context.Context, w http.Res
 	if err != nil {
 		err = errors.Wrap(err, "error creating modified request body")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error creating modified request")
 		return
 	}
 
 	lgr.Debugf(ctx, "Modified request body: %s", string(modifiedBody))
 
-	// Create the proxy request to OpenRouter
-	targetURL := b.endpoint + "/chat/completions"
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
-	}
+	// Bound the request by its timeout, which depends on whether it streams
+	ctx, cancel := b.timeouts.Context(ctx, req.Stream)
+	defer cancel()
 
-	lgr.Debugf(ctx, "Forwarding to: %s", targetURL)
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
-	if err != nil {
-		err = errors.Wrap(err, "error creating proxy request")
-		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
+	resp, ok := b.forward(ctx, w, r, modifiedBody, req.Stream)
+	if !ok {
 		return
 	}
+	defer resp.Body.Close()
 
-	// Copy headers
-	copyHeaders(proxyReq.Header, r.Header)
-
-	// Set OpenRouter API key and required headers
-	proxyReq.Header.Set("Authorization", "Bearer "+b.apikey)
-	proxyReq.Header.Set("Content-Type", "application/json")
-	proxyReq.Header.Set("HTTP-Referer", "https://github.com/danilofalcao/cursor-deepseek") // Optional, for OpenRouter rankings
-	proxyReq.Header.Set("X-Title", "Cursor DeepSeek")                                      // Optional, for OpenRouter rankings
+	// Handle streaming response
 	if req.Stream {
-		proxyReq.Header.Set("Accept", "text/event-stream")
+		handleStreamingResponse(ctx, w, resp, originalModel, req.IncludeUsage(), b.keepAliveComments, b.streaming)
+		return
 	}
 
-	lgr.Debugf(ctx, "Proxy request headers: %v", proxyReq.Header)
+	// Handle regular response
+	handleRegularResponse(ctx, w, resp, originalModel)
+}
 
-	// Create a custom client with keepalive
-	client := &http.Client{
-		Transport: &http2.Transport{
-			AllowHTTP: true,
-			DialTLS:   nil,
-		},
-		// Remove global timeout as we'll handle timeouts per request type
-		Timeout: 0,
-	}
+// forward sends body to the next upstream endpoint. Error responses are
+// written to w, in which case ok is false.
+func (b *openrouterBackend) forward(ctx context.Context, w http.ResponseWriter, r *http.Request, body []byte, streaming bool) (resp *http.Response, ok bool) {
+	lgr := logutils.FromContext(ctx)
 
-	// Create context with timeout based on streaming
-	if !req.Stream {
-		// Use timeout only for non-streaming requests
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, b.timeout)
-		defer cancel()
-	}
+	// Every attempt goes to the next upstream endpoint
+	send := func() (*http.Response, error) {
+		ep := b.pool.Next()
+		if ep == nil {
+			return nil, balancer.ErrNoEndpoints
+		}
+		targetURL := ep.URL + "/chat/completions"
+		if r.URL.RawQuery != "" {
+			targetURL += "?" + r.URL.RawQuery
+		}
 
-	// Create the request with context
-	proxyReq = proxyReq.WithContext(ctx)
+		lgr.Debugf(ctx, "Forwarding to: %s", targetURL)
+		proxyReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating proxy request")
+		}
 
-	// Send the request
-	resp, err := client.Do(proxyReq)
+		// Copy headers
+		copyHeaders(proxyReq.Header, r.Header)
+
+		// Set OpenRouter API key and required headers
+		proxyReq.Header.Set("Authorization", "Bearer "+b.apikey.Get())
+		proxyReq.Header.Set("Content-Type", "application/json")
+		proxyReq.Header.Set("HTTP-Referer", "https://github.com/danilofalcao/cursor-deepseek") // Optional, for OpenRouter rankings
+		proxyReq.Header.Set("X-Title", "Cursor DeepSeek")                                      // Optional, for OpenRouter rankings
+		backend.SetRequestID(ctx, proxyReq.Header)
+		if streaming {
+			proxyReq.Header.Set("Accept", "text/event-stream")
+		}
+
+		lgr.Tracef(ctx, "Proxy request headers: %v", logger.RedactHeaders(proxyReq.Header))
+
+		// Send the request
+		resp, err := b.client.Do(proxyReq)
+		if err != nil {
+			b.pool.MarkFailure(ep)
+			return nil, errors.Wrap(err, "error forwarding request")
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			b.pool.MarkFailure(ep)
+		} else {
+			b.pool.MarkSuccess(ep)
+		}
+		return resp, nil
+	}
+
+	resp, err := b.retry.Do(ctx, send)
 	if err != nil {
-		err = errors.Wrap(err, "error forwarding request")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error forwarding request", http.StatusBadGateway)
-		return
+		backend.WriteForwardError(ctx, w, err)
+		return nil, false
 	}
-	defer resp.Body.Close()
 
 	lgr.Debugf(ctx, "OpenRouter response status: %d", resp.StatusCode)
-	lgr.Debugf(ctx, "OpenRouter response headers: %v", resp.Header)
+	lgr.Tracef(ctx, "OpenRouter response headers: %v", logger.RedactHeaders(resp.Header))
+	backend.ReportUpstreamRequestID(ctx, w, backend.UpstreamRequestID(ctx, resp.Header))
 
 	// Handle error responses
 	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
 		respBody, err := io.ReadAll(resp.Body)
 		if err != nil {
 			err = errors.Wrapf(err, "error reading error response")
 			lgr.Error(ctx, err.Error())
-			http.Error(w, "Error reading response", http.StatusInternalServerError)
-			return
+			response.WriteError(w, http.StatusInternalServerError, "Error reading response")
+			return nil, false
 		}
 
 		lgr.Infof(ctx, "OpenRouter error response: %s", string(respBody))
 
-		// Forward the error response
-		maps.Copy(w.Header(), resp.Header)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		w.Write(respBody)
-		return
+		// Translate the error into its OpenAI equivalent
+		response.WriteUpstreamError(w, resp, respBody)
+		return nil, false
 	}
 
-	// Handle streaming response
-	if req.Stream {
-		handleStreamingResponse(ctx, w, resp)
-		return
-	}
-
-	// Handle regular response
-	handleRegularResponse(ctx, w, resp, originalModel)
+	return resp, true
 }
 
 // ListModels returns the list of available models
 func (b *openrouterBackend) ListModels(ctx context.Context) ([]openai.Model, error) {
-	openAiModels := make([]openai.Model, 0, len(b.models))
-	for servedModel := range b.models {
-		openAiModels = append(openAiModels, openai.Model{
-			ID:      servedModel,
-			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: "deepseek",
-		})
-	}
-	if len(openAiModels) == 0 {
-		openAiModels = append(openAiModels, openai.Model{
-			ID:      b.defaultModel,
-			Object:  "model",
-			Created: time.Now().Unix(),
-			OwnedBy: "deepseek",
-		})
+	models := backend.MergeModels(b.models, b.defaultModel, "openrouter", b.catalog.Models(ctx))
+	return b.modelFilter.FilterModels(models), nil
+}
+
+// fetchModels lists the models available on OpenRouter
+func (b *openrouterBackend) fetchModels(ctx context.Context) ([]openai.Model, error) {
+	ep := b.pool.Next()
+	if ep == nil {
+		return nil, balancer.ErrNoEndpoints
 	}
-	return openAiModels, nil
+	return backend.FetchOpenAIModels(ctx, b.probeClient, ep.URL+"/models", b.apikey.Get(), "openrouter")
 }
 
 // ValidateAPIKey validates the provided API key
 func (b *openrouterBackend) ValidateAPIKey(apiKey string) bool {
-	return utils.SecureCompareString(apiKey, b.apikey)
+	return utils.SecureCompareString(apiKey, b.apikey.Get())
 }
 
-func handleStreamingResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response) {
-	lgr := logutils.FromContext(ctx)
-	lgr.Debug(ctx, "Starting streaming response handling")
+// SetAPIKey replaces the upstream API key, such as when it is rotated
+func (b *openrouterBackend) SetAPIKey(apiKey string) {
+	b.apikey.Set(apiKey)
+}
 
-	// Set headers for streaming response
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(resp.StatusCode)
+// HealthCheck probes every upstream endpoint's models route
+func (b *openrouterBackend) HealthCheck(ctx context.Context) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+b.apikey.Get())
+	return b.pool.Probe(ctx, balancer.HTTPProbe(b.probeClient, "/models", header))
+}
+
+// Stats returns the state of every upstream endpoint
+func (b *openrouterBackend) Stats() any {
+	return b.pool.Status()
+}
 
-	// Create a buffered reader for the response body
-	reader := bufio.NewReaderSize(resp.Body, 1024)
+func handleStreamingResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, originalModel string, includeUsage bool, keepAliveComments string, opts stream.Options) {
+	lgr := logutils.FromContext(ctx)
+	lgr.Debugf(ctx, "Starting streaming response handling with model: %s", originalModel)
 
-	// Create a context that will be cancelled when the client disconnects
+	// Create a context that will be cancelled once the stream has been relayed
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Create a channel for errors
-	errChan := make(chan error, 1)
-
-	// Start processing in a goroutine
-	go func() {
-		defer close(errChan)
-		for {
+	// Turn OpenRouter's keep-alives into heartbeats unless they are dropped
+	keepAlive := make(chan struct{}, 1)
+	var readOpts stream.ReadOptions
+	if keepAliveComments != KeepAliveDrop {
+		readOpts.OnComment = func(string) {
 			select {
-			case <-ctx.Done():
-				return
+			case keepAlive <- struct{}{}:
 			default:
-				// Read until we get a complete SSE message
-				var buffer bytes.Buffer
-				for {
-					line, err := reader.ReadBytes('\n')
-					if err != nil {
-						if err == io.EOF {
-							lgr.Debug(ctx, "EOF reached")
-							return
-						}
-						err = errors.Wrap(err, "error reading from upstream server stream")
-						errChan <- err
-						return
-					}
-
-					// Log the received line for debugging
-					lgr.Debugf(ctx, "Received line: %s", string(line))
-
-					// Write to buffer
-					buffer.Write(line)
-
-					// If we've reached the end of an event (double newline)
-					if bytes.HasSuffix(buffer.Bytes(), []byte("\n\n")) {
-						break
-					}
-				}
-
-				// Get the complete message
-				message := buffer.Bytes()
-
-				// Skip if empty
-				if len(bytes.TrimSpace(message)) == 0 {
-					continue
-				}
-
-				// Write the message
-				if _, err := w.Write(message); err != nil {
-					err = errors.Wrap(err, "error writing to downstream client stream")
-					errChan <- err
-					return
-				}
-
-				// Flush after each complete message
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-					lgr.Debug(ctx, "flushed message to client")
-				}
 			}
 		}
-	}()
-
-	// Wait for completion or error
-	select {
-	case err := <-errChan:
-		if err != nil {
-			lgr.Error(ctx, err.Error())
-		}
-	case <-ctx.Done():
-		lgr.Info(ctx, "context cancelled")
 	}
 
-	lgr.Info(ctx, "streaming response handler completed")
+	chunks, errs := stream.ReadOpenAI(ctx, resp.Body, readOpts)
+	// The ID of the chunks is OpenRouter's generation ID, which arrives after
+	// the response headers have been written
+	reported := false
+	chunks = stream.Transform(ctx, chunks, func(chunk *openai.ChatCompletionStreamResponse) {
+		if !reported && chunk.ID != "" {
+			reported = true
+			backend.ReportUpstreamRequestID(ctx, nil, chunk.ID)
+		}
+		if chunk.Usage != nil {
+			backend.ReportUpstreamCost(ctx, nil, chunk.Usage.Cost)
+		}
+	})
+	chunks = stream.Stabilize(ctx, chunks)
+	chunks = stream.RewriteModel(ctx, chunks, originalModel)
+	chunks = stream.Usage(ctx, chunks, includeUsage)
+	chunks = stream.FinishReasons(ctx, chunks)
+	opts.KeepAlive = keepAlive
+	stream.Write(ctx, w, chunks, errs, opts)
 }
 
 func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, originalModel string) {
 	lgr := logutils.FromContext(ctx)
 	lgr.Infof(ctx, "Handling regular (non-streaming) response")
 	lgr.Debugf(ctx, "Response status: %d", resp.StatusCode)
-	lgr.Debugf(ctx, "Response headers: %+v", resp.Header)
+	lgr.Tracef(ctx, "Response headers: %+v", logger.RedactHeaders(resp.Header))
 
 	// Read and log response body
 	body, err := readResponse(resp)
 	if err != nil {
 		err = errors.Wrap(err, "error reading response")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error reading response from upstream")
 		return
 	}
 
@@ -358,22 +474,32 @@ func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *htt
 	if err := json.Unmarshal(body, &deepseekResp); err != nil {
 		err = errors.Wrap(err, "error parsing DeepSeek response")
 		lgr.Error(ctx, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error processing response from upstream")
 		return
 	}
 
+	// The ID of the response is OpenRouter's generation ID
+	backend.ReportUpstreamRequestID(ctx, w, deepseekResp.ID)
+	backend.ReportUpstreamCost(ctx, w, deepseekResp.Usage.Cost)
+
 	// Use the original model name instead of hardcoding gpt-4o
 	deepseekResp.Model = originalModel
 
 	// If we have tools calls, make sure the have type "function"
 	for i, choice := range deepseekResp.Choices {
+		// The reasoning of OpenRouter's models is returned as reasoning_content
+		if choice.Message.ReasoningContent == "" {
+			choice.Message.ReasoningContent = choice.Message.Reasoning
+		}
+		choice.Message.Reasoning = ""
 		if choice.Message.ToolCalls != nil {
 			for j, tc := range choice.Message.ToolCalls {
 				tc.Type = "function"
 				choice.Message.ToolCalls[j] = tc
 			}
-			deepseekResp.Choices[i] = choice
 		}
+		choice.FinishReason = openai.NormalizeFinishReason(choice.FinishReason, len(choice.Message.ToolCalls) > 0)
+		deepseekResp.Choices[i] = choice
 	}
 
 	// Convert back to JSON
@@ -381,7 +507,7 @@ func handleRegularResponse(ctx context.Context, w http.ResponseWriter, resp *htt
 	if err != nil {
 		err = errors.Wrap(err, "error creating modified response")
 		lgr.Error(ctx, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Error processing response from upstream")
 		return
 	}
 
@@ -0,0 +1,72 @@
+package openrouter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// handlePassthrough forwards the request with the model and parameters the
+// client sent, including those unknown to the proxy, only adding the API key,
+// and relays the response as OpenRouter sent it
+func (b *openrouterBackend) handlePassthrough(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	if model := contextutils.GetModelOverride(ctx); model != "" {
+		req.Model = model
+	}
+	lgr := logutils.FromContext(ctx).With("model", req.Model)
+	ctx = logutils.ContextWithLogger(ctx, lgr)
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		err = errors.Wrap(err, "error creating passthrough request body")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Error creating modified request")
+		return
+	}
+	lgr.Debugf(ctx, "Passthrough request body: %s", string(body))
+
+	// Bound the request by its timeout, which depends on whether it streams
+	ctx, cancel := b.timeouts.Context(ctx, req.Stream)
+	defer cancel()
+
+	resp, ok := b.forward(ctx, w, r, body, req.Stream)
+	if !ok {
+		return
+	}
+	defer resp.Body.Close()
+
+	if req.Stream {
+		handlePassthroughResponse(ctx, w, resp, b.streaming)
+		return
+	}
+
+	respBody, err := readResponse(resp)
+	if err != nil {
+		err = errors.Wrap(err, "error reading response")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Error reading response from upstream")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+}
+
+// handlePassthroughResponse copies a stream to the client as it is, its
+// OpenRouter keep-alive comments included
+func handlePassthroughResponse(ctx context.Context, w http.ResponseWriter, resp *http.Response, opts stream.Options) {
+	lgr := logutils.FromContext(ctx)
+	lgr.Debugf(ctx, "Passing stream through, response status: %d", resp.StatusCode)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream.Passthrough(ctx, w, resp.Body, opts)
+}
@@ -11,10 +11,13 @@ import (
 )
 
 func copyHeaders(dst, src http.Header) {
-	// Headers to skip
+	// Headers to skip. The transport negotiates the encoding of the response
+	// with the upstream and decodes it, streams included, while the proxy
+	// compresses responses for the client itself.
 	skipHeaders := map[string]bool{
 		"Content-Length":    true,
 		"Content-Encoding":  true,
+		"Accept-Encoding":   true,
 		"Transfer-Encoding": true,
 		"Connection":        true,
 	}
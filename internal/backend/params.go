@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+// Names of the optional request parameters which can be stripped
+const (
+	ParamTemperature       = "temperature"
+	ParamTopP              = "top_p"
+	ParamStop              = "stop"
+	ParamSeed              = "seed"
+	ParamFrequencyPenalty  = "frequency_penalty"
+	ParamPresencePenalty   = "presence_penalty"
+	ParamLogitBias         = "logit_bias"
+	ParamLogprobs          = "logprobs"
+	ParamTopLogprobs       = "top_logprobs"
+	ParamParallelToolCalls = "parallel_tool_calls"
+	ParamResponseFormat    = "response_format"
+)
+
+// StrippedParamsHeader lists the parameters which were stripped from a request
+const StrippedParamsHeader = "X-Proxy-Stripped-Params"
+
+// ParamStripper removes request parameters which the upstream model doesn't
+// support, so that they are dropped with a warning instead of failing the
+// request with a 400.
+type ParamStripper struct {
+	// Unsupported maps upstream model names or glob patterns such as "*" to
+	// the parameters they don't support
+	Unsupported map[string][]string
+	// Header reports the stripped parameters in the StrippedParamsHeader
+	// response header
+	Header bool
+}
+
+// Strip clears every parameter set on req which model doesn't support. The
+// names of the stripped parameters are logged and, if enabled, set in the
+// response header.
+func (s ParamStripper) Strip(ctx context.Context, w http.ResponseWriter, model string, req *openai.ChatCompletionRequest) []string {
+	var unsupported []string
+	for pattern, params := range s.Unsupported {
+		// "*" also matches models with a slash, such as "deepseek/deepseek-chat"
+		if pattern == "*" || matchAny([]string{pattern}, model) {
+			unsupported = append(unsupported, params...)
+		}
+	}
+
+	var stripped []string
+	for _, param := range unsupported {
+		if slices.Contains(stripped, param) || !stripParam(req, param) {
+			continue
+		}
+		stripped = append(stripped, param)
+	}
+	if len(stripped) == 0 {
+		return nil
+	}
+
+	slices.Sort(stripped)
+	logutils.FromContext(ctx).Warnf(ctx, "Stripped unsupported parameters model=%s params=%s", model, strings.Join(stripped, ","))
+	if s.Header {
+		w.Header().Set(StrippedParamsHeader, strings.Join(stripped, ", "))
+	}
+	return stripped
+}
+
+// MergeUnsupportedParams combines parameter matrices, with later matrices
+// adding to the parameters of earlier ones
+func MergeUnsupportedParams(matrices ...map[string][]string) map[string][]string {
+	merged := map[string][]string{}
+	for _, m := range matrices {
+		for pattern, params := range m {
+			merged[pattern] = append(merged[pattern], params...)
+		}
+	}
+	return merged
+}
+
+// stripParam clears param on req, returning whether it was set
+func stripParam(req *openai.ChatCompletionRequest, param string) bool {
+	var set bool
+	switch param {
+	case ParamTemperature:
+		set = req.Temperature != nil
+		req.Temperature = nil
+	case ParamTopP:
+		set = req.TopP != nil
+		req.TopP = nil
+	case ParamStop:
+		set = len(req.Stop) > 0
+		req.Stop = nil
+	case ParamSeed:
+		set = req.Seed != nil
+		req.Seed = nil
+	case ParamFrequencyPenalty:
+		set = req.FrequencyPenalty != nil
+		req.FrequencyPenalty = nil
+	case ParamPresencePenalty:
+		set = req.PresencePenalty != nil
+		req.PresencePenalty = nil
+	case ParamLogitBias:
+		set = len(req.LogitBias) > 0
+		req.LogitBias = nil
+	case ParamLogprobs:
+		set = req.Logprobs != nil
+		req.Logprobs = nil
+	case ParamTopLogprobs:
+		set = req.TopLogprobs != nil
+		req.TopLogprobs = nil
+	case ParamParallelToolCalls:
+		set = req.ParallelToolCalls != nil
+		req.ParallelToolCalls = nil
+	case ParamResponseFormat:
+		set = req.ResponseFormat != nil
+		req.ResponseFormat = nil
+	}
+	return set
+}
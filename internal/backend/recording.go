@@ -0,0 +1,363 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+// Recording modes
+const (
+	// RecordingRecord sends requests upstream, recording them along with
+	// their responses
+	RecordingRecord = "record"
+	// RecordingReplay serves requests with their recorded responses, never
+	// sending them upstream
+	RecordingReplay = "replay"
+)
+
+// Recording records the requests a backend sends upstream, along with their
+// responses and the chunks they were streamed in, to a directory, or replays
+// them from it instead of sending requests upstream, such as to develop
+// without spending tokens. Requests are identified by their method, path and
+// body, so that identical requests are served the same response.
+type Recording struct {
+	// Mode is RecordingRecord or RecordingReplay, or empty to disable
+	// recording
+	Mode string
+	// Dir is where the recordings are kept, one JSON file per request
+	Dir string
+	// Realtime replays the chunks of responses with the delays they were
+	// recorded with, rather than at once
+	Realtime bool
+}
+
+// ValidateRecordingMode returns an error if mode isn't one of the recording
+// modes
+func ValidateRecordingMode(mode string) error {
+	switch mode {
+	case "", RecordingRecord, RecordingReplay:
+		return nil
+	default:
+		return errors.Errorf("unknown recording mode %q, which must be record or replay", mode)
+	}
+}
+
+// recorded is a request and its response, as they are kept on disk
+type recorded struct {
+	Request  recordedRequest  `json:"request"`
+	Response recordedResponse `json:"response"`
+}
+
+type recordedRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type recordedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// Chunks are the body as it was read, in order
+	Chunks []recordedChunk `json:"chunks"`
+}
+
+type recordedChunk struct {
+	// DelayMs is how long after the previous chunk, or the response headers,
+	// the chunk arrived
+	DelayMs int64  `json:"delay_ms"`
+	Data    string `json:"data"`
+}
+
+// unrecordedHeaders aren't recorded, as they are either per connection or
+// describe the body as it was sent rather than replayed
+var unrecordedHeaders = []string{"Set-Cookie", "Content-Length", "Connection", "Date"}
+
+// withRecording wraps rt with the recording's mode, if any
+func withRecording(rt http.RoundTripper, rec Recording) http.RoundTripper {
+	switch rec.Mode {
+	case RecordingRecord:
+		return recordingRoundTripper{rt: rt, rec: rec}
+	case RecordingReplay:
+		return replayRoundTripper{rec: rec}
+	default:
+		return rt
+	}
+}
+
+// recordingPath returns the file the request with body is recorded in, which
+// is named after its path and a hash of its method, path and body
+func recordingPath(dir string, req *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s\n", req.Method, req.URL.RequestURI())
+	hash.Write(body)
+	name := strings.ReplaceAll(strings.Trim(req.URL.Path, "/"), "/", "-")
+	return filepath.Join(dir, name+"-"+hex.EncodeToString(hash.Sum(nil))[:16]+".json")
+}
+
+// readBody reads the body of the request, restoring it to be sent
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading request body")
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// recordingRoundTripper sends requests upstream, recording those whose
+// responses are read to the end
+type recordingRoundTripper struct {
+	rt  http.RoundTripper
+	rec Recording
+}
+
+func (t recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	header := resp.Header.Clone()
+	for _, name := range unrecordedHeaders {
+		header.Del(name)
+	}
+	r := recorded{
+		Request: recordedRequest{
+			Method: req.Method,
+			Path:   req.URL.RequestURI(),
+			Body:   rawJSON(body),
+		},
+		Response: recordedResponse{
+			Status: resp.StatusCode,
+			Header: header,
+		},
+	}
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		ctx:        req.Context(),
+		path:       recordingPath(t.rec.Dir, req, body),
+		recorded:   r,
+		last:       time.Now(),
+	}
+	return resp, nil
+}
+
+// rawJSON returns body as JSON, as it is if it is JSON and otherwise as a
+// string
+func rawJSON(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
+
+// recordingBody records the chunks of a response as they are read, and saves
+// the recording once the response is read to the end
+type recordingBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	path     string
+	recorded recorded
+	last     time.Time
+	// partial is the start of a character split across reads, which is
+	// recorded along with the next chunk
+	partial []byte
+	saved   bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		data := append(b.partial, p[:n]...)
+		cut := len(data)
+		for i := 1; i <= utf8.UTFMax && i <= len(data); i++ {
+			if utf8.RuneStart(data[len(data)-i]) {
+				if !utf8.FullRune(data[len(data)-i:]) {
+					cut = len(data) - i
+				}
+				break
+			}
+		}
+		b.record(data[:cut])
+		b.partial = bytes.Clone(data[cut:])
+	}
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.record(b.partial)
+		if err := b.save(); err != nil {
+			// Failing to record doesn't fail the request
+			logutils.FromContext(b.ctx).Error(b.ctx, err.Error())
+		}
+	}
+	return n, err
+}
+
+// record appends a chunk read to the recording
+func (b *recordingBody) record(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	now := time.Now()
+	b.recorded.Response.Chunks = append(b.recorded.Response.Chunks, recordedChunk{
+		DelayMs: now.Sub(b.last).Milliseconds(),
+		Data:    string(data),
+	})
+	b.last = now
+}
+
+// save writes the recording to its file, replacing any previous recording of
+// the request
+func (b *recordingBody) save() error {
+	if err := os.MkdirAll(filepath.Dir(b.path), 0o755); err != nil {
+		return errors.Wrap(err, "error creating recording directory")
+	}
+	data, err := json.MarshalIndent(b.recorded, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error marshalling recording")
+	}
+	// Identical requests may be recorded at once, so each is written to its
+	// own file, which then replaces the recording
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "error writing recording")
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), b.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "error writing recording")
+	}
+	return nil
+}
+
+// replayRoundTripper serves requests with their recorded responses, and those
+// which weren't recorded with a 404
+type replayRoundTripper struct {
+	rec Recording
+}
+
+func (t replayRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	path := recordingPath(t.rec.Dir, req, body)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return notRecorded(req, path), nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading recording")
+	}
+	var r recorded
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errors.Wrapf(err, "error decoding recording %s", path)
+	}
+
+	header := r.Response.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Response.Status, http.StatusText(r.Response.Status)),
+		StatusCode:    r.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          &replayBody{ctx: req.Context(), chunks: r.Response.Chunks, realtime: t.rec.Realtime},
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// notRecorded is the response to a request which wasn't recorded, an error in
+// the format of the OpenAI API
+func notRecorded(req *http.Request, path string) *http.Response {
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]string{
+			"message": fmt.Sprintf("No recording of %s %s, expected in %s", req.Method, req.URL.Path, path),
+			"type":    "invalid_request_error",
+			"code":    "recording_not_found",
+		},
+	})
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+		StatusCode:    http.StatusNotFound,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// replayBody serves the recorded chunks of a response in order, after their
+// recorded delays if realtime is set
+type replayBody struct {
+	ctx      context.Context
+	chunks   []recordedChunk
+	realtime bool
+	// pending is what remains of the current chunk
+	pending string
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	if b.pending == "" {
+		if len(b.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk := b.chunks[0]
+		b.chunks = b.chunks[1:]
+		if b.realtime && chunk.DelayMs > 0 {
+			timer := time.NewTimer(time.Duration(chunk.DelayMs) * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-b.ctx.Done():
+				timer.Stop()
+				return 0, b.ctx.Err()
+			}
+		}
+		b.pending = chunk.Data
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *replayBody) Close() error {
+	return nil
+}
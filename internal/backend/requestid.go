@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// UpstreamRequestIDHeader reports the upstream provider's ID for a request to
+// the client, to correlate support tickets with the provider
+const UpstreamRequestIDHeader = "X-Upstream-Request-ID"
+
+// upstreamRequestIDHeaders are the response headers providers report their ID
+// for a request in, by preference
+var upstreamRequestIDHeaders = []string{
+	"X-Ds-Trace-Id",
+	"X-Request-Id",
+	"Request-Id",
+	"X-Generation-Id",
+}
+
+// SetRequestID forwards the proxy's ID for the request upstream
+func SetRequestID(ctx context.Context, header http.Header) {
+	if id := contextutils.GetRequestID(ctx); id != "" {
+		header.Set("X-Request-ID", id)
+	}
+}
+
+// UpstreamRequestID returns the provider's ID for a request from the headers
+// of its response. Providers echoing the proxy's own ID are ignored.
+func UpstreamRequestID(ctx context.Context, header http.Header) string {
+	for _, name := range upstreamRequestIDHeaders {
+		if id := header.Get(name); id != "" && id != contextutils.GetRequestID(ctx) {
+			return id
+		}
+	}
+	return ""
+}
+
+// ReportUpstreamRequestID logs the provider's ID for a request and records it
+// on the request's span. Unless w is nil, because the response headers have
+// already been written, it's also reported in the X-Upstream-Request-ID
+// header.
+func ReportUpstreamRequestID(ctx context.Context, w http.ResponseWriter, id string) {
+	if id == "" {
+		return
+	}
+	logutils.FromContext(ctx).With("upstream_request_id", id).Infof(ctx, "Upstream request ID: %s", id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("upstream.request_id", id))
+	if w != nil {
+		w.Header().Set(UpstreamRequestIDHeader, id)
+	}
+}
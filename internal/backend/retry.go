@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+// Defaults of Retry
+const (
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	DefaultRetryMaxBackoff = 10 * time.Second
+)
+
+// DefaultRetryStatusCodes are the upstream statuses retried unless configured
+// otherwise
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// Retry configures how upstream requests failing transiently, by a
+// connection error or a retryable status, are retried. Since a response is
+// only returned once its headers arrive, streaming requests are retried as
+// long as they fail before their first byte.
+type Retry struct {
+	// MaxAttempts is the number of attempts, the first included. Zero or one
+	// disables retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubling on each one up
+	// to MaxBackoff. Zero means DefaultRetryBackoff.
+	Backoff time.Duration
+	// MaxBackoff caps the delays, including those an upstream asks for with
+	// Retry-After, whose responses are returned when they ask for longer.
+	// Zero means DefaultRetryMaxBackoff.
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to this fraction of it, so that
+	// clients failing together don't retry together
+	Jitter float64
+	// StatusCodes are the retried statuses, DefaultRetryStatusCodes if empty
+	StatusCodes []int
+}
+
+// Do calls send until it succeeds, fails permanently or runs out of
+// attempts, waiting between attempts. send makes a single attempt, such as to
+// the next endpoint of a pool. The last response or error is returned, and
+// the bodies of the responses retried are closed.
+func (r Retry) Do(ctx context.Context, send func() (*http.Response, error)) (*http.Response, error) {
+	lgr := logutils.FromContext(ctx)
+	backoff := orDefault(r.Backoff, DefaultRetryBackoff)
+	maxBackoff := orDefault(r.MaxBackoff, DefaultRetryMaxBackoff)
+	statusCodes := r.StatusCodes
+	if len(statusCodes) == 0 {
+		statusCodes = DefaultRetryStatusCodes
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := send()
+		if attempt >= r.MaxAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+
+		var reason string
+		delay := min(jitter(backoff, r.Jitter), maxBackoff)
+		switch {
+		case err != nil:
+			reason = err.Error()
+		case slices.Contains(statusCodes, resp.StatusCode):
+			reason = resp.Status
+			if after, ok := retryAfter(resp.Header); ok {
+				if after > maxBackoff {
+					return resp, nil
+				}
+				delay = max(delay, after)
+			}
+		default:
+			return resp, nil
+		}
+
+		lgr.Warnf(ctx, "Retrying upstream request in %v, attempt %d of %d: %s", delay, attempt+1, r.MaxAttempts, reason)
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// retryAfter parses the Retry-After-Ms or Retry-After header of a response,
+// which may hold seconds or a date
+func retryAfter(header http.Header) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+	return 0, false
+}
+
+// jitter randomizes d by up to fraction of it, either way
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// orDefault returns d, or def if d isn't set
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
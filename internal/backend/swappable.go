@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+)
+
+var _ Backend = &Swappable{}
+
+// Swappable is a backend which delegates to another that can be replaced
+// while requests are served, such as when the config is reloaded. Requests
+// finish on the backend they started on.
+type Swappable struct {
+	current atomic.Pointer[swapped]
+}
+
+// swapped holds the current backend, as atomic pointers can't hold interfaces
+type swapped struct {
+	Backend
+}
+
+// NewSwappable creates a Swappable delegating to be
+func NewSwappable(be Backend) *Swappable {
+	s := &Swappable{}
+	s.Swap(be)
+	return s
+}
+
+// Swap replaces the backend new requests are sent to, returning the previous
+// one
+func (s *Swappable) Swap(be Backend) Backend {
+	if old := s.current.Swap(&swapped{be}); old != nil {
+		return old.Backend
+	}
+	return nil
+}
+
+// Current returns the backend new requests are sent to
+func (s *Swappable) Current() Backend {
+	return s.current.Load().Backend
+}
+
+// Name returns the name of the current backend
+func (s *Swappable) Name() string {
+	return s.Current().Name()
+}
+
+// HandleChatCompletion sends the request to the current backend
+func (s *Swappable) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	s.Current().HandleChatCompletion(ctx, w, r, req)
+}
+
+// ListModels returns the models of the current backend
+func (s *Swappable) ListModels(ctx context.Context) ([]openai.Model, error) {
+	return s.Current().ListModels(ctx)
+}
+
+// ValidateAPIKey validates the API key against the current backend
+func (s *Swappable) ValidateAPIKey(apiKey string) bool {
+	return s.Current().ValidateAPIKey(apiKey)
+}
+
+// HealthCheck probes the current backend
+func (s *Swappable) HealthCheck(ctx context.Context) error {
+	return s.Current().HealthCheck(ctx)
+}
+
+// Stats returns the statistics of the current backend, if any
+func (s *Swappable) Stats() any {
+	if provider, ok := s.Current().(StatsProvider); ok {
+		return provider.Stats()
+	}
+	return nil
+}
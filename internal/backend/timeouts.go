@@ -0,0 +1,51 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// Timeouts bound the requests a backend serves, by whether they stream. The
+// connection to the upstream is bounded by the timeouts of its Transport.
+// Zero disables a timeout.
+type Timeouts struct {
+	// Total bounds non-streaming requests, retries included
+	Total time.Duration
+	// MaxStream bounds streaming requests, from the first attempt to the end
+	// of the stream
+	MaxStream time.Duration
+	// FirstToken bounds the wait for the first chunk of a stream once its
+	// headers have arrived
+	FirstToken time.Duration
+}
+
+// Context bounds ctx by the timeout of a streaming or non-streaming request
+func (t Timeouts) Context(ctx context.Context, streaming bool) (context.Context, context.CancelFunc) {
+	if streaming && t.MaxStream > 0 {
+		return context.WithTimeoutCause(ctx, t.MaxStream, errors.Errorf("stream exceeded its maximum duration of %s", t.MaxStream))
+	}
+	if !streaming && t.Total > 0 {
+		return context.WithTimeoutCause(ctx, t.Total, errors.Errorf("request exceeded its timeout of %s", t.Total))
+	}
+	return context.WithCancel(ctx)
+}
+
+// WriteForwardError writes the error of a request which got no response from
+// the upstream: a 504 if it timed out, and a 502 otherwise
+func WriteForwardError(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		response.WriteError(w, http.StatusGatewayTimeout, "Upstream "+context.Cause(ctx).Error())
+		return
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		response.WriteError(w, http.StatusGatewayTimeout, "Upstream request timed out")
+		return
+	}
+	response.WriteError(w, http.StatusBadGateway, "Error forwarding request")
+}
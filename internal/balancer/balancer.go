@@ -0,0 +1,263 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxFailures = 3
+	defaultCooldown    = 30 * time.Second
+)
+
+// ErrNoEndpoints is returned when a pool has no endpoint to send requests to
+var ErrNoEndpoints = errors.New("no endpoints configured")
+
+// Target describes a single upstream endpoint and its relative weight
+type Target struct {
+	URL    string
+	Weight int
+}
+
+// Options configures a Pool
+type Options struct {
+	Targets []Target
+	// MaxFailures is the number of consecutive failures after which an
+	// endpoint is considered unhealthy
+	MaxFailures int
+	// Cooldown is how long an unhealthy endpoint is skipped before it is
+	// tried again
+	Cooldown time.Duration
+}
+
+// Endpoint is a single upstream endpoint tracked by a Pool
+type Endpoint struct {
+	URL    string
+	Weight int
+
+	current   int
+	failures  int
+	downUntil time.Time
+	// probeDown is set when the last active health probe failed
+	probeDown bool
+	probeErr  string
+}
+
+// Pool distributes requests across a set of weighted endpoints using smooth
+// weighted round-robin, skipping endpoints that have recently failed.
+type Pool struct {
+	mu          sync.Mutex
+	endpoints   []*Endpoint
+	maxFailures int
+	cooldown    time.Duration
+}
+
+// ValidateTargets returns an error unless there is at least one target, and
+// every target has a URL
+func ValidateTargets(targets []Target) error {
+	if len(targets) == 0 {
+		return ErrNoEndpoints
+	}
+	for i, t := range targets {
+		if strings.TrimSpace(t.URL) == "" {
+			return errors.Errorf("endpoint %d has no URL", i)
+		}
+	}
+	return nil
+}
+
+// New creates a new Pool. Targets with a non-positive weight are given a weight of 1.
+func New(opts Options) *Pool {
+	p := &Pool{
+		maxFailures: opts.MaxFailures,
+		cooldown:    opts.Cooldown,
+	}
+	if p.maxFailures <= 0 {
+		p.maxFailures = defaultMaxFailures
+	}
+	if p.cooldown <= 0 {
+		p.cooldown = defaultCooldown
+	}
+	for _, t := range opts.Targets {
+		url := strings.TrimSpace(t.URL)
+		if url == "" {
+			continue
+		}
+		weight := t.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		p.endpoints = append(p.endpoints, &Endpoint{URL: url, Weight: weight})
+	}
+	return p
+}
+
+// Next returns the next endpoint to use, or nil if the pool has none. If every
+// endpoint is unhealthy, the pool falls back to considering all of them so
+// requests are never starved.
+func (p *Pool) Next() *Endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.endpoints) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	candidates := make([]*Endpoint, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		if e.healthy(now) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	var best *Endpoint
+	total := 0
+	for _, e := range candidates {
+		e.current += e.Weight
+		total += e.Weight
+		if best == nil || e.current > best.current {
+			best = e
+		}
+	}
+	best.current -= total
+	return best
+}
+
+// MarkSuccess records a successful request against the endpoint
+func (p *Pool) MarkSuccess(e *Endpoint) {
+	if e == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.failures = 0
+	e.downUntil = time.Time{}
+}
+
+// MarkFailure records a failed request against the endpoint, taking it out
+// of rotation for the cooldown period once MaxFailures is reached.
+func (p *Pool) MarkFailure(e *Endpoint) {
+	if e == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.failures++
+	if e.failures >= p.maxFailures {
+		e.downUntil = time.Now().Add(p.cooldown)
+	}
+}
+
+// ProbeFunc actively checks the health of a single endpoint
+type ProbeFunc func(ctx context.Context, e *Endpoint) error
+
+// Probe runs probe against every endpoint in the pool, marking each up or
+// down. An error is returned only when no endpoint is healthy.
+func (p *Pool) Probe(ctx context.Context, probe ProbeFunc) error {
+	p.mu.Lock()
+	endpoints := make([]*Endpoint, len(p.endpoints))
+	copy(endpoints, p.endpoints)
+	p.mu.Unlock()
+
+	if len(endpoints) == 0 {
+		return ErrNoEndpoints
+	}
+
+	var lastErr error
+	healthy := 0
+	for _, e := range endpoints {
+		err := probe(ctx, e)
+		p.mu.Lock()
+		e.probeDown = err != nil
+		e.probeErr = ""
+		if err != nil {
+			e.probeErr = err.Error()
+			lastErr = errors.Wrapf(err, "endpoint %s", e.URL)
+		} else {
+			healthy++
+		}
+		p.mu.Unlock()
+	}
+	if healthy == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// HTTPProbe returns a ProbeFunc which issues a GET request with client to the
+// endpoint URL joined with path, treating any non-2xx response as unhealthy.
+func HTTPProbe(client *http.Client, path string, header http.Header) ProbeFunc {
+	return func(ctx context.Context, e *Endpoint) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.URL+path, nil)
+		if err != nil {
+			return errors.Wrap(err, "error creating probe request")
+		}
+		for k, vv := range header {
+			for _, v := range vv {
+				req.Header.Add(k, v)
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "error sending probe request")
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+			return fmt.Errorf("probe returned status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Status describes the current state of an endpoint
+type Status struct {
+	URL     string `json:"url"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Status returns a snapshot of every endpoint in the pool
+func (p *Pool) Status() []Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	statuses := make([]Status, len(p.endpoints))
+	for i, e := range p.endpoints {
+		statuses[i] = Status{
+			URL:     e.URL,
+			Weight:  e.Weight,
+			Healthy: e.healthy(now),
+			Error:   e.probeErr,
+		}
+	}
+	return statuses
+}
+
+func (e *Endpoint) healthy(now time.Time) bool {
+	if e.probeDown {
+		return false
+	}
+	return e.downUntil.IsZero() || now.After(e.downUntil)
+}
+
+// Targets returns the configured targets, falling back to a single target
+// for endpoint when none are configured.
+func Targets(endpoint string, targets []Target) []Target {
+	if len(targets) > 0 {
+		return targets
+	}
+	return []Target{{URL: endpoint, Weight: 1}}
+}
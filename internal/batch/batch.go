@@ -0,0 +1,556 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/limiter"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+const defaultConcurrency = 4
+
+// ChatCompletionsEndpoint is the only endpoint batches may target
+const ChatCompletionsEndpoint = "/v1/chat/completions"
+
+// ErrNotFound is returned for unknown batches and files
+var ErrNotFound = errors.New("not found")
+
+// Options configures a Manager
+type Options struct {
+	// Dir is the directory files and batches are persisted in
+	Dir     string
+	Backend backend.Backend
+	// Concurrency is the number of requests of a batch executed at once
+	Concurrency int
+}
+
+// Manager stores uploaded files and executes batches of chat completion
+// requests against a backend in the background. Files and the state of
+// batches are persisted in a directory, so batches survive restarts.
+type Manager struct {
+	dir         string
+	backend     backend.Backend
+	concurrency int
+
+	mu sync.Mutex
+	// ctx is the context batches run with, set by Start
+	ctx     context.Context
+	batches map[string]*batchRecord
+	cancels map[string]context.CancelFunc
+}
+
+// batchRecord is a batch along with the client which created it, which it is
+// only visible to and executed as
+type batchRecord struct {
+	openai.Batch
+	Client string `json:"client,omitempty"`
+	Tier   string `json:"tier,omitempty"`
+}
+
+// New creates a new Manager, loading the batches persisted in opts.Dir
+func New(opts Options) (*Manager, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("batch directory is required")
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	m := &Manager{
+		dir:         opts.Dir,
+		backend:     opts.Backend,
+		concurrency: concurrency,
+		ctx:         context.Background(),
+		batches:     map[string]*batchRecord{},
+		cancels:     map[string]context.CancelFunc{},
+	}
+	for _, sub := range []string{"files", "batches"} {
+		if err := os.MkdirAll(filepath.Join(m.dir, sub), 0o755); err != nil {
+			return nil, errors.Wrap(err, "error creating batch directory")
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(m.dir, "batches", "*.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing batches")
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading batch")
+		}
+		var b batchRecord
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, errors.Wrapf(err, "error parsing batch %s", path)
+		}
+		m.batches[b.ID] = &b
+	}
+	return m, nil
+}
+
+// Start runs batches with ctx from now on, and resumes the batches which were
+// unfinished when the proxy last stopped. Resumed batches are executed again
+// from the start.
+func (m *Manager) Start(ctx context.Context) {
+	m.mu.Lock()
+	m.ctx = ctx
+	var resume []string
+	for id, b := range m.batches {
+		switch b.Status {
+		case openai.BatchStatusValidating, openai.BatchStatusInProgress, openai.BatchStatusFinalizing:
+			b.RequestCounts = openai.BatchRequestCounts{}
+			resume = append(resume, id)
+		case openai.BatchStatusCancelling:
+			b.Status = openai.BatchStatusCancelled
+			b.CancelledAt = now()
+			m.save(ctx, b)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, id := range resume {
+		logutils.FromContext(ctx).Infof(ctx, "Resuming batch %s", id)
+		m.start(id)
+	}
+}
+
+// CreateBatch validates req and starts executing the batch as the client of
+// ctx
+func (m *Manager) CreateBatch(ctx context.Context, req openai.BatchCreateRequest) (openai.Batch, error) {
+	if req.Endpoint != ChatCompletionsEndpoint {
+		return openai.Batch{}, errors.Errorf("endpoint must be %s", ChatCompletionsEndpoint)
+	}
+	if _, err := m.GetFile(ctx, req.InputFileID); err != nil {
+		return openai.Batch{}, err
+	}
+
+	b := &batchRecord{
+		Batch: openai.Batch{
+			ID:               utils.GenerateID("batch_"),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileID:      req.InputFileID,
+			CompletionWindow: req.CompletionWindow,
+			Status:           openai.BatchStatusValidating,
+			CreatedAt:        time.Now().Unix(),
+			Metadata:         req.Metadata,
+		},
+		Client: contextutils.GetClient(ctx),
+		Tier:   contextutils.GetTier(ctx),
+	}
+
+	m.mu.Lock()
+	m.batches[b.ID] = b
+	m.save(m.ctx, b)
+	created := b.Batch
+	m.mu.Unlock()
+
+	m.start(b.ID)
+	return created, nil
+}
+
+// GetBatch returns the batch with the given ID, if the client of ctx created
+// it
+func (m *Manager) GetBatch(ctx context.Context, id string) (openai.Batch, error) {
+	b, err := m.batch(id)
+	if err != nil || b.Client != contextutils.GetClient(ctx) {
+		return openai.Batch{}, ErrNotFound
+	}
+	return b.Batch, nil
+}
+
+// batch returns the batch with the given ID, whichever client created it
+func (m *Manager) batch(id string) (batchRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.batches[id]
+	if !ok {
+		return batchRecord{}, ErrNotFound
+	}
+	return *b, nil
+}
+
+// ListBatches returns the batches the client of ctx created, most recently
+// created first
+func (m *Manager) ListBatches(ctx context.Context) []openai.Batch {
+	client := contextutils.GetClient(ctx)
+	m.mu.Lock()
+	batches := make([]openai.Batch, 0, len(m.batches))
+	for _, b := range m.batches {
+		if b.Client == client {
+			batches = append(batches, b.Batch)
+		}
+	}
+	m.mu.Unlock()
+
+	slices.SortFunc(batches, func(a, b openai.Batch) int {
+		if a.CreatedAt != b.CreatedAt {
+			return int(b.CreatedAt - a.CreatedAt)
+		}
+		return strings.Compare(b.ID, a.ID)
+	})
+	return batches
+}
+
+// CancelBatch stops executing the batch, if the client of ctx created it. The
+// responses received so far are still written to its output.
+func (m *Manager) CancelBatch(ctx context.Context, id string) (openai.Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.batches[id]
+	if !ok || b.Client != contextutils.GetClient(ctx) {
+		return openai.Batch{}, ErrNotFound
+	}
+	if b.Status == openai.BatchStatusValidating || b.Status == openai.BatchStatusInProgress {
+		b.Status = openai.BatchStatusCancelling
+		b.CancellingAt = now()
+		m.save(m.ctx, b)
+		if cancel, ok := m.cancels[id]; ok {
+			cancel()
+		}
+	}
+	return b.Batch, nil
+}
+
+func (m *Manager) start(id string) {
+	m.mu.Lock()
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.cancels[id] = cancel
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			delete(m.cancels, id)
+			m.mu.Unlock()
+			cancel()
+		}()
+		m.run(ctx, id)
+	}()
+}
+
+// run executes the batch as the client which created it. If the proxy is
+// stopping, the batch is left to be resumed by the next Start.
+func (m *Manager) run(ctx context.Context, id string) {
+	lgr := logutils.FromContext(ctx)
+	b, err := m.batch(id)
+	if err != nil {
+		return
+	}
+	// Its requests are routed, limited and billed as the client's own
+	ctx = contextutils.WithTier(contextutils.WithClient(ctx, b.Client), b.Tier)
+
+	inputs, validationErrs, err := m.readInput(b.InputFileID)
+	if err != nil {
+		validationErrs = []openai.BatchError{{Code: "invalid_file", Message: err.Error()}}
+	}
+	if len(validationErrs) > 0 {
+		lgr.Warnf(ctx, "Batch %s failed validation", id)
+		m.update(id, func(b *openai.Batch) {
+			b.Status = openai.BatchStatusFailed
+			b.FailedAt = now()
+			b.Errors = &openai.BatchErrors{Object: "list", Data: validationErrs}
+		})
+		return
+	}
+
+	m.update(id, func(b *openai.Batch) {
+		if b.Status == openai.BatchStatusValidating {
+			b.Status = openai.BatchStatusInProgress
+		}
+		b.InProgressAt = now()
+		b.RequestCounts.Total = len(inputs)
+	})
+	lgr.Infof(ctx, "Executing batch %s with %d requests", id, len(inputs))
+
+	output, err := newResultFile(m.resultPath(id, "output"))
+	if err != nil {
+		lgr.Error(ctx, err.Error())
+		m.fail(id, err)
+		return
+	}
+	errOutput, err := newResultFile(m.resultPath(id, "errors"))
+	if err != nil {
+		output.Close()
+		lgr.Error(ctx, err.Error())
+		m.fail(id, err)
+		return
+	}
+
+	sem := make(chan struct{}, m.concurrency)
+	var wg sync.WaitGroup
+run:
+	for _, input := range inputs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break run
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result, ok := m.execute(ctx, input)
+			if !ok {
+				errOutput.write(result)
+			} else {
+				output.write(result)
+			}
+			m.update(id, func(b *openai.Batch) {
+				if ok {
+					b.RequestCounts.Completed++
+				} else {
+					b.RequestCounts.Failed++
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	output.Close()
+	errOutput.Close()
+
+	if m.stopping() {
+		lgr.Infof(ctx, "Stopping batch %s, it will be resumed on restart", id)
+		return
+	}
+
+	cancelled := ctx.Err() != nil
+	m.update(id, func(b *openai.Batch) {
+		if !cancelled {
+			b.Status = openai.BatchStatusFinalizing
+			b.FinalizingAt = now()
+		}
+	})
+
+	outputID, err := m.finalizeFile(b.Client, output, id+"_output.jsonl")
+	if err == nil {
+		var errorID *string
+		errorID, err = m.finalizeFile(b.Client, errOutput, id+"_errors.jsonl")
+		m.update(id, func(b *openai.Batch) {
+			b.OutputFileID = outputID
+			b.ErrorFileID = errorID
+		})
+	}
+	if err != nil {
+		lgr.Error(ctx, err.Error())
+		m.fail(id, err)
+		return
+	}
+
+	m.update(id, func(b *openai.Batch) {
+		if cancelled {
+			b.Status = openai.BatchStatusCancelled
+			b.CancelledAt = now()
+			return
+		}
+		b.Status = openai.BatchStatusCompleted
+		b.CompletedAt = now()
+	})
+	lgr.Infof(ctx, "Batch %s finished", id)
+}
+
+// readInput parses and validates the requests of the input file
+func (m *Manager) readInput(fileID string) ([]openai.BatchInput, []openai.BatchError, error) {
+	f, err := m.openFile(fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var inputs []openai.BatchInput
+	var errs []openai.BatchError
+	customIDs := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 32*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		lineErr := func(code, message string) {
+			errs = append(errs, openai.BatchError{Code: code, Message: message, Line: &line})
+		}
+
+		var input openai.BatchInput
+		if err := json.Unmarshal(scanner.Bytes(), &input); err != nil {
+			lineErr("invalid_json_line", "This line is not parseable as valid JSON.")
+			continue
+		}
+		switch {
+		case input.CustomID == "":
+			lineErr("missing_required_parameter", "Missing required parameter: custom_id.")
+		case customIDs[input.CustomID]:
+			lineErr("duplicate_custom_id", fmt.Sprintf("The custom_id %q is used more than once.", input.CustomID))
+		case input.Method != http.MethodPost:
+			lineErr("invalid_method", "The method must be POST.")
+		case input.URL != ChatCompletionsEndpoint:
+			lineErr("mismatched_endpoint", fmt.Sprintf("The url must be %s, the endpoint of the batch.", ChatCompletionsEndpoint))
+		}
+		customIDs[input.CustomID] = true
+		inputs = append(inputs, input)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "error reading input file")
+	}
+	if len(inputs) == 0 && len(errs) == 0 {
+		errs = append(errs, openai.BatchError{Code: "empty_file", Message: "The input file is empty."})
+	}
+	return inputs, errs, nil
+}
+
+// execute sends a request of a batch to the backend. ok is false if the
+// request failed.
+func (m *Manager) execute(ctx context.Context, input openai.BatchInput) (result openai.BatchOutput, ok bool) {
+	result = openai.BatchOutput{
+		ID:       utils.GenerateID("batch_req_"),
+		CustomID: input.CustomID,
+	}
+
+	var req openai.ChatCompletionRequest
+	if err := json.Unmarshal(input.Body, &req); err != nil {
+		result.Error = &openai.BatchOutputError{Code: "invalid_request", Message: err.Error()}
+		return result, false
+	}
+	req.Stream = false
+	req.StreamOptions = nil
+	// Batches yield to interactive requests for backends with concurrency
+	// limits
+	ctx = contextutils.WithPriority(ctx, limiter.PriorityLow)
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, input.URL, nil)
+	if err != nil {
+		result.Error = &openai.BatchOutputError{Code: "invalid_request", Message: err.Error()}
+		return result, false
+	}
+	rec := response.NewRecorder()
+	m.backend.HandleChatCompletion(ctx, rec, r, &req)
+
+	body := bytes.TrimSpace(rec.Body.Bytes())
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	result.Response = &openai.BatchOutputResponse{
+		StatusCode: rec.Status,
+		RequestID:  utils.GenerateRequestID(),
+		Body:       body,
+	}
+	return result, rec.Status == http.StatusOK
+}
+
+// resultPath is where the results of a batch are collected until it finishes
+func (m *Manager) resultPath(id, kind string) string {
+	return filepath.Join(m.dir, "batches", id+"."+kind+".jsonl")
+}
+
+// finalizeFile registers the results as a file of the client, returning its
+// ID, or nil if there were no results
+func (m *Manager) finalizeFile(client string, results *resultFile, filename string) (*string, error) {
+	if results.count == 0 {
+		os.Remove(results.path)
+		return nil, nil
+	}
+
+	f, err := os.Open(results.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening batch results")
+	}
+	defer f.Close()
+	defer os.Remove(results.path)
+
+	file, err := m.createFile(client, filename, "batch_output", f)
+	if err != nil {
+		return nil, err
+	}
+	return &file.ID, nil
+}
+
+// stopping returns whether the context batches run with is done
+func (m *Manager) stopping() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ctx.Err() != nil
+}
+
+func (m *Manager) fail(id string, err error) {
+	m.update(id, func(b *openai.Batch) {
+		b.Status = openai.BatchStatusFailed
+		b.FailedAt = now()
+		b.Errors = &openai.BatchErrors{
+			Object: "list",
+			Data:   []openai.BatchError{{Code: "server_error", Message: err.Error()}},
+		}
+	})
+}
+
+// update applies fn to the batch and persists it
+func (m *Manager) update(id string, fn func(b *openai.Batch)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.batches[id]
+	if !ok {
+		return
+	}
+	fn(&b.Batch)
+	m.save(m.ctx, b)
+}
+
+// save persists the batch. The caller must hold m.mu.
+func (m *Manager) save(ctx context.Context, b *batchRecord) {
+	if err := writeJSON(filepath.Join(m.dir, "batches", b.ID+".json"), b); err != nil {
+		err = errors.Wrapf(err, "error saving batch %s", b.ID)
+		logutils.FromContext(ctx).Error(ctx, err.Error())
+	}
+}
+
+func now() *int64 {
+	t := time.Now().Unix()
+	return &t
+}
+
+// resultFile collects the results of a batch as JSON lines
+type resultFile struct {
+	path  string
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	count int
+}
+
+func newResultFile(path string) (*resultFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating batch results")
+	}
+	return &resultFile{path: path, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *resultFile) write(result openai.BatchOutput) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(result); err == nil {
+		r.count++
+	}
+}
+
+func (r *resultFile) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,133 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	"github.com/pkg/errors"
+)
+
+// fileRecord is the metadata of a file along with the client which owns it,
+// which it is only visible to
+type fileRecord struct {
+	openai.File
+	Client string `json:"client,omitempty"`
+}
+
+// CreateFile stores the contents of r as a new file of the client of ctx
+func (m *Manager) CreateFile(ctx context.Context, filename, purpose string, r io.Reader) (openai.File, error) {
+	return m.createFile(contextutils.GetClient(ctx), filename, purpose, r)
+}
+
+func (m *Manager) createFile(client, filename, purpose string, r io.Reader) (openai.File, error) {
+	file := fileRecord{
+		File: openai.File{
+			ID:        utils.GenerateID("file-"),
+			Object:    "file",
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+		},
+		Client: client,
+	}
+
+	f, err := os.Create(m.filePath(file.ID))
+	if err != nil {
+		return openai.File{}, errors.Wrap(err, "error creating file")
+	}
+	file.Bytes, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(m.filePath(file.ID))
+		return openai.File{}, errors.Wrap(err, "error writing file")
+	}
+
+	if err := writeJSON(m.filePath(file.ID)+".json", file); err != nil {
+		os.Remove(m.filePath(file.ID))
+		return openai.File{}, err
+	}
+	return file.File, nil
+}
+
+// GetFile returns the file with the given ID, if the client of ctx owns it
+func (m *Manager) GetFile(ctx context.Context, id string) (openai.File, error) {
+	file, err := m.file(id)
+	if err != nil {
+		return openai.File{}, err
+	}
+	if file.Client != contextutils.GetClient(ctx) {
+		return openai.File{}, ErrNotFound
+	}
+	return file.File, nil
+}
+
+// file returns the file with the given ID, whichever client owns it
+func (m *Manager) file(id string) (fileRecord, error) {
+	var file fileRecord
+	if !validID(id) {
+		return file, ErrNotFound
+	}
+	data, err := os.ReadFile(m.filePath(id) + ".json")
+	if os.IsNotExist(err) {
+		return file, ErrNotFound
+	}
+	if err != nil {
+		return file, errors.Wrap(err, "error reading file metadata")
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, errors.Wrap(err, "error parsing file metadata")
+	}
+	return file, nil
+}
+
+// OpenFile opens the contents of the file with the given ID, if the client of
+// ctx owns it
+func (m *Manager) OpenFile(ctx context.Context, id string) (io.ReadCloser, error) {
+	if _, err := m.GetFile(ctx, id); err != nil {
+		return nil, err
+	}
+	return m.openFile(id)
+}
+
+func (m *Manager) openFile(id string) (io.ReadCloser, error) {
+	if _, err := m.file(id); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(m.filePath(id))
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening file")
+	}
+	return f, nil
+}
+
+func (m *Manager) filePath(id string) string {
+	return filepath.Join(m.dir, "files", id)
+}
+
+// validID returns whether id is safe to use as a file name
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
+
+// writeJSON atomically replaces the file at path with v encoded as JSON
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "error encoding metadata")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.Wrap(err, "error writing metadata")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "error writing metadata")
+}
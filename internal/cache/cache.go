@@ -0,0 +1,348 @@
+// Package cache serves repeated chat completions from a cache of the
+// responses to identical requests.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	"github.com/danilofalcao/cursor-deepseek/internal/store"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Header reports whether a response was served from the cache, hit,
+	// semantic or miss
+	Header = "X-Proxy-Cache"
+
+	Hit  = "hit"
+	Miss = "miss"
+)
+
+// maxEntrySize caps the size of the responses cached
+const maxEntrySize = 1 << 20
+
+// keyPrefix is prepended to the keys of cached responses in the store
+const keyPrefix = "cache:chat:"
+
+var _ backend.Backend = &Cache{}
+
+// Options configures a Cache
+type Options struct {
+	Backend backend.Backend
+	// Store holds the cached responses, in memory or shared through Redis
+	Store store.Store
+	// TTL is how long responses are cached
+	TTL time.Duration
+	// Semantic configures the semantic cache
+	Semantic SemanticOptions
+}
+
+// Cache is a backend which serves chat completions identical to one already
+// served from the cache, within its TTL. Only successful non-streaming
+// responses are cached, and they are replayed as a stream for identical
+// streaming requests. With a semantic cache, requests which differ from a
+// cached one by a similar final user message alone are also served from it.
+type Cache struct {
+	backend.Backend
+	store store.Store
+	ttl   time.Duration
+	// semantic is nil unless the semantic cache is enabled
+	semantic *semanticIndex
+
+	hits         atomic.Int64
+	semanticHits atomic.Int64
+	misses       atomic.Int64
+	stored       atomic.Int64
+}
+
+// New creates a new Cache
+func New(opts Options) *Cache {
+	c := &Cache{
+		Backend: opts.Backend,
+		store:   opts.Store,
+		ttl:     opts.TTL,
+	}
+	if opts.Semantic.Embedder != nil {
+		c.semantic = newSemanticIndex(opts.Semantic, opts.TTL)
+	}
+	return c
+}
+
+// HandleChatCompletion serves the request from the cache if an identical one
+// was cached, and otherwise with the wrapped backend, caching its response
+func (c *Cache) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	// The key is taken before the backend maps the request in place, and is
+	// scoped to the client, whose requests may be served by its own upstream
+	// or with its own models and system prompt
+	key, err := Key(req)
+	if err != nil {
+		lgr.Error(ctx, err.Error())
+		c.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+	key = contextutils.ScopeKey(ctx, key)
+
+	cached, err := c.store.Get(ctx, key)
+	if err != nil {
+		// Requests are served uncached while the store is down
+		lgr.Error(ctx, errors.Wrap(err, "error reading cache").Error())
+	}
+	if cached != nil {
+		chunks, err := replay(req, cached)
+		if err == nil {
+			c.hits.Add(1)
+			lgr.Debug(ctx, "Serving response from the cache")
+			w.Header().Set(Header, Hit)
+			// Responses from the cache use no tokens upstream
+			contextutils.ReportTokens(ctx, 0)
+			serve(ctx, w, req, cached, chunks)
+			return
+		}
+		lgr.Error(ctx, err.Error())
+	}
+
+	query, served := c.serveSemantic(ctx, w, req)
+	if served {
+		return
+	}
+
+	c.misses.Add(1)
+	w.Header().Set(Header, Miss)
+	if req.Stream {
+		c.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	c.Backend.HandleChatCompletion(ctx, rec, r, req)
+	if !rec.cacheable() {
+		return
+	}
+	response := rec.body.Bytes()
+	if err := c.store.Set(context.WithoutCancel(ctx), key, response, c.ttl); err != nil {
+		lgr.Error(ctx, errors.Wrap(err, "error writing cache").Error())
+		return
+	}
+	c.stored.Add(1)
+	if query != nil {
+		c.semantic.add(query, response)
+	}
+}
+
+// serveSemantic serves the request with the cached response to the most
+// similar request, if any is similar enough. Otherwise it returns the query to
+// index the request's response with, which is nil if the semantic cache is
+// disabled or the request can't be embedded.
+func (c *Cache) serveSemantic(ctx context.Context, w http.ResponseWriter, req *openai.ChatCompletionRequest) (*semanticQuery, bool) {
+	if c.semantic == nil {
+		return nil, false
+	}
+	lgr := logutils.FromContext(ctx)
+
+	query, err := c.semantic.query(ctx, req)
+	if err != nil {
+		// Requests are served uncached while the embedder is down
+		lgr.Error(ctx, err.Error())
+		return nil, false
+	}
+	if query == nil {
+		return nil, false
+	}
+	cached, similarity := c.semantic.lookup(query)
+	if cached == nil {
+		return query, false
+	}
+	chunks, err := replay(req, cached)
+	if err != nil {
+		lgr.Error(ctx, err.Error())
+		return query, false
+	}
+
+	c.semanticHits.Add(1)
+	lgr.Debugf(ctx, "Serving response from the semantic cache with similarity %.4f", similarity)
+	w.Header().Set(Header, Semantic)
+	w.Header().Set(SimilarityHeader, strconv.FormatFloat(similarity, 'f', 4, 64))
+	contextutils.ReportTokens(ctx, 0)
+	serve(ctx, w, req, cached, chunks)
+	return nil, true
+}
+
+// Key returns the cache key of a request, which hashes its model, messages
+// and parameters, whether it streams aside
+func Key(req *openai.ChatCompletionRequest) (string, error) {
+	keyed := *req
+	keyed.Stream = false
+	keyed.StreamOptions = nil
+	data, err := json.Marshal(&keyed)
+	if err != nil {
+		return "", errors.Wrap(err, "error marshalling cache key")
+	}
+	sum := sha256.Sum256(data)
+	return keyPrefix + hex.EncodeToString(sum[:]), nil
+}
+
+// replay returns the chunks a cached response is streamed as, if the request
+// streams
+func replay(req *openai.ChatCompletionRequest, cached []byte) ([]openai.ChatCompletionStreamResponse, error) {
+	if !req.Stream {
+		return nil, nil
+	}
+	var resp openai.ChatCompletionResponse
+	if err := json.Unmarshal(cached, &resp); err != nil {
+		return nil, errors.Wrap(err, "error decoding cached response")
+	}
+	return Chunks(resp, req.IncludeUsage()), nil
+}
+
+// serve writes a cached response to w, or its chunks if the request streams
+func serve(ctx context.Context, w http.ResponseWriter, req *openai.ChatCompletionRequest, cached []byte, chunks []openai.ChatCompletionStreamResponse) {
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(cached)
+		return
+	}
+	out := make(chan openai.ChatCompletionStreamResponse, len(chunks))
+	for _, chunk := range chunks {
+		out <- chunk
+	}
+	close(out)
+	stream.Write(ctx, w, out, nil, stream.Options{})
+}
+
+// Chunks converts a response into the chunks it would have been streamed as:
+// one holding the message of each choice, one finishing them, and one
+// reporting the usage if includeUsage is set
+func Chunks(resp openai.ChatCompletionResponse, includeUsage bool) []openai.ChatCompletionStreamResponse {
+	chunk := func(choices []openai.StreamChoice) openai.ChatCompletionStreamResponse {
+		return openai.ChatCompletionStreamResponse{
+			ID:      resp.ID,
+			Object:  "chat.completion.chunk",
+			Created: resp.Created,
+			Model:   resp.Model,
+			Choices: choices,
+		}
+	}
+
+	messages := make([]openai.StreamChoice, 0, len(resp.Choices))
+	finishes := make([]openai.StreamChoice, 0, len(resp.Choices))
+	for _, choice := range resp.Choices {
+		delta := openai.Delta{
+			Role:             choice.Message.Role,
+			Content:          choice.Message.Content,
+			ReasoningContent: choice.Message.ReasoningContent,
+		}
+		for i, call := range choice.Message.ToolCalls {
+			delta.ToolCalls = append(delta.ToolCalls, openai.ToolCallDelta{
+				Index: i,
+				ID:    call.ID,
+				Type:  call.Type,
+				Function: openai.ToolCallFunctionDelta{
+					Name:      call.Function.Name,
+					Arguments: call.Function.Arguments,
+				},
+			})
+		}
+		messages = append(messages, openai.StreamChoice{
+			Index:    choice.Index,
+			Delta:    delta,
+			Logprobs: choice.Logprobs,
+		})
+		finishes = append(finishes, openai.StreamChoice{
+			Index:        choice.Index,
+			FinishReason: choice.FinishReason,
+		})
+	}
+
+	chunks := []openai.ChatCompletionStreamResponse{chunk(messages), chunk(finishes)}
+	if includeUsage {
+		chunks = append(chunks, stream.UsageChunk(chunks[0], resp.Usage))
+	}
+	return chunks
+}
+
+// Stats describes how often requests were served from the cache
+type Stats struct {
+	TTLSeconds float64 `json:"ttl_seconds"`
+	Hits       int64   `json:"hits"`
+	Misses     int64   `json:"misses"`
+	Stored     int64   `json:"stored"`
+	// SemanticHits and SemanticEntries are only set with a semantic cache
+	SemanticHits    int64 `json:"semantic_hits,omitempty"`
+	SemanticEntries int   `json:"semantic_entries,omitempty"`
+	Backend         any   `json:"backend,omitempty"`
+}
+
+// Stats returns the cache statistics along with the wrapped backend's, if any
+func (c *Cache) Stats() any {
+	stats := Stats{
+		TTLSeconds: c.ttl.Seconds(),
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Stored:     c.stored.Load(),
+	}
+	if c.semantic != nil {
+		stats.SemanticHits = c.semanticHits.Load()
+		stats.SemanticEntries = c.semantic.len()
+	}
+	if provider, ok := c.Backend.(backend.StatsProvider); ok {
+		stats.Backend = provider.Stats()
+	}
+	return stats
+}
+
+// recorder writes a response through while keeping a copy of it to cache
+type recorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if !r.overflow {
+		if r.body.Len()+len(b) > maxEntrySize {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// cacheable is whether the response recorded is a complete successful
+// completion
+func (r *recorder) cacheable() bool {
+	if r.status != http.StatusOK || r.overflow || r.body.Len() == 0 {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header().Get("Content-Type"))
+	return mediaType == "application/json" && json.Valid(r.body.Bytes())
+}
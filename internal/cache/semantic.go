@@ -0,0 +1,222 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Semantic is the value of Header for responses served because their
+	// final user message is similar to that of a cached request
+	Semantic = "semantic"
+
+	// SimilarityHeader reports the cosine similarity of the final user
+	// message of a semantic hit to that of the cached request
+	SimilarityHeader = "X-Proxy-Cache-Similarity"
+)
+
+const (
+	// DefaultSimilarityThreshold is the similarity above which a cached
+	// response is served, unless configured otherwise
+	DefaultSimilarityThreshold = 0.95
+	// defaultMaxSemanticEntries is the number of responses indexed unless
+	// configured otherwise
+	defaultMaxSemanticEntries = 1000
+)
+
+// SemanticOptions configures the semantic cache, which also serves requests
+// whose final user message is similar, if not identical, to that of a cached
+// request. It is disabled unless Embedder is set.
+type SemanticOptions struct {
+	// Embedder embeds the final user messages
+	Embedder backend.Embedder
+	// Model is the embedding model
+	Model string
+	// Threshold is the cosine similarity above which a cached response is
+	// served
+	Threshold float64
+	// MaxEntries is the number of responses indexed, beyond which the oldest
+	// are evicted
+	MaxEntries int
+}
+
+// semanticIndex holds the responses cached along with the embedding of the
+// final user message of their request. Responses are only served to requests
+// of the same client which differ from theirs by that message alone, so the
+// index is partitioned by the client and the hash of the rest of the request.
+// It is kept in memory, as the embeddings are compared on every lookup.
+type semanticIndex struct {
+	embedder   backend.Embedder
+	model      string
+	threshold  float64
+	maxEntries int
+	ttl        time.Duration
+
+	mu sync.Mutex
+	// entries holds the *semanticEntry indexed, oldest first
+	entries *list.List
+}
+
+type semanticEntry struct {
+	partition string
+	// embedding is normalized, so that cosine similarity is a dot product
+	embedding []float64
+	response  []byte
+	expires   time.Time
+}
+
+// semanticQuery is a request looked up in the index, which is indexed with
+// its response on a miss
+type semanticQuery struct {
+	partition string
+	embedding []float64
+}
+
+func newSemanticIndex(opts SemanticOptions, ttl time.Duration) *semanticIndex {
+	threshold := opts.Threshold
+	if threshold <= 0 {
+		threshold = DefaultSimilarityThreshold
+	}
+	maxEntries := opts.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxSemanticEntries
+	}
+	return &semanticIndex{
+		embedder:   opts.Embedder,
+		model:      opts.Model,
+		threshold:  threshold,
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    list.New(),
+	}
+}
+
+// query embeds the final user message of a request. It returns nil if the
+// request doesn't end with a user message with text.
+func (s *semanticIndex) query(ctx context.Context, req *openai.ChatCompletionRequest) (*semanticQuery, error) {
+	if len(req.Messages) == 0 {
+		return nil, nil
+	}
+	last := req.Messages[len(req.Messages)-1]
+	prompt := messageText(last)
+	if last.Role != openai.RoleUser || strings.TrimSpace(prompt) == "" {
+		return nil, nil
+	}
+
+	rest := *req
+	rest.Messages = req.Messages[:len(req.Messages)-1]
+	rest.Stream = false
+	rest.StreamOptions = nil
+	data, err := json.Marshal(&rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshalling semantic cache partition")
+	}
+	sum := sha256.Sum256(data)
+
+	embeddings, err := s.embedder.Embed(ctx, s.model, []string{prompt})
+	if err != nil {
+		return nil, errors.Wrap(err, "error embedding prompt")
+	}
+	return &semanticQuery{
+		partition: contextutils.ScopeKey(ctx, hex.EncodeToString(sum[:])),
+		embedding: normalize(embeddings[0]),
+	}, nil
+}
+
+// lookup returns the cached response most similar to the query, if its
+// similarity reaches the threshold
+func (s *semanticIndex) lookup(q *semanticQuery) ([]byte, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var best *semanticEntry
+	bestSimilarity := s.threshold
+	for elem := s.entries.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*semanticEntry)
+		switch {
+		case now.After(entry.expires):
+			s.entries.Remove(elem)
+		case entry.partition == q.partition && len(entry.embedding) == len(q.embedding):
+			if similarity := dot(entry.embedding, q.embedding); similarity >= bestSimilarity {
+				best, bestSimilarity = entry, similarity
+			}
+		}
+		elem = next
+	}
+	if best == nil {
+		return nil, 0
+	}
+	return best.response, bestSimilarity
+}
+
+// add indexes the response to a query, evicting the oldest entries beyond
+// the maximum
+func (s *semanticIndex) add(q *semanticQuery, response []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries.PushBack(&semanticEntry{
+		partition: q.partition,
+		embedding: q.embedding,
+		response:  response,
+		expires:   time.Now().Add(s.ttl),
+	})
+	for s.entries.Len() > s.maxEntries {
+		s.entries.Remove(s.entries.Front())
+	}
+}
+
+// len returns the number of entries indexed
+func (s *semanticIndex) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries.Len()
+}
+
+// messageText returns the text of a message, joining its text parts
+func messageText(msg openai.Message) string {
+	if text := msg.GetContentString(); text != "" {
+		return text
+	}
+	var parts []string
+	for _, part := range msg.GetContentArray() {
+		if text, ok := part.(openai.ContentPart_Text); ok {
+			parts = append(parts, text.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func normalize(v []float64) []float64 {
+	norm := math.Sqrt(dot(v, v))
+	if norm == 0 {
+		return v
+	}
+	out := make([]float64, len(v))
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
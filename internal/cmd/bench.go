@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	"github.com/pkg/errors"
+)
+
+// benchOptions configures the bench command
+type benchOptions struct {
+	configPath   string
+	url          string
+	apiKey       string
+	model        string
+	concurrency  int
+	requests     int
+	duration     time.Duration
+	promptTokens int
+	maxTokens    int
+	noStream     bool
+	asJSON       bool
+}
+
+func benchCommand() *command {
+	flags, configPath := newFlags("bench")
+	opts := benchOptions{}
+	flags.StringVar(&opts.url, "url", "", "the base URL of a running proxy, or of an upstream such as https://api.deepseek.com/v1, instead of serving the config")
+	flags.StringVar(&opts.apiKey, "api-key", "", "the API key requests are sent with, by default the first client's or else the backend's when serving the config")
+	flags.StringVarP(&opts.model, "model", "m", "gpt-4o", "the model requested")
+	flags.IntVar(&opts.concurrency, "concurrency", 4, "the requests sent at once")
+	flags.IntVarP(&opts.requests, "requests", "n", 100, "the requests sent in all")
+	flags.DurationVar(&opts.duration, "duration", 0, "sends requests for this long instead of a number of them")
+	flags.IntVar(&opts.promptTokens, "prompt-tokens", 200, "the approximate size of the prompts, in tokens")
+	flags.IntVar(&opts.maxTokens, "max-tokens", 200, "the maximum number of tokens generated for each request")
+	flags.BoolVar(&opts.noStream, "no-stream", false, "waits for whole responses instead of streaming them")
+	flags.BoolVar(&opts.asJSON, "json", false, "prints the report as JSON")
+	return &command{
+		name:  "bench",
+		short: "Measure the latency and throughput of the proxy or a backend",
+		flags: flags,
+		run: func(ctx context.Context) error {
+			opts.configPath = *configPath
+			return bench(ctx, opts)
+		},
+	}
+}
+
+// bench sends chat completions to the URL, or else to the config served on a
+// local port, and reports their latency, throughput and errors
+func bench(ctx context.Context, opts benchOptions) error {
+	if opts.concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if opts.duration <= 0 && opts.requests < 1 {
+		return errors.New("requests must be at least 1, unless a duration is set")
+	}
+	target := strings.TrimSuffix(opts.url, "/")
+	if target == "" {
+		v, err := newViper(opts.configPath)
+		if err != nil {
+			return err
+		}
+		cfg, err := loadConfig(ctx, v)
+		if err != nil {
+			return err
+		}
+		local, err := startLocalProxy(ctx, v, cfg)
+		if err != nil {
+			return err
+		}
+		defer local.stop()
+		target = local.url
+		if opts.apiKey == "" {
+			opts.apiKey = local.apiKey
+		}
+	}
+
+	// Streams are read with the CLI's logger, as the proxy's is its own
+	ctx = withCLILogger(ctx)
+	b := &bencher{
+		url:  target + "/chat/completions",
+		opts: opts,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: opts.concurrency,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+	}
+	if !opts.asJSON {
+		mode := "streaming"
+		if opts.noStream {
+			mode = "non-streaming"
+		}
+		fmt.Fprintf(os.Stderr, "Benchmarking %s with %s requests of %s, %d at once...\n", target, mode, opts.model, opts.concurrency)
+	}
+	start := time.Now()
+	results := b.run(ctx)
+	report := newBenchReport(results, time.Since(start))
+	if report.Requests == 0 {
+		return errors.New("no request completed")
+	}
+
+	if opts.asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return report.print(os.Stdout)
+}
+
+// bencher sends the requests of a benchmark
+type bencher struct {
+	url    string
+	opts   benchOptions
+	client *http.Client
+}
+
+// benchResult is the outcome of a request
+type benchResult struct {
+	// err is why the request failed, if it did, which is its status if the
+	// proxy returned one
+	err string
+	// ttft is the time until the first token, the whole response's for
+	// non-streaming requests
+	ttft             time.Duration
+	latency          time.Duration
+	completionTokens int
+}
+
+// run sends the requests, opts.concurrency at once, until they are all sent,
+// the duration passes or ctx is done
+func (b *bencher) run(ctx context.Context) []benchResult {
+	if b.opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.duration)
+		defer cancel()
+	}
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i := 0; b.opts.duration > 0 || i < b.opts.requests; i++ {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var results []benchResult
+	var wg sync.WaitGroup
+	for range b.opts.concurrency {
+		wg.Go(func() {
+			for i := range indexes {
+				result := b.send(ctx, i)
+				// Requests cut short by the end of the benchmark aren't
+				// counted
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return results
+}
+
+// prompt returns the prompt of the ith request, of about opts.promptTokens
+// tokens. Each prompt is unique, so that caches don't serve them.
+func (b *bencher) prompt(i int) string {
+	words := []string{"river", "lantern", "orchard", "compass", "harbor", "meadow", "signal", "granite"}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Request %d. Write a long story mentioning these words:", i)
+	for j := range b.opts.promptTokens {
+		sb.WriteString(" " + words[j%len(words)])
+	}
+	return sb.String()
+}
+
+// send sends the ith request, timing its response
+func (b *bencher) send(ctx context.Context, i int) benchResult {
+	maxTokens := b.opts.maxTokens
+	req := openai.ChatCompletionRequest{
+		Model:     b.opts.model,
+		Messages:  []openai.Message{{Role: "user", Content: openai.Content_String{Content: b.prompt(i)}}},
+		Stream:    !b.opts.noStream,
+		MaxTokens: &maxTokens,
+	}
+	if req.Stream {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return benchResult{err: err.Error()}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return benchResult{err: err.Error()}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if b.opts.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+b.opts.apiKey)
+	}
+
+	start := time.Now()
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		return benchResult{err: "request failed"}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return benchResult{err: strconv.Itoa(resp.StatusCode)}
+	}
+
+	var result benchResult
+	if !req.Stream {
+		var completion openai.ChatCompletionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			return benchResult{err: "invalid response"}
+		}
+		result.latency = time.Since(start)
+		result.ttft = result.latency
+		result.completionTokens = completion.Usage.CompletionTokens
+		return result
+	}
+
+	// Streams which don't report their usage are counted a token per chunk
+	var chunkTokens int
+	chunks, errs := stream.ReadOpenAI(ctx, resp.Body, stream.ReadOptions{Strict: true})
+	for chunk := range chunks {
+		if chunk.Usage != nil {
+			result.completionTokens = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			if !hasTokens(choice.Delta) {
+				continue
+			}
+			if result.ttft == 0 {
+				result.ttft = time.Since(start)
+			}
+			chunkTokens++
+		}
+	}
+	if err := <-errs; err != nil {
+		return benchResult{err: "stream failed"}
+	}
+	result.latency = time.Since(start)
+	if result.ttft == 0 {
+		result.ttft = result.latency
+	}
+	if result.completionTokens == 0 {
+		result.completionTokens = chunkTokens
+	}
+	return result
+}
+
+// hasTokens is whether the delta holds generated content, reasoning or tool
+// calls, rather than just a role or finish reason
+func hasTokens(delta openai.Delta) bool {
+	if delta.ReasoningContent != "" || len(delta.ToolCalls) > 0 {
+		return true
+	}
+	switch content := delta.Content.(type) {
+	case openai.Content_String:
+		return content.Content != ""
+	case nil:
+		return false
+	default:
+		return true
+	}
+}
+
+// tokensPerSecond is the rate the response's tokens were generated at, after
+// the first for streams
+func (r benchResult) tokensPerSecond() float64 {
+	generation := r.latency - r.ttft
+	if generation <= 0 {
+		generation = r.latency
+	}
+	if generation <= 0 || r.completionTokens == 0 {
+		return 0
+	}
+	return float64(r.completionTokens) / generation.Seconds()
+}
+
+// benchReport summarizes the results of a benchmark
+type benchReport struct {
+	Requests          int     `json:"requests"`
+	Succeeded         int     `json:"succeeded"`
+	Failed            int     `json:"failed"`
+	ErrorRate         float64 `json:"error_rate"`
+	DurationSeconds   float64 `json:"duration_seconds"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// Errors counts the failed requests by status, or by how they failed
+	Errors           map[string]int `json:"errors,omitempty"`
+	CompletionTokens int            `json:"completion_tokens"`
+	// TTFTMs, LatencyMs and TokensPerSecond are the percentiles of the
+	// successful requests
+	TTFTMs          benchPercentiles `json:"ttft_ms"`
+	LatencyMs       benchPercentiles `json:"latency_ms"`
+	TokensPerSecond benchPercentiles `json:"tokens_per_second"`
+}
+
+type benchPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func newBenchReport(results []benchResult, elapsed time.Duration) benchReport {
+	report := benchReport{
+		Requests:        len(results),
+		DurationSeconds: elapsed.Seconds(),
+		Errors:          map[string]int{},
+	}
+	var ttfts, latencies, rates []float64
+	for _, r := range results {
+		if r.err != "" {
+			report.Failed++
+			report.Errors[r.err]++
+			continue
+		}
+		report.Succeeded++
+		report.CompletionTokens += r.completionTokens
+		ttfts = append(ttfts, float64(r.ttft.Microseconds())/1000)
+		latencies = append(latencies, float64(r.latency.Microseconds())/1000)
+		if rate := r.tokensPerSecond(); rate > 0 {
+			rates = append(rates, rate)
+		}
+	}
+	if report.Requests > 0 {
+		report.ErrorRate = float64(report.Failed) / float64(report.Requests)
+	}
+	if elapsed > 0 {
+		report.RequestsPerSecond = float64(report.Requests) / elapsed.Seconds()
+	}
+	report.TTFTMs = percentiles(ttfts)
+	report.LatencyMs = percentiles(latencies)
+	report.TokensPerSecond = percentiles(rates)
+	return report
+}
+
+// percentiles returns the nearest-rank percentiles of values
+func percentiles(values []float64) benchPercentiles {
+	if len(values) == 0 {
+		return benchPercentiles{}
+	}
+	slices.Sort(values)
+	at := func(p float64) float64 {
+		rank := int(p*float64(len(values))+0.999999) - 1
+		return values[max(0, min(rank, len(values)-1))]
+	}
+	return benchPercentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: values[len(values)-1]}
+}
+
+// print writes the report as a table
+func (r benchReport) print(out io.Writer) error {
+	fmt.Fprintf(out, "Requests:   %d in %.1fs, %.2f/s\n", r.Requests, r.DurationSeconds, r.RequestsPerSecond)
+	fmt.Fprintf(out, "Succeeded:  %d\n", r.Succeeded)
+	fmt.Fprintf(out, "Failed:     %d (%.1f%%)\n", r.Failed, r.ErrorRate*100)
+	for _, reason := range slices.Sorted(maps.Keys(r.Errors)) {
+		fmt.Fprintf(out, "  %-16s %d\n", reason, r.Errors[reason])
+	}
+	fmt.Fprintf(out, "Tokens:     %d generated\n\n", r.CompletionTokens)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "\tP50\tP90\tP99\tMAX\t")
+	for _, row := range []struct {
+		name string
+		p    benchPercentiles
+	}{
+		{"TTFT (ms)", r.TTFTMs},
+		{"Latency (ms)", r.LatencyMs},
+		{"Tokens/s", r.TokensPerSecond},
+	} {
+		fmt.Fprintf(w, "%s\t%.1f\t%.1f\t%.1f\t%.1f\t\n", row.name, row.p.P50, row.p.P90, row.p.P99, row.p.Max)
+	}
+	return w.Flush()
+}
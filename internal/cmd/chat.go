@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	"github.com/danilofalcao/cursor-deepseek/pkg/proxy"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// chatOptions configures the chat command
+type chatOptions struct {
+	configPath string
+	model      string
+	system     string
+	apiKey     string
+	noStream   bool
+}
+
+func chatCommand() *command {
+	flags, configPath := newFlags("chat")
+	opts := chatOptions{}
+	flags.StringVarP(&opts.model, "model", "m", "gpt-4o", "the model requested, which is mapped like those of clients")
+	flags.StringVar(&opts.system, "system", "", "a system prompt sent before the conversation")
+	flags.StringVar(&opts.apiKey, "api-key", "", "the API key the proxy is called with, by default the first client's or else the backend's")
+	flags.BoolVar(&opts.noStream, "no-stream", false, "waits for whole responses instead of streaming them")
+	return &command{
+		name:  "chat",
+		short: "Chat with the configured backend through the proxy",
+		flags: flags,
+		run: func(ctx context.Context) error {
+			opts.configPath = *configPath
+			return chat(ctx, opts)
+		},
+	}
+}
+
+// chat serves the config on a local port and sends the lines read from stdin
+// to it as a conversation
+func chat(ctx context.Context, opts chatOptions) error {
+	v, err := newViper(opts.configPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(ctx, v)
+	if err != nil {
+		return err
+	}
+	local, err := startLocalProxy(ctx, v, cfg)
+	if err != nil {
+		return err
+	}
+	defer local.stop()
+
+	if opts.apiKey == "" {
+		opts.apiKey = local.apiKey
+	}
+	// Streams are read with the CLI's logger, as the proxy's is its own
+	ctx = withCLILogger(ctx)
+	c := &chatClient{
+		url:    local.url + "/chat/completions",
+		opts:   opts,
+		client: &http.Client{},
+	}
+	c.reset()
+
+	fmt.Printf("Chatting with %s through %s as %s. Type /reset to start over, /exit to quit.\n", local.backend, local.addr, opts.model)
+	lines := readLines(os.Stdin)
+	for {
+		fmt.Print("> ")
+		var line string
+		var ok bool
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return nil
+		case line, ok = <-lines:
+		}
+		if !ok {
+			fmt.Println()
+			return nil
+		}
+
+		switch line = strings.TrimSpace(line); line {
+		case "":
+			continue
+		case "/exit", "/quit":
+			return nil
+		case "/reset":
+			c.reset()
+			continue
+		}
+		if err := c.send(ctx, line); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// localProxy is a config served on a local port, for commands to send
+// requests through
+type localProxy struct {
+	addr string
+	// url is the base URL of the OpenAI API
+	url string
+	// apiKey is the first client's API key, or else the backend's
+	apiKey  string
+	backend string
+	stop    func()
+}
+
+// startLocalProxy serves the config on a local port, without its TLS and
+// network restrictions, so that requests take the same path as those of
+// clients
+func startLocalProxy(ctx context.Context, v *viper.Viper, cfg config) (*localProxy, error) {
+	be, apikey, err := getBackendAndApiKey(v, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := pipelineOptions(v, cfg, be, apikey)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, "error listening")
+	}
+	p, err := proxy.New(ctx, append(opts,
+		proxy.WithListener(listener),
+		proxy.WithLogLevel("error"),
+		proxy.WithLogSinks(proxy.LogSink{Type: logger.SinkStderr}),
+	)...)
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "unable to start proxy")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+
+	for _, client := range cfg.Clients {
+		if client.Key != "" {
+			apikey = client.Key
+			break
+		}
+	}
+	return &localProxy{
+		addr:    listener.Addr().String(),
+		url:     "http://" + listener.Addr().String() + "/v1",
+		apiKey:  apikey,
+		backend: be.Name(),
+		stop: func() {
+			cancel()
+			<-done
+		},
+	}, nil
+}
+
+// readLines sends the lines of r until it ends
+func readLines(r io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return lines
+}
+
+// chatClient holds a conversation with the proxy
+type chatClient struct {
+	url      string
+	opts     chatOptions
+	client   *http.Client
+	messages []openai.Message
+}
+
+// reset starts the conversation over
+func (c *chatClient) reset() {
+	c.messages = nil
+	if c.opts.system != "" {
+		c.messages = append(c.messages, openai.Message{Role: "system", Content: openai.Content_String{Content: c.opts.system}})
+	}
+}
+
+// send sends the user's message, printing the answer, which is kept in the
+// conversation
+func (c *chatClient) send(ctx context.Context, text string) error {
+	messages := append(c.messages, openai.Message{Role: "user", Content: openai.Content_String{Content: text}})
+	body, err := json.Marshal(&openai.ChatCompletionRequest{
+		Model:    c.opts.model,
+		Messages: messages,
+		Stream:   !c.opts.noStream,
+	})
+	if err != nil {
+		return errors.Wrap(err, "error encoding request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.opts.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error sending request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return errors.Errorf("proxy returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var answer string
+	if c.opts.noStream {
+		var completion openai.ChatCompletionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			return errors.Wrap(err, "error decoding response")
+		}
+		if len(completion.Choices) > 0 {
+			answer = completion.Choices[0].Message.GetContentString()
+		}
+		fmt.Print(answer)
+	} else {
+		chunks, errs := stream.ReadOpenAI(ctx, resp.Body, stream.ReadOptions{})
+		for chunk := range chunks {
+			for _, choice := range chunk.Choices {
+				if content, ok := choice.Delta.Content.(openai.Content_String); ok {
+					fmt.Print(content.Content)
+					answer += content.Content
+				}
+			}
+		}
+		if err := <-errs; err != nil {
+			fmt.Println()
+			return errors.Wrap(err, "error reading stream")
+		}
+	}
+	fmt.Println()
+
+	c.messages = append(messages, openai.Message{Role: "assistant", Content: openai.Content_String{Content: answer}})
+	return nil
+}
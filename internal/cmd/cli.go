@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// command is a subcommand of the CLI, such as serve
+type command struct {
+	name  string
+	short string
+	flags *pflag.FlagSet
+	run   func(ctx context.Context) error
+}
+
+// commands returns the subcommands of the CLI, the first of which runs when
+// none is named
+func commands() []*command {
+	return []*command{
+		serveCommand(),
+		validateCommand(),
+		modelsCommand(),
+		chatCommand(),
+		benchCommand(),
+		initCommand(),
+		hashKeyCommand(),
+		versionCommand(),
+	}
+}
+
+// newFlags creates the flags of the named command, along with its config flag
+func newFlags(name string) (*pflag.FlagSet, *string) {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	configPath := flags.StringP("config", "c", "", "sets the config file location e.g. $HOME/proxy-config.yaml")
+	return flags, configPath
+}
+
+func serveCommand() *command {
+	flags, configPath := newFlags("serve")
+	return &command{
+		name:  "serve",
+		short: "Serve the proxy, the default command",
+		flags: flags,
+		run: func(ctx context.Context) error {
+			return serve(ctx, *configPath)
+		},
+	}
+}
+
+func validateCommand() *command {
+	flags, configPath := newFlags("validate")
+	probe := flags.Bool("probe", false, "also checks that the upstreams are reachable and accept their API keys")
+	return &command{
+		name:  "validate",
+		short: "Check the config, listing its problems",
+		flags: flags,
+		run: func(ctx context.Context) error {
+			return validate(ctx, *configPath, *probe)
+		},
+	}
+}
+
+func Run() {
+	cmds := commands()
+	cmd, args := cmds[0], os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd = nil
+		for _, c := range cmds {
+			if c.name == args[0] {
+				cmd = c
+			}
+		}
+		if args[0] == "help" {
+			printUsage(cmds)
+			return
+		}
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+			printUsage(cmds)
+			os.Exit(2)
+		}
+		args = args[1:]
+	}
+
+	cmd.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n%s", cmd.name, cmd.flags.FlagUsages())
+	}
+	if err := cmd.flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return
+		}
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := cmd.run(ctx)
+	stop()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// printUsage lists the commands
+func printUsage(cmds []*command) {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> --help for the flags of a command.\n", os.Args[0])
+}
+
+// withCLILogger adds a logger of warnings to stderr to the context, for the
+// backends used by commands other than serve
+func withCLILogger(ctx context.Context) context.Context {
+	lgr := logger.NewWithOptions(ctx, logger.Options{
+		Name:   "cli",
+		Level:  logger.LevelFromString("warn"),
+		Output: os.Stderr,
+	})
+	return logutils.ContextWithLogger(ctx, lgr)
+}
@@ -2,143 +2,1491 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"io/fs"
 	"log"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	ollamaapi "github.com/danilofalcao/cursor-deepseek/internal/api/ollama/v1"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend/deepseek"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend/ollama"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend/openrouter"
+	"github.com/danilofalcao/cursor-deepseek/internal/balancer"
 	deepseekconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/deepseek"
 	ollamaconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/ollama"
 	openrouterconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/openrouter"
-	"github.com/danilofalcao/cursor-deepseek/internal/server"
+	"github.com/danilofalcao/cursor-deepseek/internal/contextwindow"
+	"github.com/danilofalcao/cursor-deepseek/internal/continuation"
+	"github.com/danilofalcao/cursor-deepseek/internal/limiter"
+	"github.com/danilofalcao/cursor-deepseek/internal/router"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	"github.com/danilofalcao/cursor-deepseek/internal/structured"
+	"github.com/danilofalcao/cursor-deepseek/internal/telemetry"
+	"github.com/danilofalcao/cursor-deepseek/pkg/proxy"
 	"github.com/pkg/errors"
-	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+type EndpointConfig struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
 type BackendConfig struct {
 	Endpoint     string            `mapstructure:"endpoint"`
+	Endpoints    []EndpointConfig  `mapstructure:"endpoints"`
 	Apikey       string            `mapstructure:"api_key"`
 	Models       map[string]string `mapstructure:"models"`
 	DefaultModel string            `mapstructure:"default_model"`
+	AllowModels  []string          `mapstructure:"allow_models"`
+	DenyModels   []string          `mapstructure:"deny_models"`
+	// ModelsTTL is how long the models listed upstream are cached, or 0 to
+	// only list the configured models
+	ModelsTTL string `mapstructure:"models_ttl"`
+	// UnsupportedParams maps upstream models to request parameters which are
+	// stripped before forwarding
+	UnsupportedParams map[string][]string `mapstructure:"unsupported_params"`
+	// Passthrough forwards requests with the model and parameters the client
+	// sent. It is only supported by the deepseek and openrouter backends.
+	Passthrough bool `mapstructure:"passthrough"`
+	// KeepAliveComments and IncludeCost are only supported by the openrouter
+	// backend
+	KeepAliveComments string `mapstructure:"keepalive_comments"`
+	IncludeCost       bool   `mapstructure:"include_cost"`
+	// InlineReasoning, FIM and StreamPassthrough are only supported by the
+	// deepseek backend
+	InlineReasoning   bool `mapstructure:"inline_reasoning"`
+	FIM               bool `mapstructure:"fim"`
+	StreamPassthrough bool `mapstructure:"stream_passthrough"`
+	// Options and ThinkTags are only supported by the ollama backend
+	Options   OllamaOptionsConfig `mapstructure:"options"`
+	ThinkTags string              `mapstructure:"think_tags"`
+	// EmulateStructuredOutputs validates strict json_schema responses in the
+	// proxy for backends which don't support them natively
+	EmulateStructuredOutputs bool `mapstructure:"emulate_structured_outputs"`
+	// Connections configures the pool of connections to the upstream
+	Connections ConnectionsConfig `mapstructure:"connections"`
+	// Protocol is auto, http1 or http2
+	Protocol string            `mapstructure:"protocol"`
+	TLS      UpstreamTLSConfig `mapstructure:"tls"`
+	// OutboundProxy overrides the global outbound proxy
+	OutboundProxy string `mapstructure:"outbound_proxy"`
+	// Retry retries requests failing transiently
+	Retry RetryConfig `mapstructure:"retry"`
+	// Concurrency limits the requests served at once
+	Concurrency ConcurrencyConfig `mapstructure:"concurrency"`
+	// Timeouts override the global timeouts
+	Timeouts TimeoutsConfig `mapstructure:"timeouts"`
+}
+
+// TimeoutsConfig bounds the phases of upstream requests. Zero disables a
+// timeout, or inherits the global one for a backend.
+type TimeoutsConfig struct {
+	// Connect bounds establishing a connection, the TLS handshake included
+	Connect time.Duration `mapstructure:"connect"`
+	// Header bounds the wait for the response headers
+	Header time.Duration `mapstructure:"header"`
+	// FirstToken bounds the wait for the first chunk of a stream
+	FirstToken time.Duration `mapstructure:"first_token"`
+	// Total bounds non-streaming requests, and defaults to timeout
+	Total time.Duration `mapstructure:"total"`
+	// MaxStream bounds streaming requests
+	MaxStream time.Duration `mapstructure:"max_stream"`
+}
+
+type ConcurrencyConfig struct {
+	// MaxConcurrent is the number of requests served at once, or 0 for no
+	// limit
+	MaxConcurrent int           `mapstructure:"max_concurrent"`
+	MaxQueue      int           `mapstructure:"max_queue"`
+	QueueTimeout  time.Duration `mapstructure:"queue_timeout"`
+}
+
+type RetryConfig struct {
+	// MaxAttempts includes the first attempt, so 1 disables retries
+	MaxAttempts int           `mapstructure:"max_attempts"`
+	Backoff     time.Duration `mapstructure:"backoff"`
+	MaxBackoff  time.Duration `mapstructure:"max_backoff"`
+	// Jitter is the fraction of each delay it is randomized by
+	Jitter      float64 `mapstructure:"jitter"`
+	StatusCodes []int   `mapstructure:"status_codes"`
+}
+
+// UpstreamTLSConfig configures the TLS connections to a backend's upstream
+type UpstreamTLSConfig struct {
+	// CAFile is trusted besides the system's CAs, such as a self-hosted
+	// endpoint's
+	CAFile string `mapstructure:"ca_file"`
+	// CertFile and KeyFile are the client certificate presented upstream
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// InsecureSkipVerify disables the verification of the upstream's
+	// certificate
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+type ConnectionsConfig struct {
+	MaxIdle              int           `mapstructure:"max_idle"`
+	MaxIdlePerHost       int           `mapstructure:"max_idle_per_host"`
+	MaxPerHost           int           `mapstructure:"max_per_host"`
+	IdleTimeout          time.Duration `mapstructure:"idle_timeout"`
+	HTTP2ReadIdleTimeout time.Duration `mapstructure:"http2_read_idle_timeout"`
+	HTTP2PingTimeout     time.Duration `mapstructure:"http2_ping_timeout"`
+}
+
+// OllamaOptionsConfig sets the default model parameters of Ollama requests
+type OllamaOptionsConfig struct {
+	NumPredict    *int     `mapstructure:"num_predict"`
+	NumCtx        *int     `mapstructure:"num_ctx"`
+	TopK          *int     `mapstructure:"top_k"`
+	TopP          *float64 `mapstructure:"top_p"`
+	Temperature   *float64 `mapstructure:"temperature"`
+	RepeatPenalty *float64 `mapstructure:"repeat_penalty"`
+	Stop          []string `mapstructure:"stop"`
+	Seed          *int     `mapstructure:"seed"`
+}
+
+type RoutingConfig struct {
+	Policy   string   `mapstructure:"policy"`
+	Backends []string `mapstructure:"backends"`
+}
+
+type CanaryConfig struct {
+	Percent float64 `mapstructure:"percent"`
+	Backend string  `mapstructure:"backend"`
+	Model   string  `mapstructure:"model"`
+}
+
+type ModelAliasConfig struct {
+	// Pattern is a glob pattern, or Regex a regular expression, matching the
+	// models requested
+	Pattern string `mapstructure:"pattern"`
+	Regex   string `mapstructure:"regex"`
+	// Target is the upstream model, prefixed by the backend serving it such as
+	// openrouter:anthropic/claude-3.5-sonnet unless the primary backend does
+	Target string `mapstructure:"target"`
+}
+
+type HedgingConfig struct {
+	// Delay is how long a request has to produce its first byte before it is
+	// hedged, or 0 to never hedge requests
+	Delay time.Duration `mapstructure:"delay"`
+	// Backend receives the hedged requests instead of the primary backend
+	Backend string `mapstructure:"backend"`
+}
+
+type ContextWindowConfig struct {
+	// Models maps the models requested to their context window
+	Models map[string]ContextWindowModelConfig `mapstructure:"models"`
+	// Default is the context window of the other models, which are passed
+	// through unless it is set
+	Default ContextWindowModelConfig `mapstructure:"default"`
+	// Reserve is the number of tokens left for completions which don't set
+	// max_tokens
+	Reserve   int                    `mapstructure:"reserve"`
+	Summarize ContextSummarizeConfig `mapstructure:"summarize"`
+}
+
+type ContextWindowModelConfig struct {
+	Tokens        int     `mapstructure:"tokens"`
+	CharsPerToken float64 `mapstructure:"chars_per_token"`
+}
+
+type ContextSummarizeConfig struct {
+	// Model summarizes the messages trimmed, or is empty to drop them
+	Model string `mapstructure:"model"`
+	// Backend serves Model instead of the primary backend
+	Backend string `mapstructure:"backend"`
+}
+
+type ContinuationConfig struct {
+	// MaxContinuations is how many times a response cut off by the maximum
+	// number of tokens is continued, or 0 to never continue them
+	MaxContinuations int `mapstructure:"max_continuations"`
+}
+
+type ModelParamsConfig struct {
+	Temperature      *float64 `mapstructure:"temperature"`
+	TopP             *float64 `mapstructure:"top_p"`
+	MaxTokens        *int     `mapstructure:"max_tokens"`
+	FrequencyPenalty *float64 `mapstructure:"frequency_penalty"`
+	PresencePenalty  *float64 `mapstructure:"presence_penalty"`
+
+	TemperatureCap *float64 `mapstructure:"temperature_cap"`
+	TopPCap        *float64 `mapstructure:"top_p_cap"`
+	MaxTokensCap   *int     `mapstructure:"max_tokens_cap"`
+}
+
+type StructuredOutputsConfig struct {
+	MaxAttempts int `mapstructure:"max_attempts"`
+}
+
+type BatchesConfig struct {
+	Dir         string `mapstructure:"dir"`
+	Concurrency int    `mapstructure:"concurrency"`
+}
+
+type AuditConfig struct {
+	Path   string   `mapstructure:"path"`
+	Redact []string `mapstructure:"redact"`
+}
+
+type UsageConfig struct {
+	DB string `mapstructure:"db"`
+	// Pricing maps upstream models to their price in USD per million tokens
+	Pricing map[string]PriceConfig `mapstructure:"pricing"`
+	Budgets []BudgetConfig         `mapstructure:"budgets"`
+}
+
+type BudgetConfig struct {
+	ApiKey          string    `mapstructure:"api_key"`
+	Client          string    `mapstructure:"client"`
+	Period          string    `mapstructure:"period"`
+	MaxTokens       int       `mapstructure:"max_tokens"`
+	MaxCost         float64   `mapstructure:"max_cost"`
+	AlertThresholds []float64 `mapstructure:"alert_thresholds"`
+}
+
+type ClientConfig struct {
+	Name string `mapstructure:"name"`
+	Key  string `mapstructure:"key"`
+	// KeyHash is the key hashed by the hash-key command, instead of the key
+	KeyHash string `mapstructure:"key_hash"`
+	// ExpiresAt is a YAML timestamp, such as 2025-12-31
+	ExpiresAt time.Time       `mapstructure:"expires_at"`
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	// Tier is the name of the tier the client belongs to, such as free
+	Tier string `mapstructure:"tier"`
+	// Upstream, if its backend is set, serves the client's requests with its
+	// own upstream credentials
+	Upstream ClientUpstreamConfig `mapstructure:"upstream"`
+}
+
+// ClientUpstreamConfig binds a client to its own upstream. The settings which
+// aren't set are those of the backend.
+type ClientUpstreamConfig struct {
+	// Backend is the name of the backend whose config the upstream inherits
+	Backend      string            `mapstructure:"backend"`
+	Endpoint     string            `mapstructure:"endpoint"`
+	Apikey       string            `mapstructure:"api_key"`
+	DefaultModel string            `mapstructure:"default_model"`
+	Models       map[string]string `mapstructure:"models"`
+	AllowModels  []string          `mapstructure:"allow_models"`
+	DenyModels   []string          `mapstructure:"deny_models"`
 }
+
+// TierConfig restricts the clients of a tier
+type TierConfig struct {
+	// RateLimit overrides the global rate limit, and the tier's rate limit in
+	// tier_rate_limits
+	RateLimit   RateLimitConfig `mapstructure:"rate_limit"`
+	AllowModels []string        `mapstructure:"allow_models"`
+	DenyModels  []string        `mapstructure:"deny_models"`
+	// MaxTokens caps the tokens generated for each request
+	MaxTokens int `mapstructure:"max_tokens"`
+	// Priority is the priority class of the requests, low, normal or high,
+	// for backends with concurrency limits
+	Priority string `mapstructure:"priority"`
+}
+
+type CacheConfig struct {
+	// TTL is how long responses are cached, or 0 to disable the cache
+	TTL      time.Duration       `mapstructure:"ttl"`
+	Semantic SemanticCacheConfig `mapstructure:"semantic"`
+}
+
+// RecordingConfig records the requests sent upstream and their responses, or
+// replays them instead of sending requests upstream
+type RecordingConfig struct {
+	// Mode is record or replay, or empty to disable recording
+	Mode string `mapstructure:"mode"`
+	// Dir keeps the recordings, in a directory per backend
+	Dir string `mapstructure:"dir"`
+	// Realtime replays streamed responses at the pace they were recorded
+	Realtime bool `mapstructure:"realtime"`
+}
+
+// recording returns the recording of the named backend
+func (c RecordingConfig) recording(name string) (backend.Recording, error) {
+	if err := backend.ValidateRecordingMode(c.Mode); err != nil {
+		return backend.Recording{}, errors.Wrap(err, "invalid recording config")
+	}
+	if c.Mode != "" && c.Dir == "" {
+		return backend.Recording{}, errors.New("invalid recording config: dir is required when mode is set")
+	}
+	return backend.Recording{
+		Mode:     c.Mode,
+		Dir:      filepath.Join(c.Dir, name),
+		Realtime: c.Realtime,
+	}, nil
+}
+
+type SemanticCacheConfig struct {
+	// Backend embeds the final user messages, or is empty to disable the
+	// semantic cache. Only ollama can embed text.
+	Backend    string  `mapstructure:"backend"`
+	Model      string  `mapstructure:"model"`
+	Threshold  float64 `mapstructure:"threshold"`
+	MaxEntries int     `mapstructure:"max_entries"`
+}
+
+type SystemPromptConfig struct {
+	// Prepend and Append are instructions sent before and after the client's
+	// system prompts
+	Prepend string                   `mapstructure:"prepend"`
+	Append  string                   `mapstructure:"append"`
+	Rules   []SystemPromptRuleConfig `mapstructure:"rules"`
+	// Variables are expanded in the {{name}} placeholders of the instructions
+	// and replacements
+	Variables map[string]string `mapstructure:"variables"`
+}
+
+type SystemPromptRuleConfig struct {
+	Pattern string `mapstructure:"pattern"`
+	// Action is rewrite or drop
+	Action      string `mapstructure:"action"`
+	Replacement string `mapstructure:"replacement"`
+}
+
+type ContentFilterConfig struct {
+	Rules []ContentFilterRuleConfig `mapstructure:"rules"`
+	// Responses also filters the model's responses
+	Responses bool `mapstructure:"responses"`
+	// BlockWith is error or finish_reason
+	BlockWith string `mapstructure:"block_with"`
+}
+
+type ContentFilterRuleConfig struct {
+	Pattern     string `mapstructure:"pattern"`
+	Keyword     string `mapstructure:"keyword"`
+	Action      string `mapstructure:"action"`
+	Replacement string `mapstructure:"replacement"`
+}
+
+// HTTPLimitsConfig protects the proxy from slow clients and oversized
+// headers. Unset limits use the defaults, and negative ones are disabled.
+type HTTPLimitsConfig struct {
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	ReadBodyTimeout   time.Duration `mapstructure:"read_body_timeout"`
+	// WriteTimeout bounds each write to the client rather than whole
+	// responses, so streams of any length are served
+	WriteTimeout   time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout    time.Duration `mapstructure:"idle_timeout"`
+	MaxHeaderBytes int           `mapstructure:"max_header_bytes"`
+}
+
+type RateLimitConfig struct {
+	RequestsPerMinute int `mapstructure:"requests_per_minute"`
+	TokensPerMinute   int `mapstructure:"tokens_per_minute"`
+}
+
+// CompressionConfig compresses the JSON responses of clients which accept it
+type CompressionConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// MinSize is the size below which responses are sent uncompressed
+	MinSize int `mapstructure:"min_size"`
+}
+
+// ChaosConfig injects faults into a percentage of the responses to clients
+type ChaosConfig struct {
+	ErrorPercent      float64       `mapstructure:"error_percent"`
+	ErrorStatus       int           `mapstructure:"error_status"`
+	SlowPercent       float64       `mapstructure:"slow_percent"`
+	SlowDelay         time.Duration `mapstructure:"slow_delay"`
+	DisconnectPercent float64       `mapstructure:"disconnect_percent"`
+	MalformedPercent  float64       `mapstructure:"malformed_percent"`
+}
+
+type TLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ClientCAFile requires client certificates signed by the CA
+	ClientCAFile string     `mapstructure:"client_ca_file"`
+	ACME         ACMEConfig `mapstructure:"acme"`
+}
+
+type ACMEConfig struct {
+	Hosts    []string `mapstructure:"hosts"`
+	Email    string   `mapstructure:"email"`
+	CacheDir string   `mapstructure:"cache_dir"`
+}
+
+type NetworksConfig struct {
+	Allowed        []string `mapstructure:"allowed"`
+	Admin          []string `mapstructure:"admin"`
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+}
+
+type JWTConfig struct {
+	JWKSURL   string `mapstructure:"jwks_url"`
+	Issuer    string `mapstructure:"issuer"`
+	Audience  string `mapstructure:"audience"`
+	TierClaim string `mapstructure:"tier_claim"`
+}
+
+type RedisConfig struct {
+	URL    string `mapstructure:"url"`
+	Prefix string `mapstructure:"prefix"`
+}
+
+type WebhookConfig struct {
+	URL        string        `mapstructure:"url"`
+	Secret     string        `mapstructure:"secret"`
+	Events     []string      `mapstructure:"events"`
+	MaxRetries int           `mapstructure:"max_retries"`
+	Timeout    time.Duration `mapstructure:"timeout"`
+}
+
+type PriceConfig struct {
+	Prompt     float64 `mapstructure:"prompt"`
+	Completion float64 `mapstructure:"completion"`
+}
+
+type TracingConfig struct {
+	Endpoint    string  `mapstructure:"endpoint"`
+	ServiceName string  `mapstructure:"service_name"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+type LogSinkConfig struct {
+	Type string `mapstructure:"type"`
+	Path string `mapstructure:"path"`
+	// MaxSizeMB is the size at which the file is rotated
+	MaxSizeMB  int `mapstructure:"max_size_mb"`
+	MaxAgeDays int `mapstructure:"max_age_days"`
+	MaxBackups int `mapstructure:"max_backups"`
+	// Network, Address and Tag configure syslog sinks
+	Network string `mapstructure:"network"`
+	Address string `mapstructure:"address"`
+	Tag     string `mapstructure:"tag"`
+}
+
+type HealthCheckConfig struct {
+	Interval string `mapstructure:"interval"`
+	Timeout  string `mapstructure:"timeout"`
+}
+
+type StreamingConfig struct {
+	// HeartbeatInterval is how often heartbeat comments are sent while a
+	// stream is idle, or 0 to send none
+	HeartbeatInterval string `mapstructure:"heartbeat_interval"`
+	// IdleTimeout aborts streams whose upstream sends nothing for this long,
+	// or 0 to never abort them
+	IdleTimeout string `mapstructure:"idle_timeout"`
+}
+
 type config struct {
-	Deepseek   BackendConfig `mapstructure:"deepseek"`
-	Openrouter BackendConfig `mapstructure:"openrouter"`
-	Ollama     BackendConfig `mapstructure:"ollama"`
-	Port       string        `mapstructure:"port"`
-	Loglevel   string        `mapstructure:"log_level"`
-	Timeout    string        `mapstructure:"timeout"`
+	Deepseek    BackendConfig     `mapstructure:"deepseek"`
+	Openrouter  BackendConfig     `mapstructure:"openrouter"`
+	Ollama      BackendConfig     `mapstructure:"ollama"`
+	Routing     RoutingConfig     `mapstructure:"routing"`
+	Canary      CanaryConfig      `mapstructure:"canary"`
+	Hedging     HedgingConfig     `mapstructure:"hedging"`
+	HealthCheck HealthCheckConfig `mapstructure:"health_check"`
+	Streaming   StreamingConfig   `mapstructure:"streaming"`
+	Timeouts    TimeoutsConfig    `mapstructure:"timeouts"`
+	Batches     BatchesConfig     `mapstructure:"batches"`
+	Tracing     TracingConfig     `mapstructure:"tracing"`
+	Audit       AuditConfig       `mapstructure:"audit"`
+	Usage       UsageConfig       `mapstructure:"usage"`
+	Port        string            `mapstructure:"port"`
+	// Host is the address of the interface listened on, all of them if unset
+	Host string `mapstructure:"host"`
+	// Listen are the addresses listened on instead of the host and port,
+	// including Unix sockets prefixed with unix:
+	Listen []string `mapstructure:"listen"`
+	// SocketMode is the octal permissions of the Unix sockets listened on
+	SocketMode string `mapstructure:"socket_mode"`
+	// ReusePort lets a new proxy listen on the TCP addresses before this one
+	// is shut down
+	ReusePort bool `mapstructure:"reuse_port"`
+	// ShutdownTimeout is how long requests in flight are waited for when
+	// shutting down
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+	// Server bounds how long clients may take to send requests and read
+	// responses
+	Server   HTTPLimitsConfig `mapstructure:"server"`
+	Loglevel string           `mapstructure:"log_level"`
+	Timeout  string           `mapstructure:"timeout"`
+	// AdminApiKey is required by the /admin endpoints instead of a client key
+	AdminApiKey string `mapstructure:"admin_api_key"`
+	// DebugEndpoints serves pprof and expvar under /admin/debug, which
+	// requires AdminApiKey
+	DebugEndpoints bool `mapstructure:"debug_endpoints"`
+	// LogFormat is text or json
+	LogFormat string `mapstructure:"log_format"`
+	// LogLevels overrides the log level of the named modules
+	LogLevels map[string]string `mapstructure:"log_levels"`
+	LogSinks  []LogSinkConfig   `mapstructure:"log_sinks"`
+	Webhooks  []WebhookConfig   `mapstructure:"webhooks"`
+	// SystemPrompt adds instructions to and rewrites the system prompts
+	SystemPrompt SystemPromptConfig `mapstructure:"system_prompt"`
+	// ContentFilter blocks or redacts patterns in prompts and responses
+	ContentFilter ContentFilterConfig `mapstructure:"content_filter"`
+	// OutboundProxy is the proxy the backends reach their upstreams through,
+	// or direct to ignore the environment's
+	OutboundProxy string `mapstructure:"outbound_proxy"`
+	// Redis shares rate limits and budgets between replicas
+	Redis RedisConfig `mapstructure:"redis"`
+	// Compression compresses large JSON responses for clients accepting it
+	Compression CompressionConfig `mapstructure:"compression"`
+	// Chaos injects faults into responses, to test how clients handle them
+	Chaos ChaosConfig `mapstructure:"chaos"`
+	// Deduplicate collapses identical requests in flight into one upstream
+	// request
+	Deduplicate bool `mapstructure:"deduplicate"`
+	// Cache serves identical requests from a cache
+	Cache CacheConfig `mapstructure:"cache"`
+	// Recording records upstream requests and responses, or replays them
+	Recording RecordingConfig `mapstructure:"recording"`
+	// ContextWindow trims prompts which overflow their model's context window
+	ContextWindow ContextWindowConfig `mapstructure:"context_window"`
+	// Continuation continues responses cut off by the maximum number of tokens
+	Continuation ContinuationConfig `mapstructure:"continuation"`
+	// ModelAliases map the models requested to upstream models, in order
+	ModelAliases []ModelAliasConfig `mapstructure:"model_aliases"`
+	// Models maps upstream models to their default parameters and caps
+	Models map[string]ModelParamsConfig `mapstructure:"models"`
+	// Secrets configures the providers secrets are referenced from
+	Secrets SecretsConfig `mapstructure:"secrets"`
+	// Clients are named API keys clients authenticate with instead of the
+	// backend's
+	Clients []ClientConfig `mapstructure:"clients"`
+	// RateLimit limits each client API key, unless its client sets its own
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+	// TierRateLimits are the rate limits of the tiers clients and JWTs carry
+	TierRateLimits map[string]RateLimitConfig `mapstructure:"tier_rate_limits"`
+	// Tiers restrict the rate limits, models and tokens of the clients of
+	// each tier, by name
+	Tiers map[string]TierConfig `mapstructure:"tiers"`
+	// JWT authenticates clients with JWTs
+	JWT JWTConfig `mapstructure:"jwt"`
+	TLS TLSConfig `mapstructure:"tls"`
+	// Networks restricts which source networks may call the proxy
+	Networks NetworksConfig `mapstructure:"networks"`
+	// MaxRequestBodySize is the largest request body accepted, in bytes
+	MaxRequestBodySize int64 `mapstructure:"max_request_body_size"`
+	// PathPrefixes are stripped from request paths which don't match a route
+	PathPrefixes []string `mapstructure:"path_prefixes"`
+
+	StructuredOutputs StructuredOutputsConfig `mapstructure:"structured_outputs"`
+	// StrippedParamsHeader reports parameters stripped from requests in the
+	// X-Proxy-Stripped-Params response header
+	StrippedParamsHeader bool `mapstructure:"stripped_params_header"`
+
+	// secrets are the references the config's secrets were resolved from
+	secrets *secretRefs
+	// limiters are the concurrency limits of the backends built from the
+	// config
+	limiters *backendLimiters
 }
 
-func Run() {
-	var configPath *string = pflag.StringP("config", "c", "", "sets the config file location e.g. $HOME/proxy-config.yaml")
+// backendNames are the names of the backends which can be configured
+var backendNames = []string{"deepseek", "openrouter", "ollama"}
+
+// serve serves the config at configPath until ctx is done
+func serve(ctx context.Context, configPath string) error {
+	v, err := newViper(configPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(ctx, v)
+	if err != nil {
+		return err
+	}
+
+	shutdownTracing, err := telemetry.Setup(ctx, telemetry.Options{
+		Endpoint:    cfg.Tracing.Endpoint,
+		ServiceName: cfg.Tracing.ServiceName,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	socketMode, err := parseSocketMode(cfg.SocketMode)
+	if err != nil {
+		return err
+	}
+	be, apikey, err := getBackendAndApiKey(v, cfg)
+	if err != nil {
+		return err
+	}
+	opts, err := pipelineOptions(v, cfg, be, apikey)
+	if err != nil {
+		return err
+	}
+	opts = append(opts,
+		proxy.WithNetworks(proxy.Networks(cfg.Networks)),
+		proxy.WithPort(cfg.Port),
+		proxy.WithHost(cfg.Host),
+		proxy.WithAddresses(cfg.Listen...),
+		proxy.WithSocketMode(socketMode),
+		proxy.WithReusePort(cfg.ReusePort),
+		proxy.WithShutdownTimeout(cfg.ShutdownTimeout),
+		proxy.WithHTTPLimits(proxy.HTTPLimits(cfg.Server)),
+		proxy.WithTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile),
+		proxy.WithACME(cfg.TLS.ACME.CacheDir, cfg.TLS.ACME.Email, cfg.TLS.ACME.Hosts...),
+		proxy.WithClientCA(cfg.TLS.ClientCAFile),
+		proxy.WithLogLevel(cfg.Loglevel),
+		proxy.WithLogFormat(cfg.LogFormat),
+		proxy.WithModuleLogLevels(cfg.LogLevels),
+		proxy.WithLogSinks(logSinks(cfg.LogSinks)...),
+	)
+	p, err := proxy.New(ctx, opts...)
+	if err != nil {
+		return errors.Wrap(err, "unable to start server")
+	}
 
-	pflag.Parse()
-	ctx := context.Background()
-	exitCh := make(chan string, 1)
+	reloader := &reloader{path: v.ConfigFileUsed(), proxy: p, started: cfg}
+	reloader.refresh(ctx, v, cfg)
+	go reloader.run(ctx)
 
+	return p.Run(ctx)
+}
+
+// parseSocketMode parses the octal permissions of Unix sockets, returning 0
+// for the default if unset
+func parseSocketMode(mode string) (fs.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0o777 {
+		return 0, errors.Errorf("invalid socket_mode %q, expected octal permissions such as 0660", mode)
+	}
+	return fs.FileMode(perm), nil
+}
+
+// pipelineOptions configures how the proxy serves requests with the backend,
+// without how it listens and logs
+func pipelineOptions(v *viper.Viper, cfg config, be backend.Backend, apikey string) ([]proxy.Option, error) {
+	embedder, err := newEmbedder(v, cfg, cfg.Cache.Semantic)
+	if err != nil {
+		return nil, err
+	}
+	return []proxy.Option{
+		proxy.WithBackend(be),
+		proxy.WithAPIKey(apikey),
+		proxy.WithClients(clients(cfg.Clients)...),
+		proxy.WithRateLimit(proxy.RateLimit(cfg.RateLimit)),
+		proxy.WithTierRateLimits(tierRateLimits(cfg.TierRateLimits, cfg.Tiers)),
+		proxy.WithTiers(tiers(cfg.Tiers)),
+		proxy.WithChaos(proxy.Chaos(cfg.Chaos)),
+		proxy.WithJWT(proxy.JWT(cfg.JWT)),
+		proxy.WithAdminAPIKey(cfg.AdminApiKey),
+		proxy.WithDebugEndpoints(cfg.DebugEndpoints),
+		proxy.WithTimeout(v.GetDuration("timeout")),
+		proxy.WithHealthCheck(
+			v.GetDuration("health_check#interval"),
+			v.GetDuration("health_check#timeout"),
+		),
+		proxy.WithBatches(cfg.Batches.Dir, cfg.Batches.Concurrency),
+		proxy.WithPathPrefixes(cfg.PathPrefixes...),
+		proxy.WithMaxRequestBodySize(cfg.MaxRequestBodySize),
+		proxy.WithCompression(proxy.Compression(cfg.Compression)),
+		proxy.WithAudit(cfg.Audit.Path, cfg.Audit.Redact...),
+		proxy.WithUsage(cfg.Usage.DB, pricing(cfg.Usage.Pricing)),
+		proxy.WithBudgets(budgets(cfg.Usage.Budgets)...),
+		proxy.WithWebhooks(webhooks(cfg.Webhooks)...),
+		proxy.WithSystemPrompt(cfg.SystemPrompt.Prepend, cfg.SystemPrompt.Append, systemPromptRules(cfg.SystemPrompt.Rules)...),
+		proxy.WithPromptVariables(cfg.SystemPrompt.Variables),
+		proxy.WithContentFilter(cfg.ContentFilter.BlockWith, cfg.ContentFilter.Responses, contentFilterRules(cfg.ContentFilter.Rules)...),
+		proxy.WithRedis(cfg.Redis.URL, cfg.Redis.Prefix),
+		proxy.WithDeduplication(cfg.Deduplicate),
+		proxy.WithCache(cfg.Cache.TTL),
+		proxy.WithSemanticCache(
+			embedder,
+			cfg.Cache.Semantic.Model,
+			cfg.Cache.Semantic.Threshold,
+			cfg.Cache.Semantic.MaxEntries,
+		),
+	}, nil
+}
+
+// newViper reads the config file at configPath, or config.yaml in the working
+// directory if it is empty, along with the environment and flags
+func newViper(configPath string) (*viper.Viper, error) {
 	// Have to use custom key delimiter to allow for models with periods in the name
 	v := viper.NewWithOptions(
 		viper.KeyDelimiter("#"),
 		viper.EnvKeyReplacer(strings.NewReplacer("#", "_")),
 	)
 
-	if configPath != nil && *configPath != "" {
-		v.SetConfigFile(*configPath)
+	if configPath != "" {
+		v.SetConfigFile(configPath)
 	} else {
 		v.SetConfigName("config")
 		v.SetConfigType("yaml")
 		v.AddConfigPath(".")
 	}
 
+	v.SetDefault("port", "9000")
+	v.SetDefault("log_level", "info")
+	v.SetDefault("timeout", "30s")
 	v.SetDefault("deepseek#default_model", deepseekconstants.DefaultChatModel)
 	v.SetDefault("deepseek#endpoint", deepseekconstants.DefaultEndpoint)
 	v.SetDefault("openrouter#default_model", openrouterconstants.DefaultModel)
 	v.SetDefault("openrouter#endpoint", openrouterconstants.DefaultEndpoint)
 	v.SetDefault("ollama#default_model", ollamaconstants.DefaultModel)
-
-	v.BindPFlags(pflag.CommandLine)
+	// DeepSeek only supports JSON mode, so strict schemas are emulated
+	v.SetDefault("deepseek#emulate_structured_outputs", true)
+	v.SetDefault("deepseek#fim", true)
+	v.SetDefault("openrouter#include_cost", true)
+	for _, name := range backendNames {
+		v.SetDefault(name+"#models_ttl", backend.DefaultModelsTTL.String())
+	}
+	v.SetDefault("path_prefixes", []string{"/openai"})
+	v.SetDefault("health_check#interval", "30s")
+	v.SetDefault("health_check#timeout", "5s")
+	v.SetDefault("streaming#heartbeat_interval", stream.DefaultHeartbeatInterval.String())
+	v.SetDefault("timeouts#max_stream", "10m")
+	v.SetDefault("redis#prefix", "cursor-deepseek:")
+	v.SetDefault("secrets#refresh_interval", "5m")
+	v.SetDefault("compression#enabled", true)
+	v.SetDefault("compression#min_size", 1024)
 
 	// Alias the previous env syntax to the new
 	v.BindEnv("ollama#endpoint", "OLLAMA_API_ENDPOINT")
 	v.AutomaticEnv()
 
-	err := v.ReadInConfig()
-	if err != nil {
-		err = errors.Wrap(err, "error reading config file")
-		log.Fatal(err)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrap(err, "error reading config file")
 	}
+	return v, nil
+}
 
+// loadConfig resolves the secrets the config references and unmarshals it
+func loadConfig(ctx context.Context, v *viper.Viper) (config, error) {
 	var cfg config
-	if err = v.Unmarshal(&cfg); err != nil {
-		err = errors.Wrap(err, "error unmarshaling config")
-		log.Fatal(err)
-	}
-
-	be, apikey := getBackendAndApiKey(v)
-	svr, err := server.New(ctx, server.Options{
-		Port:     cfg.Port,
-		Backend:  be,
-		ApiKey:   apikey,
-		LogLevel: cfg.Loglevel,
-		Timeout:  cfg.Timeout,
-		ExitCh:   exitCh,
-	})
+	refs, err := resolveSecrets(ctx, v)
 	if err != nil {
-		log.Fatalf("unable to start server %s", err.Error())
+		return cfg, errors.Wrap(err, "error resolving secrets")
+	}
+	if err := v.Unmarshal(&cfg); err != nil {
+		return cfg, errors.Wrap(err, "error unmarshaling config")
+	}
+	cfg.secrets = refs
+	return cfg, nil
+}
+
+// heartbeatInterval is the configured heartbeat interval of streams, where 0
+// disables heartbeats
+func heartbeatInterval(v *viper.Viper) time.Duration {
+	interval := v.GetDuration("streaming#heartbeat_interval")
+	if interval <= 0 {
+		return -1
+	}
+	return interval
+}
+
+func logSinks(configs []LogSinkConfig) []proxy.LogSink {
+	sinks := make([]proxy.LogSink, 0, len(configs))
+	for _, c := range configs {
+		sinks = append(sinks, proxy.LogSink{
+			Type:       c.Type,
+			Path:       c.Path,
+			MaxSize:    int64(c.MaxSizeMB) << 20,
+			MaxAge:     time.Duration(c.MaxAgeDays) * 24 * time.Hour,
+			MaxBackups: c.MaxBackups,
+			Network:    c.Network,
+			Address:    c.Address,
+			Tag:        c.Tag,
+		})
 	}
+	return sinks
+}
 
-	go func() {
-		if err := svr.Start(); err != nil {
-			exitCh <- err.Error()
+func pricing(configs map[string]PriceConfig) map[string]proxy.Price {
+	prices := make(map[string]proxy.Price, len(configs))
+	for model, c := range configs {
+		prices[model] = proxy.Price{
+			Prompt:     c.Prompt,
+			Completion: c.Completion,
 		}
-	}()
+	}
+	return prices
+}
+
+func budgets(configs []BudgetConfig) []proxy.Budget {
+	budgets := make([]proxy.Budget, 0, len(configs))
+	for _, c := range configs {
+		budgets = append(budgets, proxy.Budget{
+			APIKey:          c.ApiKey,
+			Client:          c.Client,
+			Period:          c.Period,
+			MaxTokens:       c.MaxTokens,
+			MaxCost:         c.MaxCost,
+			AlertThresholds: c.AlertThresholds,
+		})
+	}
+	return budgets
+}
 
-	select {
-	case s := <-exitCh:
-		log.Fatalf("killed with message %s", s)
-	case <-ctx.Done():
-		log.Fatal("context cancelled")
+func clients(configs []ClientConfig) []proxy.Client {
+	clients := make([]proxy.Client, 0, len(configs))
+	for _, c := range configs {
+		clients = append(clients, proxy.Client{
+			Name:      c.Name,
+			Key:       c.Key,
+			KeyHash:   c.KeyHash,
+			ExpiresAt: c.ExpiresAt,
+			RateLimit: proxy.RateLimit(c.RateLimit),
+			Tier:      c.Tier,
+		})
 	}
+	return clients
+}
 
+// tierRateLimits returns the rate limits of tier_rate_limits, overridden by
+// those of the tiers which set one
+func tierRateLimits(configs map[string]RateLimitConfig, tiers map[string]TierConfig) map[string]proxy.RateLimit {
+	limits := make(map[string]proxy.RateLimit, len(configs)+len(tiers))
+	for tier, c := range configs {
+		limits[tier] = proxy.RateLimit(c)
+	}
+	for tier, c := range tiers {
+		if c.RateLimit != (RateLimitConfig{}) {
+			limits[tier] = proxy.RateLimit(c.RateLimit)
+		}
+	}
+	return limits
 }
 
-func getBackendAndApiKey(v *viper.Viper) (backend.Backend, string) {
-	var be backend.Backend
-	var apikey string
+func tiers(configs map[string]TierConfig) map[string]proxy.Tier {
+	tiers := make(map[string]proxy.Tier, len(configs))
+	for tier, c := range configs {
+		tiers[tier] = proxy.Tier{
+			Models:    proxy.ModelFilter{Allow: c.AllowModels, Deny: c.DenyModels},
+			MaxTokens: c.MaxTokens,
+			Priority:  c.Priority,
+		}
+	}
+	return tiers
+}
+
+func webhooks(configs []WebhookConfig) []proxy.Webhook {
+	hooks := make([]proxy.Webhook, 0, len(configs))
+	for _, c := range configs {
+		hooks = append(hooks, proxy.Webhook{
+			URL:        c.URL,
+			Secret:     c.Secret,
+			Events:     c.Events,
+			MaxRetries: c.MaxRetries,
+			Timeout:    c.Timeout,
+		})
+	}
+	return hooks
+}
+
+func systemPromptRules(configs []SystemPromptRuleConfig) []proxy.SystemPromptRule {
+	rules := make([]proxy.SystemPromptRule, 0, len(configs))
+	for _, c := range configs {
+		rules = append(rules, proxy.SystemPromptRule(c))
+	}
+	return rules
+}
+
+func contentFilterRules(configs []ContentFilterRuleConfig) []proxy.ContentFilterRule {
+	rules := make([]proxy.ContentFilterRule, 0, len(configs))
+	for _, c := range configs {
+		rules = append(rules, proxy.ContentFilterRule(c))
+	}
+	return rules
+}
+
+func getBackendAndApiKey(v *viper.Viper, cfg config) (backend.Backend, string, error) {
+	cfg.limiters = &backendLimiters{}
+	be, apikey, err := getPrimaryBackendAndApiKey(v, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	if be, err = withFeatures(v, cfg, be); err != nil {
+		return nil, "", err
+	}
+	return newSwitch(v, cfg, be), apikey, nil
+}
+
+// withFeatures layers the features of the config, such as the clients' own
+// upstreams, hedging and model aliases, over the primary backend
+func withFeatures(v *viper.Viper, cfg config, primary backend.Backend) (backend.Backend, error) {
+	// Hedges and canaries use the shared upstream credentials, so they only
+	// wrap the backend of the clients without their own upstream
+	be := primary
+	var err error
+	if cfg.Hedging.Delay > 0 {
+		var hedge backend.Backend
+		if cfg.Hedging.Backend != "" {
+			if hedge, _, err = newBackend(v, cfg, cfg.Hedging.Backend); err != nil {
+				return nil, err
+			}
+		}
+		be = router.NewHedge(router.HedgeOptions{
+			Primary: be,
+			Backend: hedge,
+			Delay:   cfg.Hedging.Delay,
+		})
+	}
+	if cfg.Canary.Percent > 0 {
+		var canary backend.Backend
+		if cfg.Canary.Backend != "" {
+			if canary, _, err = newBackend(v, cfg, cfg.Canary.Backend); err != nil {
+				return nil, err
+			}
+		}
+		be = router.NewCanary(router.CanaryOptions{
+			Primary: be,
+			Canary:  canary,
+			Model:   cfg.Canary.Model,
+			Percent: cfg.Canary.Percent,
+		})
+	}
+	if be, err = newClientBackends(v, cfg, be); err != nil {
+		return nil, err
+	}
+	if len(cfg.ModelAliases) > 0 {
+		if be, err = newAliases(v, cfg, be); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.ContextWindow.Models) > 0 || cfg.ContextWindow.Default.Tokens > 0 {
+		var summarizer backend.Backend
+		if cfg.ContextWindow.Summarize.Model != "" {
+			summarizer = be
+			if cfg.ContextWindow.Summarize.Backend != "" {
+				if summarizer, _, err = newBackend(v, cfg, cfg.ContextWindow.Summarize.Backend); err != nil {
+					return nil, err
+				}
+			}
+		}
+		windows := make(map[string]contextwindow.Window, len(cfg.ContextWindow.Models))
+		for model, c := range cfg.ContextWindow.Models {
+			windows[model] = contextwindow.Window(c)
+		}
+		be = contextwindow.New(contextwindow.Options{
+			Backend:      be,
+			Windows:      windows,
+			Default:      contextwindow.Window(cfg.ContextWindow.Default),
+			Reserve:      cfg.ContextWindow.Reserve,
+			Summarizer:   summarizer,
+			SummaryModel: cfg.ContextWindow.Summarize.Model,
+		})
+	}
+	if cfg.Continuation.MaxContinuations > 0 {
+		// Continuations are trimmed to the context window like any request
+		be = continuation.New(continuation.Options{
+			Backend:          be,
+			MaxContinuations: cfg.Continuation.MaxContinuations,
+		})
+	}
+	return be, nil
+}
+
+// newClientBackends wraps the backend of the other clients with the backends
+// of the clients bound to their own upstream, if any
+func newClientBackends(v *viper.Viper, cfg config, primary backend.Backend) (backend.Backend, error) {
+	backends := map[string]backend.Backend{}
+	for i, client := range cfg.Clients {
+		if client.Upstream.Backend == "" {
+			continue
+		}
+		be, err := newClientBackend(v, cfg, fmt.Sprintf("clients[%d].upstream", i), client.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		backends[client.Name] = be
+	}
+	if len(backends) == 0 {
+		return primary, nil
+	}
+	return router.NewClients(router.ClientsOptions{Default: primary, Backends: backends}), nil
+}
+
+// newClientBackend creates the backend of a client bound to its own upstream,
+// at path in the config, with the settings of the backend it names which it
+// doesn't override
+func newClientBackend(v *viper.Viper, cfg config, path string, upstream ClientUpstreamConfig) (backend.Backend, error) {
+	name := upstream.Backend
+	bcfg, ok := cfg.backendConfig(name)
+	if !ok {
+		return nil, errors.Errorf("%s.backend: unknown backend %s", path, name)
+	}
+	settings := backendSettings(v, name)
+	if upstream.Endpoint != "" {
+		settings.endpoint = upstream.Endpoint
+		bcfg.Endpoints = nil
+	}
+	if upstream.Apikey != "" {
+		settings.apikey = upstream.Apikey
+	}
+	if upstream.DefaultModel != "" {
+		settings.defaultModel = upstream.DefaultModel
+	}
+	if upstream.Models != nil {
+		settings.models = upstream.Models
+	}
+	if upstream.AllowModels != nil {
+		bcfg.AllowModels = upstream.AllowModels
+	}
+	if upstream.DenyModels != nil {
+		bcfg.DenyModels = upstream.DenyModels
+	}
+	be, err := newUpstreamWith(v, cfg, name, bcfg, settings)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	cfg.secrets.watch(path, be, settings.apikey)
+	return withBackendFeatures(cfg, name, bcfg, be), nil
+}
+
+// newSwitch wraps the configured backends with a switch, which the admin API
+// points at another backend with a config, or another default model, such as
+// during an outage of the provider. The backends switched to are created when
+// they are first switched to, with the same features as the primary backend.
+func newSwitch(v *viper.Viper, cfg config, primary backend.Backend) backend.Backend {
+	return router.NewSwitch(router.SwitchOptions{
+		Primary:  primary,
+		Backends: configuredBackends(v),
+		New: func(name string) (backend.Backend, error) {
+			be, _, err := newBackend(v, cfg, name)
+			if err != nil {
+				return nil, err
+			}
+			return withFeatures(v, cfg, be)
+		},
+	})
+}
+
+// configuredBackends returns the names of the backends with a config
+func configuredBackends(v *viper.Viper) []string {
+	var names []string
+	for _, name := range backendNames {
+		if isConfigured(v, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// isConfigured is whether the named backend has a config, which requires an
+// API key, or endpoints for Ollama
+func isConfigured(v *viper.Viper, name string) bool {
+	if name == "ollama" {
+		return v.IsSet("ollama#endpoint") || v.IsSet("ollama#endpoints")
+	}
+	return v.IsSet(name + "#api_key")
+}
+
+func getPrimaryBackendAndApiKey(v *viper.Viper, cfg config) (backend.Backend, string, error) {
+	if len(cfg.Routing.Backends) > 0 {
+		return getRouterAndApiKey(v, cfg)
+	}
+
 	switch {
-	case v.IsSet("deepseek#api_key"):
-		apikey = v.GetString("deepseek#api_key")
+	case isConfigured(v, "deepseek"):
+		return newBackend(v, cfg, "deepseek")
+	case isConfigured(v, "openrouter"):
+		return newBackend(v, cfg, "openrouter")
+	case isConfigured(v, "ollama"):
+		return newBackend(v, cfg, "ollama")
+	default:
+		return nil, "", errors.New("unable to determine backend")
+	}
+}
+
+// getRouterAndApiKey builds every backend listed in the routing config and
+// wraps them in a router. The API key of the first backend is used for auth.
+func getRouterAndApiKey(v *viper.Viper, cfg config) (backend.Backend, string, error) {
+	backends := make([]backend.Backend, 0, len(cfg.Routing.Backends))
+	var apikey string
+	for i, name := range cfg.Routing.Backends {
+		be, key, err := newBackend(v, cfg, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if i == 0 {
+			apikey = key
+		}
+		backends = append(backends, be)
+	}
+	return router.New(router.Options{
+		Backends: backends,
+		Policy:   cfg.Routing.Policy,
+	}), apikey, nil
+}
+
+func newBackend(v *viper.Viper, cfg config, name string) (backend.Backend, string, error) {
+	be, apikey, bcfg, err := newUpstream(v, cfg, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return withBackendFeatures(cfg, name, bcfg, be), apikey, nil
+}
+
+// withBackendFeatures layers the features configured for the named backend
+// over it
+func withBackendFeatures(cfg config, name string, bcfg BackendConfig, be backend.Backend) backend.Backend {
+	if bcfg.EmulateStructuredOutputs {
+		be = structured.New(structured.Options{
+			Backend:     be,
+			MaxAttempts: cfg.StructuredOutputs.MaxAttempts,
+		})
+	}
+	if bcfg.Concurrency.MaxConcurrent > 0 {
+		be = cfg.limiters.limit(name, bcfg.Concurrency, be)
+	}
+	return be
+}
+
+// backendLimiters are the concurrency limits of the backends, one for each
+// backend however many times it is built, such as for routing and hedging,
+// so that its requests all draw on the same budget
+type backendLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*limiter.Limiter
+}
+
+// limit wraps be with the concurrency limit of the named backend, created
+// the first time it is used
+func (l *backendLimiters) limit(name string, c ConcurrencyConfig, be backend.Backend) backend.Backend {
+	if l == nil {
+		return limiter.New(c.options(be))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lim, ok := l.limiters[name]; ok {
+		return lim.With(be)
+	}
+	if l.limiters == nil {
+		l.limiters = map[string]*limiter.Limiter{}
+	}
+	lim := limiter.New(c.options(be))
+	l.limiters[name] = lim
+	return lim
+}
+
+func (c ConcurrencyConfig) options(be backend.Backend) limiter.Options {
+	return limiter.Options{
+		Backend:       be,
+		MaxConcurrent: c.MaxConcurrent,
+		MaxQueue:      c.MaxQueue,
+		QueueTimeout:  c.QueueTimeout,
+	}
+}
+
+// upstreamSettings are the settings of a backend's upstream which clients may
+// override with their own
+type upstreamSettings struct {
+	endpoint     string
+	apikey       string
+	defaultModel string
+	models       map[string]string
+}
+
+// backendSettings returns the upstream settings of the named backend
+func backendSettings(v *viper.Viper, name string) upstreamSettings {
+	return upstreamSettings{
+		endpoint:     v.GetString(name + "#endpoint"),
+		apikey:       v.GetString(name + "#api_key"),
+		defaultModel: v.GetString(name + "#default_model"),
+		models:       v.GetStringMapString(name + "#models"),
+	}
+}
+
+// newUpstream creates the named backend, without the features layered over
+// it, along with its API key and config
+func newUpstream(v *viper.Viper, cfg config, name string) (backend.Backend, string, BackendConfig, error) {
+	bcfg, ok := cfg.backendConfig(name)
+	if !ok {
+		return nil, "", bcfg, errors.Errorf("unknown backend %s", name)
+	}
+	settings := backendSettings(v, name)
+	be, err := newUpstreamWith(v, cfg, name, bcfg, settings)
+	if err != nil {
+		return nil, "", bcfg, err
+	}
+	cfg.secrets.watch(name, be, settings.apikey)
+	return be, settings.apikey, bcfg, nil
+}
+
+// newUpstreamWith creates the named backend with its config and upstream
+// settings
+func newUpstreamWith(v *viper.Viper, cfg config, name string, bcfg BackendConfig, settings upstreamSettings) (backend.Backend, error) {
+	var be backend.Backend
+	if err := balancer.ValidateTargets(balancer.Targets(settings.endpoint, bcfg.targets())); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s endpoints", name)
+	}
+	transport, err := bcfg.transport(name, cfg.OutboundProxy, cfg.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+	if transport.Recording, err = cfg.Recording.recording(name); err != nil {
+		return nil, err
+	}
+	switch name {
+	case "deepseek":
 		be = deepseek.NewDeepseekBackend(deepseek.Options{
-			Endpoint:     v.GetString("deepseek#endpoint"),
-			DefaultModel: v.GetString("deepseek#default_model"),
-			Models:       v.GetStringMapString("deepseek#models"),
-			ApiKey:       apikey,
+			Endpoint:     settings.endpoint,
+			Endpoints:    bcfg.targets(),
+			DefaultModel: settings.defaultModel,
+			Models:       settings.models,
+			ApiKey:       settings.apikey,
 			Timeout:      v.GetDuration("timeout"),
+			Timeouts:     bcfg.Timeouts.merge(cfg.Timeouts).timeouts(),
+			Heartbeat:    heartbeatInterval(v),
+			IdleTimeout:  v.GetDuration("streaming#idle_timeout"),
+			ModelFilter:  bcfg.modelFilter(),
+			Transport:    transport,
+			Retry:        bcfg.Retry.retry(),
+			ModelsTTL:    v.GetDuration("deepseek#models_ttl"),
+
+			Passthrough:          bcfg.Passthrough,
+			ModelParams:          cfg.modelParams(),
+			UnsupportedParams:    bcfg.UnsupportedParams,
+			StrippedParamsHeader: cfg.StrippedParamsHeader,
+
+			InlineReasoning:   bcfg.InlineReasoning,
+			FIM:               bcfg.FIM,
+			StreamPassthrough: bcfg.StreamPassthrough,
 		})
-	case v.IsSet("openrouter#api_key"):
-		apikey = v.GetString("openrouter#api_key")
+	case "openrouter":
 		be = openrouter.NewOpenrouterBackend(openrouter.Options{
-			Endpoint:     v.GetString("openrouter#endpoint"),
-			DefaultModel: v.GetString("openrouter#default_model"),
-			Models:       v.GetStringMapString("openrouter#models"),
-			ApiKey:       apikey,
+			Endpoint:     settings.endpoint,
+			Endpoints:    bcfg.targets(),
+			DefaultModel: settings.defaultModel,
+			Models:       settings.models,
+			ApiKey:       settings.apikey,
 			Timeout:      v.GetDuration("timeout"),
+			Timeouts:     bcfg.Timeouts.merge(cfg.Timeouts).timeouts(),
+			Heartbeat:    heartbeatInterval(v),
+			IdleTimeout:  v.GetDuration("streaming#idle_timeout"),
+			ModelFilter:  bcfg.modelFilter(),
+			Transport:    transport,
+			Retry:        bcfg.Retry.retry(),
+			ModelsTTL:    v.GetDuration("openrouter#models_ttl"),
+
+			Passthrough:          bcfg.Passthrough,
+			ModelParams:          cfg.modelParams(),
+			UnsupportedParams:    bcfg.UnsupportedParams,
+			StrippedParamsHeader: cfg.StrippedParamsHeader,
+			KeepAliveComments:    bcfg.KeepAliveComments,
+			IncludeCost:          bcfg.IncludeCost,
 		})
-	case v.IsSet("ollama#endpoint"):
-		apikey = v.GetString("ollama#api_key")
+	case "ollama":
 		be = ollama.NewOllamaBackend(ollama.Options{
-			Endpoint:     v.GetString("ollama#endpoint"),
-			DefaultModel: v.GetString("ollama#default_model"),
-			Models:       v.GetStringMapString("ollama#models"),
-			ApiKey:       apikey,
+			Endpoint:     settings.endpoint,
+			Endpoints:    bcfg.targets(),
+			DefaultModel: settings.defaultModel,
+			Models:       settings.models,
+			ApiKey:       settings.apikey,
 			Timeout:      v.GetDuration("timeout"),
+			Timeouts:     bcfg.Timeouts.merge(cfg.Timeouts).timeouts(),
+			Heartbeat:    heartbeatInterval(v),
+			IdleTimeout:  v.GetDuration("streaming#idle_timeout"),
+			ModelFilter:  bcfg.modelFilter(),
+			Transport:    transport,
+			Retry:        bcfg.Retry.retry(),
+			ModelsTTL:    v.GetDuration("ollama#models_ttl"),
+
+			ModelParams:          cfg.modelParams(),
+			UnsupportedParams:    bcfg.UnsupportedParams,
+			StrippedParamsHeader: cfg.StrippedParamsHeader,
+			DefaultOptions:       bcfg.Options.options(),
+			ThinkTags:            bcfg.ThinkTags,
 		})
-	default:
-		log.Fatal("unable to determine backend")
 	}
-	return be, apikey
+	return be, nil
+}
+
+// backendConfig returns the config of the named backend
+func (cfg config) backendConfig(name string) (BackendConfig, bool) {
+	switch name {
+	case "deepseek":
+		return cfg.Deepseek, true
+	case "openrouter":
+		return cfg.Openrouter, true
+	case "ollama":
+		return cfg.Ollama, true
+	}
+	return BackendConfig{}, false
+}
+
+// newAliases wraps the primary backend with the model aliases, creating the
+// backends their targets name
+func newAliases(v *viper.Viper, cfg config, primary backend.Backend) (backend.Backend, error) {
+	backends := map[string]backend.Backend{}
+	rules := make([]router.AliasRule, 0, len(cfg.ModelAliases))
+	for _, alias := range cfg.ModelAliases {
+		rule := router.AliasRule{Pattern: alias.Pattern, Regex: alias.Regex, Model: alias.Target}
+		// Ollama models contain colons too, so only the names of backends are
+		// read as a prefix
+		if name, model, ok := strings.Cut(alias.Target, ":"); ok && slices.Contains(backendNames, name) {
+			if backends[name] == nil {
+				be, _, err := newBackend(v, cfg, name)
+				if err != nil {
+					return nil, err
+				}
+				backends[name] = be
+			}
+			rule.Backend, rule.Model = backends[name], model
+		}
+		rules = append(rules, rule)
+	}
+	aliases, err := router.NewAliases(router.AliasOptions{Primary: primary, Rules: rules})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid model_aliases config")
+	}
+	return aliases, nil
+}
+
+// newEmbedder creates the backend the semantic cache embeds text with, if it
+// is enabled
+func newEmbedder(v *viper.Viper, cfg config, semantic SemanticCacheConfig) (backend.Embedder, error) {
+	if semantic.Backend == "" {
+		return nil, nil
+	}
+	if semantic.Model == "" {
+		return nil, errors.New("invalid cache config: semantic requires an embedding model")
+	}
+	be, _, _, err := newUpstream(v, cfg, semantic.Backend)
+	if err != nil {
+		return nil, err
+	}
+	embedder, ok := be.(backend.Embedder)
+	if !ok {
+		return nil, errors.Errorf("invalid cache config: backend %s can't embed text", semantic.Backend)
+	}
+	return embedder, nil
+}
+
+func (c BackendConfig) targets() []balancer.Target {
+	targets := make([]balancer.Target, 0, len(c.Endpoints))
+	for _, ep := range c.Endpoints {
+		targets = append(targets, balancer.Target{
+			URL:    ep.URL,
+			Weight: ep.Weight,
+		})
+	}
+	return targets
+}
+
+// transport configures the connections to the upstream of the named backend,
+// through its own outbound proxy or else the global one
+func (c BackendConfig) transport(name, outboundProxy string, timeouts TimeoutsConfig) (backend.Transport, error) {
+	if err := backend.ValidateProtocol(c.Protocol); err != nil {
+		return backend.Transport{}, errors.Wrapf(err, "invalid %s config", name)
+	}
+	tlsConfig, err := backend.NewTLSConfig(c.TLS.CAFile, c.TLS.CertFile, c.TLS.KeyFile, c.TLS.InsecureSkipVerify)
+	if err != nil {
+		return backend.Transport{}, errors.Wrapf(err, "invalid %s config", name)
+	}
+	if c.TLS.InsecureSkipVerify {
+		log.Printf("warning: the certificates of the %s upstream are not verified", name)
+	}
+	if c.OutboundProxy != "" {
+		outboundProxy = c.OutboundProxy
+	}
+	if _, err := backend.ParseProxy(outboundProxy); err != nil {
+		return backend.Transport{}, errors.Wrapf(err, "invalid %s config", name)
+	}
+	timeouts = c.Timeouts.merge(timeouts)
+	return backend.Transport{
+		Pool:           c.Connections.connPool(),
+		Protocol:       c.Protocol,
+		TLSConfig:      tlsConfig,
+		Proxy:          outboundProxy,
+		ConnectTimeout: timeouts.Connect,
+		HeaderTimeout:  timeouts.Header,
+	}, nil
+}
+
+// merge returns the timeouts with those unset taken from defaults
+func (c TimeoutsConfig) merge(defaults TimeoutsConfig) TimeoutsConfig {
+	or := func(d, def time.Duration) time.Duration {
+		if d == 0 {
+			return def
+		}
+		return d
+	}
+	return TimeoutsConfig{
+		Connect:    or(c.Connect, defaults.Connect),
+		Header:     or(c.Header, defaults.Header),
+		FirstToken: or(c.FirstToken, defaults.FirstToken),
+		Total:      or(c.Total, defaults.Total),
+		MaxStream:  or(c.MaxStream, defaults.MaxStream),
+	}
+}
+
+func (c TimeoutsConfig) timeouts() backend.Timeouts {
+	return backend.Timeouts{
+		Total:      c.Total,
+		MaxStream:  c.MaxStream,
+		FirstToken: c.FirstToken,
+	}
+}
+
+func (c RetryConfig) retry() backend.Retry {
+	return backend.Retry{
+		MaxAttempts: c.MaxAttempts,
+		Backoff:     c.Backoff,
+		MaxBackoff:  c.MaxBackoff,
+		Jitter:      c.Jitter,
+		StatusCodes: c.StatusCodes,
+	}
+}
+
+func (c ConnectionsConfig) connPool() backend.ConnPool {
+	return backend.ConnPool{
+		MaxIdleConns:         c.MaxIdle,
+		MaxIdleConnsPerHost:  c.MaxIdlePerHost,
+		MaxConnsPerHost:      c.MaxPerHost,
+		IdleConnTimeout:      c.IdleTimeout,
+		HTTP2ReadIdleTimeout: c.HTTP2ReadIdleTimeout,
+		HTTP2PingTimeout:     c.HTTP2PingTimeout,
+	}
+}
+
+func (c BackendConfig) modelFilter() backend.ModelFilter {
+	return backend.ModelFilter{
+		Allow: c.AllowModels,
+		Deny:  c.DenyModels,
+	}
+}
+
+func (c OllamaOptionsConfig) options() ollamaapi.Options {
+	return ollamaapi.Options{
+		NumPredict:    c.NumPredict,
+		NumCtx:        c.NumCtx,
+		TopK:          c.TopK,
+		TopP:          c.TopP,
+		Temperature:   c.Temperature,
+		RepeatPenalty: c.RepeatPenalty,
+		Stop:          c.Stop,
+		Seed:          c.Seed,
+	}
+}
+
+// modelParams returns the default parameters and caps of the models
+func (c config) modelParams() map[string]backend.ModelParams {
+	params := make(map[string]backend.ModelParams, len(c.Models))
+	for model, m := range c.Models {
+		params[model] = backend.ModelParams{
+			Temperature:      m.Temperature,
+			TopP:             m.TopP,
+			MaxTokens:        m.MaxTokens,
+			FrequencyPenalty: m.FrequencyPenalty,
+			PresencePenalty:  m.PresencePenalty,
+			TemperatureCap:   m.TemperatureCap,
+			TopPCap:          m.TopPCap,
+			MaxTokensCap:     m.MaxTokensCap,
+		}
+	}
+	return params
 }
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/pkg/proxy"
+	"github.com/pkg/errors"
+)
+
+func hashKeyCommand() *command {
+	flags, _ := newFlags("hash-key")
+	return &command{
+		name:  "hash-key",
+		short: "Hash a client API key read from stdin, for its key_hash",
+		flags: flags,
+		run: func(context.Context) error {
+			return printKeyHash()
+		},
+	}
+}
+
+// printKeyHash prints the hash of the client API key read from stdin
+func printKeyHash() error {
+	key, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return errors.Wrap(err, "error reading API key")
+	}
+	hash, err := proxy.HashKey(strings.TrimSpace(string(key)))
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	deepseekconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/deepseek"
+	ollamaconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/ollama"
+	openrouterconstants "github.com/danilofalcao/cursor-deepseek/internal/constants/openrouter"
+	"github.com/pkg/errors"
+)
+
+// initOptions configures the init command. The values which aren't set are
+// asked for when stdin is a terminal.
+type initOptions struct {
+	configPath     string
+	backends       []string
+	deepseekKey    string
+	openrouterKey  string
+	ollamaEndpoint string
+	port           string
+	publicURL      string
+	force          bool
+	noProbe        bool
+}
+
+func initCommand() *command {
+	flags, configPath := newFlags("init")
+	opts := initOptions{}
+	flags.StringSliceVar(&opts.backends, "backend", nil, "the backends to configure, deepseek, openrouter or ollama, the first serving requests and the others taking over when it fails")
+	flags.StringVar(&opts.deepseekKey, "deepseek-api-key", "", "the DeepSeek API key")
+	flags.StringVar(&opts.openrouterKey, "openrouter-api-key", "", "the OpenRouter API key")
+	flags.StringVar(&opts.ollamaEndpoint, "ollama-endpoint", "", "the Ollama API endpoint, such as http://127.0.0.1:11434/api")
+	flags.StringVar(&opts.port, "port", "", "the port the proxy serves on (default 9000)")
+	flags.StringVar(&opts.publicURL, "public-url", "", "the public URL Cursor reaches the proxy at, such as an ngrok URL")
+	flags.BoolVar(&opts.force, "force", false, "overwrites the config file if it exists")
+	flags.BoolVar(&opts.noProbe, "no-probe", false, "doesn't check that the upstreams accept their API keys")
+	return &command{
+		name:  "init",
+		short: "Write a starter config for the chosen backends",
+		flags: flags,
+		run: func(ctx context.Context) error {
+			opts.configPath = *configPath
+			return initConfig(ctx, opts)
+		},
+	}
+}
+
+// initBackend is a backend of the starter config
+type initBackend struct {
+	Name         string
+	Endpoint     string
+	APIKey       string
+	DefaultModel string
+}
+
+// initConfig writes a starter config, checks it along with the API keys, and
+// prints the settings Cursor is configured with
+func initConfig(ctx context.Context, opts initOptions) error {
+	if opts.configPath == "" {
+		opts.configPath = "config.yaml"
+	}
+	if _, err := os.Stat(opts.configPath); err == nil && !opts.force {
+		return errors.Errorf("%s already exists, use --force to overwrite it", opts.configPath)
+	}
+
+	p := newPrompter(os.Stdin)
+	if len(opts.backends) == 0 {
+		answer := p.ask("Backends, the first serving requests and the others taking over when it fails", "deepseek")
+		for _, name := range strings.Split(answer, ",") {
+			opts.backends = append(opts.backends, strings.TrimSpace(name))
+		}
+	}
+	var backends []initBackend
+	for _, name := range opts.backends {
+		if !slices.Contains(backendNames, name) {
+			return errors.Errorf("unknown backend %q, expected one of %s", name, strings.Join(backendNames, ", "))
+		}
+		switch name {
+		case "deepseek":
+			backends = append(backends, initBackend{
+				Name:         name,
+				APIKey:       p.require(opts.deepseekKey, "DeepSeek API key"),
+				DefaultModel: deepseekconstants.DefaultChatModel,
+			})
+		case "openrouter":
+			backends = append(backends, initBackend{
+				Name:         name,
+				APIKey:       p.require(opts.openrouterKey, "OpenRouter API key"),
+				DefaultModel: openrouterconstants.DefaultModel,
+			})
+		case "ollama":
+			endpoint := opts.ollamaEndpoint
+			if endpoint == "" {
+				endpoint = p.ask("Ollama API endpoint", "http://127.0.0.1:11434/api")
+			}
+			backends = append(backends, initBackend{
+				Name:         name,
+				Endpoint:     endpoint,
+				DefaultModel: ollamaconstants.DefaultModel,
+			})
+		}
+	}
+	for _, be := range backends {
+		if be.Name != "ollama" && be.APIKey == "" {
+			return errors.Errorf("the %s API key is required, set it with --%s-api-key", be.Name, be.Name)
+		}
+	}
+	if opts.port == "" {
+		opts.port = p.ask("Port", "9000")
+	}
+
+	clientKey, err := newClientKey()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := starterConfig.Execute(&buf, map[string]any{
+		"Port":      opts.port,
+		"ClientKey": clientKey,
+		"Backends":  backends,
+	}); err != nil {
+		return errors.Wrap(err, "error generating config")
+	}
+	if err := os.WriteFile(opts.configPath, buf.Bytes(), 0o600); err != nil {
+		return errors.Wrap(err, "error writing config")
+	}
+	fmt.Printf("Wrote %s\n", opts.configPath)
+
+	if err := validate(ctx, opts.configPath, !opts.noProbe); err != nil {
+		return errors.Wrap(err, "the config was written, but needs fixing")
+	}
+
+	baseURL := strings.TrimSuffix(opts.publicURL, "/")
+	if baseURL == "" {
+		baseURL = "http://localhost:" + opts.port
+	}
+	fmt.Printf(`
+Start the proxy with: proxy serve -c %s
+
+Then, in Cursor's settings, under Models:
+  1. Enable "Override OpenAI Base URL" and set it to %s/v1
+  2. Set the OpenAI API Key to %s
+  3. Add the models to use, such as gpt-4o, which the proxy sends to %s unless mapped in the config
+`, opts.configPath, baseURL, clientKey, backends[0].DefaultModel)
+	if opts.publicURL == "" {
+		fmt.Println(`
+Cursor calls the base URL from its own servers, so the proxy must be publicly reachable, such as through ngrok, and
+--public-url set to its public URL. See "Exposing the Endpoint Publicly" in the README.`)
+	}
+	return nil
+}
+
+// newClientKey generates the API key Cursor authenticates with
+func newClientKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating client API key")
+	}
+	return "sk-proxy-" + hex.EncodeToString(b), nil
+}
+
+// prompter asks for the values of the config when stdin is a terminal
+type prompter struct {
+	in          *bufio.Reader
+	interactive bool
+}
+
+func newPrompter(in *os.File) *prompter {
+	// /dev/null is a character device too
+	info, err := in.Stat()
+	null, nullErr := os.Stat(os.DevNull)
+	return &prompter{
+		in:          bufio.NewReader(in),
+		interactive: err == nil && info.Mode()&os.ModeCharDevice != 0 && (nullErr != nil || !os.SameFile(info, null)),
+	}
+}
+
+// ask asks for a value, returning def if none is entered or stdin isn't a
+// terminal
+func (p *prompter) ask(question, def string) string {
+	if !p.interactive {
+		return def
+	}
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := p.in.ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer == "" || (err != nil && err != io.EOF) {
+		return def
+	}
+	return answer
+}
+
+// require returns value, or else asks for it
+func (p *prompter) require(value, question string) string {
+	if value != "" {
+		return value
+	}
+	return p.ask(question, "")
+}
+
+// starterConfig is the config written by init
+var starterConfig = template.Must(template.New("config").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`# Generated by proxy init. See the README for every option, and check changes with: proxy validate
+port: {{quote .Port}}
+log_level: info # one of trace, debug, info, warn, error, fatal
+timeout: 60s
+
+# Cursor authenticates with this key, so the upstream API keys never leave the proxy
+clients:
+  - name: cursor
+    key: {{quote .ClientKey}}
+{{range .Backends}}
+{{.Name}}:
+{{- if .Endpoint}}
+  endpoint: {{quote .Endpoint}}
+{{- end}}
+{{- if .APIKey}}
+  api_key: {{quote .APIKey}} # or a reference such as ${ENV_VAR} or file:/run/secrets/key
+{{- end}}
+  default_model: {{quote .DefaultModel}} # serves the models requested which aren't mapped
+  # models: # maps the models Cursor requests to upstream models
+  #   gpt-4o: {{quote .DefaultModel}}
+{{end}}
+{{- if gt (len .Backends) 1}}
+# Requests are sent to the first backend, and to the others when it fails
+routing:
+  policy: first # or fastest
+  backends:
+{{- range .Backends}}
+    - {{.Name}}
+{{- end}}
+{{end -}}
+`))
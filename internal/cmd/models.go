@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/pkg/errors"
+)
+
+func modelsCommand() *command {
+	flags, configPath := newFlags("models")
+	asJSON := flags.Bool("json", false, "prints the models as JSON")
+	return &command{
+		name:  "models",
+		short: "List the models of the configured backend",
+		flags: flags,
+		run: func(ctx context.Context) error {
+			return listModels(ctx, *configPath, *asJSON)
+		},
+	}
+}
+
+// listModels prints the models the backend of the config at configPath
+// serves, as clients listing them would see them
+func listModels(ctx context.Context, configPath string, asJSON bool) error {
+	v, err := newViper(configPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(ctx, v)
+	if err != nil {
+		return err
+	}
+	be, _, err := getBackendAndApiKey(v, cfg)
+	if err != nil {
+		return err
+	}
+
+	models, err := be.ListModels(withCLILogger(ctx))
+	if err != nil {
+		return errors.Wrap(err, "error listing models")
+	}
+	slices.SortFunc(models, func(a, b openai.Model) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(models)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOWNED BY")
+	for _, model := range models {
+		fmt.Fprintf(w, "%s\t%s\n", model.ID, model.OwnedBy)
+	}
+	return w.Flush()
+}
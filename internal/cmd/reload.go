@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/pkg/proxy"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// reloadDelay is how long the config file must be left unchanged before it is
+// reloaded, as editors write files in several steps
+const reloadDelay = 250 * time.Millisecond
+
+// reloader reloads the config file when it changes or the process receives
+// SIGHUP, swapping the backends, clients, rate limits and log levels of the
+// proxy
+type reloader struct {
+	path  string
+	proxy *proxy.Proxy
+	// started is the config the proxy started with, whose settings which
+	// aren't reloaded are still in effect
+	started config
+
+	// stopRefresh stops refreshing the secrets of the current backends
+	stopRefresh context.CancelFunc
+}
+
+// run reloads the config until ctx is done
+func (r *reloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// The watcher only detects changes, the config is read afresh on reload
+	changed := make(chan struct{}, 1)
+	watcher := viper.New()
+	watcher.SetConfigFile(r.path)
+	watcher.OnConfigChange(func(fsnotify.Event) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	watcher.WatchConfig()
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("received SIGHUP, reloading config %s", r.path)
+			r.reload(ctx)
+		case <-changed:
+			delay = time.After(reloadDelay)
+		case <-delay:
+			log.Printf("config %s changed, reloading it", r.path)
+			r.reload(ctx)
+		}
+	}
+}
+
+// reload applies the config file to the proxy, keeping the current config if
+// it is invalid
+func (r *reloader) reload(ctx context.Context) {
+	if err := r.apply(ctx); err != nil {
+		log.Printf("error reloading config, keeping the current one: %v", err)
+	}
+}
+
+func (r *reloader) apply(ctx context.Context) error {
+	v, err := newViper(r.path)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(ctx, v)
+	if err != nil {
+		return err
+	}
+	be, apikey, err := getBackendAndApiKey(v, cfg)
+	if err != nil {
+		return err
+	}
+	err = r.proxy.Reload(
+		proxy.WithBackend(be),
+		proxy.WithAPIKey(apikey),
+		proxy.WithClients(clients(cfg.Clients)...),
+		proxy.WithRateLimit(proxy.RateLimit(cfg.RateLimit)),
+		proxy.WithTierRateLimits(tierRateLimits(cfg.TierRateLimits, cfg.Tiers)),
+		proxy.WithTiers(tiers(cfg.Tiers)),
+		proxy.WithChaos(proxy.Chaos(cfg.Chaos)),
+		proxy.WithLogLevel(cfg.Loglevel),
+		proxy.WithModuleLogLevels(cfg.LogLevels),
+	)
+	if err != nil {
+		return errors.Wrap(err, "error reloading proxy")
+	}
+	if changed := restartChanges(r.started, cfg); len(changed) > 0 {
+		log.Printf("warning: changes to %s take effect when the proxy is restarted", strings.Join(changed, ", "))
+	}
+	r.refresh(ctx, v, cfg)
+	return nil
+}
+
+// restartSettings are the settings which aren't reloaded, by their key
+var restartSettings = []struct {
+	key   string
+	value func(cfg config) any
+}{
+	{"port", func(cfg config) any { return cfg.Port }},
+	{"host", func(cfg config) any { return cfg.Host }},
+	{"listen", func(cfg config) any { return cfg.Listen }},
+	{"socket_mode", func(cfg config) any { return cfg.SocketMode }},
+	{"reuse_port", func(cfg config) any { return cfg.ReusePort }},
+	{"shutdown_timeout", func(cfg config) any { return cfg.ShutdownTimeout }},
+	{"server", func(cfg config) any { return cfg.Server }},
+	{"tls", func(cfg config) any { return cfg.TLS }},
+	{"networks", func(cfg config) any { return cfg.Networks }},
+	{"log_format", func(cfg config) any { return cfg.LogFormat }},
+	{"log_sinks", func(cfg config) any { return cfg.LogSinks }},
+	{"tracing", func(cfg config) any { return cfg.Tracing }},
+	{"timeout", func(cfg config) any { return cfg.Timeout }},
+	{"health_check", func(cfg config) any { return cfg.HealthCheck }},
+	{"jwt", func(cfg config) any { return cfg.JWT }},
+	{"admin_api_key", func(cfg config) any { return cfg.AdminApiKey }},
+	{"debug_endpoints", func(cfg config) any { return cfg.DebugEndpoints }},
+	{"batches", func(cfg config) any { return cfg.Batches }},
+	{"path_prefixes", func(cfg config) any { return cfg.PathPrefixes }},
+	{"max_request_body_size", func(cfg config) any { return cfg.MaxRequestBodySize }},
+	{"compression", func(cfg config) any { return cfg.Compression }},
+	{"audit", func(cfg config) any { return cfg.Audit }},
+	{"usage", func(cfg config) any { return cfg.Usage }},
+	{"webhooks", func(cfg config) any { return cfg.Webhooks }},
+	{"system_prompt", func(cfg config) any { return cfg.SystemPrompt }},
+	{"content_filter", func(cfg config) any { return cfg.ContentFilter }},
+	{"redis", func(cfg config) any { return cfg.Redis }},
+	{"deduplicate", func(cfg config) any { return cfg.Deduplicate }},
+	{"cache", func(cfg config) any { return cfg.Cache }},
+}
+
+// restartChanges returns the keys of the settings which aren't reloaded and
+// differ between the configs
+func restartChanges(old, new config) []string {
+	var changed []string
+	for _, setting := range restartSettings {
+		if !reflect.DeepEqual(setting.value(old), setting.value(new)) {
+			changed = append(changed, setting.key)
+		}
+	}
+	return changed
+}
+
+// refresh refreshes the secrets of the backends of cfg, instead of those of
+// the previous config
+func (r *reloader) refresh(ctx context.Context, v *viper.Viper, cfg config) {
+	if r.stopRefresh != nil {
+		r.stopRefresh()
+	}
+	ctx, r.stopRefresh = context.WithCancel(ctx)
+	go cfg.secrets.refresh(ctx, v.GetDuration("secrets#refresh_interval"))
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/secrets"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// secretsKey is the config section configuring the secret providers, whose
+// own values may only reference environment variables and files
+const secretsKey = "secrets"
+
+// envReference matches ${VAR} references to environment variables
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+type SecretsConfig struct {
+	// RefreshInterval is how often the upstream API keys are fetched again,
+	// so rotated keys are picked up, or 0 to never refresh them
+	RefreshInterval string      `mapstructure:"refresh_interval"`
+	Vault           VaultConfig `mapstructure:"vault"`
+	AWS             AWSConfig   `mapstructure:"aws"`
+}
+
+type VaultConfig struct {
+	// Address and Token default to VAULT_ADDR and VAULT_TOKEN
+	Address   string `mapstructure:"address"`
+	Token     string `mapstructure:"token"`
+	Namespace string `mapstructure:"namespace"`
+}
+
+type AWSConfig struct {
+	Region string `mapstructure:"region"`
+}
+
+// secretRefs are the references of the config values resolved from secret
+// providers, by their path, such as deepseek.api_key
+type secretRefs struct {
+	resolver *secrets.Resolver
+	refs     map[string]string
+
+	mu   sync.Mutex
+	keys []rotatingKey
+}
+
+// rotatingKey is a backend whose API key is refreshed from its reference
+type rotatingKey struct {
+	name    string
+	ref     string
+	backend backend.APIKeySetter
+	current string
+}
+
+// resolveSecrets replaces the references to secrets in the config's values by
+// the secrets, before the backends are constructed from them
+func resolveSecrets(ctx context.Context, v *viper.Viper) (*secretRefs, error) {
+	settings := v.AllSettings()
+
+	// The providers are configured by the secrets section, so it is resolved
+	// first
+	s := &secretRefs{resolver: secrets.NewResolver(), refs: map[string]string{}}
+	if value, ok := settings[secretsKey]; ok {
+		resolved, err := s.resolve(ctx, secretsKey, value)
+		if err != nil {
+			return nil, err
+		}
+		v.Set(secretsKey, resolved)
+	}
+	var cfg SecretsConfig
+	if err := v.UnmarshalKey(secretsKey, &cfg); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling secrets config")
+	}
+	s.resolver.Register("vault", &secrets.Vault{
+		Address:   firstNonEmpty(cfg.Vault.Address, os.Getenv("VAULT_ADDR")),
+		Token:     firstNonEmpty(cfg.Vault.Token, os.Getenv("VAULT_TOKEN")),
+		Namespace: firstNonEmpty(cfg.Vault.Namespace, os.Getenv("VAULT_NAMESPACE")),
+	})
+	s.resolver.Register("aws-sm", &secrets.AWS{Region: cfg.AWS.Region})
+	s.resolver.Register("gcp-sm", &secrets.GCP{})
+
+	for key, value := range settings {
+		if key == secretsKey {
+			continue
+		}
+		resolved, err := s.resolve(ctx, key, value)
+		if err != nil {
+			return nil, err
+		}
+		v.Set(key, resolved)
+	}
+	return s, nil
+}
+
+// resolve replaces the secret references in the value at path, descending
+// into maps and lists
+func (s *secretRefs) resolve(ctx context.Context, path string, value any) (any, error) {
+	switch value := value.(type) {
+	case string:
+		return s.resolveString(ctx, path, value)
+	case map[string]any:
+		resolved := make(map[string]any, len(value))
+		for k, v := range value {
+			r, err := s.resolve(ctx, path+"."+k, v)
+			if err != nil {
+				return nil, err
+			}
+			resolved[k] = r
+		}
+		return resolved, nil
+	case []any:
+		resolved := make([]any, len(value))
+		for i, v := range value {
+			r, err := s.resolve(ctx, fmt.Sprintf("%s[%d]", path, i), v)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	default:
+		return value, nil
+	}
+}
+
+// resolveString interpolates ${VAR} references to environment variables, and
+// fetches values prefixed by the scheme of a provider, such as file: or
+// vault:, from it
+func (s *secretRefs) resolveString(ctx context.Context, path, value string) (string, error) {
+	var missing []string
+	value = envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return env
+	})
+	if len(missing) > 0 {
+		return "", errors.Errorf("%s references unset environment variables %s", path, strings.Join(missing, ", "))
+	}
+
+	if !s.resolver.IsReference(value) {
+		return value, nil
+	}
+	secret, err := s.resolver.Resolve(ctx, value)
+	if err != nil {
+		return "", errors.Wrapf(err, "error resolving secret of %s", path)
+	}
+	s.refs[path] = value
+	return secret, nil
+}
+
+// watch refreshes the API key of the backend if it references a secret
+func (s *secretRefs) watch(name string, be backend.Backend, apikey string) {
+	ref, ok := s.refs[name+".api_key"]
+	setter, settable := be.(backend.APIKeySetter)
+	if !ok || !settable {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, rotatingKey{name: name, ref: ref, backend: setter, current: apikey})
+}
+
+// refresh fetches the watched API keys every interval until ctx is done,
+// replacing those which changed. A key which can't be fetched is kept. The
+// keys are read on every tick, as backends such as those switched to by model
+// are built, and watched, after refreshing starts.
+func (s *secretRefs) refresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		for i := range s.keys {
+			key := &s.keys[i]
+			secret, err := s.resolver.Resolve(ctx, key.ref)
+			if err != nil {
+				log.Printf("error refreshing API key of %s: %v", key.name, err)
+				continue
+			}
+			if secret != key.current {
+				key.backend.SetAPIKey(secret)
+				key.current = secret
+				log.Printf("rotated API key of %s", key.name)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
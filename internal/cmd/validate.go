@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/limiter"
+	"github.com/danilofalcao/cursor-deepseek/internal/router"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/middleware"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// probeTimeout bounds the probe of each upstream by validate
+const probeTimeout = 10 * time.Second
+
+// validate checks the config at configPath, and probes the upstreams of its
+// backends if probe is set, returning an error listing the problems found
+func validate(ctx context.Context, configPath string, probe bool) error {
+	v, err := newViper(configPath)
+	if err != nil {
+		return err
+	}
+	path := v.ConfigFileUsed()
+	cfg, err := loadConfig(ctx, v)
+	if err != nil {
+		return errors.Wrap(err, path)
+	}
+
+	names, problems := referencedBackends(v, cfg)
+	for _, name := range names {
+		problems = append(problems, checkBackend(v, cfg, name)...)
+	}
+	problems = append(problems, checkListen(cfg)...)
+	problems = append(problems, checkClients(v, cfg)...)
+	problems = append(problems, checkTiers(cfg)...)
+	if cfg.DebugEndpoints && cfg.AdminApiKey == "" {
+		problems = append(problems, "debug_endpoints requires admin_api_key, as client API keys can't read the profiles")
+	}
+	if cfg.Cache.Semantic.Backend != "" && cfg.Cache.Semantic.Model == "" {
+		problems = append(problems, "cache.semantic.model is required when cache.semantic.backend is set")
+	}
+	if err := middleware.Chaos(cfg.Chaos).Validate(); err != nil {
+		problems = append(problems, fmt.Sprintf("chaos: %v", err))
+	}
+	if _, err := cfg.Recording.recording(""); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := router.NewAliases(router.AliasOptions{Rules: aliasRules(cfg)}); err != nil {
+		problems = append(problems, fmt.Sprintf("model_aliases: %v", err))
+	}
+	// Building the backends checks what remains, such as their TLS files
+	if len(problems) == 0 {
+		if _, _, err := getBackendAndApiKey(v, cfg); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if probe && len(problems) == 0 {
+		for _, name := range names {
+			if problem := probeBackend(ctx, v, cfg, name); problem != "" {
+				problems = append(problems, problem)
+			} else {
+				fmt.Printf("%s: upstream reachable and API key accepted\n", name)
+			}
+		}
+		for i, client := range cfg.Clients {
+			if client.Upstream.Backend == "" {
+				continue
+			}
+			field := fmt.Sprintf("clients[%d].upstream", i)
+			if problem := probeClientUpstream(ctx, v, cfg, field, client.Upstream); problem != "" {
+				problems = append(problems, problem)
+			} else {
+				fmt.Printf("%s (%s): upstream reachable and API key accepted\n", field, client.Name)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("%s is invalid:\n  - %s", path, strings.Join(problems, "\n  - "))
+	}
+	fmt.Printf("%s is valid, serving backends %s\n", path, strings.Join(names, ", "))
+	return nil
+}
+
+// referencedBackends returns the names of the backends the config uses, the
+// primary ones first, along with the problems of their references
+func referencedBackends(v *viper.Viper, cfg config) ([]string, []string) {
+	var names, problems []string
+	add := func(field, name string) {
+		if !slices.Contains(backendNames, name) {
+			problems = append(problems, fmt.Sprintf("%s: unknown backend %q, expected one of %s", field, name, strings.Join(backendNames, ", ")))
+			return
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	switch {
+	case len(cfg.Routing.Backends) > 0:
+		for i, name := range cfg.Routing.Backends {
+			add(fmt.Sprintf("routing.backends[%d]", i), name)
+		}
+	case isConfigured(v, "deepseek"):
+		add("deepseek", "deepseek")
+	case isConfigured(v, "openrouter"):
+		add("openrouter", "openrouter")
+	case isConfigured(v, "ollama"):
+		add("ollama", "ollama")
+	default:
+		problems = append(problems, "no backend is configured: set deepseek.api_key, openrouter.api_key, or ollama.endpoint or endpoints")
+	}
+
+	if cfg.Hedging.Delay > 0 && cfg.Hedging.Backend != "" {
+		add("hedging.backend", cfg.Hedging.Backend)
+	}
+	if cfg.Canary.Percent > 0 && cfg.Canary.Backend != "" {
+		add("canary.backend", cfg.Canary.Backend)
+	}
+	if cfg.ContextWindow.Summarize.Backend != "" {
+		add("context_window.summarize.backend", cfg.ContextWindow.Summarize.Backend)
+	}
+	if cfg.Cache.Semantic.Backend != "" {
+		add("cache.semantic.backend", cfg.Cache.Semantic.Backend)
+	}
+	for _, alias := range cfg.ModelAliases {
+		if name, _, ok := strings.Cut(alias.Target, ":"); ok && slices.Contains(backendNames, name) {
+			add("model_aliases", name)
+		}
+	}
+	return names, problems
+}
+
+// checkBackend returns the problems of the required fields and endpoints of
+// the named backend's config
+func checkBackend(v *viper.Viper, cfg config, name string) []string {
+	var problems []string
+	bcfg, _ := cfg.backendConfig(name)
+	if name != "ollama" && v.GetString(name+"#api_key") == "" {
+		problems = append(problems, fmt.Sprintf("%s.api_key is required", name))
+	}
+	endpoint := v.GetString(name + "#endpoint")
+	if endpoint == "" && len(bcfg.Endpoints) == 0 {
+		problems = append(problems, fmt.Sprintf("%s.endpoint or %s.endpoints is required", name, name))
+	}
+	if endpoint != "" {
+		if problem := checkURL(name+".endpoint", endpoint); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	for i, ep := range bcfg.Endpoints {
+		if problem := checkURL(fmt.Sprintf("%s.endpoints[%d].url", name, i), ep.URL); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if bcfg.Passthrough && name == "ollama" {
+		problems = append(problems, "ollama.passthrough is not supported, only deepseek and openrouter forward requests untouched")
+	}
+	return problems
+}
+
+// checkURL returns the problem of an endpoint URL, if any
+func checkURL(field, value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Sprintf("%s: invalid URL %q: %v", field, value, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Sprintf("%s: %q must be an http:// or https:// URL", field, value)
+	}
+	return ""
+}
+
+// checkClients returns the problems of the client API keys and upstreams
+func checkClients(v *viper.Viper, cfg config) []string {
+	var problems []string
+	for i, client := range cfg.Clients {
+		if client.Name == "" {
+			problems = append(problems, fmt.Sprintf("clients[%d].name is required", i))
+		}
+		if strings.HasPrefix(client.Name, middleware.JWTIdentityPrefix) {
+			problems = append(problems, fmt.Sprintf("clients[%d].name: %q is reserved for JWT subjects", i, middleware.JWTIdentityPrefix))
+		}
+		if strings.HasPrefix(client.Name, middleware.CertIdentityPrefix) {
+			problems = append(problems, fmt.Sprintf("clients[%d].name: %q is reserved for client certificates", i, middleware.CertIdentityPrefix))
+		}
+		if client.Key == "" && client.KeyHash == "" {
+			problems = append(problems, fmt.Sprintf("clients[%d] requires a key or key_hash", i))
+		}
+		if client.KeyHash != "" {
+			if err := middleware.ValidateKeyHash(client.KeyHash); err != nil {
+				problems = append(problems, fmt.Sprintf("clients[%d].key_hash: %v, generate it with the hash-key command", i, err))
+			}
+		}
+		if client.Tier != "" {
+			_, tiered := cfg.Tiers[client.Tier]
+			_, limited := cfg.TierRateLimits[client.Tier]
+			if !tiered && !limited {
+				problems = append(problems, fmt.Sprintf("clients[%d].tier: unknown tier %q, define it under tiers", i, client.Tier))
+			}
+		}
+		problems = append(problems, checkClientUpstream(v, fmt.Sprintf("clients[%d].upstream", i), client.Upstream)...)
+	}
+	return problems
+}
+
+// checkTiers checks the priorities, model patterns and token caps of the
+// tiers
+func checkTiers(cfg config) []string {
+	var problems []string
+	for _, name := range slices.Sorted(maps.Keys(cfg.Tiers)) {
+		tier := cfg.Tiers[name]
+		if tier.Priority != "" && !slices.Contains(limiter.Priorities, tier.Priority) {
+			problems = append(problems, fmt.Sprintf("tiers.%s.priority: unknown priority %q, expected one of %s", name, tier.Priority, strings.Join(limiter.Priorities, ", ")))
+		}
+		if tier.MaxTokens < 0 {
+			problems = append(problems, fmt.Sprintf("tiers.%s.max_tokens must not be negative", name))
+		}
+		for _, pattern := range slices.Concat(tier.AllowModels, tier.DenyModels) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				problems = append(problems, fmt.Sprintf("tiers.%s: invalid model pattern %q", name, pattern))
+			}
+		}
+	}
+	return problems
+}
+
+// checkClientUpstream returns the problems of the upstream a client is bound
+// to, at field in the config
+func checkClientUpstream(v *viper.Viper, field string, upstream ClientUpstreamConfig) []string {
+	if upstream.Backend == "" {
+		if upstream.Endpoint != "" || upstream.Apikey != "" || upstream.DefaultModel != "" || upstream.Models != nil {
+			return []string{fmt.Sprintf("%s.backend is required, naming the backend whose config the upstream inherits", field)}
+		}
+		return nil
+	}
+	if !slices.Contains(backendNames, upstream.Backend) {
+		return []string{fmt.Sprintf("%s.backend: unknown backend %q, expected one of %s", field, upstream.Backend, strings.Join(backendNames, ", "))}
+	}
+	var problems []string
+	if upstream.Backend != "ollama" && upstream.Apikey == "" && v.GetString(upstream.Backend+"#api_key") == "" {
+		problems = append(problems, fmt.Sprintf("%s.api_key is required, as %s has none", field, upstream.Backend))
+	}
+	if upstream.Endpoint != "" {
+		if problem := checkURL(field+".endpoint", upstream.Endpoint); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+// checkListen checks the address the proxy listens on
+func checkListen(cfg config) []string {
+	var problems []string
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 0 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port: %q is not a port number", cfg.Port))
+	}
+	if strings.ContainsAny(cfg.Host, "[]/") || (strings.Contains(cfg.Host, ":") && net.ParseIP(cfg.Host) == nil) {
+		problems = append(problems, fmt.Sprintf("host: %q is not an address, which is set without brackets or a port", cfg.Host))
+	}
+	for i, addr := range cfg.Listen {
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			if path == "" {
+				problems = append(problems, fmt.Sprintf("listen[%d]: the socket path is missing after unix:", i))
+			}
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			problems = append(problems, fmt.Sprintf("listen[%d]: %q is neither host:port nor unix: followed by a socket path", i, addr))
+		}
+	}
+	if _, err := parseSocketMode(cfg.SocketMode); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// aliasRules returns the model aliases without their backends, to check their
+// syntax
+func aliasRules(cfg config) []router.AliasRule {
+	rules := make([]router.AliasRule, 0, len(cfg.ModelAliases))
+	for _, alias := range cfg.ModelAliases {
+		rules = append(rules, router.AliasRule{Pattern: alias.Pattern, Regex: alias.Regex, Model: alias.Target})
+	}
+	return rules
+}
+
+// probeBackend checks that the upstream of the named backend is reachable
+// and accepts its API key, returning the problem otherwise
+func probeBackend(ctx context.Context, v *viper.Viper, cfg config, name string) string {
+	be, _, _, err := newUpstream(v, cfg, name)
+	if err != nil {
+		return err.Error()
+	}
+	return probeUpstream(ctx, name, be)
+}
+
+// probeClientUpstream checks that the upstream a client is bound to, at field
+// in the config, is reachable and accepts its API key, returning the problem
+// otherwise
+func probeClientUpstream(ctx context.Context, v *viper.Viper, cfg config, field string, upstream ClientUpstreamConfig) string {
+	be, err := newClientBackend(v, cfg, field, upstream)
+	if err != nil {
+		return err.Error()
+	}
+	return probeUpstream(ctx, field, be)
+}
+
+// probeUpstream checks the upstream of the backend at field in the config
+func probeUpstream(ctx context.Context, field string, be backend.Backend) string {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	err := be.HealthCheck(ctx)
+	switch {
+	case err == nil:
+		return ""
+	case strings.Contains(err.Error(), "status 401") || strings.Contains(err.Error(), "status 403"):
+		return fmt.Sprintf("%s: the upstream rejected the API key, check %s.api_key: %v", field, field, err)
+	default:
+		return fmt.Sprintf("%s: the upstream is unreachable, check %s.endpoint: %v", field, field, err)
+	}
+}
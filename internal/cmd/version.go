@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is the release the binary was built from, set with
+// -ldflags "-X github.com/danilofalcao/cursor-deepseek/internal/cmd.version=v1.2.3"
+var version string
+
+func versionCommand() *command {
+	flags, _ := newFlags("version")
+	return &command{
+		name:  "version",
+		short: "Print the build information",
+		flags: flags,
+		run: func(context.Context) error {
+			printVersion()
+			return nil
+		},
+	}
+}
+
+// printVersion prints the version, the commit the binary was built from if
+// known, and the Go version
+func printVersion() {
+	v := version
+	var revision, modified, built string
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				revision = setting.Value
+			case "vcs.modified":
+				if setting.Value == "true" {
+					modified = " (modified)"
+				}
+			case "vcs.time":
+				built = setting.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	fmt.Printf("cursor-deepseek %s\n", v)
+	if revision != "" {
+		fmt.Printf("commit: %s%s\n", revision, modified)
+	}
+	if built != "" {
+		fmt.Printf("built: %s\n", built)
+	}
+	fmt.Printf("go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
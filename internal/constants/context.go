@@ -3,6 +3,13 @@ package constants
 type ContextKey string
 
 const (
-	LoggerKey    ContextKey = "logger"
-	RequestIDKey ContextKey = "request_id"
+	LoggerKey         ContextKey = "logger"
+	RequestIDKey      ContextKey = "request_id"
+	ModelOverrideKey  ContextKey = "model_override"
+	DefaultModelKey   ContextKey = "default_model"
+	CompletionKey     ContextKey = "completion"
+	ClientKey         ContextKey = "client"
+	TierKey           ContextKey = "tier"
+	PriorityKey       ContextKey = "priority"
+	TokensReporterKey ContextKey = "tokens_reporter"
 )
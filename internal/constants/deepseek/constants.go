@@ -5,4 +5,15 @@ const (
 	DefaultBetaEndpoint = "https://api.deepseek.com/beta"
 	DefaultChatModel    = "deepseek-chat"
 	DefaultCoderModel   = "deepseek-coder"
+	ReasonerModel       = "deepseek-reasoner"
 )
+
+// UnsupportedParams lists the request parameters DeepSeek models don't support
+var UnsupportedParams = map[string][]string{
+	"*":           {"logit_bias"},
+	ReasonerModel: {"temperature", "top_p", "presence_penalty", "frequency_penalty", "logprobs", "top_logprobs"},
+}
+
+// FIMPath is the path, relative to the endpoint, of the fill-in-the-middle
+// completions API
+const FIMPath = "/beta/completions"
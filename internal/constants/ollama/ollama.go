@@ -4,3 +4,8 @@ const (
 	DefaultModel    = "llama3"
 	DefaultEndpoint = "http://127.0.0.1:11434/api"
 )
+
+// UnsupportedParams lists the request parameters Ollama models don't support
+var UnsupportedParams = map[string][]string{
+	"*": {"logit_bias", "logprobs", "top_logprobs", "parallel_tool_calls"},
+}
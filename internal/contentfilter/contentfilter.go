@@ -0,0 +1,281 @@
+// Package contentfilter blocks or redacts configured patterns, such as
+// internal hostnames or credentials, in prompts before they leave the network
+// and in the model's responses.
+package contentfilter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// Rule actions
+const (
+	ActionRedact = "redact"
+	ActionBlock  = "block"
+)
+
+// How blocked requests are answered
+const (
+	// BlockWithError rejects them with a 400
+	BlockWithError = "error"
+	// BlockWithFinishReason answers them with an empty completion whose
+	// finish reason is content_filter, as OpenAI does
+	BlockWithFinishReason = "finish_reason"
+)
+
+// defaultReplacement replaces redacted matches
+const defaultReplacement = "[REDACTED]"
+
+var _ backend.Backend = &Filter{}
+
+// Rule matches content to block or redact
+type Rule struct {
+	// Pattern is a regular expression, and Keyword a word matched
+	// case-insensitively. One of them is required.
+	Pattern string
+	Keyword string
+	// Action is ActionRedact, the default, or ActionBlock
+	Action string
+	// Replacement replaces redacted matches, [REDACTED] by default
+	Replacement string
+}
+
+// Options configures a Filter
+type Options struct {
+	Backend backend.Backend
+	Rules   []Rule
+	// Responses also filters the model's responses
+	Responses bool
+	// BlockWith is how blocked prompts are answered, BlockWithError by
+	// default or BlockWithFinishReason
+	BlockWith string
+}
+
+type rule struct {
+	re          *regexp.Regexp
+	block       bool
+	replacement string
+}
+
+// Filter is a backend which filters the prompts of the backend it wraps, and
+// optionally its responses
+type Filter struct {
+	backend.Backend
+	rules     []rule
+	responses bool
+	blockWith string
+}
+
+// New compiles the rules of a Filter
+func New(opts Options) (*Filter, error) {
+	f := &Filter{
+		Backend:   opts.Backend,
+		responses: opts.Responses,
+		blockWith: opts.BlockWith,
+	}
+	switch f.blockWith {
+	case "":
+		f.blockWith = BlockWithError
+	case BlockWithError, BlockWithFinishReason:
+	default:
+		return nil, errors.Errorf("unknown content filter block_with %q", opts.BlockWith)
+	}
+
+	for i, r := range opts.Rules {
+		pattern := r.Pattern
+		switch {
+		case r.Pattern != "" && r.Keyword != "":
+			return nil, errors.Errorf("content filter rule %d has both a pattern and a keyword", i)
+		case r.Keyword != "":
+			pattern = `(?i)\b` + regexp.QuoteMeta(r.Keyword) + `\b`
+		case r.Pattern == "":
+			return nil, errors.Errorf("content filter rule %d requires a pattern or a keyword", i)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid content filter rule %d", i)
+		}
+
+		compiled := rule{re: re, replacement: r.Replacement}
+		switch r.Action {
+		case "", ActionRedact:
+			if compiled.replacement == "" {
+				compiled.replacement = defaultReplacement
+			}
+		case ActionBlock:
+			compiled.block = true
+		default:
+			return nil, errors.Errorf("content filter rule %d has unknown action %q", i, r.Action)
+		}
+		f.rules = append(f.rules, compiled)
+	}
+	return f, nil
+}
+
+// Stats returns the statistics of the wrapped backend, if any
+func (f *Filter) Stats() any {
+	if provider, ok := f.Backend.(backend.StatsProvider); ok {
+		return provider.Stats()
+	}
+	return nil
+}
+
+// HandleChatCompletion blocks prompts matching a block rule, and redacts the
+// matches of the other rules before forwarding them
+func (f *Filter) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	filtered := *req
+	filtered.Messages = make([]openai.Message, len(req.Messages))
+	for i, msg := range req.Messages {
+		blocked := false
+		switch content := msg.Content.(type) {
+		case openai.Content_String:
+			content.Content, blocked = f.filter(content.Content)
+			msg.Content = content
+		case openai.Content_Array:
+			parts := make(openai.Content_Array, len(content))
+			for j, part := range content {
+				if text, ok := part.(openai.ContentPart_Text); ok {
+					var partBlocked bool
+					text.Text, partBlocked = f.filter(text.Text)
+					blocked = blocked || partBlocked
+					part = text
+				}
+				parts[j] = part
+			}
+			msg.Content = parts
+		}
+		if blocked {
+			lgr.Warnf(ctx, "Blocking request whose message %d matches a content filter", i)
+			f.block(w, req)
+			return
+		}
+		filtered.Messages[i] = msg
+	}
+
+	if !f.responses {
+		f.Backend.HandleChatCompletion(ctx, w, r, &filtered)
+		return
+	}
+	if req.Stream {
+		sw := newStreamWriter(w, f)
+		f.Backend.HandleChatCompletion(ctx, sw, r, &filtered)
+		sw.close()
+		return
+	}
+
+	rec := response.NewRecorder()
+	f.Backend.HandleChatCompletion(ctx, rec, r, &filtered)
+	if rec.Status != http.StatusOK {
+		rec.WriteTo(w, nil)
+		return
+	}
+	var resp openai.ChatCompletionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		lgr.Warn(ctx, "Unable to parse backend response for content filtering")
+		rec.WriteTo(w, nil)
+		return
+	}
+	for i := range resp.Choices {
+		content, blocked := f.filter(resp.Choices[i].Message.GetContentString())
+		if blocked {
+			lgr.Warnf(ctx, "Blocking choice %d of the response, which matches a content filter", i)
+			content = ""
+			resp.Choices[i].FinishReason = openai.FinishReasonContentFilter
+		}
+		if resp.Choices[i].Message.Content != nil {
+			resp.Choices[i].Message.Content = openai.Content_String{Content: content}
+		}
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		rec.WriteTo(w, nil)
+		return
+	}
+	rec.WriteTo(w, body)
+}
+
+// filter redacts the matches of the redact rules in text, unless it matches a
+// block rule
+func (f *Filter) filter(text string) (string, bool) {
+	if f.blocks(text) {
+		return text, true
+	}
+	return f.redact(text), false
+}
+
+// blocks is whether text matches a block rule
+func (f *Filter) blocks(text string) bool {
+	for _, r := range f.rules {
+		if r.block && r.re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact redacts the matches of the redact rules in text
+func (f *Filter) redact(text string) string {
+	for _, r := range f.rules {
+		if !r.block {
+			text = r.re.ReplaceAllLiteralString(text, r.replacement)
+		}
+	}
+	return text
+}
+
+// block answers a blocked request as configured
+func (f *Filter) block(w http.ResponseWriter, req *openai.ChatCompletionRequest) {
+	if f.blockWith == BlockWithError {
+		response.WriteErrorResponse(w, http.StatusBadRequest, openai.Error{
+			Message: "The request was blocked by the content filter",
+			Code:    "content_filter",
+		})
+		return
+	}
+
+	id, created := "chatcmpl-filtered", time.Now().Unix()
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			ID:      id,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openai.Choice{{
+				Message:      openai.Message{Role: openai.RoleAssistant, Content: openai.Content_String{}},
+				FinishReason: openai.FinishReasonContentFilter,
+			}},
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	chunk, _ := json.Marshal(openai.ChatCompletionStreamResponse{
+		ID:      id,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   req.Model,
+		Choices: []openai.StreamChoice{{
+			Delta:        openai.Delta{Role: openai.RoleAssistant},
+			FinishReason: openai.FinishReasonContentFilter,
+		}},
+	})
+	var b strings.Builder
+	b.WriteString("data: ")
+	b.Write(chunk)
+	b.WriteString("\n\ndata: [DONE]\n\n")
+	w.Write([]byte(b.String()))
+}
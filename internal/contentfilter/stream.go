@@ -0,0 +1,135 @@
+package contentfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+)
+
+// streamWindow is how much of the end of each choice's streamed content is
+// checked against the block rules, so that matches split across chunks are
+// found without rescanning the whole content
+const streamWindow = 4096
+
+// streamWriter filters the chunks of a streamed completion as they are
+// written. Redact rules are applied to each chunk's content, so matches split
+// across chunks are missed. Once a choice matches a block rule the stream is
+// finished with the content_filter finish reason, and the rest discarded.
+type streamWriter struct {
+	http.ResponseWriter
+	filter *Filter
+	status int
+	// pending is the incomplete line last written
+	pending []byte
+	// tails are the ends of the content of each choice
+	tails   map[int]string
+	blocked bool
+}
+
+func newStreamWriter(w http.ResponseWriter, f *Filter) *streamWriter {
+	return &streamWriter{
+		ResponseWriter: w,
+		filter:         f,
+		status:         http.StatusOK,
+		tails:          map[int]string{},
+	}
+}
+
+func (s *streamWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	if s.status != http.StatusOK {
+		return s.ResponseWriter.Write(b)
+	}
+	if s.blocked {
+		return len(b), nil
+	}
+
+	s.pending = append(s.pending, b...)
+	var out []byte
+	for !s.blocked {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 {
+			break
+		}
+		out = append(out, s.filterLine(s.pending[:i+1])...)
+		s.pending = s.pending[i+1:]
+	}
+	s.pending = bytes.Clone(s.pending)
+	if len(out) > 0 {
+		if _, err := s.ResponseWriter.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (s *streamWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close writes what remains of an unterminated last line
+func (s *streamWriter) close() {
+	if len(s.pending) > 0 && !s.blocked {
+		s.ResponseWriter.Write(s.filterLine(s.pending))
+	}
+	s.pending = nil
+}
+
+// filterLine filters the chunk of a data line, returning the line to write
+func (s *streamWriter) filterLine(line []byte) []byte {
+	data, ok := bytes.CutPrefix(line, []byte("data: "))
+	if !ok || bytes.HasPrefix(data, []byte("[DONE]")) {
+		return line
+	}
+	var chunk openai.ChatCompletionStreamResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return line
+	}
+
+	modified := false
+	for i := range chunk.Choices {
+		choice := &chunk.Choices[i]
+		content, ok := choice.Delta.Content.(openai.Content_String)
+		if !ok || content.Content == "" {
+			continue
+		}
+		tail := s.tails[choice.Index] + content.Content
+		if len(tail) > streamWindow {
+			tail = tail[len(tail)-streamWindow:]
+		}
+		s.tails[choice.Index] = tail
+		if s.filter.blocks(tail) {
+			s.blocked = true
+			return s.blockedChunk(chunk, choice.Index)
+		}
+		if redacted := s.filter.redact(content.Content); redacted != content.Content {
+			choice.Delta.Content = openai.Content_String{Content: redacted}
+			modified = true
+		}
+	}
+	if !modified {
+		return line
+	}
+	body, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return append(append([]byte("data: "), body...), '\n')
+}
+
+// blockedChunk finishes the stream with the content_filter finish reason of
+// the choice
+func (s *streamWriter) blockedChunk(chunk openai.ChatCompletionStreamResponse, index int) []byte {
+	chunk.Choices = []openai.StreamChoice{{Index: index, FinishReason: openai.FinishReasonContentFilter}}
+	chunk.Usage = nil
+	body, _ := json.Marshal(chunk)
+	return append(append([]byte("data: "), body...), "\n\ndata: [DONE]\n\n"...)
+}
@@ -0,0 +1,313 @@
+// Package contextwindow keeps the prompts of chat completions within the
+// context window of their model, trimming or summarizing their oldest
+// messages instead of letting the upstream reject them.
+package contextwindow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TrimmedHeader reports the number of messages dropped from a request to
+	// fit its model's context window
+	TrimmedHeader = "X-Proxy-Context-Trimmed"
+
+	// defaultReserve is the number of tokens left for the completion of
+	// requests which don't set a maximum
+	defaultReserve = 1024
+	// messageOverhead is the number of tokens the formatting of a message
+	// takes, its role aside
+	messageOverhead = 4
+	// charsPerToken is the number of characters per token estimated unless
+	// configured otherwise for a model
+	charsPerToken = 4.0
+)
+
+const summaryPrompt = "Summarize the following conversation between a user and an assistant. Keep every fact, decision, " +
+	"file name, identifier and open question the conversation would need to continue. Reply with the summary alone."
+
+var _ backend.Backend = &Trimmer{}
+
+// Window is the context window of a model
+type Window struct {
+	// Tokens is the size of the context window
+	Tokens int
+	// CharsPerToken is how many characters a token of the model's tokenizer
+	// holds on average, 4 if unset
+	CharsPerToken float64
+}
+
+// Options configures a Trimmer
+type Options struct {
+	Backend backend.Backend
+	// Windows maps the models requested to their context window
+	Windows map[string]Window
+	// Default is the context window of the models not in Windows, which are
+	// passed through if it is unset
+	Default Window
+	// Reserve is the number of tokens left for the completion of requests
+	// which don't set max_tokens, 1024 if unset
+	Reserve int
+	// Summarizer, if set, summarizes the messages trimmed with SummaryModel,
+	// and the summary is sent in their place
+	Summarizer   backend.Backend
+	SummaryModel string
+}
+
+// Trimmer is a backend which estimates the prompt tokens of chat completions
+// and, when a prompt would overflow its model's context window, drops its
+// oldest messages other than the system messages and the final message. The
+// messages dropped are optionally summarized by a cheap model.
+type Trimmer struct {
+	backend.Backend
+	windows      map[string]Window
+	fallback     Window
+	reserve      int
+	summarizer   backend.Backend
+	summaryModel string
+
+	trimmed    atomic.Int64
+	summarized atomic.Int64
+	rejected   atomic.Int64
+}
+
+// New creates a new Trimmer
+func New(opts Options) *Trimmer {
+	reserve := opts.Reserve
+	if reserve <= 0 {
+		reserve = defaultReserve
+	}
+	return &Trimmer{
+		Backend:      opts.Backend,
+		windows:      opts.Windows,
+		fallback:     opts.Default,
+		reserve:      reserve,
+		summarizer:   opts.Summarizer,
+		summaryModel: opts.SummaryModel,
+	}
+}
+
+// HandleChatCompletion trims the request to its model's context window before
+// forwarding it, or rejects it if it can't be trimmed to fit
+func (t *Trimmer) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	window, ok := t.windows[req.Model]
+	if !ok {
+		window = t.fallback
+	}
+	if window.Tokens <= 0 {
+		t.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+	if window.CharsPerToken <= 0 {
+		window.CharsPerToken = charsPerToken
+	}
+
+	budget := window.Tokens - t.completionTokens(req)
+	prompt := window.estimate(req.Messages)
+	if prompt <= budget {
+		t.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	kept, dropped := trim(req.Messages, budget, window)
+	if kept == nil {
+		t.rejected.Add(1)
+		lgr.Warnf(ctx, "Rejecting request of about %d tokens for %s, whose context window is %d tokens", prompt, req.Model, window.Tokens)
+		response.WriteErrorResponse(w, http.StatusBadRequest, openai.Error{
+			Message: fmt.Sprintf("This model's maximum context length is %d tokens, which the messages exceed even with the earlier ones trimmed", window.Tokens),
+			Type:    response.ErrorTypeInvalidRequest,
+			Code:    "context_length_exceeded",
+			Param:   "messages",
+		})
+		return
+	}
+
+	if t.summarizer != nil {
+		summarized, more, err := t.summarize(ctx, r, kept, dropped, budget, window)
+		if err != nil {
+			// The messages are trimmed alone if they can't be summarized
+			lgr.Error(ctx, err.Error())
+		} else {
+			kept = summarized
+			dropped = append(dropped, more...)
+			t.summarized.Add(1)
+		}
+	}
+
+	t.trimmed.Add(1)
+	lgr.Infof(ctx, "Trimmed %d of %d messages from a request of about %d tokens for %s, whose context window is %d tokens",
+		len(dropped), len(req.Messages), prompt, req.Model, window.Tokens)
+	w.Header().Set(TrimmedHeader, strconv.Itoa(len(dropped)))
+	trimmed := *req
+	trimmed.Messages = kept
+	t.Backend.HandleChatCompletion(ctx, w, r, &trimmed)
+}
+
+// completionTokens returns the number of tokens left for the completion
+func (t *Trimmer) completionTokens(req *openai.ChatCompletionRequest) int {
+	if limit := req.CompletionTokenLimit(); limit != nil && *limit > 0 {
+		return *limit
+	}
+	return t.reserve
+}
+
+// trim drops the oldest turns, each a user message and the replies to it,
+// until the rest fit within budget. System messages and the final turn are
+// kept, as is every tool result along with the call it answers. It returns
+// nil if the messages can't fit.
+func trim(messages []openai.Message, budget int, window Window) (kept, dropped []openai.Message) {
+	last := len(messages) - 1
+	total := window.estimate(messages)
+	drop := make([]bool, len(messages))
+	for i := 0; i < last && total > budget; {
+		if openai.NormalizeRole(messages[i].Role) == openai.RoleSystem {
+			i++
+			continue
+		}
+		end := i + 1
+		for ; end <= last; end++ {
+			role := openai.NormalizeRole(messages[end].Role)
+			if role == openai.RoleUser || role == openai.RoleSystem {
+				break
+			}
+		}
+		if end > last {
+			break
+		}
+		for ; i < end; i++ {
+			drop[i] = true
+			total -= window.estimateMessage(messages[i])
+		}
+	}
+	if total > budget {
+		return nil, nil
+	}
+	for i, msg := range messages {
+		if drop[i] {
+			dropped = append(dropped, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, dropped
+}
+
+// summarize replaces the dropped messages by a summary of them, following
+// the system messages. Further turns are dropped, unsummarized, to make room
+// for the summary, and returned.
+func (t *Trimmer) summarize(ctx context.Context, r *http.Request, kept, dropped []openai.Message, budget int, window Window) ([]openai.Message, []openai.Message, error) {
+	var transcript strings.Builder
+	for _, msg := range dropped {
+		fmt.Fprintf(&transcript, "%s: %s\n\n", msg.Role, messageText(msg))
+	}
+	req := &openai.ChatCompletionRequest{
+		Model: t.summaryModel,
+		Messages: []openai.Message{
+			{Role: openai.RoleSystem, Content: openai.Content_String{Content: summaryPrompt}},
+			{Role: openai.RoleUser, Content: openai.Content_String{Content: transcript.String()}},
+		},
+	}
+
+	// The summary's tokens aren't the completion's, so they aren't reported
+	summaryCtx := contextutils.WithTokensReporter(ctx, func(int) {})
+	rec := response.NewRecorder()
+	t.summarizer.HandleChatCompletion(summaryCtx, rec, r, req)
+	if rec.Status != http.StatusOK {
+		return nil, nil, errors.Errorf("summarizer returned status %d", rec.Status)
+	}
+	var resp openai.ChatCompletionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		return nil, nil, errors.Wrap(err, "error decoding summary")
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.GetContentString() == "" {
+		return nil, nil, errors.New("summarizer returned no summary")
+	}
+
+	summary := openai.Message{
+		Role:    openai.RoleSystem,
+		Content: openai.Content_String{Content: "Summary of the earlier conversation:\n" + resp.Choices[0].Message.GetContentString()},
+	}
+	systems := 0
+	for systems < len(kept) && openai.NormalizeRole(kept[systems].Role) == openai.RoleSystem {
+		systems++
+	}
+	summarized := make([]openai.Message, 0, len(kept)+1)
+	summarized = append(summarized, kept[:systems]...)
+	summarized = append(summarized, summary)
+	summarized = append(summarized, kept[systems:]...)
+	summarized, more := trim(summarized, budget, window)
+	if summarized == nil {
+		return nil, nil, errors.New("summary doesn't fit within the context window")
+	}
+	return summarized, more, nil
+}
+
+// estimate estimates the prompt tokens of messages
+func (w Window) estimate(messages []openai.Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += w.estimateMessage(msg)
+	}
+	return total
+}
+
+// estimateMessage estimates the tokens of a message from its characters
+func (w Window) estimateMessage(msg openai.Message) int {
+	chars := utf8.RuneCountInString(msg.Role) + utf8.RuneCountInString(messageText(msg))
+	for _, tc := range msg.ToolCalls {
+		chars += utf8.RuneCountInString(tc.Function.Name) + utf8.RuneCountInString(tc.Function.Arguments)
+	}
+	return messageOverhead + int(float64(chars)/w.CharsPerToken+0.5)
+}
+
+// messageText returns the text of a message, joining its text parts
+func messageText(msg openai.Message) string {
+	if text := msg.GetContentString(); text != "" {
+		return text
+	}
+	var parts []string
+	for _, part := range msg.GetContentArray() {
+		if text, ok := part.(openai.ContentPart_Text); ok {
+			parts = append(parts, text.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Stats describes how often requests were trimmed to fit
+type Stats struct {
+	Trimmed    int64 `json:"trimmed"`
+	Summarized int64 `json:"summarized"`
+	Rejected   int64 `json:"rejected"`
+	Backend    any   `json:"backend,omitempty"`
+}
+
+// Stats returns the trimming statistics along with the wrapped backend's, if
+// any
+func (t *Trimmer) Stats() any {
+	stats := Stats{
+		Trimmed:    t.trimmed.Load(),
+		Summarized: t.summarized.Load(),
+		Rejected:   t.rejected.Load(),
+	}
+	if provider, ok := t.Backend.(backend.StatsProvider); ok {
+		stats.Backend = provider.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,152 @@
+package contextwindow
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+)
+
+// perMessage is a window in which every message is estimated to take
+// messageOverhead tokens, whatever its text
+var perMessage = Window{Tokens: 1 << 20, CharsPerToken: 1 << 20}
+
+// message returns a message whose text names it
+func message(role, name string) openai.Message {
+	return openai.Message{Role: role, Content: openai.Content_String{Content: name}}
+}
+
+// names returns the names of messages
+func names(messages []openai.Message) []string {
+	var names []string
+	for _, msg := range messages {
+		names = append(names, msg.GetContentString())
+	}
+	return names
+}
+
+func TestTrim(t *testing.T) {
+	var (
+		system  = message(openai.RoleSystem, "system")
+		system2 = message(openai.RoleSystem, "system2")
+		dev     = message(openai.RoleDeveloper, "developer")
+		user1   = message(openai.RoleUser, "user1")
+		reply1  = message(openai.RoleAssistant, "reply1")
+		user2   = message(openai.RoleUser, "user2")
+		reply2  = message(openai.RoleAssistant, "reply2")
+		user3   = message(openai.RoleUser, "user3")
+		call    = openai.Message{Role: openai.RoleAssistant, Content: openai.Content_String{Content: "call"}, ToolCalls: []openai.ToolCall{{ID: "1"}}}
+		result  = message(openai.RoleTool, "result")
+	)
+
+	for _, tc := range []struct {
+		name     string
+		messages []openai.Message
+		// fit is the number of messages which fit within the budget
+		fit         int
+		wantKept    []string
+		wantDropped []string
+	}{
+		{
+			name:     "fits",
+			messages: []openai.Message{system, user1, reply1, user2},
+			fit:      4,
+			wantKept: []string{"system", "user1", "reply1", "user2"},
+		},
+		{
+			name:        "oldest turn",
+			messages:    []openai.Message{system, user1, reply1, user2, reply2, user3},
+			fit:         4,
+			wantKept:    []string{"system", "user2", "reply2", "user3"},
+			wantDropped: []string{"user1", "reply1"},
+		},
+		{
+			name:        "whole turns",
+			messages:    []openai.Message{system, user1, reply1, user2, reply2, user3},
+			fit:         3,
+			wantKept:    []string{"system", "user3"},
+			wantDropped: []string{"user1", "reply1", "user2", "reply2"},
+		},
+		{
+			name:        "system messages between turns",
+			messages:    []openai.Message{system, user1, reply1, system2, user2},
+			fit:         3,
+			wantKept:    []string{"system", "system2", "user2"},
+			wantDropped: []string{"user1", "reply1"},
+		},
+		{
+			name:        "developer messages between turns",
+			messages:    []openai.Message{dev, user1, reply1, dev, user2},
+			fit:         3,
+			wantKept:    []string{"developer", "developer", "user2"},
+			wantDropped: []string{"user1", "reply1"},
+		},
+		{
+			name:        "tool results with their calls",
+			messages:    []openai.Message{user1, call, result, reply1, user2},
+			fit:         2,
+			wantKept:    []string{"user2"},
+			wantDropped: []string{"user1", "call", "result", "reply1"},
+		},
+		{
+			name:        "replies before the first user message",
+			messages:    []openai.Message{reply1, user1, call, result, user2},
+			fit:         3,
+			wantKept:    []string{"user2"},
+			wantDropped: []string{"reply1", "user1", "call", "result"},
+		},
+		{
+			name:     "final message doesn't fit",
+			messages: []openai.Message{system, user1, reply1, user2},
+			fit:      1,
+		},
+		{
+			name:     "final turn is kept whole",
+			messages: []openai.Message{user1, call, result, reply1},
+			fit:      2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kept, dropped := trim(tc.messages, tc.fit*messageOverhead, perMessage)
+			if got := names(kept); !slices.Equal(got, tc.wantKept) {
+				t.Errorf("kept %v, want %v", got, tc.wantKept)
+			}
+			if got := names(dropped); !slices.Equal(got, tc.wantDropped) {
+				t.Errorf("dropped %v, want %v", got, tc.wantDropped)
+			}
+		})
+	}
+}
+
+func TestEstimateMessage(t *testing.T) {
+	window := Window{CharsPerToken: 4}
+	for _, tc := range []struct {
+		name string
+		msg  openai.Message
+		want int
+	}{
+		{name: "text", msg: message("user", "12345678"), want: messageOverhead + 3},
+		{name: "runes", msg: message("user", "éééééééé"), want: messageOverhead + 3},
+		{
+			name: "parts",
+			msg: openai.Message{Role: "user", Content: openai.Content_Array{
+				openai.ContentPart_Text{Type: "text", Text: "1234"},
+				openai.ContentPart_Text{Type: "text", Text: "567"},
+			}},
+			want: messageOverhead + 3,
+		},
+		{
+			name: "tool calls",
+			msg: openai.Message{Role: "assistant", ToolCalls: []openai.ToolCall{{
+				Function: openai.ToolCallFunction{Name: "lookup", Arguments: `{"q":1}`},
+			}}},
+			want: messageOverhead + 6,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := window.estimateMessage(tc.msg); got != tc.want {
+				t.Errorf("estimateMessage() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
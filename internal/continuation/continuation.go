@@ -0,0 +1,191 @@
+// Package continuation completes chat completions which were cut off by the
+// maximum number of tokens, by asking the model to continue where it stopped.
+package continuation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+// Header reports the number of continuations a response was stitched from
+const Header = "X-Proxy-Continuations"
+
+const continuePrompt = "Your previous response was cut off. Continue it exactly where it stopped, without repeating " +
+	"anything or adding any preamble."
+
+var _ backend.Backend = &Continuer{}
+
+// Options configures a Continuer
+type Options struct {
+	Backend backend.Backend
+	// MaxContinuations is the number of times a response is continued
+	MaxContinuations int
+}
+
+// Continuer is a backend which detects completions cut off by the maximum
+// number of tokens, with the length finish reason, and requests their
+// continuation with the partial output appended, up to a maximum number of
+// times. The continuations are stitched into a single response or stream.
+// Requests for several choices are passed through, as are responses which
+// were cut off calling tools.
+type Continuer struct {
+	backend.Backend
+	maxContinuations int
+
+	continued     atomic.Int64
+	continuations atomic.Int64
+}
+
+// New creates a new Continuer
+func New(opts Options) *Continuer {
+	return &Continuer{
+		Backend:          opts.Backend,
+		maxContinuations: opts.MaxContinuations,
+	}
+}
+
+// HandleChatCompletion serves the request, continuing its response while it
+// is cut off
+func (c *Continuer) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	if c.maxContinuations <= 0 || (req.N != nil && *req.N > 1) {
+		c.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+	// Backends map the request in place, so each continuation starts from a
+	// copy of the original
+	original := *req
+	original.Messages = slices.Clone(req.Messages)
+	if req.Stream {
+		c.handleStream(ctx, w, r, req, original)
+		return
+	}
+	c.handleResponse(ctx, w, r, req, original)
+}
+
+// handleResponse serves a non-streaming request, merging the responses to
+// its continuations into the first
+func (c *Continuer) handleResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest, original openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	rec := response.NewRecorder()
+	c.Backend.HandleChatCompletion(ctx, rec, r, req)
+	var merged openai.ChatCompletionResponse
+	if rec.Status != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &merged) != nil || !truncated(merged) {
+		rec.WriteTo(w, nil)
+		return
+	}
+
+	n := 0
+	for ; n < c.maxContinuations && truncated(merged); n++ {
+		lgr.Infof(ctx, "Continuing response cut off after %d completion tokens (%d/%d)", merged.Usage.CompletionTokens, n+1, c.maxContinuations)
+		next := continuationRequest(original, merged.Choices[0].Message.GetContentString())
+		attempt := response.NewRecorder()
+		c.Backend.HandleChatCompletion(ctx, attempt, r, next)
+		var resp openai.ChatCompletionResponse
+		if attempt.Status != http.StatusOK || json.Unmarshal(attempt.Body.Bytes(), &resp) != nil || len(resp.Choices) == 0 {
+			// The response is returned as far as it got
+			lgr.Warnf(ctx, "Continuation failed with status %d", attempt.Status)
+			break
+		}
+		merge(&merged, resp)
+	}
+	c.record(n)
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		rec.WriteTo(w, nil)
+		return
+	}
+	w.Header().Set(Header, strconv.Itoa(n))
+	rec.WriteTo(w, body)
+}
+
+// record counts the continuations of a response
+func (c *Continuer) record(n int) {
+	if n > 0 {
+		c.continued.Add(1)
+		c.continuations.Add(int64(n))
+	}
+}
+
+// truncated is whether a response was cut off in its content, which can be
+// continued, rather than in a tool call
+func truncated(resp openai.ChatCompletionResponse) bool {
+	if len(resp.Choices) != 1 {
+		return false
+	}
+	choice := resp.Choices[0]
+	return choice.FinishReason == openai.FinishReasonLength && len(choice.Message.ToolCalls) == 0
+}
+
+// continuationRequest asks for the continuation of the partial output to the
+// original request
+func continuationRequest(original openai.ChatCompletionRequest, partial string) *openai.ChatCompletionRequest {
+	next := original
+	next.Messages = append(slices.Clone(original.Messages),
+		openai.Message{
+			Role:    openai.RoleAssistant,
+			Content: openai.Content_String{Content: partial},
+		},
+		openai.Message{
+			Role:    openai.RoleUser,
+			Content: openai.Content_String{Content: continuePrompt},
+		},
+	)
+	return &next
+}
+
+// merge appends the continuation of a response to it
+func merge(merged *openai.ChatCompletionResponse, next openai.ChatCompletionResponse) {
+	choice := &merged.Choices[0]
+	nextChoice := next.Choices[0]
+	choice.Message.Content = openai.Content_String{
+		Content: choice.Message.GetContentString() + nextChoice.Message.GetContentString(),
+	}
+	choice.Message.ReasoningContent += nextChoice.Message.ReasoningContent
+	choice.Message.ToolCalls = nextChoice.Message.ToolCalls
+	choice.FinishReason = nextChoice.FinishReason
+	merged.Usage = addUsage(merged.Usage, next.Usage)
+}
+
+func addUsage(a, b openai.Usage) openai.Usage {
+	sum := openai.Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+	if a.CompletionTokensDetails != nil || b.CompletionTokensDetails != nil {
+		sum.CompletionTokensDetails = &openai.CompletionTokensDetails{ReasoningTokens: a.ReasoningTokens() + b.ReasoningTokens()}
+	}
+	return sum
+}
+
+// Stats describes how often responses were continued
+type Stats struct {
+	// Continued is the number of responses continued at least once
+	Continued     int64 `json:"continued"`
+	Continuations int64 `json:"continuations"`
+	Backend       any   `json:"backend,omitempty"`
+}
+
+// Stats returns the continuation statistics along with the wrapped backend's,
+// if any
+func (c *Continuer) Stats() any {
+	stats := Stats{
+		Continued:     c.continued.Load(),
+		Continuations: c.continuations.Load(),
+	}
+	if provider, ok := c.Backend.(backend.StatsProvider); ok {
+		stats.Backend = provider.Stats()
+	}
+	return stats
+}
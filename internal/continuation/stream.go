@@ -0,0 +1,252 @@
+package continuation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+// handleStream serves a streaming request, streaming its continuations on as
+// part of the first stream
+func (c *Continuer) handleStream(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest, original openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	sw := &streamWriter{ResponseWriter: w, status: http.StatusOK}
+	c.Backend.HandleChatCompletion(ctx, sw, r, req)
+	sw.close()
+
+	n := 0
+	for ; n < c.maxContinuations && sw.continuable() && ctx.Err() == nil; n++ {
+		lgr.Infof(ctx, "Continuing stream cut off after %d characters (%d/%d)", sw.content.Len(), n+1, c.maxContinuations)
+		sw.next()
+		c.Backend.HandleChatCompletion(ctx, sw, r, continuationRequest(original, sw.content.String()))
+		sw.close()
+		if sw.status != http.StatusOK {
+			lgr.Warnf(ctx, "Continuation failed with status %d", sw.status)
+			break
+		}
+	}
+	c.record(n)
+	sw.finish()
+}
+
+// streamWriter passes the chunks of a stream through while holding back its
+// end, which is only written once the stream isn't continued. The chunks of
+// continuations are written as part of the first stream, and their headers
+// and errors are discarded.
+type streamWriter struct {
+	http.ResponseWriter
+	status int
+	// continuation is whether a continuation is being written
+	continuation bool
+	// pending is the incomplete line last written
+	pending []byte
+	// skipBlank drops the blank line ending an event held back
+	skipBlank bool
+
+	// first is the first chunk, whose ID the continuations are given
+	first *openai.ChatCompletionStreamResponse
+	// content is the content streamed so far
+	content strings.Builder
+	// finishChunk is the chunk finishing the stream, held back
+	finishChunk *openai.ChatCompletionStreamResponse
+	usage       *openai.Usage
+	// done is whether the stream was terminated, which the continuations
+	// aren't once it has been
+	done   bool
+	failed bool
+	calls  bool
+}
+
+func (s *streamWriter) WriteHeader(status int) {
+	s.status = status
+	if !s.continuation {
+		s.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	if s.status != http.StatusOK {
+		if s.continuation {
+			return len(b), nil
+		}
+		return s.ResponseWriter.Write(b)
+	}
+
+	s.pending = append(s.pending, b...)
+	var out []byte
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 {
+			break
+		}
+		out = append(out, s.line(s.pending[:i+1])...)
+		s.pending = s.pending[i+1:]
+	}
+	s.pending = bytes.Clone(s.pending)
+	if len(out) > 0 {
+		if _, err := s.ResponseWriter.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (s *streamWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close writes what remains of an unterminated last line
+func (s *streamWriter) close() {
+	if len(s.pending) > 0 && s.status == http.StatusOK {
+		s.ResponseWriter.Write(s.line(s.pending))
+	}
+	s.pending = nil
+}
+
+// continuable is whether the stream was cut off in its content
+func (s *streamWriter) continuable() bool {
+	return s.status == http.StatusOK && s.finishChunk != nil && !s.failed && !s.calls &&
+		s.finishChunk.Choices[0].FinishReason == openai.FinishReasonLength
+}
+
+// next prepares the writer for a continuation
+func (s *streamWriter) next() {
+	s.continuation = true
+	s.finishChunk = nil
+	s.done = false
+	s.skipBlank = false
+}
+
+// finish ends the stream with the chunks held back
+func (s *streamWriter) finish() {
+	if s.first == nil || s.done {
+		// Streams which failed before their first chunk, or whose last
+		// continuation wasn't held back, are ended already
+		return
+	}
+	if s.finishChunk != nil {
+		s.writeChunk(*s.finishChunk)
+	}
+	if s.usage != nil {
+		s.writeChunk(stream.UsageChunk(*s.first, *s.usage))
+	}
+	s.ResponseWriter.Write([]byte("data: " + stream.Done + "\n\n"))
+	s.Flush()
+}
+
+// line handles a line of the stream, returning what is written of it
+func (s *streamWriter) line(line []byte) []byte {
+	if len(bytes.TrimSpace(line)) == 0 {
+		if s.skipBlank {
+			s.skipBlank = false
+			return nil
+		}
+		return line
+	}
+	data, ok := bytes.CutPrefix(line, []byte("data: "))
+	if !ok {
+		return line
+	}
+	data = bytes.TrimSpace(data)
+	if string(data) == stream.Done {
+		if s.failed {
+			s.done = true
+			return line
+		}
+		s.skipBlank = true
+		return nil
+	}
+
+	var event struct {
+		openai.ChatCompletionStreamResponse
+		Error *openai.Error `json:"error"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return line
+	}
+	if event.Error != nil {
+		// Errors end the stream, which isn't continued
+		s.failed = true
+		return line
+	}
+	chunk := event.ChatCompletionStreamResponse
+
+	if s.first == nil {
+		first := chunk
+		s.first = &first
+	} else if s.continuation {
+		chunk.ID = s.first.ID
+		chunk.Created = s.first.Created
+		chunk.Model = s.first.Model
+	}
+	if chunk.Usage != nil {
+		usage := addUsage(ptrValue(s.usage), *chunk.Usage)
+		s.usage = &usage
+		chunk.Usage = nil
+	}
+
+	choices := make([]openai.StreamChoice, 0, len(chunk.Choices))
+	for _, choice := range chunk.Choices {
+		if s.continuation {
+			choice.Delta.Role = ""
+		}
+		if content, ok := choice.Delta.Content.(openai.Content_String); ok {
+			s.content.WriteString(content.Content)
+		}
+		if len(choice.Delta.ToolCalls) > 0 {
+			s.calls = true
+		}
+		if choice.FinishReason != "" {
+			s.finishChunk = &openai.ChatCompletionStreamResponse{
+				ID:      chunk.ID,
+				Object:  chunk.Object,
+				Created: chunk.Created,
+				Model:   chunk.Model,
+				Choices: []openai.StreamChoice{{Index: choice.Index, FinishReason: choice.FinishReason}},
+			}
+			choice.FinishReason = ""
+			if isEmpty(choice.Delta) {
+				continue
+			}
+		}
+		choices = append(choices, choice)
+	}
+	if len(choices) == 0 {
+		s.skipBlank = true
+		return nil
+	}
+	chunk.Choices = choices
+	return encode(chunk)
+}
+
+// writeChunk writes a chunk held back
+func (s *streamWriter) writeChunk(chunk openai.ChatCompletionStreamResponse) {
+	s.ResponseWriter.Write(append(encode(chunk), '\n'))
+}
+
+func encode(chunk openai.ChatCompletionStreamResponse) []byte {
+	body, _ := json.Marshal(chunk)
+	return append(append([]byte("data: "), body...), '\n')
+}
+
+func isEmpty(delta openai.Delta) bool {
+	content, _ := delta.Content.(openai.Content_String)
+	return content.Content == "" && delta.ReasoningContent == "" && len(delta.ToolCalls) == 0
+}
+
+func ptrValue[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
+	}
+	return *p
+}
@@ -0,0 +1,34 @@
+// Package dashboard serves a small web UI showing the live traffic of the
+// proxy, drawn from the admin API
+package dashboard
+
+import (
+	_ "embed"
+	"net/http"
+
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+//go:embed index.html
+var index []byte
+
+// Handler serves the dashboard page. The page holds no data itself, it asks
+// for the admin API key and polls the admin endpoints with it.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		lgr := logutils.FromContext(ctx)
+		// Validate request method
+		if r.Method != "GET" {
+			lgr.Infof(ctx, "Invalid method %s", r.Method)
+			response.WriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Write(index)
+	})
+}
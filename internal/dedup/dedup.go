@@ -0,0 +1,206 @@
+// Package dedup collapses identical chat completions in flight into a single
+// upstream request, whose response is fanned out to all of them, such as the
+// duplicate retries agentic tools fire.
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/cache"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+// Header is set on the responses shared with identical requests
+const Header = "X-Proxy-Deduplicated"
+
+// maxResponseSize caps the size of the responses shared
+const maxResponseSize = 1 << 20
+
+var _ backend.Backend = &Deduplicator{}
+
+// Deduplicator is a backend which sends only the first of the identical
+// non-streaming chat completions of a client in flight to the backend it
+// wraps, and serves the others with its response once it completes. If it
+// doesn't complete successfully, such as when its client disconnects, the
+// others are sent to the backend themselves. Requests are identical if their
+// model, messages and parameters are.
+type Deduplicator struct {
+	backend.Backend
+
+	mu       sync.Mutex
+	inFlight map[string]*call
+
+	sent   atomic.Int64
+	shared atomic.Int64
+}
+
+// call is a request in flight, whose response identical requests wait for
+type call struct {
+	// done is closed once the response is recorded
+	done   chan struct{}
+	header http.Header
+	body   []byte
+	// ok is whether the response is a complete successful completion, which
+	// may be shared
+	ok bool
+}
+
+// New creates a new Deduplicator
+func New(be backend.Backend) *Deduplicator {
+	return &Deduplicator{
+		Backend:  be,
+		inFlight: map[string]*call{},
+	}
+}
+
+// HandleChatCompletion serves the request with the response of an identical
+// one in flight, if any, and otherwise with the wrapped backend
+func (d *Deduplicator) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	if req.Stream {
+		d.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+	lgr := logutils.FromContext(ctx)
+
+	// The key is taken before the backend maps the request in place, and is
+	// scoped to the client, whose requests may be served by its own upstream
+	key, err := cache.Key(req)
+	if err != nil {
+		lgr.Error(ctx, err.Error())
+		d.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+	key = contextutils.ScopeKey(ctx, key)
+
+	d.mu.Lock()
+	if c, ok := d.inFlight[key]; ok {
+		d.mu.Unlock()
+		d.wait(ctx, w, r, req, c)
+		return
+	}
+	c := &call{done: make(chan struct{})}
+	d.inFlight[key] = c
+	d.mu.Unlock()
+
+	d.sent.Add(1)
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		d.mu.Lock()
+		delete(d.inFlight, key)
+		d.mu.Unlock()
+		c.header, c.body, c.ok = rec.header, rec.body.Bytes(), rec.shareable()
+		close(c.done)
+	}()
+	d.Backend.HandleChatCompletion(ctx, rec, r, req)
+}
+
+// wait serves the request with the response of the identical call in flight
+// once it completes, or with the wrapped backend if it can't be shared
+func (d *Deduplicator) wait(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest, c *call) {
+	lgr := logutils.FromContext(ctx)
+	lgr.Debug(ctx, "Waiting for the response of an identical request in flight")
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		lgr.Info(ctx, "Context cancelled while waiting for an identical request")
+		return
+	}
+	if !c.ok {
+		lgr.Debug(ctx, "Identical request failed, sending the request upstream")
+		d.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	d.shared.Add(1)
+	// The headers the request was already served with, such as its request
+	// ID and rate limits, are its own
+	for name, values := range c.header {
+		if _, ok := w.Header()[name]; !ok {
+			w.Header()[name] = values
+		}
+	}
+	// The upstream cost is that of the identical request alone
+	w.Header().Del(backend.UpstreamCostHeader)
+	w.Header().Set(Header, "true")
+	// Shared responses use no tokens upstream
+	contextutils.ReportTokens(ctx, 0)
+	w.Write(c.body)
+}
+
+// Stats describes the requests sent to the backend and those served with the
+// responses of identical ones
+type Stats struct {
+	InFlight int   `json:"in_flight"`
+	Sent     int64 `json:"sent"`
+	Shared   int64 `json:"shared"`
+	Backend  any   `json:"backend,omitempty"`
+}
+
+// Stats returns the deduplication statistics along with the wrapped backend's,
+// if any
+func (d *Deduplicator) Stats() any {
+	d.mu.Lock()
+	stats := Stats{InFlight: len(d.inFlight)}
+	d.mu.Unlock()
+	stats.Sent = d.sent.Load()
+	stats.Shared = d.shared.Load()
+	if provider, ok := d.Backend.(backend.StatsProvider); ok {
+		stats.Backend = provider.Stats()
+	}
+	return stats
+}
+
+// recorder writes a response through while keeping a copy of it to share
+type recorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.header = r.ResponseWriter.Header().Clone()
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.header == nil {
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	if !r.overflow {
+		if r.body.Len()+len(b) > maxResponseSize {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// shareable is whether the response recorded is a complete successful
+// completion
+func (r *recorder) shareable() bool {
+	if r.status != http.StatusOK || r.overflow || r.body.Len() == 0 {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.header.Get("Content-Type"))
+	return mediaType == "application/json" && json.Valid(r.body.Bytes())
+}
@@ -0,0 +1,139 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Options configures a Checker
+type Options struct {
+	Backend backend.Backend
+	// Interval between probes. A zero interval disables health checking and
+	// the backend is always reported healthy.
+	Interval time.Duration
+	// Timeout for a single probe
+	Timeout time.Duration
+	// OnChange, if set, is called when the backend becomes unhealthy, and
+	// when it recovers
+	OnChange func(context.Context, Status)
+}
+
+// Checker periodically probes a backend and tracks whether it is healthy
+type Checker struct {
+	backend  backend.Backend
+	interval time.Duration
+	timeout  time.Duration
+	onChange func(context.Context, Status)
+
+	mu          sync.RWMutex
+	checked     bool
+	lastErr     error
+	lastChecked time.Time
+}
+
+// Status describes the result of the most recent probe
+type Status struct {
+	Enabled     bool      `json:"enabled"`
+	Healthy     bool      `json:"healthy"`
+	Error       string    `json:"error,omitempty"`
+	LastChecked time.Time `json:"last_checked,omitempty"`
+}
+
+// New creates a new Checker
+func New(opts Options) *Checker {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Checker{
+		backend:  opts.Backend,
+		interval: opts.Interval,
+		timeout:  timeout,
+		onChange: opts.OnChange,
+	}
+}
+
+// Run probes the backend immediately and then on every interval until the
+// context is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	if c.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready returns true once the backend has been probed successfully, or if
+// health checking is disabled.
+func (c *Checker) Ready() bool {
+	if c.interval <= 0 {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.checked && c.lastErr == nil
+}
+
+// Status returns the result of the most recent probe
+func (c *Checker) Status() Status {
+	if c.interval <= 0 {
+		return Status{Healthy: true}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	status := Status{
+		Enabled:     true,
+		Healthy:     c.checked && c.lastErr == nil,
+		LastChecked: c.lastChecked,
+	}
+	if c.lastErr != nil {
+		status.Error = c.lastErr.Error()
+	}
+	return status
+}
+
+func (c *Checker) check(ctx context.Context) {
+	lgr := logutils.FromContext(ctx)
+	probeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := c.backend.HealthCheck(probeCtx)
+
+	c.mu.Lock()
+	wasChecked := c.checked
+	wasHealthy := c.checked && c.lastErr == nil
+	c.checked = true
+	c.lastErr = err
+	c.lastChecked = time.Now()
+	c.mu.Unlock()
+
+	changed := false
+	switch {
+	case err != nil && (wasHealthy || !wasChecked):
+		lgr.Warnf(ctx, "Backend %s is unhealthy: %s", c.backend.Name(), err.Error())
+		changed = true
+	case err != nil:
+		lgr.Debugf(ctx, "Backend %s is still unhealthy: %s", c.backend.Name(), err.Error())
+	case !wasHealthy:
+		lgr.Infof(ctx, "Backend %s is healthy", c.backend.Name())
+		// Becoming healthy on the first probe isn't a recovery
+		changed = wasChecked
+	}
+	if changed && c.onChange != nil {
+		c.onChange(ctx, c.Status())
+	}
+}
@@ -0,0 +1,262 @@
+// Package jsonschema implements validation against the subset of JSON Schema
+// used by OpenAI structured outputs.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Validate checks value, as decoded by encoding/json, against schema and
+// returns a description of every violation found. A nil result means the
+// value is valid.
+func Validate(schema any, value any) []string {
+	v := &validator{root: schema}
+	v.validate(schema, value, "$")
+	return v.errs
+}
+
+type validator struct {
+	root any
+	errs []string
+}
+
+func (v *validator) errorf(path, format string, args ...any) {
+	v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) validate(schema any, value any, path string) {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			v.errorf(path, "no value is allowed")
+		}
+		return
+	case map[string]any:
+		v.validateObjectSchema(s, value, path)
+	}
+}
+
+func (v *validator) validateObjectSchema(s map[string]any, value any, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		resolved, err := v.resolve(ref)
+		if err != nil {
+			v.errorf(path, "%s", err.Error())
+			return
+		}
+		v.validate(resolved, value, path)
+		return
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, value) {
+		v.errorf(path, "expected type %v but got %s", t, typeOf(value))
+		return
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.errorf(path, "value is not one of %v", enum)
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, value) {
+		v.errorf(path, "value must be %v", c)
+	}
+
+	v.validateCombinators(s, value, path)
+
+	switch val := value.(type) {
+	case map[string]any:
+		v.validateObject(s, val, path)
+	case []any:
+		v.validateArray(s, val, path)
+	case string:
+		if n, ok := number(s["minLength"]); ok && float64(len([]rune(val))) < n {
+			v.errorf(path, "string is shorter than %v", n)
+		}
+		if n, ok := number(s["maxLength"]); ok && float64(len([]rune(val))) > n {
+			v.errorf(path, "string is longer than %v", n)
+		}
+	case float64:
+		if n, ok := number(s["minimum"]); ok && val < n {
+			v.errorf(path, "value is less than %v", n)
+		}
+		if n, ok := number(s["maximum"]); ok && val > n {
+			v.errorf(path, "value is greater than %v", n)
+		}
+	}
+}
+
+func (v *validator) validateCombinators(s map[string]any, value any, path string) {
+	if all, ok := s["allOf"].([]any); ok {
+		for _, sub := range all {
+			v.validate(sub, value, path)
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		if v.countMatches(anyOf, value, path) == 0 {
+			v.errorf(path, "value does not match any of the allowed schemas")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]any); ok {
+		if n := v.countMatches(oneOf, value, path); n != 1 {
+			v.errorf(path, "value must match exactly one schema but matched %d", n)
+		}
+	}
+}
+
+func (v *validator) countMatches(schemas []any, value any, path string) int {
+	matches := 0
+	for _, sub := range schemas {
+		child := &validator{root: v.root}
+		child.validate(sub, value, path)
+		if len(child.errs) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func (v *validator) validateObject(s map[string]any, obj map[string]any, path string) {
+	props, _ := s["properties"].(map[string]any)
+	if required, ok := s["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				v.errorf(path, "missing required property %q", name)
+			}
+		}
+	}
+	for name, val := range obj {
+		childPath := path + "." + name
+		if sub, ok := props[name]; ok {
+			v.validate(sub, val, childPath)
+			continue
+		}
+		switch additional := s["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.errorf(path, "unexpected property %q", name)
+			}
+		case map[string]any:
+			v.validate(additional, val, childPath)
+		}
+	}
+}
+
+func (v *validator) validateArray(s map[string]any, arr []any, path string) {
+	if n, ok := number(s["minItems"]); ok && float64(len(arr)) < n {
+		v.errorf(path, "array has fewer than %v items", n)
+	}
+	if n, ok := number(s["maxItems"]); ok && float64(len(arr)) > n {
+		v.errorf(path, "array has more than %v items", n)
+	}
+	if items, ok := s["items"]; ok {
+		for i, item := range arr {
+			v.validate(items, item, fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// resolve resolves local references such as "#/$defs/name"
+func (v *validator) resolve(ref string) (any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported reference %q", ref)
+	}
+	var cur any = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+	}
+	return cur, nil
+}
+
+func matchesType(t any, value any) bool {
+	switch tt := t.(type) {
+	case string:
+		return matchesSingleType(tt, value)
+	case []any:
+		for _, single := range tt {
+			if s, ok := single.(string); ok && matchesSingleType(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesSingleType(t string, value any) bool {
+	switch t {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func typeOf(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,91 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// decode decodes JSON as encoding/json does into an any
+func decode(t *testing.T, data string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	person := `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 5},
+			"age": {"type": "integer", "minimum": 0, "maximum": 150},
+			"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 2},
+			"role": {"enum": ["admin", "user"]},
+			"kind": {"const": "person"},
+			"nickname": {"type": ["string", "null"]}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false
+	}`
+
+	for _, tc := range []struct {
+		name   string
+		schema string
+		value  string
+		// wantErrs is the number of violations
+		wantErrs int
+	}{
+		{name: "valid", schema: person, value: `{"name": "Ann", "age": 30, "tags": ["a"], "role": "admin", "kind": "person", "nickname": null}`},
+		{name: "missing required", schema: person, value: `{"name": "Ann"}`, wantErrs: 1},
+		{name: "wrong type", schema: person, value: `{"name": 1, "age": 30}`, wantErrs: 1},
+		{name: "not an integer", schema: person, value: `{"name": "Ann", "age": 30.5}`, wantErrs: 1},
+		{name: "out of range", schema: person, value: `{"name": "Ann", "age": 200}`, wantErrs: 1},
+		{name: "too short", schema: person, value: `{"name": "", "age": 1}`, wantErrs: 1},
+		{name: "too long in runes", schema: person, value: `{"name": "Zoë Ann", "age": 1}`, wantErrs: 1},
+		{name: "runes not bytes", schema: person, value: `{"name": "Zoëyü", "age": 1}`},
+		{name: "too few items", schema: person, value: `{"name": "Ann", "age": 1, "tags": []}`, wantErrs: 1},
+		{name: "too many items", schema: person, value: `{"name": "Ann", "age": 1, "tags": ["a", "b", "c"]}`, wantErrs: 1},
+		{name: "invalid item", schema: person, value: `{"name": "Ann", "age": 1, "tags": [1]}`, wantErrs: 1},
+		{name: "not in enum", schema: person, value: `{"name": "Ann", "age": 1, "role": "root"}`, wantErrs: 1},
+		{name: "not the const", schema: person, value: `{"name": "Ann", "age": 1, "kind": "robot"}`, wantErrs: 1},
+		{name: "additional property", schema: person, value: `{"name": "Ann", "age": 1, "extra": true}`, wantErrs: 1},
+		{name: "several violations", schema: person, value: `{"age": -1, "extra": true}`, wantErrs: 3},
+		{name: "not an object", schema: person, value: `[]`, wantErrs: 1},
+		{
+			name:   "additional properties schema",
+			schema: `{"type": "object", "additionalProperties": {"type": "number"}}`,
+			value:  `{"a": 1, "b": "two"}`, wantErrs: 1,
+		},
+		{
+			name:   "reference",
+			schema: `{"$defs": {"id": {"type": "string"}}, "type": "object", "properties": {"id": {"$ref": "#/$defs/id"}}}`,
+			value:  `{"id": 1}`, wantErrs: 1,
+		},
+		{
+			name:   "unresolvable reference",
+			schema: `{"properties": {"id": {"$ref": "#/$defs/missing"}}}`,
+			value:  `{"id": 1}`, wantErrs: 1,
+		},
+		{
+			name:   "remote reference",
+			schema: `{"$ref": "https://example.com/schema.json"}`,
+			value:  `{}`, wantErrs: 1,
+		},
+		{name: "anyOf", schema: `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, value: `1`},
+		{name: "anyOf unmatched", schema: `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, value: `true`, wantErrs: 1},
+		{name: "oneOf", schema: `{"oneOf": [{"type": "string"}, {"type": "integer"}]}`, value: `"a"`},
+		{name: "oneOf matching both", schema: `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, value: `1`, wantErrs: 1},
+		{name: "allOf", schema: `{"allOf": [{"type": "number"}, {"minimum": 2}]}`, value: `1`, wantErrs: 1},
+		{name: "true schema", schema: `true`, value: `{"anything": [1]}`},
+		{name: "false schema", schema: `false`, value: `null`, wantErrs: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := Validate(decode(t, tc.schema), decode(t, tc.value))
+			if len(errs) != tc.wantErrs {
+				t.Errorf("Validate() = %q, want %d violations", errs, tc.wantErrs)
+			}
+		})
+	}
+}
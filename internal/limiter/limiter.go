@@ -0,0 +1,308 @@
+// Package limiter bounds the number of requests a backend serves at once,
+// queueing the excess by priority, and then in arrival order.
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+// defaultQueueTimeout is how long a request waits in the queue unless
+// configured otherwise
+const defaultQueueTimeout = 30 * time.Second
+
+// Priority classes of requests. The queued requests of a higher class are
+// served before those of lower ones.
+const (
+	// PriorityLow is that of background requests, such as batches
+	PriorityLow = "low"
+	// PriorityNormal is that of requests which don't stream, by default
+	PriorityNormal = "normal"
+	// PriorityHigh is that of interactive requests, which stream, by default
+	PriorityHigh = "high"
+)
+
+// Priorities are the priority classes, lowest first
+var Priorities = []string{PriorityLow, PriorityNormal, PriorityHigh}
+
+// queueDepths publishes the queue depth of every backend on the expvar
+// variables
+var queueDepths = expvar.NewMap("backend_queue_depth")
+
+var _ backend.Backend = &Limiter{}
+
+// Options configures a Limiter
+type Options struct {
+	Backend backend.Backend
+	// MaxConcurrent is the number of requests served at once
+	MaxConcurrent int
+	// MaxQueue is the number of requests waiting for one to finish, beyond
+	// which requests are rejected. Zero rejects requests as soon as
+	// MaxConcurrent are being served.
+	MaxQueue int
+	// QueueTimeout is how long a request waits in the queue before it is
+	// rejected
+	QueueTimeout time.Duration
+}
+
+// Limiter is a backend which serves at most a maximum number of chat
+// completions at once, such as to keep a local Ollama from being overwhelmed.
+// The requests beyond the maximum wait in a bounded queue, ordered by their
+// priority class and then their arrival, and are rejected with a 429 when the
+// queue is full of requests of their class or higher, or they waited for too
+// long. When the queue is full, a request displaces the last queued request of
+// a lower class, which is rejected instead.
+type Limiter struct {
+	backend.Backend
+	*slots
+}
+
+// slots are the requests a Limiter serves and queues, which the Limiters
+// created with With share
+type slots struct {
+	maxConcurrent int
+	maxQueue      int
+	queueTimeout  time.Duration
+
+	mu     sync.Mutex
+	active int
+	// queue holds the waiting requests, which receive their turn in order
+	queue *list.List
+
+	served    atomic.Int64
+	queued    atomic.Int64
+	rejected  atomic.Int64
+	timedOut  atomic.Int64
+	displaced atomic.Int64
+}
+
+// waiter is a request waiting in the queue
+type waiter struct {
+	priority int
+	// turn receives true when it is the request's turn, or false when a
+	// request of a higher class displaced it. It is buffered so that neither
+	// blocks on a request which gave up waiting.
+	turn chan bool
+}
+
+// New creates a new Limiter
+func New(opts Options) *Limiter {
+	queueTimeout := opts.QueueTimeout
+	if queueTimeout <= 0 {
+		queueTimeout = defaultQueueTimeout
+	}
+	l := &Limiter{
+		Backend: opts.Backend,
+		slots: &slots{
+			maxConcurrent: max(opts.MaxConcurrent, 1),
+			maxQueue:      max(opts.MaxQueue, 0),
+			queueTimeout:  queueTimeout,
+			queue:         list.New(),
+		},
+	}
+	queueDepths.Set(l.Name(), expvar.Func(func() any {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.queue.Len()
+	}))
+	return l
+}
+
+// With returns a Limiter serving requests with be within the limit and queue
+// of l, such as another upstream of the same backend
+func (l *Limiter) With(be backend.Backend) *Limiter {
+	return &Limiter{Backend: be, slots: l.slots}
+}
+
+// HandleChatCompletion serves the request once the backend has room for it,
+// or rejects it
+func (l *Limiter) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	start := time.Now()
+	if rejected := l.acquire(ctx, priority(ctx, req)); rejected != nil {
+		if ctx.Err() != nil {
+			lgr.Info(ctx, "Context cancelled while queued")
+			return
+		}
+		lgr.Warnf(ctx, "Rejecting request to %s: %s", l.Name(), rejected.message)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(l.queueTimeout.Seconds()))))
+		response.WriteErrorResponse(w, http.StatusTooManyRequests, openai.Error{
+			Message: rejected.message,
+			Type:    response.ErrorTypeRateLimit,
+			Code:    rejected.code,
+		})
+		return
+	}
+	defer l.release()
+
+	if waited := time.Since(start); waited >= time.Millisecond {
+		lgr.Debugf(ctx, "Request to %s was queued for %v", l.Name(), waited)
+	}
+	l.served.Add(1)
+	l.Backend.HandleChatCompletion(ctx, w, r, req)
+}
+
+// priority returns the rank of the priority class of the request, which is
+// high for streams and normal otherwise unless the context sets one
+func priority(ctx context.Context, req *openai.ChatCompletionRequest) int {
+	class := contextutils.GetPriority(ctx)
+	if class == "" {
+		class = PriorityNormal
+		if req.Stream {
+			class = PriorityHigh
+		}
+	}
+	if rank := slices.Index(Priorities, class); rank >= 0 {
+		return rank
+	}
+	return slices.Index(Priorities, PriorityNormal)
+}
+
+// rejection is why a request wasn't served
+type rejection struct {
+	code    string
+	message string
+}
+
+// acquire takes a slot, waiting in the queue for one if they are all taken,
+// behind the requests of the same priority or higher
+func (l *Limiter) acquire(ctx context.Context, priority int) *rejection {
+	l.mu.Lock()
+	if l.active < l.maxConcurrent && l.queue.Len() == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= l.maxQueue {
+		last := l.queue.Back()
+		if last == nil || last.Value.(*waiter).priority >= priority {
+			l.mu.Unlock()
+			l.rejected.Add(1)
+			return &rejection{
+				code:    "concurrency_limit_exceeded",
+				message: fmt.Sprintf("%s is serving %d requests with %d queued, please try again later", l.Name(), l.maxConcurrent, l.maxQueue),
+			}
+		}
+		l.queue.Remove(last)
+		last.Value.(*waiter).turn <- false
+	}
+	w := &waiter{priority: priority, turn: make(chan bool, 1)}
+	var elem *list.Element
+	for e := l.queue.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*waiter).priority >= priority {
+			elem = l.queue.InsertAfter(w, e)
+			break
+		}
+	}
+	if elem == nil {
+		elem = l.queue.PushFront(w)
+	}
+	l.mu.Unlock()
+	l.queued.Add(1)
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	timedOut := false
+	select {
+	case served := <-w.turn:
+		if served {
+			return nil
+		}
+		l.displaced.Add(1)
+		return &rejection{
+			code:    "concurrency_limit_exceeded",
+			message: fmt.Sprintf("Request was displaced from the queue of %s by a request of a higher priority, please try again later", l.Name()),
+		}
+	case <-timer.C:
+		timedOut = true
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	select {
+	case served := <-w.turn:
+		// The turn came while giving up, so it is passed on, unless the
+		// request was displaced and so is no longer queued
+		l.mu.Unlock()
+		if served {
+			l.release()
+		}
+	default:
+		l.queue.Remove(elem)
+		l.mu.Unlock()
+	}
+	if !timedOut {
+		return &rejection{code: "cancelled", message: ctx.Err().Error()}
+	}
+	l.timedOut.Add(1)
+	return &rejection{
+		code:    "queue_timeout",
+		message: fmt.Sprintf("Request was queued for %s for more than %v, please try again later", l.Name(), l.queueTimeout),
+	}
+}
+
+// release frees a slot, handing it to the first request in the queue
+func (l *Limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if front := l.queue.Front(); front != nil {
+		l.queue.Remove(front)
+		front.Value.(*waiter).turn <- true
+		return
+	}
+	l.active--
+}
+
+// Stats describes the requests being served and queued
+type Stats struct {
+	MaxConcurrent int   `json:"max_concurrent"`
+	MaxQueue      int   `json:"max_queue"`
+	Active        int   `json:"active"`
+	QueueDepth    int   `json:"queue_depth"`
+	Served        int64 `json:"served"`
+	Queued        int64 `json:"queued"`
+	Rejected      int64 `json:"rejected"`
+	TimedOut      int64 `json:"timed_out"`
+	// Displaced are the queued requests rejected to make room for requests
+	// of a higher priority class
+	Displaced int64 `json:"displaced"`
+	Backend   any   `json:"backend,omitempty"`
+}
+
+// Stats returns the concurrency statistics along with the wrapped backend's,
+// if any
+func (l *Limiter) Stats() any {
+	l.mu.Lock()
+	stats := Stats{
+		MaxConcurrent: l.maxConcurrent,
+		MaxQueue:      l.maxQueue,
+		Active:        l.active,
+		QueueDepth:    l.queue.Len(),
+	}
+	l.mu.Unlock()
+	stats.Served = l.served.Load()
+	stats.Queued = l.queued.Load()
+	stats.Rejected = l.rejected.Load()
+	stats.TimedOut = l.timedOut.Load()
+	stats.Displaced = l.displaced.Load()
+	if provider, ok := l.Backend.(backend.StatsProvider); ok {
+		stats.Backend = provider.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,275 @@
+package limiter
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+)
+
+// timeout bounds how long the tests wait for requests to be queued or served
+const timeout = 5 * time.Second
+
+// namedBackend is a backend of which only the name is used
+type namedBackend struct {
+	backend.Backend
+	name string
+}
+
+func (b namedBackend) Name() string { return b.name }
+
+// queued is a request waiting for a slot
+type queued struct {
+	name     string
+	priority string
+}
+
+// result is the outcome of a queued request
+type result struct {
+	name     string
+	rejected *rejection
+}
+
+func TestAcquireOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxQueue int
+		// requests are queued in order while the only slot is taken
+		requests []queued
+		// wantServed are the requests served in order as slots free up
+		wantServed []string
+		// wantRejected are the requests rejected or displaced
+		wantRejected  []string
+		wantDisplaced int64
+	}{
+		{
+			name:       "arrival order within a class",
+			maxQueue:   3,
+			requests:   []queued{{"first", PriorityNormal}, {"second", PriorityNormal}, {"third", PriorityNormal}},
+			wantServed: []string{"first", "second", "third"},
+		},
+		{
+			name:       "higher classes first",
+			maxQueue:   4,
+			requests:   []queued{{"low", PriorityLow}, {"normal", PriorityNormal}, {"high", PriorityHigh}, {"normal2", PriorityNormal}},
+			wantServed: []string{"high", "normal", "normal2", "low"},
+		},
+		{
+			name:         "full queue rejects the same class",
+			maxQueue:     1,
+			requests:     []queued{{"first", PriorityNormal}, {"second", PriorityNormal}},
+			wantServed:   []string{"first"},
+			wantRejected: []string{"second"},
+		},
+		{
+			name:         "full queue rejects a lower class",
+			maxQueue:     1,
+			requests:     []queued{{"high", PriorityHigh}, {"low", PriorityLow}},
+			wantServed:   []string{"high"},
+			wantRejected: []string{"low"},
+		},
+		{
+			name:          "higher class displaces the last of a lower class",
+			maxQueue:      2,
+			requests:      []queued{{"low", PriorityLow}, {"normal", PriorityNormal}, {"high", PriorityHigh}},
+			wantServed:    []string{"high", "normal"},
+			wantRejected:  []string{"low"},
+			wantDisplaced: 1,
+		},
+		{
+			name:          "displaced in turn",
+			maxQueue:      1,
+			requests:      []queued{{"low", PriorityLow}, {"normal", PriorityNormal}, {"high", PriorityHigh}},
+			wantServed:    []string{"high"},
+			wantRejected:  []string{"low", "normal"},
+			wantDisplaced: 2,
+		},
+		{
+			name:         "no queue",
+			maxQueue:     0,
+			requests:     []queued{{"normal", PriorityNormal}, {"high", PriorityHigh}},
+			wantRejected: []string{"normal", "high"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := New(Options{
+				Backend:       namedBackend{name: "test"},
+				MaxConcurrent: 1,
+				MaxQueue:      tc.maxQueue,
+				QueueTimeout:  time.Minute,
+			})
+			ctx := context.Background()
+			if rejected := l.acquire(ctx, slices.Index(Priorities, PriorityNormal)); rejected != nil {
+				t.Fatalf("first request was rejected: %s", rejected.message)
+			}
+
+			results := make(chan result, len(tc.requests))
+			for i, req := range tc.requests {
+				go func() {
+					results <- result{req.name, l.acquire(ctx, slices.Index(Priorities, req.priority))}
+				}()
+				// Each request is queued or rejected before the next arrives
+				waitFor(t, func() bool { return l.queued.Load()+l.rejected.Load() == int64(i+1) })
+			}
+
+			var rejected []string
+			for range tc.wantRejected {
+				r := receive(t, results)
+				if r.rejected == nil {
+					t.Fatalf("%s was served while the slot was taken", r.name)
+				}
+				rejected = append(rejected, r.name)
+			}
+			if !sameElements(rejected, tc.wantRejected) {
+				t.Errorf("rejected %v, want %v", rejected, tc.wantRejected)
+			}
+
+			var served []string
+			for range tc.wantServed {
+				l.release()
+				r := receive(t, results)
+				if r.rejected != nil {
+					t.Fatalf("%s was rejected: %s", r.name, r.rejected.message)
+				}
+				served = append(served, r.name)
+			}
+			if !slices.Equal(served, tc.wantServed) {
+				t.Errorf("served %v, want %v", served, tc.wantServed)
+			}
+			if got := l.displaced.Load(); got != tc.wantDisplaced {
+				t.Errorf("displaced %d, want %d", got, tc.wantDisplaced)
+			}
+
+			l.release()
+			stats := l.Stats().(Stats)
+			if stats.Active != 0 || stats.QueueDepth != 0 {
+				t.Errorf("%d requests still active and %d queued", stats.Active, stats.QueueDepth)
+			}
+		})
+	}
+}
+
+func TestAcquireGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		timeout  time.Duration
+		cancel   bool
+		wantCode string
+	}{
+		{name: "timed out", timeout: 10 * time.Millisecond, wantCode: "queue_timeout"},
+		{name: "cancelled", timeout: time.Minute, cancel: true, wantCode: "cancelled"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := New(Options{
+				Backend:       namedBackend{name: "test"},
+				MaxConcurrent: 1,
+				MaxQueue:      1,
+				QueueTimeout:  tc.timeout,
+			})
+			if rejected := l.acquire(context.Background(), 0); rejected != nil {
+				t.Fatalf("first request was rejected: %s", rejected.message)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			results := make(chan result, 1)
+			go func() {
+				results <- result{"queued", l.acquire(ctx, 0)}
+			}()
+			waitFor(t, func() bool { return l.queued.Load() == 1 })
+			if tc.cancel {
+				cancel()
+			}
+
+			r := receive(t, results)
+			if r.rejected == nil || r.rejected.code != tc.wantCode {
+				t.Fatalf("got rejection %+v, want code %s", r.rejected, tc.wantCode)
+			}
+			// The request left the queue, so the slot is free once released
+			l.release()
+			if rejected := l.acquire(context.Background(), 0); rejected != nil {
+				t.Errorf("slot wasn't freed: %s", rejected.message)
+			}
+		})
+	}
+}
+
+func TestWithSharesSlots(t *testing.T) {
+	l := New(Options{Backend: namedBackend{name: "test"}, MaxConcurrent: 1})
+	other := l.With(namedBackend{name: "other"})
+	if other.Name() != "other" {
+		t.Errorf("Name() = %s, want other", other.Name())
+	}
+
+	if rejected := l.acquire(context.Background(), 0); rejected != nil {
+		t.Fatalf("first request was rejected: %s", rejected.message)
+	}
+	if rejected := other.acquire(context.Background(), 0); rejected == nil {
+		t.Error("a Limiter created with With took a slot beyond the shared limit")
+	}
+	l.release()
+	if rejected := other.acquire(context.Background(), 0); rejected != nil {
+		t.Errorf("a Limiter created with With didn't take the freed slot: %s", rejected.message)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		class  string
+		stream bool
+		want   string
+	}{
+		{name: "request", want: PriorityNormal},
+		{name: "stream", stream: true, want: PriorityHigh},
+		{name: "set by the context", class: PriorityLow, stream: true, want: PriorityLow},
+		{name: "unknown class", class: "urgent", want: PriorityNormal},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.class != "" {
+				ctx = contextutils.WithPriority(ctx, tc.class)
+			}
+			got := priority(ctx, &openai.ChatCompletionRequest{Stream: tc.stream})
+			if want := slices.Index(Priorities, tc.want); got != want {
+				t.Errorf("priority() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// waitFor waits until cond holds, failing t if it doesn't in time
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the requests")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// receive receives a result, failing t if there is none in time
+func receive(t *testing.T, results <-chan result) result {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for a request's outcome")
+		return result{}
+	}
+}
+
+// sameElements is whether a and b hold the same elements in any order
+func sameElements(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
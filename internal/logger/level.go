@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"log/slog"
 	"strings"
 )
 
@@ -17,23 +18,30 @@ type LogLevel int
 
 func LevelFromString(level string) LogLevel {
 	defaultLogLevel := LogLevel(INFO)
+	if l, ok := ParseLevel(level); ok {
+		return l
+	}
+	return defaultLogLevel
+}
+
+// ParseLevel parses a level name, such as debug, returning whether it is one
+func ParseLevel(level string) (LogLevel, bool) {
 	switch strings.ToLower(level) {
 	case "trace":
-		return TRACE
+		return TRACE, true
 	case "debug":
-		return DEBUG
+		return DEBUG, true
 	case "info":
-		return INFO
+		return INFO, true
 	case "warn", "warning":
-		return WARN
+		return WARN, true
 	case "error":
-		return ERROR
+		return ERROR, true
 	case "fatal", "panic":
-		return FATAL
+		return FATAL, true
 	default:
-		return defaultLogLevel
+		return INFO, false
 	}
-
 }
 
 func (l LogLevel) String() string {
@@ -54,3 +62,35 @@ func (l LogLevel) String() string {
 
 	return "UNKNOWN"
 }
+
+// slogLevel maps l onto slog's levels, which are spaced four apart
+func slogLevel(l LogLevel) slog.Level {
+	switch l {
+	case TRACE:
+		return slog.LevelDebug - 4
+	case DEBUG:
+		return slog.LevelDebug
+	case INFO:
+		return slog.LevelInfo
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	default:
+		return slog.LevelError + 4
+	}
+}
+
+// replaceLevel names the TRACE and FATAL levels, which slog doesn't know
+func replaceLevel(_ []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.LevelKey {
+		return a
+	}
+	switch level := a.Value.Any().(slog.Level); {
+	case level < slog.LevelDebug:
+		a.Value = slog.StringValue(LogLevel(TRACE).String())
+	case level > slog.LevelError:
+		a.Value = slog.StringValue(LogLevel(FATAL).String())
+	}
+	return a
+}
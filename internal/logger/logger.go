@@ -3,7 +3,12 @@ package logger
 import (
 	"context"
 	"fmt"
-	"time"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+	"sync"
 
 	"github.com/danilofalcao/cursor-deepseek/internal/constants"
 	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
@@ -13,73 +18,213 @@ var (
 	Fallback = New(context.Background(), "fallback", DEBUG, make(chan string))
 )
 
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Options configures a Logger
+type Options struct {
+	Name  string
+	Level LogLevel
+	// ModuleLevels overrides Level for the loggers of the named modules, such
+	// as "deepseek" for the deepseek backend
+	ModuleLevels map[string]LogLevel
+	// Format is either FormatText, the default, or FormatJSON
+	Format string
+	// Output defaults to stdout
+	Output io.Writer
+	ExitCh chan string
+}
+
+// Logger is a leveled logger built on slog. Each record carries the name of
+// the logger's module, the request ID of the context it is logged with, and
+// any fields added with With.
 type Logger struct {
 	name   string
 	ctx    context.Context
-	level  LogLevel
 	exitCh chan string
+	// levels are shared with clones, so they can be changed at runtime
+	levels *levels
+	// override is the level set with WithLevel, which takes precedence
+	override *LogLevel
+
+	// base has no fields, so clones don't inherit the fields of their parent
+	base *slog.Logger
+	slog *slog.Logger
 }
 
-func New(ctx context.Context, name string, level LogLevel, exitCh chan string) *Logger {
-	return &Logger{
-		name:   name,
-		ctx:    ctx,
-		level:  level,
-		exitCh: exitCh,
-	}
+// levels are the default level of a logger and its clones, and the levels
+// which override it for some modules
+type levels struct {
+	mu      sync.RWMutex
+	level   LogLevel
+	modules map[string]LogLevel
 }
 
-func out(ctx context.Context, s string, level LogLevel) {
-	if reqId := contextutils.GetRequestID(ctx); reqId != "" {
-		outWithReqId(s, level, reqId)
-		return
+func (lv *levels) get(module string) LogLevel {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+	if level, ok := lv.modules[module]; ok {
+		return level
 	}
-	fmt.Printf("[%s][%s] %s\n", time.Now().Local().Format(time.DateTime), level.String(), s)
+	return lv.level
 }
 
-func outWithReqId(s string, level LogLevel, reqId string) {
-	fmt.Printf("[%s][%s][%s] %s\n", time.Now().Local().Format(time.DateTime), level.String(), reqId, s)
+// New creates a logger writing text to stdout
+func New(ctx context.Context, name string, level LogLevel, exitCh chan string) *Logger {
+	return NewWithOptions(ctx, Options{
+		Name:   name,
+		Level:  level,
+		ExitCh: exitCh,
+	})
 }
 
+// NewWithOptions creates a logger configured by opts
+func NewWithOptions(ctx context.Context, opts Options) *Logger {
+	output := opts.Output
+	if output == nil {
+		output = os.Stdout
+	}
+
+	handlerOpts := &slog.HandlerOptions{
+		// Levels are filtered by the Logger so they can differ per module
+		Level:       slogLevel(TRACE),
+		ReplaceAttr: replaceAttr,
+	}
+	var handler slog.Handler
+	if strings.EqualFold(opts.Format, FormatJSON) {
+		handler = slog.NewJSONHandler(output, handlerOpts)
+	} else {
+		handler = slog.NewTextHandler(output, handlerOpts)
+	}
+
+	modules := make(map[string]LogLevel, len(opts.ModuleLevels))
+	for module, level := range opts.ModuleLevels {
+		modules[module] = level
+	}
+
+	base := slog.New(handler)
+	return &Logger{
+		name:   opts.Name,
+		ctx:    ctx,
+		exitCh: opts.ExitCh,
+		levels: &levels{
+			level:   opts.Level,
+			modules: modules,
+		},
+		base: base,
+		slog: base.With("module", opts.Name),
+	}
+}
+
+// Clone creates a logger for the named module, returning it along with a
+// context carrying it
 func (l *Logger) Clone(name string) (*Logger, context.Context) {
-	lgr := New(l.ctx, name, l.level, l.exitCh)
+	lgr := &Logger{
+		name:   name,
+		ctx:    l.ctx,
+		exitCh: l.exitCh,
+		levels: l.levels,
+		base:   l.base,
+		slog:   l.base.With("module", name),
+	}
 	ctx := context.WithValue(l.ctx, constants.LoggerKey, lgr)
 	return lgr, ctx
 }
 
+// With returns a logger which adds the key/value pairs, such as "model" and
+// its name, to every record
+func (l *Logger) With(args ...any) *Logger {
+	lgr := *l
+	lgr.slog = l.slog.With(args...)
+	return &lgr
+}
+
 func (l *Logger) WithLevel(level LogLevel) *Logger {
-	l.level = level
+	l.override = &level
 	return l
 }
 
-func (l *Logger) Trace(ctx context.Context, s string) {
-	if l.level > TRACE {
+// Level returns the level of the logger
+func (l *Logger) Level() LogLevel {
+	if l.override != nil {
+		return *l.override
+	}
+	return l.levels.get(l.name)
+}
+
+// Levels returns the default level of the logger and its clones, and the
+// levels configured for modules
+func (l *Logger) Levels() (LogLevel, map[string]LogLevel) {
+	l.levels.mu.RLock()
+	defer l.levels.mu.RUnlock()
+	return l.levels.level, maps.Clone(l.levels.modules)
+}
+
+// SetLevel changes the default level of the logger and its clones
+func (l *Logger) SetLevel(level LogLevel) {
+	l.levels.mu.Lock()
+	defer l.levels.mu.Unlock()
+	l.levels.level = level
+}
+
+// SetModuleLevel changes the level of the named module's loggers
+func (l *Logger) SetModuleLevel(module string, level LogLevel) {
+	l.levels.mu.Lock()
+	defer l.levels.mu.Unlock()
+	l.levels.modules[module] = level
+}
+
+// ResetModuleLevel makes the named module's loggers use the default level
+func (l *Logger) ResetModuleLevel(module string) {
+	l.levels.mu.Lock()
+	defer l.levels.mu.Unlock()
+	delete(l.levels.modules, module)
+}
+
+func (l *Logger) out(ctx context.Context, s string, level LogLevel) {
+	if l.Level() > level {
 		return
 	}
-	out(ctx, s, TRACE)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var attrs []any
+	if reqId := contextutils.GetRequestID(ctx); reqId != "" {
+		attrs = append(attrs, "request_id", reqId)
+	}
+	if client := contextutils.GetClient(ctx); client != "" {
+		attrs = append(attrs, "client", client)
+	}
+	l.slog.Log(ctx, slogLevel(level), s, attrs...)
+}
+
+func (l *Logger) Trace(ctx context.Context, s string) {
+	l.out(ctx, s, TRACE)
 }
 
 func (l *Logger) Tracef(ctx context.Context, s string, args ...any) {
+	if l.Level() > TRACE {
+		return
+	}
 	l.Trace(ctx, fmt.Sprintf(s, args...))
 }
 
 func (l *Logger) Debug(ctx context.Context, s string) {
-	if l.level > DEBUG {
-		return
-	}
-	out(ctx, s, DEBUG)
+	l.out(ctx, s, DEBUG)
 }
 
 func (l *Logger) Debugf(ctx context.Context, s string, args ...any) {
+	if l.Level() > DEBUG {
+		return
+	}
 	l.Debug(ctx, fmt.Sprintf(s, args...))
-
 }
 
 func (l *Logger) Info(ctx context.Context, s string) {
-	if l.level > INFO {
-		return
-	}
-	out(ctx, s, INFO)
+	l.out(ctx, s, INFO)
 }
 
 func (l *Logger) Infof(ctx context.Context, s string, args ...any) {
@@ -87,10 +232,7 @@ func (l *Logger) Infof(ctx context.Context, s string, args ...any) {
 }
 
 func (l *Logger) Warn(ctx context.Context, s string) {
-	if l.level > WARN {
-		return
-	}
-	out(ctx, s, WARN)
+	l.out(ctx, s, WARN)
 }
 
 func (l *Logger) Warnf(ctx context.Context, s string, args ...any) {
@@ -98,10 +240,7 @@ func (l *Logger) Warnf(ctx context.Context, s string, args ...any) {
 }
 
 func (l *Logger) Error(ctx context.Context, s string) {
-	if l.level > ERROR {
-		return
-	}
-	out(ctx, s, ERROR)
+	l.out(ctx, s, ERROR)
 }
 
 func (l *Logger) Errorf(ctx context.Context, s string, args ...any) {
@@ -109,13 +248,25 @@ func (l *Logger) Errorf(ctx context.Context, s string, args ...any) {
 }
 
 func (l *Logger) Fatal(ctx context.Context, s string) {
-	if l.level > FATAL {
+	if l.Level() > FATAL {
 		return
 	}
-	out(ctx, s, FATAL)
+	l.out(ctx, s, FATAL)
 	l.exitCh <- s
 }
 
 func (l *Logger) Fatalf(ctx context.Context, s string, args ...any) {
 	l.Fatal(ctx, fmt.Sprintf(s, args...))
 }
+
+// replaceAttr names the custom levels and masks secrets in the message and
+// string fields of every record, so that they never reach the logs
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey {
+		return replaceLevel(groups, a)
+	}
+	if a.Value.Kind() == slog.KindString {
+		a.Value = slog.StringValue(Redact(a.Value.String()))
+	}
+	return a
+}
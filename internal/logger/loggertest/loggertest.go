@@ -0,0 +1,21 @@
+// Package loggertest provides loggers for tests
+package loggertest
+
+import (
+	"context"
+	"io"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+// Context returns a context with a logger discarding what is logged, which
+// the code logging with the logger of its context requires
+func Context() context.Context {
+	lgr := logger.NewWithOptions(context.Background(), logger.Options{
+		Name:   "test",
+		Level:  logger.LevelFromString("error"),
+		Output: io.Discard,
+	})
+	return logutils.ContextWithLogger(context.Background(), lgr)
+}
@@ -0,0 +1,69 @@
+package logger
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// sensitiveHeaders carry credentials, and are masked by RedactHeaders
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"X-Api-Key",
+	"Cookie",
+	"Set-Cookie",
+}
+
+var (
+	// bearerPattern matches the tokens of authorization header values
+	bearerPattern = regexp.MustCompile(`(?i)\b(bearer\s+)([A-Za-z0-9._~+/=*-]+)`)
+	// keyPattern matches API keys such as those of DeepSeek and OpenRouter
+	keyPattern = regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{8,}`)
+)
+
+// MaskSecret masks all but the last four characters of a secret, keeping the
+// sk- prefix of API keys, such as sk-***abcd
+func MaskSecret(secret string) string {
+	prefix := ""
+	if strings.HasPrefix(secret, "sk-") {
+		prefix = "sk-"
+	}
+	if len(secret)-len(prefix) <= 8 {
+		return prefix + "***"
+	}
+	return prefix + "***" + secret[len(secret)-4:]
+}
+
+// Redact masks the bearer tokens and API keys in s
+func Redact(s string) string {
+	if !strings.Contains(s, "sk-") && !strings.Contains(strings.ToLower(s), "bearer") {
+		return s
+	}
+	s = bearerPattern.ReplaceAllStringFunc(s, func(match string) string {
+		parts := bearerPattern.FindStringSubmatch(match)
+		// Leave tokens which were already masked
+		if strings.Contains(parts[2], "***") {
+			return match
+		}
+		return parts[1] + MaskSecret(parts[2])
+	})
+	return keyPattern.ReplaceAllStringFunc(s, MaskSecret)
+}
+
+// RedactHeaders returns a copy of header with the values of the headers which
+// carry credentials masked
+func RedactHeaders(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range sensitiveHeaders {
+		values := header.Values(name)
+		for i, value := range values {
+			if scheme, token, ok := strings.Cut(value, " "); ok && strings.EqualFold(scheme, "bearer") {
+				values[i] = scheme + " " + MaskSecret(token)
+			} else {
+				values[i] = MaskSecret(value)
+			}
+		}
+	}
+	return header
+}
@@ -0,0 +1,150 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backupTimeFormat sorts lexically in time order and is safe in file names
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is a log file which is renamed with the time of rotation once
+// it reaches maxSize. Rotated files are pruned by count and age.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errors.Wrap(err, "error creating log directory")
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, errors.New("log file is closed")
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "error opening log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "error reading log file")
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file and opens a new one in its place
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return errors.Wrap(err, "error closing log file")
+	}
+	f.file = nil
+
+	prefix, ext := f.backupPrefix()
+	backup := prefix + time.Now().UTC().Format(backupTimeFormat) + ext
+	if err := os.Rename(f.path, backup); err != nil {
+		return errors.Wrap(err, "error rotating log file")
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes the oldest backups beyond maxBackups and those older than
+// maxAge. Failures are ignored, as they will be retried on the next rotation.
+func (f *rotatingFile) prune() {
+	if f.maxBackups <= 0 && f.maxAge <= 0 {
+		return
+	}
+
+	prefix, ext := f.backupPrefix()
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return
+	}
+	// Skip other files which happen to share the prefix
+	var backups []string
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, prefix), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// Newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, backup := range backups {
+		if f.maxBackups > 0 && i >= f.maxBackups {
+			os.Remove(backup)
+			continue
+		}
+		if f.maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				os.Remove(backup)
+			}
+		}
+	}
+}
+
+// backupPrefix splits the path around where backups insert their timestamp,
+// such as proxy- and .log for proxy.log
+func (f *rotatingFile) backupPrefix() (string, string) {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-", ext
+}
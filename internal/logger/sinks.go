@@ -0,0 +1,119 @@
+package logger
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sink types
+const (
+	SinkStdout = "stdout"
+	SinkStderr = "stderr"
+	SinkFile   = "file"
+	SinkSyslog = "syslog"
+)
+
+const defaultSyslogTag = "cursor-deepseek"
+
+// Sink is a destination logs are written to
+type Sink struct {
+	// Type is one of SinkStdout, SinkStderr, SinkFile or SinkSyslog
+	Type string
+
+	// Path is the file written by file sinks
+	Path string
+	// MaxSize is the size in bytes at which the file is rotated, or 0 to never
+	// rotate it
+	MaxSize int64
+	// MaxAge is how long rotated files are kept, or 0 to keep them regardless
+	// of age
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files are kept, or 0 to keep them all
+	MaxBackups int
+
+	// Network and Address are the syslog server, such as udp and
+	// localhost:514. The local syslog daemon is used if Address is empty.
+	Network string
+	Address string
+	// Tag is the syslog tag, which defaults to cursor-deepseek
+	Tag string
+}
+
+// OpenSinks opens the sinks, returning a writer which writes to all of them.
+// Closing it closes the files and syslog connections. Stdout is used if no
+// sinks are given.
+func OpenSinks(sinks []Sink) (io.WriteCloser, error) {
+	if len(sinks) == 0 {
+		sinks = []Sink{{Type: SinkStdout}}
+	}
+
+	var out multiSink
+	for _, sink := range sinks {
+		w, err := openSink(sink)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+func openSink(sink Sink) (io.WriteCloser, error) {
+	switch strings.ToLower(sink.Type) {
+	case SinkStdout, "":
+		return nopCloser{os.Stdout}, nil
+	case SinkStderr:
+		return nopCloser{os.Stderr}, nil
+	case SinkFile:
+		if sink.Path == "" {
+			return nil, errors.New("file log sink requires a path")
+		}
+		return openRotatingFile(sink.Path, sink.MaxSize, sink.MaxAge, sink.MaxBackups)
+	case SinkSyslog:
+		tag := sink.Tag
+		if tag == "" {
+			tag = defaultSyslogTag
+		}
+		return openSyslog(sink.Network, sink.Address, tag)
+	default:
+		return nil, errors.Errorf("unknown log sink type %s", sink.Type)
+	}
+}
+
+// multiSink writes to every sink, so that a failing sink doesn't stop logs
+// reaching the others
+type multiSink []io.WriteCloser
+
+func (m multiSink) Write(p []byte) (int, error) {
+	var err error
+	for _, w := range m {
+		if _, writeErr := w.Write(p); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	return len(p), err
+}
+
+func (m multiSink) Close() error {
+	var err error
+	for _, w := range m {
+		if closeErr := w.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// nopCloser keeps the standard streams open when the sinks are closed
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
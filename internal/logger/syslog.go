@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"io"
+	"log/syslog"
+
+	"github.com/pkg/errors"
+)
+
+// openSyslog connects to the syslog server. Records are sent with the info
+// priority, as the level is already part of the formatted record.
+func openSyslog(network, address, tag string) (io.WriteCloser, error) {
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to syslog")
+	}
+	return w, nil
+}
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+var _ backend.Backend = &Aliases{}
+
+// AliasRule maps the models requested which match it to an upstream model
+type AliasRule struct {
+	// Pattern is a glob pattern such as "gpt-4*", which "*" matches models
+	// with a slash too
+	Pattern string
+	// Regex is a regular expression, used instead of Pattern
+	Regex string
+	// Backend serves the models matched. If nil, the primary backend does.
+	Backend backend.Backend
+	// Model is the upstream model, which may refer to the submatches of Regex
+	// as $1
+	Model string
+}
+
+// AliasOptions configures Aliases
+type AliasOptions struct {
+	Primary backend.Backend
+	// Rules are evaluated in order, the first matching the model requested
+	// applying
+	Rules []AliasRule
+}
+
+type aliasRule struct {
+	AliasRule
+	re *regexp.Regexp
+}
+
+// Aliases is a backend which maps the models requested to upstream models by
+// wildcard and regular expression rules, so that clients hardcoding the names
+// of other providers' models are served without an entry for each name. The
+// models matched by a rule with a backend are sent to that backend. Models
+// which match no rule are passed on as they are.
+type Aliases struct {
+	primary backend.Backend
+	rules   []aliasRule
+
+	aliased atomic.Int64
+}
+
+// NewAliases compiles the rules of Aliases
+func NewAliases(opts AliasOptions) (*Aliases, error) {
+	a := &Aliases{primary: opts.Primary}
+	for i, r := range opts.Rules {
+		rule := aliasRule{AliasRule: r}
+		switch {
+		case r.Model == "":
+			return nil, errors.Errorf("model alias %d requires a model", i)
+		case r.Regex != "":
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid model alias %d", i)
+			}
+			rule.re = re
+		case r.Pattern != "":
+			if _, err := path.Match(r.Pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid model alias %d", i)
+			}
+		default:
+			return nil, errors.Errorf("model alias %d requires a pattern or a regex", i)
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+// Name returns the name of the primary backend
+func (a *Aliases) Name() string {
+	return a.primary.Name()
+}
+
+// HandleChatCompletion sends the request to the backend and upstream model of
+// the first rule matching its model
+func (a *Aliases) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	be, model, ok := a.resolve(req.Model)
+	if !ok {
+		a.primary.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+	a.aliased.Add(1)
+	logutils.FromContext(ctx).Debugf(ctx, "Aliasing model %s to %s on backend %s", req.Model, model, be.Name())
+	be.HandleChatCompletion(contextutils.WithModelOverride(ctx, model), w, r, req)
+}
+
+// resolve returns the backend and upstream model of the first rule matching
+// model
+func (a *Aliases) resolve(model string) (backend.Backend, string, bool) {
+	for _, rule := range a.rules {
+		be := rule.Backend
+		if be == nil {
+			be = a.primary
+		}
+		if rule.re != nil {
+			match := rule.re.FindStringSubmatchIndex(model)
+			if match == nil {
+				continue
+			}
+			return be, string(rule.re.ExpandString(nil, rule.Model, model, match)), true
+		}
+		if ok, _ := path.Match(rule.Pattern, model); ok || rule.Pattern == "*" {
+			return be, rule.Model, true
+		}
+	}
+	return nil, "", false
+}
+
+// ListModels returns the models of the primary backend
+func (a *Aliases) ListModels(ctx context.Context) ([]openai.Model, error) {
+	return a.primary.ListModels(ctx)
+}
+
+// ValidateAPIKey validates the API key against the primary backend
+func (a *Aliases) ValidateAPIKey(apiKey string) bool {
+	return a.primary.ValidateAPIKey(apiKey)
+}
+
+// HealthCheck probes the primary backend, and the backends of the rules
+func (a *Aliases) HealthCheck(ctx context.Context) error {
+	checked := map[backend.Backend]bool{a.primary: true}
+	for _, rule := range a.rules {
+		if rule.Backend == nil || checked[rule.Backend] {
+			continue
+		}
+		checked[rule.Backend] = true
+		if err := rule.Backend.HealthCheck(ctx); err != nil {
+			logutils.FromContext(ctx).Warnf(ctx, "Alias backend %s is unhealthy: %s", rule.Backend.Name(), err.Error())
+		}
+	}
+	return a.primary.HealthCheck(ctx)
+}
+
+// AliasStats describes how often models were aliased
+type AliasStats struct {
+	Rules   int   `json:"rules"`
+	Aliased int64 `json:"aliased"`
+	Primary any   `json:"primary,omitempty"`
+}
+
+// Stats returns the aliasing statistics along with the primary backend's, if
+// any
+func (a *Aliases) Stats() any {
+	stats := AliasStats{
+		Rules:   len(a.rules),
+		Aliased: a.aliased.Load(),
+	}
+	if provider, ok := a.primary.(backend.StatsProvider); ok {
+		stats.Primary = provider.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger/loggertest"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+)
+
+func TestAliases(t *testing.T) {
+	// served records the backend and upstream model a request was sent to
+	var servedBy, servedModel string
+	newBackend := func(name string) *funcBackend {
+		return &funcBackend{name: name, handle: func(ctx context.Context, w http.ResponseWriter, req *openai.ChatCompletionRequest) {
+			servedBy, servedModel = name, contextutils.GetModelOverride(ctx)
+		}}
+	}
+	primary, ollama := newBackend("primary"), newBackend("ollama")
+	a, err := NewAliases(AliasOptions{
+		Primary: primary,
+		Rules: []AliasRule{
+			{Pattern: "gpt-4o-mini", Model: "deepseek-chat"},
+			{Pattern: "gpt-4*", Model: "deepseek-reasoner"},
+			{Regex: `^llama-(\d+)b$`, Model: "llama3:${1}b", Backend: ollama},
+			{Pattern: "claude-?-*", Model: "deepseek-chat"},
+			{Pattern: "*", Model: "fallback"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAliases: %v", err)
+	}
+	unmatched, err := NewAliases(AliasOptions{
+		Primary: primary,
+		Rules:   []AliasRule{{Pattern: "gpt-*", Model: "deepseek-chat"}},
+	})
+	if err != nil {
+		t.Fatalf("NewAliases: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		aliases     *Aliases
+		model       string
+		wantBackend string
+		// wantModel is the upstream model override, empty when the model
+		// isn't aliased
+		wantModel string
+	}{
+		{name: "exact pattern", aliases: a, model: "gpt-4o-mini", wantBackend: "primary", wantModel: "deepseek-chat"},
+		{name: "first matching rule", aliases: a, model: "gpt-4o", wantBackend: "primary", wantModel: "deepseek-reasoner"},
+		{name: "regex with backend", aliases: a, model: "llama-70b", wantBackend: "ollama", wantModel: "llama3:70b"},
+		{name: "single character wildcard", aliases: a, model: "claude-3-opus", wantBackend: "primary", wantModel: "deepseek-chat"},
+		{name: "catch-all with a slash", aliases: a, model: "openai/gpt-4o", wantBackend: "primary", wantModel: "fallback"},
+		{name: "unanchored regex part", aliases: a, model: "llama-70b-instruct", wantBackend: "primary", wantModel: "fallback"},
+		{name: "wildcard without a slash", aliases: unmatched, model: "openai/gpt-4o", wantBackend: "primary"},
+		{name: "no matching rule", aliases: unmatched, model: "deepseek-chat", wantBackend: "primary"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			servedBy, servedModel = "", ""
+			req := &openai.ChatCompletionRequest{Model: tc.model}
+			tc.aliases.HandleChatCompletion(loggertest.Context(), httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), req)
+			if servedBy != tc.wantBackend || servedModel != tc.wantModel {
+				t.Errorf("served by %q as %q, want %q as %q", servedBy, servedModel, tc.wantBackend, tc.wantModel)
+			}
+			if req.Model != tc.model {
+				t.Errorf("requested model changed to %q", req.Model)
+			}
+		})
+	}
+}
+
+func TestNewAliases(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rule    AliasRule
+		wantErr bool
+	}{
+		{name: "pattern", rule: AliasRule{Pattern: "gpt-*", Model: "deepseek-chat"}},
+		{name: "regex", rule: AliasRule{Regex: "^gpt-(.*)$", Model: "$1"}},
+		{name: "no model", rule: AliasRule{Pattern: "gpt-*"}, wantErr: true},
+		{name: "no pattern", rule: AliasRule{Model: "deepseek-chat"}, wantErr: true},
+		{name: "invalid pattern", rule: AliasRule{Pattern: "gpt-[", Model: "deepseek-chat"}, wantErr: true},
+		{name: "invalid regex", rule: AliasRule{Regex: "gpt-(", Model: "deepseek-chat"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAliases(AliasOptions{Primary: &funcBackend{name: "primary"}, Rules: []AliasRule{tc.rule}})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("NewAliases() error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
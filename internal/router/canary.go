@@ -0,0 +1,134 @@
+package router
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+const (
+	// VariantHeader is the response header identifying which variant served a request
+	VariantHeader = "X-Proxy-Variant"
+
+	VariantPrimary = "primary"
+	VariantCanary  = "canary"
+)
+
+var _ backend.Backend = &Canary{}
+
+// CanaryOptions configures a Canary
+type CanaryOptions struct {
+	Primary backend.Backend
+	// Canary is the backend receiving the canary traffic. If nil, the
+	// primary backend is used with the canary model.
+	Canary backend.Backend
+	// Model, if set, is the upstream model used for canary traffic
+	Model string
+	// Percent is the share of traffic, from 0 to 100, sent to the canary
+	Percent float64
+}
+
+// Canary is a backend which sends a percentage of chat completion traffic to
+// an alternate backend and/or model, tagging every response with the variant
+// which served it.
+type Canary struct {
+	primary backend.Backend
+	canary  backend.Backend
+	model   string
+	percent float64
+
+	primaryRequests atomic.Int64
+	canaryRequests  atomic.Int64
+	canaryHealthy   atomic.Bool
+}
+
+// NewCanary creates a new Canary
+func NewCanary(opts CanaryOptions) *Canary {
+	canary := opts.Canary
+	if canary == nil {
+		canary = opts.Primary
+	}
+	c := &Canary{
+		primary: opts.Primary,
+		canary:  canary,
+		model:   opts.Model,
+		percent: opts.Percent,
+	}
+	c.canaryHealthy.Store(true)
+	return c
+}
+
+// Name returns the name of the primary backend
+func (c *Canary) Name() string {
+	return c.primary.Name()
+}
+
+// HandleChatCompletion sends the request to the primary or canary variant
+func (c *Canary) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	if !c.canaryHealthy.Load() || rand.Float64()*100 >= c.percent {
+		c.primaryRequests.Add(1)
+		w.Header().Set(VariantHeader, VariantPrimary)
+		c.primary.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	c.canaryRequests.Add(1)
+	logutils.FromContext(ctx).Debugf(ctx, "Routing request to canary backend %s", c.canary.Name())
+	if c.model != "" {
+		ctx = contextutils.WithModelOverride(ctx, c.model)
+	}
+	w.Header().Set(VariantHeader, VariantCanary)
+	c.canary.HandleChatCompletion(ctx, w, r, req)
+}
+
+// ListModels returns the models of the primary backend
+func (c *Canary) ListModels(ctx context.Context) ([]openai.Model, error) {
+	return c.primary.ListModels(ctx)
+}
+
+// ValidateAPIKey validates the API key against the primary backend
+func (c *Canary) ValidateAPIKey(apiKey string) bool {
+	return c.primary.ValidateAPIKey(apiKey)
+}
+
+// HealthCheck probes the primary backend, and the canary backend if it differs.
+// While the canary is unhealthy, all traffic is sent to the primary.
+func (c *Canary) HealthCheck(ctx context.Context) error {
+	if c.canary != c.primary {
+		c.canaryHealthy.Store(c.canary.HealthCheck(ctx) == nil)
+	}
+	return c.primary.HealthCheck(ctx)
+}
+
+// CanaryStats describes how traffic has been split between the variants
+type CanaryStats struct {
+	Percent         float64 `json:"percent"`
+	CanaryBackend   string  `json:"canary_backend"`
+	CanaryModel     string  `json:"canary_model,omitempty"`
+	CanaryHealthy   bool    `json:"canary_healthy"`
+	PrimaryRequests int64   `json:"primary_requests"`
+	CanaryRequests  int64   `json:"canary_requests"`
+	Primary         any     `json:"primary,omitempty"`
+}
+
+// Stats returns the traffic split along with the primary backend's statistics, if any
+func (c *Canary) Stats() any {
+	stats := CanaryStats{
+		Percent:         c.percent,
+		CanaryBackend:   c.canary.Name(),
+		CanaryModel:     c.model,
+		CanaryHealthy:   c.canaryHealthy.Load(),
+		PrimaryRequests: c.primaryRequests.Load(),
+		CanaryRequests:  c.canaryRequests.Load(),
+	}
+	if provider, ok := c.primary.(backend.StatsProvider); ok {
+		stats.Primary = provider.Stats()
+	}
+	return stats
+}
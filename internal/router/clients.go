@@ -0,0 +1,101 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+var _ backend.Backend = &Clients{}
+
+// ClientsOptions configures Clients
+type ClientsOptions struct {
+	// Default serves the clients without a backend of their own
+	Default backend.Backend
+	// Backends are the backends serving the named clients, such as with their
+	// own upstream API keys
+	Backends map[string]backend.Backend
+}
+
+// Clients is a backend which sends the requests of each client bound to its
+// own backend, such as a backend with the client's upstream API key, to that
+// backend, by the name of the client which authenticated the request. The
+// requests of other clients are sent to the default backend.
+type Clients struct {
+	defaultBackend backend.Backend
+	backends       map[string]backend.Backend
+
+	bound atomic.Int64
+}
+
+// NewClients creates a new Clients
+func NewClients(opts ClientsOptions) *Clients {
+	return &Clients{
+		defaultBackend: opts.Default,
+		backends:       opts.Backends,
+	}
+}
+
+// Name returns the name of the default backend
+func (c *Clients) Name() string {
+	return c.defaultBackend.Name()
+}
+
+// pick returns the backend of the client which authenticated the request
+func (c *Clients) pick(ctx context.Context) (backend.Backend, bool) {
+	if be, ok := c.backends[contextutils.GetClient(ctx)]; ok {
+		return be, true
+	}
+	return c.defaultBackend, false
+}
+
+// HandleChatCompletion sends the request to the backend of its client
+func (c *Clients) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	be, bound := c.pick(ctx)
+	if bound {
+		c.bound.Add(1)
+		logutils.FromContext(ctx).Debugf(ctx, "Routing request to the %s backend of client %s", be.Name(), contextutils.GetClient(ctx))
+	}
+	be.HandleChatCompletion(ctx, w, r, req)
+}
+
+// ListModels returns the models of the backend of the client listing them
+func (c *Clients) ListModels(ctx context.Context) ([]openai.Model, error) {
+	be, _ := c.pick(ctx)
+	return be.ListModels(ctx)
+}
+
+// ValidateAPIKey validates the API key against the default backend
+func (c *Clients) ValidateAPIKey(apiKey string) bool {
+	return c.defaultBackend.ValidateAPIKey(apiKey)
+}
+
+// HealthCheck probes the default backend
+func (c *Clients) HealthCheck(ctx context.Context) error {
+	return c.defaultBackend.HealthCheck(ctx)
+}
+
+// ClientsStats describes the requests sent to the backends of clients
+type ClientsStats struct {
+	Clients int   `json:"clients"`
+	Bound   int64 `json:"bound"`
+	Default any   `json:"default,omitempty"`
+}
+
+// Stats returns the number of requests sent to the backends of clients along
+// with the default backend's statistics, if any
+func (c *Clients) Stats() any {
+	stats := ClientsStats{
+		Clients: len(c.backends),
+		Bound:   c.bound.Load(),
+	}
+	if provider, ok := c.defaultBackend.(backend.StatsProvider); ok {
+		stats.Default = provider.Stats()
+	}
+	return stats
+}
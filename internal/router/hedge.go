@@ -0,0 +1,299 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HedgeHeader is the response header identifying which request served a
+	// hedged request, primary or hedge
+	HedgeHeader = "X-Proxy-Hedge"
+
+	HedgePrimary = "primary"
+	HedgeHedge   = "hedge"
+)
+
+var _ backend.Backend = &Hedge{}
+
+// HedgeOptions configures a Hedge
+type HedgeOptions struct {
+	Primary backend.Backend
+	// Backend receives the hedged requests. If nil, they are sent to the
+	// primary backend again.
+	Backend backend.Backend
+	// Delay is how long the primary request has to produce its first byte
+	// before it is hedged
+	Delay time.Duration
+}
+
+// Hedge is a backend which hedges requests against tail latency. When the
+// primary request hasn't produced its first byte within the delay, a
+// duplicate request is sent, and whichever responds first is served while
+// the other is cancelled.
+type Hedge struct {
+	primary backend.Backend
+	hedge   backend.Backend
+	delay   time.Duration
+
+	requests  atomic.Int64
+	hedged    atomic.Int64
+	hedgeWins atomic.Int64
+}
+
+// NewHedge creates a new Hedge
+func NewHedge(opts HedgeOptions) *Hedge {
+	hedge := opts.Backend
+	if hedge == nil {
+		hedge = opts.Primary
+	}
+	return &Hedge{
+		primary: opts.Primary,
+		hedge:   hedge,
+		delay:   opts.Delay,
+	}
+}
+
+// Name returns the name of the primary backend
+func (h *Hedge) Name() string {
+	return h.primary.Name()
+}
+
+// HandleChatCompletion sends the request to the primary backend, hedging it
+// if it is slow to respond. A request which fails with a server error or a
+// rate limit loses to one still running.
+func (h *Hedge) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+	h.requests.Add(1)
+
+	// Backends modify the request while the primary runs, so the hedge gets
+	// its own deep copy, taken before the primary starts
+	hedgeReq, err := cloneRequest(req)
+	if err != nil {
+		lgr.Warnf(ctx, "Unable to copy the request, it won't be hedged: %s", err.Error())
+		h.primary.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	results := make(chan *contender, 2)
+	primary := h.start(ctx, h.primary, r, req, results)
+	defer primary.cancel()
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+
+	var hedge *contender
+	running := 1
+	for {
+		select {
+		case <-timer.C:
+			h.hedged.Add(1)
+			lgr.Infof(ctx, "No response from %s within %v, hedging the request with %s", h.primary.Name(), h.delay, h.hedge.Name())
+			hedge = h.start(ctx, h.hedge, r, hedgeReq, results)
+			defer hedge.cancel()
+			running++
+			continue
+		case winner := <-results:
+			running--
+			if winner.failed() && running > 0 {
+				lgr.Infof(ctx, "Hedged request to %s failed with status %d, waiting for the other", winner.backend.Name(), winner.status)
+				continue
+			}
+
+			// The loser is cancelled as soon as the winner is served
+			if hedge != nil {
+				served := HedgePrimary
+				if winner == hedge {
+					served = HedgeHedge
+					h.hedgeWins.Add(1)
+					primary.cancel()
+				} else {
+					hedge.cancel()
+				}
+				w.Header().Set(HedgeHeader, served)
+			}
+			winner.serve(w)
+			<-winner.done
+			return
+		}
+	}
+}
+
+// start runs the request on be, reporting the contender to results once it
+// produces its first byte or finishes
+func (h *Hedge) start(ctx context.Context, be backend.Backend, r *http.Request, req *openai.ChatCompletionRequest, results chan<- *contender) *contender {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &contender{
+		backend: be,
+		cancel:  cancel,
+		header:  http.Header{},
+		status:  http.StatusOK,
+		ready:   results,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(c.done)
+		be.HandleChatCompletion(ctx, c, r.WithContext(ctx), req)
+		c.report()
+	}()
+	return c
+}
+
+// cloneRequest deep copies the request, which shares none of its messages,
+// tools or parameters with it
+func cloneRequest(req *openai.ChatCompletionRequest) (*openai.ChatCompletionRequest, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding request")
+	}
+	var clone openai.ChatCompletionRequest
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, errors.Wrap(err, "error decoding request")
+	}
+	return &clone, nil
+}
+
+// ListModels returns the models of the primary backend
+func (h *Hedge) ListModels(ctx context.Context) ([]openai.Model, error) {
+	return h.primary.ListModels(ctx)
+}
+
+// ValidateAPIKey validates the API key against the primary backend
+func (h *Hedge) ValidateAPIKey(apiKey string) bool {
+	return h.primary.ValidateAPIKey(apiKey)
+}
+
+// HealthCheck probes the primary backend, and the hedge backend if it differs
+func (h *Hedge) HealthCheck(ctx context.Context) error {
+	if h.hedge != h.primary {
+		if err := h.hedge.HealthCheck(ctx); err != nil {
+			logutils.FromContext(ctx).Warnf(ctx, "Hedge backend %s is unhealthy: %s", h.hedge.Name(), err.Error())
+		}
+	}
+	return h.primary.HealthCheck(ctx)
+}
+
+// HedgeStats describes how often requests were hedged
+type HedgeStats struct {
+	DelayMs      int64  `json:"delay_ms"`
+	HedgeBackend string `json:"hedge_backend"`
+	Requests     int64  `json:"requests"`
+	Hedged       int64  `json:"hedged"`
+	HedgeWins    int64  `json:"hedge_wins"`
+	Primary      any    `json:"primary,omitempty"`
+}
+
+// Stats returns the hedging statistics along with the primary backend's, if any
+func (h *Hedge) Stats() any {
+	stats := HedgeStats{
+		DelayMs:      h.delay.Milliseconds(),
+		HedgeBackend: h.hedge.Name(),
+		Requests:     h.requests.Load(),
+		Hedged:       h.hedged.Load(),
+		HedgeWins:    h.hedgeWins.Load(),
+	}
+	if provider, ok := h.primary.(backend.StatsProvider); ok {
+		stats.Primary = provider.Stats()
+	}
+	return stats
+}
+
+// contender is the response writer of one of the requests of a hedged
+// request. It buffers the response until it is served, and then writes
+// through to the client.
+type contender struct {
+	backend backend.Backend
+	cancel  context.CancelFunc
+	ready   chan<- *contender
+	done    chan struct{}
+
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	buf      bytes.Buffer
+	w        http.ResponseWriter
+	reported bool
+}
+
+func (c *contender) Header() http.Header {
+	return c.header
+}
+
+func (c *contender) WriteHeader(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w != nil {
+		c.w.WriteHeader(status)
+		return
+	}
+	c.status = status
+}
+
+func (c *contender) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.w != nil {
+		defer c.mu.Unlock()
+		return c.w.Write(b)
+	}
+	c.buf.Write(b)
+	c.mu.Unlock()
+
+	// Comments, such as heartbeats, don't count as the first byte
+	if len(b) > 0 && b[0] != ':' {
+		c.report()
+	}
+	return len(b), nil
+}
+
+func (c *contender) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if flusher, ok := c.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// report offers the contender to be served, once
+func (c *contender) report() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.reported {
+		c.reported = true
+		c.ready <- c
+	}
+}
+
+// failed returns whether the response is an error another request may do
+// better than
+func (c *contender) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status >= http.StatusInternalServerError || c.status == http.StatusTooManyRequests
+}
+
+// serve writes what has been buffered to w, and the rest of the response
+// straight to it
+func (c *contender) serve(w http.ResponseWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, values := range c.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.buf.Bytes())
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	c.buf = bytes.Buffer{}
+	c.w = w
+}
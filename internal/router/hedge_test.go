@@ -0,0 +1,99 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger/loggertest"
+)
+
+// funcBackend is a backend serving chat completions with a function
+type funcBackend struct {
+	name   string
+	handle func(ctx context.Context, w http.ResponseWriter, req *openai.ChatCompletionRequest)
+}
+
+func (b *funcBackend) Name() string { return b.name }
+
+func (b *funcBackend) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	b.handle(ctx, w, req)
+}
+
+func (b *funcBackend) ListModels(context.Context) ([]openai.Model, error) { return nil, nil }
+
+func (b *funcBackend) ValidateAPIKey(string) bool { return true }
+
+func (b *funcBackend) HealthCheck(context.Context) error { return nil }
+
+func TestHedgeCopiesRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// mutate changes the request in place, as backends do
+		mutate func(req *openai.ChatCompletionRequest)
+		// unchanged returns whether the hedge's request is the original
+		unchanged func(req *openai.ChatCompletionRequest) bool
+	}{
+		{
+			name: "messages",
+			mutate: func(req *openai.ChatCompletionRequest) {
+				req.Messages[0].Content = openai.Content_String{Content: "changed"}
+			},
+			unchanged: func(req *openai.ChatCompletionRequest) bool {
+				return req.Messages[0].Content == openai.Content_String{Content: "Hello"}
+			},
+		},
+		{
+			name: "tools",
+			mutate: func(req *openai.ChatCompletionRequest) {
+				req.Tools[0].Function.Name = "changed"
+			},
+			unchanged: func(req *openai.ChatCompletionRequest) bool {
+				return req.Tools[0].Function.Name == "lookup"
+			},
+		},
+		{
+			name: "parameters",
+			mutate: func(req *openai.ChatCompletionRequest) {
+				*req.Temperature = 2
+			},
+			unchanged: func(req *openai.ChatCompletionRequest) bool {
+				return *req.Temperature == 0.5
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primary := &funcBackend{name: "primary", handle: func(ctx context.Context, w http.ResponseWriter, req *openai.ChatCompletionRequest) {
+				tc.mutate(req)
+				<-ctx.Done()
+			}}
+			unchanged := make(chan bool, 1)
+			hedge := &funcBackend{name: "hedge", handle: func(ctx context.Context, w http.ResponseWriter, req *openai.ChatCompletionRequest) {
+				unchanged <- tc.unchanged(req)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("{}"))
+			}}
+			h := NewHedge(HedgeOptions{Primary: primary, Backend: hedge, Delay: time.Millisecond})
+
+			temperature := 0.5
+			req := &openai.ChatCompletionRequest{
+				Model:       "model",
+				Messages:    []openai.Message{{Role: "user", Content: openai.Content_String{Content: "Hello"}}},
+				Tools:       []openai.Tool{{Type: "function", Function: openai.Function{Name: "lookup"}}},
+				Temperature: &temperature,
+			}
+			rec := httptest.NewRecorder()
+			h.HandleChatCompletion(loggertest.Context(), rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), req)
+
+			if got := rec.Header().Get(HedgeHeader); got != HedgeHedge {
+				t.Fatalf("expected the hedge to serve the request, got %q", got)
+			}
+			if !<-unchanged {
+				t.Error("the hedge's request was changed by the primary backend")
+			}
+		})
+	}
+}
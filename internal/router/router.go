@@ -0,0 +1,286 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+const (
+	// PolicyFirst always routes to the first configured backend
+	PolicyFirst = "first"
+	// PolicyFastest routes to the backend with the best rolling latency and error rate
+	PolicyFastest = "fastest"
+
+	// weight given to the newest sample in the rolling averages
+	ewmaAlpha = 0.2
+	// how heavily errors penalize a backend's latency score
+	errorPenalty = 10
+)
+
+var _ backend.Backend = &Router{}
+
+// Options configures a Router
+type Options struct {
+	Backends []backend.Backend
+	Policy   string
+}
+
+// Router is a backend which routes each request to one of a set of backends
+// according to a policy, tracking live statistics for each of them.
+type Router struct {
+	backends []backend.Backend
+	policy   string
+
+	mu     sync.Mutex
+	stats  map[string]*stats
+	health map[string]error
+}
+
+// New creates a new Router
+func New(opts Options) *Router {
+	policy := opts.Policy
+	if policy == "" {
+		policy = PolicyFirst
+	}
+	r := &Router{
+		backends: opts.Backends,
+		policy:   policy,
+		stats:    make(map[string]*stats, len(opts.Backends)),
+		health:   make(map[string]error, len(opts.Backends)),
+	}
+	for _, be := range opts.Backends {
+		r.stats[be.Name()] = &stats{}
+	}
+	return r
+}
+
+// Name returns the name of the backend
+func (r *Router) Name() string {
+	return "router"
+}
+
+// HandleChatCompletion routes the request to the selected backend and records
+// its latency, time to first byte and outcome.
+func (r *Router) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, req *http.Request, chatReq *openai.ChatCompletionRequest) {
+	be := r.pick()
+	logutils.FromContext(ctx).Debugf(ctx, "Routing request to backend %s with policy %s", be.Name(), r.policy)
+
+	rec := &recorder{
+		ResponseWriter: w,
+		Flusher:        w.(http.Flusher),
+		start:          time.Now(),
+		status:         http.StatusOK,
+	}
+	be.HandleChatCompletion(ctx, rec, req, chatReq)
+	r.record(be.Name(), rec)
+}
+
+// ListModels returns the union of the models of every backend
+func (r *Router) ListModels(ctx context.Context) ([]openai.Model, error) {
+	seen := make(map[string]bool)
+	models := make([]openai.Model, 0)
+	for _, be := range r.backends {
+		beModels, err := be.ListModels(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range beModels {
+			if seen[m.ID] {
+				continue
+			}
+			seen[m.ID] = true
+			models = append(models, m)
+		}
+	}
+	return models, nil
+}
+
+// ValidateAPIKey accepts an API key which is valid for any of the backends
+func (r *Router) ValidateAPIKey(apiKey string) bool {
+	for _, be := range r.backends {
+		if be.ValidateAPIKey(apiKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthCheck probes every backend, recording which are healthy so that
+// unhealthy ones are skipped by routing. An error is returned only if no
+// backend is healthy.
+func (r *Router) HealthCheck(ctx context.Context) error {
+	var lastErr error
+	healthy := 0
+	for _, be := range r.backends {
+		err := be.HealthCheck(ctx)
+		r.mu.Lock()
+		r.health[be.Name()] = err
+		r.mu.Unlock()
+		if err != nil {
+			lastErr = errors.Wrapf(err, "backend %s", be.Name())
+			continue
+		}
+		healthy++
+	}
+	if healthy == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// BackendStats describes the live statistics of a single backend
+type BackendStats struct {
+	Name        string  `json:"name"`
+	Healthy     bool    `json:"healthy"`
+	HealthError string  `json:"health_error,omitempty"`
+	Requests    int64   `json:"requests"`
+	Errors      int64   `json:"errors"`
+	LatencyMs   float64 `json:"latency_ms"`
+	TTFTMs      float64 `json:"ttft_ms"`
+	ErrorRate   float64 `json:"error_rate"`
+	Endpoints   any     `json:"endpoints,omitempty"`
+}
+
+// Stats returns a snapshot of the statistics of every backend
+func (r *Router) Stats() any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]BackendStats, 0, len(r.backends))
+	for _, be := range r.backends {
+		s := r.stats[be.Name()]
+		bs := BackendStats{
+			Name:      be.Name(),
+			Healthy:   r.health[be.Name()] == nil,
+			Requests:  s.requests,
+			Errors:    s.errors,
+			LatencyMs: s.latency,
+			TTFTMs:    s.ttft,
+			ErrorRate: s.errorRate,
+		}
+		if err := r.health[be.Name()]; err != nil {
+			bs.HealthError = err.Error()
+		}
+		if provider, ok := be.(backend.StatsProvider); ok {
+			bs.Endpoints = provider.Stats()
+		}
+		out = append(out, bs)
+	}
+	return out
+}
+
+func (r *Router) pick() backend.Backend {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	candidates := make([]backend.Backend, 0, len(r.backends))
+	for _, be := range r.backends {
+		if r.health[be.Name()] == nil {
+			candidates = append(candidates, be)
+		}
+	}
+	// If nothing is healthy, try anyway rather than refusing every request
+	if len(candidates) == 0 {
+		candidates = r.backends
+	}
+
+	if r.policy != PolicyFastest || len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	var best backend.Backend
+	bestScore := 0.0
+	for _, be := range candidates {
+		s := r.stats[be.Name()]
+		// Make sure every backend gets sampled before trusting the numbers
+		if s.requests == 0 {
+			return be
+		}
+		score := s.score()
+		if best == nil || score < bestScore {
+			best = be
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func (r *Router) record(name string, rec *recorder) {
+	latency := time.Since(rec.start)
+	ttft := latency
+	if !rec.firstByte.IsZero() {
+		ttft = rec.firstByte.Sub(rec.start)
+	}
+	failed := rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats[name].add(latency, ttft, failed)
+}
+
+type stats struct {
+	requests  int64
+	errors    int64
+	latency   float64
+	ttft      float64
+	errorRate float64
+}
+
+func (s *stats) add(latency, ttft time.Duration, failed bool) {
+	errVal := 0.0
+	if failed {
+		errVal = 1
+		s.errors++
+	}
+	latencyMs := float64(latency) / float64(time.Millisecond)
+	ttftMs := float64(ttft) / float64(time.Millisecond)
+	if s.requests == 0 {
+		s.latency, s.ttft, s.errorRate = latencyMs, ttftMs, errVal
+	} else {
+		s.latency = ewma(s.latency, latencyMs)
+		s.ttft = ewma(s.ttft, ttftMs)
+		s.errorRate = ewma(s.errorRate, errVal)
+	}
+	s.requests++
+}
+
+// score is lower for better backends
+func (s *stats) score() float64 {
+	return s.ttft * (1 + errorPenalty*s.errorRate)
+}
+
+func ewma(prev, sample float64) float64 {
+	return ewmaAlpha*sample + (1-ewmaAlpha)*prev
+}
+
+// recorder captures the status and time to first byte of a response
+type recorder struct {
+	http.ResponseWriter
+	http.Flusher
+	start         time.Time
+	firstByte     time.Time
+	status        int
+	headerWritten bool
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.headerWritten {
+		rec.status = status
+		rec.headerWritten = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.firstByte.IsZero() {
+		rec.firstByte = time.Now()
+	}
+	rec.headerWritten = true
+	return rec.ResponseWriter.Write(b)
+}
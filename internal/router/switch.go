@@ -0,0 +1,161 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	"github.com/pkg/errors"
+)
+
+var (
+	_ backend.Backend  = &Switch{}
+	_ backend.Switcher = &Switch{}
+)
+
+// SwitchOptions configures a Switch
+type SwitchOptions struct {
+	// Primary serves requests unless another backend is switched to
+	Primary backend.Backend
+	// Backends are the names of the backends which may be switched to
+	Backends []string
+	// New creates the named backend the first time it is switched to
+	New func(name string) (backend.Backend, error)
+}
+
+// switched is the backend and default model a Switch sends requests to
+type switched struct {
+	name         string
+	backend      backend.Backend
+	defaultModel string
+}
+
+// Switch is a backend which sends requests to the primary backend, or to
+// another one switched to at runtime, optionally with another default model.
+// Switching applies to new requests, while those in flight finish on the
+// backend they started on.
+type Switch struct {
+	primary backend.Backend
+	names   []string
+	new     func(name string) (backend.Backend, error)
+	current atomic.Pointer[switched]
+
+	mu sync.Mutex
+	// backends are those created so far, by name
+	backends map[string]backend.Backend
+}
+
+// NewSwitch creates a new Switch sending requests to the primary backend
+func NewSwitch(opts SwitchOptions) *Switch {
+	s := &Switch{
+		primary:  opts.Primary,
+		names:    slices.Sorted(slices.Values(opts.Backends)),
+		new:      opts.New,
+		backends: map[string]backend.Backend{},
+	}
+	s.current.Store(&switched{backend: opts.Primary})
+	return s
+}
+
+// Switch sends new requests to the named backend, or the primary one if name
+// is empty, with the default model, or the backend's own if empty
+func (s *Switch) Switch(name, defaultModel string) error {
+	be := s.primary
+	if name != "" {
+		var err error
+		if be, err = s.backend(name); err != nil {
+			return err
+		}
+	}
+	s.current.Store(&switched{name: name, backend: be, defaultModel: defaultModel})
+	return nil
+}
+
+// backend returns the named backend, creating it if it is switched to for the
+// first time
+func (s *Switch) backend(name string) (backend.Backend, error) {
+	if !slices.Contains(s.names, name) {
+		return nil, errors.Errorf("unknown backend %s, expected one of %s", name, strings.Join(s.names, ", "))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if be, ok := s.backends[name]; ok {
+		return be, nil
+	}
+	be, err := s.new(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating backend %s", name)
+	}
+	s.backends[name] = be
+	return be, nil
+}
+
+// Switched returns the backend and default model switched to
+func (s *Switch) Switched() (string, string) {
+	current := s.current.Load()
+	return current.name, current.defaultModel
+}
+
+// Backends returns the names of the backends which may be switched to
+func (s *Switch) Backends() []string {
+	return s.names
+}
+
+// Name returns the name of the current backend
+func (s *Switch) Name() string {
+	return s.current.Load().backend.Name()
+}
+
+// HandleChatCompletion sends the request to the current backend, with the
+// default model switched to
+func (s *Switch) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	current := s.current.Load()
+	if current.defaultModel != "" {
+		ctx = contextutils.WithDefaultModel(ctx, current.defaultModel)
+	}
+	current.backend.HandleChatCompletion(ctx, w, r, req)
+}
+
+// ListModels returns the models of the current backend
+func (s *Switch) ListModels(ctx context.Context) ([]openai.Model, error) {
+	return s.current.Load().backend.ListModels(ctx)
+}
+
+// ValidateAPIKey validates the API key against the primary backend, so that
+// clients keep authenticating with the same key after switching
+func (s *Switch) ValidateAPIKey(apiKey string) bool {
+	return s.primary.ValidateAPIKey(apiKey)
+}
+
+// HealthCheck probes the current backend
+func (s *Switch) HealthCheck(ctx context.Context) error {
+	return s.current.Load().backend.HealthCheck(ctx)
+}
+
+// SwitchStats describes the backend and default model switched to
+type SwitchStats struct {
+	Backend      string `json:"backend"`
+	Switched     bool   `json:"switched"`
+	DefaultModel string `json:"default_model,omitempty"`
+	Current      any    `json:"current,omitempty"`
+}
+
+// Stats returns the backend switched to along with its statistics, if any
+func (s *Switch) Stats() any {
+	current := s.current.Load()
+	stats := SwitchStats{
+		Backend:      current.backend.Name(),
+		Switched:     current.name != "" || current.defaultModel != "",
+		DefaultModel: current.defaultModel,
+	}
+	if provider, ok := current.backend.(backend.StatsProvider); ok {
+		stats.Current = provider.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,57 @@
+package secrets
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/pkg/errors"
+)
+
+// AWS reads secrets from AWS Secrets Manager, given their name or ARN and
+// optionally a field of a JSON secret, such as cursor-deepseek#api_key. The
+// credentials are found by the default chain, such as the environment or the
+// instance role.
+type AWS struct {
+	// Region overrides the region of the default chain
+	Region string
+
+	once   sync.Once
+	client *secretsmanager.Client
+	err    error
+}
+
+func (a *AWS) Fetch(ctx context.Context, ref string) (string, error) {
+	a.once.Do(func() {
+		var opts []func(*config.LoadOptions) error
+		if a.Region != "" {
+			opts = append(opts, config.WithRegion(a.Region))
+		}
+		cfg, err := config.LoadDefaultConfig(ctx, opts...)
+		if err != nil {
+			a.err = errors.Wrap(err, "error loading AWS config")
+			return
+		}
+		a.client = secretsmanager.NewFromConfig(cfg)
+	})
+	if a.err != nil {
+		return "", a.err
+	}
+
+	// ARNs contain colons, but not #
+	id, name, _ := strings.Cut(ref, "#")
+	out, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(id),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error reading AWS secret")
+	}
+	secret := out.SecretBinary
+	if out.SecretString != nil {
+		secret = []byte(*out.SecretString)
+	}
+	return field(secret, name)
+}
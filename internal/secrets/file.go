@@ -0,0 +1,21 @@
+package secrets
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// File reads secrets from files, such as Docker or Kubernetes secrets, given
+// their path. Trailing newlines are trimmed.
+type File struct{}
+
+func (File) Fetch(ctx context.Context, path string) (string, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading secret file")
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
@@ -0,0 +1,75 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// gcpSecretManager is the endpoint of Google Cloud Secret Manager's API
+const gcpSecretManager = "https://secretmanager.googleapis.com/v1/"
+
+// GCP reads secrets from Google Cloud Secret Manager, given their version's
+// resource name and optionally a field of a JSON secret, such as
+// projects/my-project/secrets/cursor-deepseek/versions/latest. The
+// credentials are the application default credentials.
+type GCP struct {
+	once   sync.Once
+	client *http.Client
+	err    error
+}
+
+func (g *GCP) Fetch(ctx context.Context, ref string) (string, error) {
+	g.once.Do(func() {
+		// The client outlives the context of the first fetch
+		ts, err := google.DefaultTokenSource(context.WithoutCancel(ctx), "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			g.err = errors.Wrap(err, "error finding Google Cloud credentials")
+			return
+		}
+		g.client = oauth2.NewClient(context.WithoutCancel(ctx), ts)
+	})
+	if g.err != nil {
+		return "", g.err
+	}
+
+	version, name, _ := strings.Cut(ref, "#")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpSecretManager+strings.TrimPrefix(version, "/")+":access", nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating Secret Manager request")
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "error requesting Secret Manager")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading Secret Manager response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Secret Manager responded with %s", resp.Status)
+	}
+
+	var access struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &access); err != nil {
+		return "", errors.Wrap(err, "error parsing Secret Manager response")
+	}
+	secret, err := base64.StdEncoding.DecodeString(access.Payload.Data)
+	if err != nil {
+		return "", errors.Wrap(err, "error decoding Google Cloud secret")
+	}
+	return field(secret, name)
+}
@@ -0,0 +1,80 @@
+// Package secrets resolves references to secrets held outside the config,
+// such as in files, HashiCorp Vault or a cloud secret manager
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Provider fetches secrets from where they are held
+type Provider interface {
+	// Fetch returns the secret ref refers to, in the provider's syntax
+	Fetch(ctx context.Context, ref string) (string, error)
+}
+
+// Resolver resolves references to secrets, which are prefixed by the scheme
+// of their provider, such as vault:
+type Resolver struct {
+	providers map[string]Provider
+}
+
+// NewResolver creates a resolver of references to files
+func NewResolver() *Resolver {
+	return &Resolver{
+		providers: map[string]Provider{
+			"file": File{},
+		},
+	}
+}
+
+// Register makes the provider resolve the references prefixed by scheme
+func (r *Resolver) Register(scheme string, provider Provider) {
+	r.providers[scheme] = provider
+}
+
+// IsReference is whether value refers to a secret
+func (r *Resolver) IsReference(value string) bool {
+	_, _, ok := r.provider(value)
+	return ok
+}
+
+// Resolve returns the secret value refers to, or value itself if it isn't a
+// reference
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	provider, ref, ok := r.provider(value)
+	if !ok {
+		return value, nil
+	}
+	secret, err := provider.Fetch(ctx, ref)
+	return secret, errors.Wrapf(err, "error fetching secret %s", value)
+}
+
+func (r *Resolver) provider(value string) (Provider, string, bool) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, "", false
+	}
+	provider, ok := r.providers[scheme]
+	return provider, ref, ok
+}
+
+// field returns the field of a JSON object secret selected by the #field
+// suffix of a reference, or the whole secret if there's none
+func field(secret []byte, name string) (string, error) {
+	if name == "" {
+		return string(secret), nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(secret, &fields); err != nil {
+		return "", errors.Wrap(err, "secret isn't a JSON object")
+	}
+	value, ok := fields[name].(string)
+	if !ok {
+		return "", errors.Errorf("secret has no string field %s", name)
+	}
+	return value, nil
+}
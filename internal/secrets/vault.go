@@ -0,0 +1,77 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Vault reads secrets from HashiCorp Vault's KV secrets engine, given their
+// API path and field, such as secret/data/cursor-deepseek#api_key
+type Vault struct {
+	// Address is Vault's address, such as https://vault:8200
+	Address string
+	Token   string
+	// Namespace is the Vault Enterprise namespace, if any
+	Namespace string
+	Client    *http.Client
+}
+
+func (v *Vault) Fetch(ctx context.Context, ref string) (string, error) {
+	if v.Address == "" || v.Token == "" {
+		return "", errors.New("Vault requires an address and a token")
+	}
+	path, name, _ := strings.Cut(ref, "#")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(v.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating Vault request")
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "error requesting Vault")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading Vault response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Vault responded with %s", resp.Status)
+	}
+
+	// KV version 2 nests the secret's fields in a second data object
+	var secret struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", errors.Wrap(err, "error parsing Vault response")
+	}
+	data := secret.Data
+	if nested, ok := data["data"]; ok && data["metadata"] != nil {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", errors.Wrap(err, "error parsing Vault secret")
+		}
+	}
+	if name == "" {
+		return "", errors.New("Vault references require a #field")
+	}
+	var value string
+	if err := json.Unmarshal(data[name], &value); err != nil {
+		return "", errors.Errorf("Vault secret has no string field %s", name)
+	}
+	return value, nil
+}
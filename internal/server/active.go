@@ -0,0 +1,200 @@
+package server
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/telemetry"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+)
+
+// recentRequests is how many completed requests are kept for the dashboard
+const recentRequests = 200
+
+// activeRequests tracks the requests being served, and the most recently
+// completed ones, for the admin API
+type activeRequests struct {
+	mu       sync.Mutex
+	requests map[*activeRequest]struct{}
+	// recent is a ring buffer of completed requests, next being the oldest
+	recent []ActiveRequest
+	next   int
+
+	// onStart and onDone, if set, are called when a client request starts and
+	// completes
+	onStart func(context.Context, ActiveRequest)
+	onDone  func(context.Context, ActiveRequest)
+}
+
+type activeRequest struct {
+	id      string
+	method  string
+	path    string
+	started time.Time
+	phases  *telemetry.Phases
+
+	status    atomic.Int32
+	streaming atomic.Bool
+	bytes     atomic.Int64
+	// firstByte is when the first byte of the response was written, relative
+	// to started
+	firstByte atomic.Int64
+}
+
+// ActiveRequest describes a request being served
+type ActiveRequest struct {
+	ID         string    `json:"id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	// Streaming is whether the response is a stream
+	Streaming bool `json:"streaming"`
+	// Bytes is how much of the response has been written
+	Bytes int64 `json:"bytes"`
+	// Status is the status of the response, once it has been written
+	Status int `json:"status,omitempty"`
+	// TTFBMs is the time until the first byte of the response was written
+	TTFBMs int64 `json:"ttfb_ms,omitempty"`
+	// Phases breaks the duration down into the parts of the request's
+	// lifecycle
+	Phases *telemetry.Breakdown `json:"phases,omitempty"`
+}
+
+func newActiveRequests() *activeRequests {
+	return &activeRequests{
+		requests: map[*activeRequest]struct{}{},
+	}
+}
+
+// middleware tracks every request served by next until it completes
+func (a *activeRequests) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &activeRequest{
+			id:      contextutils.GetRequestID(r.Context()),
+			method:  r.Method,
+			path:    r.URL.Path,
+			started: time.Now(),
+			phases:  telemetry.PhasesFromContext(r.Context()),
+		}
+		a.mu.Lock()
+		a.requests[req] = struct{}{}
+		a.mu.Unlock()
+		internal := isInternalPath(req.path)
+		if !internal && a.onStart != nil {
+			a.onStart(r.Context(), req.snapshot())
+		}
+		defer func() {
+			snapshot := req.snapshot()
+			a.mu.Lock()
+			delete(a.requests, req)
+			if !internal {
+				a.remember(snapshot)
+			}
+			a.mu.Unlock()
+			if !internal && a.onDone != nil {
+				a.onDone(r.Context(), snapshot)
+			}
+		}()
+
+		next.ServeHTTP(&activeWriter{ResponseWriter: w, req: req}, r)
+	})
+}
+
+// list returns the active requests, oldest first
+func (a *activeRequests) list() []ActiveRequest {
+	a.mu.Lock()
+	list := make([]ActiveRequest, 0, len(a.requests))
+	for req := range a.requests {
+		list = append(list, req.snapshot())
+	}
+	a.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+	return list
+}
+
+// completed returns the most recently completed requests, oldest first
+func (a *activeRequests) completed() []ActiveRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append(slices.Clone(a.recent[a.next:]), a.recent[:a.next]...)
+}
+
+// remember adds a completed request to the ring buffer
+func (a *activeRequests) remember(req ActiveRequest) {
+	if len(a.recent) < recentRequests {
+		a.recent = append(a.recent, req)
+		return
+	}
+	a.recent[a.next] = req
+	a.next = (a.next + 1) % recentRequests
+}
+
+func (req *activeRequest) snapshot() ActiveRequest {
+	var phases *telemetry.Breakdown
+	if req.phases != nil {
+		breakdown := req.phases.Breakdown()
+		phases = &breakdown
+	}
+	return ActiveRequest{
+		ID:         req.id,
+		Method:     req.method,
+		Path:       req.path,
+		StartedAt:  req.started,
+		DurationMs: time.Since(req.started).Milliseconds(),
+		Streaming:  req.streaming.Load(),
+		Bytes:      req.bytes.Load(),
+		Status:     int(req.status.Load()),
+		TTFBMs:     time.Duration(req.firstByte.Load()).Milliseconds(),
+		Phases:     phases,
+	}
+}
+
+// isInternalPath is whether path serves the proxy's operators rather than
+// its clients, which are left out of the recent requests
+func isInternalPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || path == "/healthz" || path == "/readyz"
+}
+
+// activeWriter records the progress of a response
+type activeWriter struct {
+	http.ResponseWriter
+	req *activeRequest
+}
+
+func (w *activeWriter) WriteHeader(status int) {
+	w.req.status.CompareAndSwap(0, int32(status))
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *activeWriter) Write(b []byte) (int, error) {
+	if w.req.firstByte.Load() == 0 {
+		w.req.firstByte.Store(int64(time.Since(w.req.started)))
+		w.req.status.CompareAndSwap(0, http.StatusOK)
+		mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		w.req.streaming.Store(mediaType == "text/event-stream" || mediaType == "application/x-ndjson")
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.req.bytes.Add(int64(n))
+	return n, err
+}
+
+func (w *activeWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *activeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/middleware"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// logLevels is the body of the log level admin endpoint
+type logLevels struct {
+	Level string `json:"level,omitempty"`
+	// Modules maps module names to their level. Setting a module's level to
+	// an empty string makes it use the default level again.
+	Modules map[string]string `json:"modules,omitempty"`
+}
+
+// switchState is the body of the switch admin endpoint
+type switchState struct {
+	// Backend is the name of the backend switched to, or empty for the
+	// configured one
+	Backend string `json:"backend"`
+	// DefaultModel serves the models the backend doesn't map, or its
+	// configured default model if empty
+	DefaultModel string `json:"default_model"`
+}
+
+// handleConfig reports the effective configuration of the server, with
+// secrets masked
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	opts := s.opts
+	s.mu.RUnlock()
+	budgets := make([]map[string]any, 0, len(opts.UsageBudgets))
+	for _, budget := range opts.UsageBudgets {
+		apiKey := ""
+		if budget.APIKey != "" {
+			apiKey = logger.MaskSecret(budget.APIKey)
+		}
+		budgets = append(budgets, map[string]any{
+			"api_key":          apiKey,
+			"client":           budget.Client,
+			"period":           budget.Period,
+			"max_tokens":       budget.MaxTokens,
+			"max_cost":         budget.MaxCost,
+			"alert_thresholds": budget.AlertThresholds,
+		})
+	}
+
+	clients := make([]map[string]any, 0, len(opts.Clients))
+	for _, client := range opts.Clients {
+		c := map[string]any{
+			"name": client.Name,
+		}
+		if client.Key != "" {
+			c["key"] = logger.MaskSecret(client.Key)
+		}
+		if client.KeyHash != "" {
+			c["key_hashed"] = true
+		}
+		if !client.ExpiresAt.IsZero() {
+			c["expires_at"] = client.ExpiresAt
+		}
+		if client.RateLimit != (middleware.RateLimit{}) {
+			c["rate_limit"] = rateLimit(client.RateLimit)
+		}
+		if client.Tier != "" {
+			c["tier"] = client.Tier
+		}
+		clients = append(clients, c)
+	}
+
+	tierRateLimits := make(map[string]any, len(opts.TierRateLimits))
+	for tier, limit := range opts.TierRateLimits {
+		tierRateLimits[tier] = rateLimit(limit)
+	}
+
+	tiers := make(map[string]any, len(opts.Tiers))
+	for name, tier := range opts.Tiers {
+		tiers[name] = map[string]any{
+			"allow_models": tier.Models.Allow,
+			"deny_models":  tier.Models.Deny,
+			"max_tokens":   tier.MaxTokens,
+			"priority":     tier.Priority,
+		}
+	}
+
+	webhooks := make([]map[string]any, 0, len(opts.Webhooks))
+	for _, hook := range opts.Webhooks {
+		webhooks = append(webhooks, map[string]any{
+			"url":         hook.Redacted(),
+			"signed":      hook.Secret != "",
+			"events":      hook.Events,
+			"max_retries": hook.MaxRetries,
+			"timeout":     hook.Timeout.String(),
+		})
+	}
+
+	writeJSON(w, map[string]any{
+		"backend":          s.backend.Name(),
+		"port":             opts.Port,
+		"api_key_required": opts.ApiKey != "" || len(opts.Clients) > 0 || s.jwt != nil || opts.TLSClientCAFile != "",
+		"clients":          clients,
+		"rate_limit":       rateLimit(opts.RateLimit),
+		"tier_rate_limits": tierRateLimits,
+		"tiers":            tiers,
+		"jwt": map[string]any{
+			"enabled":    s.jwt != nil,
+			"jwks_url":   opts.JWT.JWKSURL,
+			"issuer":     opts.JWT.Issuer,
+			"audience":   opts.JWT.Audience,
+			"tier_claim": opts.JWT.TierClaim,
+		},
+		"timeout":               s.timeout.String(),
+		"max_request_body_size": s.maxRequestBodySize(),
+		"path_prefixes":         s.pathPrefixes,
+		"log":                   s.logLevels(),
+		"log_format":            opts.LogFormat,
+		"debug_endpoints":       opts.DebugEndpoints,
+		"health_check": map[string]any{
+			"interval": opts.HealthCheckInterval.String(),
+			"timeout":  opts.HealthCheckTimeout.String(),
+		},
+		"batches": map[string]any{
+			"enabled":     s.batches != nil,
+			"dir":         opts.BatchDir,
+			"concurrency": opts.BatchConcurrency,
+		},
+		"audit": map[string]any{
+			"enabled": s.audit != nil,
+			"path":    opts.AuditPath,
+		},
+		"webhooks": webhooks,
+		"content_filter": map[string]any{
+			"enabled":    len(opts.ContentFilterRules) > 0,
+			"rules":      len(opts.ContentFilterRules),
+			"responses":  opts.ContentFilterResponses,
+			"block_with": opts.ContentFilterBlockWith,
+		},
+		"store": storeConfig(opts),
+		"networks": map[string]any{
+			"allowed":         opts.Networks.Allowed,
+			"admin":           opts.Networks.Admin,
+			"trusted_proxies": opts.Networks.TrustedProxies,
+		},
+		"tls": map[string]any{
+			"enabled":        opts.TLSCertFile != "" || len(opts.ACMEHosts) > 0,
+			"cert_file":      opts.TLSCertFile,
+			"acme_hosts":     opts.ACMEHosts,
+			"client_ca_file": opts.TLSClientCAFile,
+		},
+		"usage": map[string]any{
+			"enabled": s.usage != nil,
+			"db":      opts.UsageDB,
+			"pricing": opts.UsagePricing,
+			"budgets": budgets,
+		},
+	})
+}
+
+// handleLogLevel reports the log levels
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.logLevels())
+}
+
+// handleSetLogLevel changes the log levels at runtime
+func (s *Server) handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	var req logLevels
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = errors.Wrap(err, "error parsing request")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Validate every level before changing any
+	if _, ok := logger.ParseLevel(req.Level); req.Level != "" && !ok {
+		response.WriteError(w, http.StatusBadRequest, "Invalid log level "+req.Level)
+		return
+	}
+	for module, level := range req.Modules {
+		if _, ok := logger.ParseLevel(level); level != "" && !ok {
+			response.WriteError(w, http.StatusBadRequest, "Invalid log level "+level+" for module "+module)
+			return
+		}
+	}
+
+	root := logutils.FromContext(s.ctx)
+	if req.Level != "" {
+		root.SetLevel(logger.LevelFromString(req.Level))
+	}
+	for module, level := range req.Modules {
+		if level == "" {
+			root.ResetModuleLevel(module)
+		} else {
+			root.SetModuleLevel(module, logger.LevelFromString(level))
+		}
+	}
+	levels := s.logLevels()
+	lgr.Infof(ctx, "Changed log level to %s with module levels %v", levels.Level, levels.Modules)
+	writeJSON(w, levels)
+}
+
+// handleSwitch reports the backend and default model switched to, along with
+// the backends which may be switched to
+func (s *Server) handleSwitch(w http.ResponseWriter, r *http.Request) {
+	switcher, _ := s.switcher()
+	writeJSON(w, s.switchStatus(switcher))
+}
+
+// handleSetSwitch switches new requests to another backend or default model
+// at runtime, while the requests in flight finish on the previous ones
+func (s *Server) handleSetSwitch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	var req switchState
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = errors.Wrap(err, "error parsing request")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switcher, _ := s.switcher()
+	if err := switcher.Switch(req.Backend, req.DefaultModel); err != nil {
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	lgr.Infof(ctx, "Switched to backend %s with default model %q", s.upstream.Name(), req.DefaultModel)
+	writeJSON(w, s.switchStatus(switcher))
+}
+
+// switcher returns the backend switching requests, if the backend can be
+// switched
+func (s *Server) switcher() (backend.Switcher, bool) {
+	switcher, ok := s.upstream.Current().(backend.Switcher)
+	return switcher, ok
+}
+
+func (s *Server) switchStatus(switcher backend.Switcher) map[string]any {
+	name, defaultModel := switcher.Switched()
+	return map[string]any{
+		"backend":       name,
+		"default_model": defaultModel,
+		"serving":       s.upstream.Name(),
+		"backends":      switcher.Backends(),
+	}
+}
+
+// handleActiveRequests lists the requests being served, including streams
+func (s *Server) handleActiveRequests(w http.ResponseWriter, r *http.Request) {
+	requests := s.active.list()
+	streams := 0
+	for _, req := range requests {
+		if req.Streaming {
+			streams++
+		}
+	}
+	writeJSON(w, map[string]any{
+		"object":  "list",
+		"data":    requests,
+		"streams": streams,
+	})
+}
+
+// handleRecentRequests lists the most recently completed client requests,
+// along with their error rate, latency and, for streams, time to first token
+func (s *Server) handleRecentRequests(w http.ResponseWriter, r *http.Request) {
+	requests := s.active.completed()
+	var errors int
+	latencies := make([]int64, 0, len(requests))
+	var ttfts []int64
+	var proxy, connect, upstream, stream []float64
+	for _, req := range requests {
+		if req.Status >= http.StatusBadRequest {
+			errors++
+		}
+		latencies = append(latencies, req.DurationMs)
+		if req.Streaming {
+			ttfts = append(ttfts, req.TTFBMs)
+		}
+		if req.Phases != nil && req.Phases.Upstream > 0 {
+			proxy = append(proxy, req.Phases.Proxy)
+			connect = append(connect, req.Phases.Connect)
+			upstream = append(upstream, req.Phases.Upstream)
+			stream = append(stream, req.Phases.Stream)
+		}
+	}
+	var errorRate float64
+	if len(requests) > 0 {
+		errorRate = float64(errors) / float64(len(requests))
+	}
+	writeJSON(w, map[string]any{
+		"object": "list",
+		"data":   requests,
+		"summary": map[string]any{
+			"requests":   len(requests),
+			"errors":     errors,
+			"error_rate": errorRate,
+			"latency_ms": percentiles(latencies),
+			"ttft_ms":    percentiles(ttfts),
+			// The breakdown of requests which reached the upstream
+			"phases_ms": map[string]any{
+				"proxy":    percentiles(proxy),
+				"connect":  percentiles(connect),
+				"upstream": percentiles(upstream),
+				"stream":   percentiles(stream),
+			},
+		},
+	})
+}
+
+// percentiles returns the median and 95th percentile of the values
+func percentiles[T cmp.Ordered](values []T) map[string]T {
+	if len(values) == 0 {
+		return map[string]T{}
+	}
+	slices.Sort(values)
+	return map[string]T{
+		"p50": values[len(values)*50/100],
+		"p95": values[len(values)*95/100],
+	}
+}
+
+func (s *Server) logLevels() logLevels {
+	level, modules := logutils.FromContext(s.ctx).Levels()
+	levels := logLevels{
+		Level:   strings.ToLower(level.String()),
+		Modules: make(map[string]string, len(modules)),
+	}
+	for module, level := range modules {
+		levels.Modules[module] = strings.ToLower(level.String())
+	}
+	return levels
+}
+
+func rateLimit(limit middleware.RateLimit) map[string]any {
+	return map[string]any{
+		"requests_per_minute": limit.RequestsPerMinute,
+		"tokens_per_minute":   limit.TokensPerMinute,
+	}
+}
+
+// storeConfig describes the store, with the password of the Redis URL masked
+func storeConfig(opts Options) map[string]any {
+	if opts.RedisURL == "" {
+		return map[string]any{"type": "memory"}
+	}
+	redisURL := "***"
+	if u, err := url.Parse(opts.RedisURL); err == nil {
+		redisURL = u.Redacted()
+	}
+	return map[string]any{
+		"type":   "redis",
+		"url":    redisURL,
+		"prefix": opts.RedisPrefix,
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/batch"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// maxUploadMemory is how much of an uploaded file is buffered in memory
+// before the rest is spilled to disk
+const maxUploadMemory = 32 << 20
+
+// handleFiles uploads batch input files
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		err = errors.Wrap(err, "error parsing upload")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	purpose := r.FormValue("purpose")
+	if purpose != "batch" {
+		response.WriteErrorResponse(w, http.StatusBadRequest, openai.Error{
+			Message: "Only files with the purpose 'batch' are supported",
+			Param:   "purpose",
+		})
+		return
+	}
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		response.WriteErrorResponse(w, http.StatusBadRequest, openai.Error{
+			Message: "Missing file",
+			Param:   "file",
+		})
+		return
+	}
+	defer upload.Close()
+
+	file, err := s.batches.CreateFile(ctx, header.Filename, purpose, upload)
+	if err != nil {
+		err = errors.Wrap(err, "error storing upload")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	lgr.Infof(ctx, "Stored file %s", file.ID)
+	writeJSON(w, file)
+}
+
+// handleFile retrieves a file's metadata
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	file, err := s.batches.GetFile(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, r, err, "file", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, file)
+}
+
+// handleFileContent downloads a file, such as the output of a batch
+func (s *Server) handleFileContent(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	content, err := s.batches.OpenFile(ctx, r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, r, err, "file", r.PathValue("id"))
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	if _, err := io.Copy(w, content); err != nil {
+		err = errors.Wrap(err, "error writing file")
+		lgr.Error(ctx, err.Error())
+	}
+}
+
+// handleCreateBatch creates a batch
+func (s *Server) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	var req openai.BatchCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = errors.Wrap(err, "error parsing request")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Endpoint != batch.ChatCompletionsEndpoint {
+		response.WriteErrorResponse(w, http.StatusBadRequest, openai.Error{
+			Message: "Only the " + batch.ChatCompletionsEndpoint + " endpoint is supported",
+			Param:   "endpoint",
+		})
+		return
+	}
+
+	b, err := s.batches.CreateBatch(ctx, req)
+	if err != nil {
+		writeBatchError(w, r, err, "input_file_id", req.InputFileID)
+		return
+	}
+	lgr.Infof(ctx, "Created batch %s", b.ID)
+	writeJSON(w, b)
+}
+
+// handleListBatches lists batches, supporting the after and limit pagination
+// parameters
+func (s *Server) handleListBatches(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+	batches := s.batches.ListBatches(r.Context())
+	if after := r.URL.Query().Get("after"); after != "" {
+		for i, b := range batches {
+			if b.ID == after {
+				batches = batches[i+1:]
+				break
+			}
+		}
+	}
+	hasMore := len(batches) > limit
+	if hasMore {
+		batches = batches[:limit]
+	}
+
+	list := map[string]any{
+		"object":   "list",
+		"data":     batches,
+		"has_more": hasMore,
+	}
+	if len(batches) > 0 {
+		list["first_id"] = batches[0].ID
+		list["last_id"] = batches[len(batches)-1].ID
+	}
+	writeJSON(w, list)
+}
+
+// handleBatch retrieves a batch
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	b, err := s.batches.GetBatch(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, r, err, "batch_id", r.PathValue("id"))
+		return
+	}
+	writeJSON(w, b)
+}
+
+// handleCancelBatch cancels a batch
+func (s *Server) handleCancelBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	b, err := s.batches.CancelBatch(ctx, r.PathValue("id"))
+	if err != nil {
+		writeBatchError(w, r, err, "batch_id", r.PathValue("id"))
+		return
+	}
+	lgr.Infof(ctx, "Cancelling batch %s", b.ID)
+	writeJSON(w, b)
+}
+
+// writeBatchError writes a 404 for unknown batches and files, and a 500 for
+// any other error
+func writeBatchError(w http.ResponseWriter, r *http.Request, err error, param, id string) {
+	ctx := r.Context()
+	if errors.Is(err, batch.ErrNotFound) {
+		response.WriteErrorResponse(w, http.StatusNotFound, openai.Error{
+			Message: "No such " + param + ": " + id,
+			Param:   param,
+		})
+		return
+	}
+	logutils.FromContext(ctx).Error(ctx, err.Error())
+	response.WriteError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// completionInstructions asks a chat model to continue the prompt of a legacy
+// completion request instead of replying to it
+const completionInstructions = "Continue the text provided by the user. Respond with only the continuation, " +
+	"without repeating the text or adding any commentary."
+
+// handleCompletions serves the legacy completions API by translating prompts
+// into chat completion requests and the responses back into completions
+func (s *Server) handleCompletions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	// Parse request
+	var req openai.CompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = errors.Wrap(err, "error parsing request")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Prompt) != 1 {
+		response.WriteErrorResponse(w, http.StatusBadRequest, openai.Error{
+			Message: "Exactly one prompt must be provided",
+			Param:   "prompt",
+		})
+		return
+	}
+
+	// Backends which proxy the request path must see a chat completion, and
+	// those with a native completions API serve the original request instead
+	ctx = backend.WithCompletion(ctx, &req)
+	r = r.Clone(ctx)
+	r.URL.Path = "/v1/chat/completions"
+
+	chatReq := completionToChat(&req)
+	if req.Stream {
+		s.streamCompletion(ctx, w, r, &req, chatReq)
+		return
+	}
+
+	rec := response.NewRecorder()
+	s.backend.HandleChatCompletion(ctx, rec, r, chatReq)
+	if rec.Status != http.StatusOK {
+		rec.WriteTo(w, nil)
+		return
+	}
+
+	var chatResp openai.ChatCompletionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &chatResp); err != nil {
+		err = errors.Wrap(err, "error parsing chat completion response")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	resp := openai.CompletionResponse{
+		ID:      completionID(chatResp.ID),
+		Object:  "text_completion",
+		Created: chatResp.Created,
+		Model:   chatResp.Model,
+		Choices: make([]openai.CompletionChoice, 0, len(chatResp.Choices)),
+		Usage:   &chatResp.Usage,
+	}
+	for _, choice := range chatResp.Choices {
+		text := choice.Message.GetContentString()
+		if req.Echo {
+			text = req.Prompt[0] + text
+		}
+		resp.Choices = append(resp.Choices, openai.CompletionChoice{
+			Index:        choice.Index,
+			Text:         text,
+			FinishReason: choice.FinishReason,
+		})
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	rec.WriteTo(w, body)
+}
+
+// streamCompletion relays the streamed chat completion of chatReq as legacy
+// completion chunks
+func (s *Server) streamCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.CompletionRequest, chatReq *openai.ChatCompletionRequest) {
+	pipe, ok := s.pipeChatCompletion(ctx, w, r, chatReq, nil)
+	if !ok {
+		return
+	}
+	// Stops the backend if the client goes away before the stream ends
+	defer pipe.CloseRead()
+
+	// Heartbeats of the backend are relayed while the model is busy
+	keepAlive := make(chan struct{}, 1)
+	chunks, errs := stream.ReadOpenAI(ctx, pipe, stream.ReadOptions{
+		OnComment: func(string) {
+			select {
+			case keepAlive <- struct{}{}:
+			default:
+			}
+		},
+	})
+	completions := make(chan openai.CompletionResponse)
+	go func() {
+		defer close(completions)
+		echoed := map[int]bool{}
+		for chunk := range chunks {
+			out := openai.CompletionResponse{
+				ID:      completionID(chunk.ID),
+				Object:  "text_completion",
+				Created: chunk.Created,
+				Model:   chunk.Model,
+				Choices: []openai.CompletionChoice{},
+				Usage:   chunk.Usage,
+			}
+			for _, choice := range chunk.Choices {
+				var text string
+				if content, ok := choice.Delta.Content.(openai.Content_String); ok {
+					text = content.Content
+				}
+				if req.Echo && !echoed[choice.Index] {
+					text = req.Prompt[0] + text
+					echoed[choice.Index] = true
+				}
+				if text == "" && choice.FinishReason == "" {
+					continue
+				}
+				out.Choices = append(out.Choices, openai.CompletionChoice{
+					Index:        choice.Index,
+					Text:         text,
+					FinishReason: choice.FinishReason,
+				})
+			}
+			if len(out.Choices) == 0 && out.Usage == nil {
+				continue
+			}
+
+			select {
+			case completions <- out:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	stream.Write(ctx, w, completions, errs, stream.Options{KeepAlive: keepAlive})
+}
+
+// pipeChatCompletion runs a streaming chat completion on the backend and waits
+// for its response to start. Errors, which are reported before the stream
+// starts, are relayed to w, rewritten by rewriteError if set, in which case ok
+// is false. Otherwise the response headers are copied to w and the caller must
+// call CloseRead on the returned pipe once done reading the stream.
+func (s *Server) pipeChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, chatReq *openai.ChatCompletionRequest, rewriteError func(status int, body []byte) []byte) (pipe *response.Pipe, ok bool) {
+	pipe = response.NewPipe()
+	go func() {
+		defer pipe.Close()
+		s.backend.HandleChatCompletion(ctx, pipe, r, chatReq)
+	}()
+
+	select {
+	case <-pipe.Started():
+	case <-ctx.Done():
+		pipe.CloseRead()
+		return nil, false
+	}
+
+	maps.Copy(w.Header(), pipe.Header())
+	w.Header().Del("Content-Length")
+	if pipe.Status() != http.StatusOK {
+		body, _ := io.ReadAll(pipe)
+		pipe.CloseRead()
+		if rewriteError != nil {
+			body = rewriteError(pipe.Status(), body)
+		}
+		w.WriteHeader(pipe.Status())
+		w.Write(body)
+		return nil, false
+	}
+	return pipe, true
+}
+
+// completionToChat translates a completion request into a chat request
+func completionToChat(req *openai.CompletionRequest) *openai.ChatCompletionRequest {
+	instructions := completionInstructions
+	if req.Suffix != "" {
+		instructions += " The continuation will be followed by the text below, which must not be repeated:\n" + req.Suffix
+	}
+
+	return &openai.ChatCompletionRequest{
+		Model: req.Model,
+		Messages: []openai.Message{
+			{Role: openai.RoleSystem, Content: openai.Content_String{Content: instructions}},
+			{Role: "user", Content: openai.Content_String{Content: req.Prompt[0]}},
+		},
+		Stream:           req.Stream,
+		StreamOptions:    req.StreamOptions,
+		N:                req.N,
+		MaxTokens:        req.MaxTokens,
+		Temperature:      req.Temperature,
+		TopP:             req.TopP,
+		Stop:             req.Stop,
+		Seed:             req.Seed,
+		FrequencyPenalty: req.FrequencyPenalty,
+		PresencePenalty:  req.PresencePenalty,
+		LogitBias:        req.LogitBias,
+	}
+}
+
+// completionID derives a completion ID from a chat completion ID
+func completionID(id string) string {
+	return "cmpl-" + strings.TrimPrefix(id, "chatcmpl-")
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// debugHandler serves the runtime profiles of net/http/pprof on
+// /admin/debug/pprof/ and the expvar variables on /admin/debug/vars
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	// pprof expects its paths without the /admin prefix
+	return http.StripPrefix("/admin", mux)
+}
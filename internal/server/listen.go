@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSocketMode is the permissions of Unix sockets unless configured
+// otherwise, which only lets the user the proxy runs as connect
+const DefaultSocketMode fs.FileMode = 0o600
+
+// unixPrefix marks the addresses which are Unix socket paths
+const unixPrefix = "unix:"
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation
+const listenFdsStart = 3
+
+// listen listens on the addresses, closing the listeners opened if one fails
+func listen(addrs []string, socketMode fs.FileMode, reuse bool) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := listenAddr(addr, socketMode, reuse)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenAddr listens on a TCP address, with SO_REUSEPORT if reuse is set, or
+// on a Unix socket for an address prefixed with unix:
+func listenAddr(addr string, socketMode fs.FileMode, reuse bool) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		var lc net.ListenConfig
+		if reuse {
+			lc.Control = reusePort
+		}
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		return l, errors.Wrapf(err, "error listening on %s", addr)
+	}
+
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listening on %s", addr)
+	}
+	if socketMode == 0 {
+		socketMode = DefaultSocketMode
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		// Closing the listener removes the socket
+		l.Close()
+		return nil, errors.Wrapf(err, "error setting the permissions of %s", path)
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at path left behind by a proxy which
+// didn't shut down, refusing to remove other files or sockets in use
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error checking %s", path)
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return errors.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return errors.Errorf("%s is in use by another process", path)
+	}
+	return errors.Wrapf(os.Remove(path), "error removing stale socket %s", path)
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// if the process was started with any. The variables passing them are unset
+// so that they aren't inherited by child processes.
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for i := range n {
+		name := "systemd socket " + strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		// The listener has a duplicate of the descriptor, so the file is closed
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "error using %s", name)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
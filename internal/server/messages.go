@@ -0,0 +1,495 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/anthropic/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	"github.com/danilofalcao/cursor-deepseek/internal/sse"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// handleMessages serves the Anthropic Messages API by translating requests
+// into chat completion requests and the chat completions back into messages
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	// Parse request
+	var req anthropic.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = errors.Wrap(err, "error parsing request")
+		lgr.Error(ctx, err.Error())
+		writeAnthropicError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chatReq := messagesToChat(&req)
+
+	// Backends which proxy the request path must see a chat completion
+	r = r.Clone(ctx)
+	r.URL.Path = "/v1/chat/completions"
+
+	if req.Stream {
+		s.streamMessage(ctx, w, r, &req, chatReq)
+		return
+	}
+
+	rec := response.NewRecorder()
+	s.backend.HandleChatCompletion(ctx, rec, r, chatReq)
+	if rec.Status != http.StatusOK {
+		rec.WriteTo(w, anthropicError(rec.Status, rec.Body.Bytes()))
+		return
+	}
+
+	var chatResp openai.ChatCompletionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &chatResp); err != nil || len(chatResp.Choices) == 0 {
+		lgr.Errorf(ctx, "error parsing chat completion response: %s", rec.Body.String())
+		writeAnthropicError(w, http.StatusBadGateway, "Error parsing chat completion response")
+		return
+	}
+
+	choice := chatResp.Choices[0]
+	stopReason := anthropicStopReason(choice.FinishReason)
+	msg := anthropic.Response{
+		ID:         utils.GenerateID("msg_"),
+		Type:       "message",
+		Role:       "assistant",
+		Model:      req.Model,
+		Content:    []anthropic.Block{},
+		StopReason: &stopReason,
+		Usage: anthropic.Usage{
+			InputTokens:  chatResp.Usage.PromptTokens,
+			OutputTokens: chatResp.Usage.CompletionTokens,
+		},
+	}
+	if reasoning := choice.Message.ReasoningContent; reasoning != "" {
+		msg.Content = append(msg.Content, anthropic.Block{Type: anthropic.BlockThinking, Thinking: reasoning})
+	}
+	if text := choice.Message.GetContentString(); text != "" {
+		msg.Content = append(msg.Content, anthropic.Block{Type: anthropic.BlockText, Text: text})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		msg.Content = append(msg.Content, anthropic.Block{
+			Type:  anthropic.BlockToolUse,
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: toolInput(call.Function.Arguments),
+		})
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		lgr.Error(ctx, err.Error())
+		writeAnthropicError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	rec.WriteTo(w, body)
+}
+
+// streamMessage relays the streamed chat completion of chatReq as the events
+// of a streamed message
+func (s *Server) streamMessage(ctx context.Context, w http.ResponseWriter, r *http.Request, req *anthropic.Request, chatReq *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		lgr.Error(ctx, "streaming unsupported")
+		writeAnthropicError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	pipe, ok := s.pipeChatCompletion(ctx, w, r, chatReq, anthropicError)
+	if !ok {
+		return
+	}
+	// Stops the backend if the client goes away before the stream ends
+	defer pipe.CloseRead()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Heartbeats of the backend are relayed as pings while the model is busy
+	keepAlive := make(chan struct{}, 1)
+	chunks, errs := stream.ReadOpenAI(ctx, pipe, stream.ReadOptions{
+		OnComment: func(string) {
+			select {
+			case keepAlive <- struct{}{}:
+			default:
+			}
+		},
+	})
+
+	ms := &messageStream{
+		w:       w,
+		flusher: flusher,
+		block:   -1,
+	}
+	ms.emit(anthropic.StreamEvent{
+		Type: "message_start",
+		Message: &anthropic.Response{
+			ID:      utils.GenerateID("msg_"),
+			Type:    "message",
+			Role:    "assistant",
+			Model:   req.Model,
+			Content: []anthropic.Block{},
+		},
+	})
+
+	for ms.err == nil {
+		select {
+		case <-ctx.Done():
+			lgr.Info(ctx, "Context cancelled, ending stream")
+			return
+		case <-keepAlive:
+			ms.emit(anthropic.StreamEvent{Type: "ping"})
+		case chunk, ok := <-chunks:
+			if !ok {
+				// Report an error the stream may have ended with
+				var err error
+				select {
+				case streamErr, ok := <-errs:
+					if ok {
+						err = streamErr
+						lgr.Error(ctx, err.Error())
+					}
+				default:
+				}
+				ms.finish(err)
+				if ms.err == nil {
+					lgr.Info(ctx, "streaming response handler completed")
+				}
+				return
+			}
+			ms.chunk(chunk)
+		}
+	}
+	lgr.Error(ctx, errors.Wrap(ms.err, "error writing response").Error())
+}
+
+// messagesToChat translates a Messages API request into a chat request
+func messagesToChat(req *anthropic.Request) *openai.ChatCompletionRequest {
+	chatReq := &openai.ChatCompletionRequest{
+		Model:       req.Model,
+		Stream:      req.Stream,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stop:        req.StopSequences,
+	}
+	if req.MaxTokens > 0 {
+		chatReq.MaxTokens = &req.MaxTokens
+	}
+	if req.Stream {
+		// The usage is reported when the message stops
+		chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
+	if system := blocksText(req.System); system != "" {
+		chatReq.Messages = append(chatReq.Messages, openai.Message{
+			Role:    openai.RoleSystem,
+			Content: openai.Content_String{Content: system},
+		})
+	}
+
+	for _, msg := range req.Messages {
+		if msg.Role == "assistant" {
+			out := openai.Message{Role: "assistant"}
+			var text []string
+			for _, block := range msg.Content {
+				switch block.Type {
+				case anthropic.BlockText:
+					text = append(text, block.Text)
+				case anthropic.BlockToolUse:
+					arguments := []byte("{}")
+					if block.Input != nil {
+						arguments, _ = json.Marshal(block.Input)
+					}
+					out.ToolCalls = append(out.ToolCalls, openai.ToolCall{
+						ID:   block.ID,
+						Type: "function",
+						Function: openai.ToolCallFunction{
+							Name:      block.Name,
+							Arguments: string(arguments),
+						},
+					})
+				}
+				// Thinking must not be sent back upstream
+			}
+			out.Content = openai.Content_String{Content: strings.Join(text, "\n")}
+			chatReq.Messages = append(chatReq.Messages, out)
+			continue
+		}
+
+		// Tool results become tool messages, which must directly follow the
+		// assistant message with the calls, so they precede any user text
+		var text []string
+		var results int
+		for _, block := range msg.Content {
+			switch block.Type {
+			case anthropic.BlockText:
+				text = append(text, block.Text)
+			case anthropic.BlockToolResult:
+				result := blocksText(block.Content)
+				if block.IsError {
+					result = "Error: " + result
+				}
+				chatReq.Messages = append(chatReq.Messages, openai.Message{
+					Role:       "tool",
+					ToolCallID: block.ToolUseID,
+					Content:    openai.Content_String{Content: result},
+				})
+				results++
+			}
+		}
+		if len(text) > 0 || results == 0 {
+			chatReq.Messages = append(chatReq.Messages, openai.Message{
+				Role:    "user",
+				Content: openai.Content_String{Content: strings.Join(text, "\n")},
+			})
+		}
+	}
+
+	for _, tool := range req.Tools {
+		chatReq.Tools = append(chatReq.Tools, openai.Tool{
+			Type: "function",
+			Function: openai.Function{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if tc := req.ToolChoice; tc != nil {
+		switch tc.Type {
+		case "auto", "none":
+			chatReq.ToolChoice = tc.Type
+		case "any":
+			chatReq.ToolChoice = "required"
+		case "tool":
+			chatReq.ToolChoice = map[string]any{
+				"type":     "function",
+				"function": map[string]any{"name": tc.Name},
+			}
+		}
+		if tc.DisableParallelToolUse {
+			parallel := false
+			chatReq.ParallelToolCalls = &parallel
+		}
+	}
+
+	return chatReq
+}
+
+// blocksText joins the text of text blocks
+func blocksText(content anthropic.Content) string {
+	var text []string
+	for _, block := range content {
+		if block.Type == anthropic.BlockText {
+			text = append(text, block.Text)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// toolInput parses the arguments of a tool call into the input of a tool_use
+// block, which must be an object
+func toolInput(arguments string) any {
+	var input map[string]any
+	if err := json.Unmarshal([]byte(arguments), &input); err != nil || input == nil {
+		return map[string]any{}
+	}
+	return input
+}
+
+// anthropicStopReason converts a chat completion finish reason
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case openai.FinishReasonLength:
+		return anthropic.StopMaxTokens
+	case openai.FinishReasonToolCalls:
+		return anthropic.StopToolUse
+	case openai.FinishReasonContentFilter:
+		return anthropic.StopRefusal
+	}
+	return anthropic.StopEndTurn
+}
+
+// anthropicErrorType returns the Anthropic error type matching a status code
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == http.StatusServiceUnavailable || status == 529:
+		return "overloaded_error"
+	case status >= http.StatusInternalServerError:
+		return "api_error"
+	}
+	return response.ErrorType(status)
+}
+
+// anthropicError converts an OpenAI-format error body into an Anthropic-format
+// one
+func anthropicError(status int, body []byte) []byte {
+	var e openai.ErrorResponse
+	message := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &e); err == nil && e.Error.Message != "" {
+		message = e.Error.Message
+	}
+	converted, _ := json.Marshal(anthropic.ErrorResponse{
+		Type:  "error",
+		Error: anthropic.Error{Type: anthropicErrorType(status), Message: message},
+	})
+	return converted
+}
+
+func writeAnthropicError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(anthropic.ErrorResponse{
+		Type:  "error",
+		Error: anthropic.Error{Type: anthropicErrorType(status), Message: message},
+	})
+}
+
+// messageStream converts the chunks of a chat completion stream into the
+// events of a streamed message. Only the first choice is streamed.
+type messageStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	// err is the first error writing to w, after which nothing is written
+	err error
+
+	// block is the index of the open content block, or -1
+	block     int
+	blockType string
+	// toolIndex is the chat tool call index of an open tool_use block
+	toolIndex    int
+	blocks       int
+	finishReason string
+	usage        anthropic.Usage
+}
+
+func (ms *messageStream) emit(event anthropic.StreamEvent) {
+	if ms.err != nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = sse.Encode(ms.w, sse.Event{Type: event.Type, Data: string(data)})
+	}
+	if err != nil {
+		ms.err = err
+		return
+	}
+	ms.flusher.Flush()
+}
+
+func (ms *messageStream) chunk(chunk openai.ChatCompletionStreamResponse) {
+	if chunk.Usage != nil {
+		ms.usage = anthropic.Usage{
+			InputTokens:  chunk.Usage.PromptTokens,
+			OutputTokens: chunk.Usage.CompletionTokens,
+		}
+	}
+
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+
+		if thinking := choice.Delta.ReasoningContent; thinking != "" {
+			if ms.blockType != anthropic.BlockThinking {
+				ms.openBlock(anthropic.Block{Type: anthropic.BlockThinking})
+			}
+			ms.delta(anthropic.BlockDelta{Type: "thinking_delta", Thinking: thinking})
+		}
+
+		if content, ok := choice.Delta.Content.(openai.Content_String); ok && content.Content != "" {
+			if ms.blockType != anthropic.BlockText {
+				ms.openBlock(anthropic.Block{Type: anthropic.BlockText})
+			}
+			ms.delta(anthropic.BlockDelta{Type: "text_delta", Text: content.Content})
+		}
+
+		for _, call := range choice.Delta.ToolCalls {
+			if ms.blockType != anthropic.BlockToolUse || ms.toolIndex != call.Index {
+				id := call.ID
+				if id == "" {
+					id = utils.GenerateToolCallID()
+				}
+				ms.toolIndex = call.Index
+				ms.openBlock(anthropic.Block{
+					Type:  anthropic.BlockToolUse,
+					ID:    id,
+					Name:  call.Function.Name,
+					Input: map[string]any{},
+				})
+			}
+			if call.Function.Arguments != "" {
+				ms.delta(anthropic.BlockDelta{Type: "input_json_delta", PartialJSON: call.Function.Arguments})
+			}
+		}
+
+		if choice.FinishReason != "" {
+			ms.finishReason = choice.FinishReason
+		}
+	}
+}
+
+// openBlock closes the open content block, if any, and starts block
+func (ms *messageStream) openBlock(block anthropic.Block) {
+	ms.closeBlock()
+	ms.block = ms.blocks
+	ms.blocks++
+	ms.blockType = block.Type
+	ms.emit(anthropic.StreamEvent{Type: "content_block_start", Index: &ms.block, ContentBlock: &block})
+}
+
+func (ms *messageStream) delta(delta anthropic.BlockDelta) {
+	ms.emit(anthropic.StreamEvent{Type: "content_block_delta", Index: &ms.block, Delta: delta})
+}
+
+// closeBlock finishes the open content block, if any
+func (ms *messageStream) closeBlock() {
+	if ms.block < 0 {
+		return
+	}
+	ms.emit(anthropic.StreamEvent{Type: "content_block_stop", Index: &ms.block})
+	ms.block = -1
+	ms.blockType = ""
+}
+
+// finish closes the open content block and ends the stream with the stop
+// reason and usage of the message, or with an error if the stream failed
+func (ms *messageStream) finish(err error) {
+	ms.closeBlock()
+
+	if err != nil {
+		ms.emit(anthropic.StreamEvent{
+			Type:  "error",
+			Error: &anthropic.Error{Type: "api_error", Message: err.Error()},
+		})
+		return
+	}
+
+	stopReason := anthropicStopReason(ms.finishReason)
+	ms.emit(anthropic.StreamEvent{
+		Type:  "message_delta",
+		Delta: anthropic.MessageDelta{StopReason: &stopReason},
+		Usage: &ms.usage,
+	})
+	ms.emit(anthropic.StreamEvent{Type: "message_stop"})
+}
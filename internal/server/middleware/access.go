@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// Networks configures which source networks may call the proxy, as CIDRs or
+// single addresses
+type Networks struct {
+	// Allowed, if set, are the networks clients may call the proxy from
+	Allowed []string
+	// Admin, if set, are the networks the admin API may be called from
+	// instead of Allowed
+	Admin []string
+	// TrustedProxies are the networks of the reverse proxies whose
+	// X-Forwarded-For header is trusted to hold the client's address
+	TrustedProxies []string
+}
+
+// AccessControl restricts which source networks may call the proxy
+type AccessControl struct {
+	allowed []netip.Prefix
+	admin   []netip.Prefix
+	trusted []netip.Prefix
+}
+
+// NewAccessControl parses the networks
+func NewAccessControl(networks Networks) (*AccessControl, error) {
+	var ac AccessControl
+	var err error
+	if ac.allowed, err = parsePrefixes(networks.Allowed); err != nil {
+		return nil, errors.Wrap(err, "invalid allowed network")
+	}
+	if ac.admin, err = parsePrefixes(networks.Admin); err != nil {
+		return nil, errors.Wrap(err, "invalid admin network")
+	}
+	if ac.trusted, err = parsePrefixes(networks.TrustedProxies); err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxy network")
+	}
+	return &ac, nil
+}
+
+func parsePrefixes(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client, which trusted proxies
+// forwarding the request append to X-Forwarded-For. The rightmost address
+// which isn't a trusted proxy's is the client's, as the addresses to its left
+// can be forged. Clients of Unix sockets are at 127.0.0.1.
+func (ac *AccessControl) clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	var addr netip.Addr
+	if host == "" || host == "@" {
+		// Clients of Unix sockets have no address, and are local
+		addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	} else if addr, err = netip.ParseAddr(host); err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && contains(ac.trusted, addr); i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		next, err := netip.ParseAddr(hop)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = next.Unmap()
+	}
+	return addr, true
+}
+
+// allows is whether the client may call the path
+func (ac *AccessControl) allows(addr netip.Addr, path string) bool {
+	if len(ac.admin) > 0 && strings.HasPrefix(path, adminPathPrefix) {
+		return contains(ac.admin, addr)
+	}
+	return len(ac.allowed) == 0 || contains(ac.allowed, addr)
+}
+
+// withAccessControl rejects requests from networks which aren't allowed
+func withAccessControl(next http.Handler, ac *AccessControl) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		addr, ok := ac.clientAddr(r)
+		if !ok || !ac.allows(addr, r.URL.Path) {
+			logutils.FromContext(ctx).Warnf(ctx, "Rejecting request from %s, which isn't an allowed network", addr)
+			response.WriteError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientAddr(t *testing.T) {
+	ac, err := NewAccessControl(Networks{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+		wantErr   bool
+	}{
+		{name: "direct", remote: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer", remote: "203.0.113.5:1234", forwarded: []string{"198.51.100.7"}, want: "203.0.113.5"},
+		{name: "trusted proxy", remote: "10.1.2.3:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted single address", remote: "192.0.2.1:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "trusted proxy without header", remote: "10.1.2.3:1234", want: "10.1.2.3"},
+		{
+			name:      "forged hops",
+			remote:    "10.1.2.3:1234",
+			forwarded: []string{"127.0.0.1, 198.51.100.7"},
+			want:      "198.51.100.7",
+		},
+		{
+			name:      "chain of trusted proxies",
+			remote:    "10.1.2.3:1234",
+			forwarded: []string{"198.51.100.7, 10.9.9.9, 192.0.2.1"},
+			want:      "198.51.100.7",
+		},
+		{
+			name:      "repeated headers",
+			remote:    "10.1.2.3:1234",
+			forwarded: []string{"127.0.0.1", "198.51.100.7, 10.9.9.9"},
+			want:      "198.51.100.7",
+		},
+		{name: "only trusted hops", remote: "10.1.2.3:1234", forwarded: []string{"10.9.9.9"}, want: "10.9.9.9"},
+		{name: "empty hops", remote: "10.1.2.3:1234", forwarded: []string{"198.51.100.7, , "}, want: "198.51.100.7"},
+		{name: "invalid hop", remote: "10.1.2.3:1234", forwarded: []string{"unknown"}, wantErr: true},
+		{name: "invalid forged hop", remote: "10.1.2.3:1234", forwarded: []string{"unknown, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "IPv4-mapped peer", remote: "[::ffff:10.1.2.3]:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "IPv6 peer", remote: "[2001:db8::1]:1234", want: "2001:db8::1"},
+		{name: "Unix socket", remote: "@", want: "127.0.0.1"},
+		{name: "invalid peer", remote: "example.com:1234", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/models", nil)
+			r.RemoteAddr = tc.remote
+			for _, value := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			addr, ok := ac.clientAddr(r)
+			if ok == tc.wantErr {
+				t.Fatalf("clientAddr() ok = %v, want %v", ok, !tc.wantErr)
+			}
+			if ok && addr.String() != tc.want {
+				t.Errorf("clientAddr() = %s, want %s", addr, tc.want)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	ac, err := NewAccessControl(Networks{Allowed: []string{"10.0.0.0/8"}, Admin: []string{"10.0.0.1"}})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %v", err)
+	}
+	open, err := NewAccessControl(Networks{})
+	if err != nil {
+		t.Fatalf("NewAccessControl: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		ac   *AccessControl
+		addr string
+		path string
+		want bool
+	}{
+		{name: "allowed", ac: ac, addr: "10.2.3.4", path: "/v1/models", want: true},
+		{name: "not allowed", ac: ac, addr: "203.0.113.5", path: "/v1/models"},
+		{name: "admin", ac: ac, addr: "10.0.0.1", path: "/admin/config", want: true},
+		{name: "allowed but not admin", ac: ac, addr: "10.2.3.4", path: "/admin/config"},
+		{name: "unrestricted", ac: open, addr: "203.0.113.5", path: "/admin/config", want: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.ac.allows(netip.MustParseAddr(tc.addr), tc.path); got != tc.want {
+				t.Errorf("allows(%s, %s) = %v, want %v", tc.addr, tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewAccessControl(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		networks Networks
+		wantErr  bool
+	}{
+		{name: "valid", networks: Networks{Allowed: []string{"10.0.0.0/8", "::1"}, TrustedProxies: []string{"192.0.2.1"}}},
+		{name: "invalid allowed", networks: Networks{Allowed: []string{"10.0.0.0/33"}}, wantErr: true},
+		{name: "invalid admin", networks: Networks{Admin: []string{"localhost"}}, wantErr: true},
+		{name: "invalid trusted proxy", networks: Networks{TrustedProxies: []string{"10.0.0"}}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewAccessControl(tc.networks); (err != nil) != tc.wantErr {
+				t.Errorf("NewAccessControl() error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -1,31 +1,112 @@
 package middleware
 
 import (
-	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
 	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
 )
 
-func withApiKeyAuth(next http.Handler, apikey string, apikeyValidation func(apikey string) bool) http.Handler {
+// adminPathPrefix is the prefix of the admin API's paths
+const adminPathPrefix = "/admin/"
+
+// Client is a named API key clients authenticate with, decoupled from the
+// backend's API key
+type Client struct {
+	Name string
+	Key  string
+	// KeyHash, set instead of Key, is the key hashed by HashKey
+	KeyHash string
+	// ExpiresAt, if set, is when the key stops being accepted
+	ExpiresAt time.Time
+	// RateLimit overrides the rate limit of the client's tier, or else the
+	// global one, for the client's key
+	RateLimit RateLimit
+	// Tier, if set, is the tier the client belongs to, such as free or
+	// priority
+	Tier string
+}
+
+// authenticate returns the client whose key apiKey is, if any
+func authenticate(clients []Client, apiKey string) (Client, bool) {
+	for _, client := range clients {
+		if client.KeyHash != "" && matchesKeyHash(client.KeyHash, apiKey) {
+			return client, true
+		}
+		if client.Key != "" && utils.SecureCompareString(apiKey, client.Key) {
+			return client, true
+		}
+	}
+	return Client{}, false
+}
+
+func withApiKeyAuth(next http.Handler, params Params) http.Handler {
+	public := make(map[string]bool, len(params.PublicPaths))
+	for _, p := range params.PublicPaths {
+		public[p] = true
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		// Validate API key
-		// TODO: add support for API key in custom header
+		admin := params.AdminApiKey != "" && strings.HasPrefix(r.URL.Path, adminPathPrefix)
+		if public[r.URL.Path] || (params.ApiKey == "" && len(params.Clients) == 0 && params.JWT == nil && !params.ClientCerts && !admin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Clients with a verified certificate need no API key
+		if name := certIdentity(r); params.ClientCerts && name != "" && !admin {
+			next.ServeHTTP(w, withIdentity(r, name, ""))
+			return
+		}
+
+		// Validate API key, which Anthropic clients send in X-Api-Key
 		apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if apiKey == "" {
+			apiKey = r.Header.Get("X-Api-Key")
+		}
 
 		if apiKey == "" {
 			logutils.FromContext(ctx).Warn(ctx, "No API Key provided")
-			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			response.WriteError(w, http.StatusUnauthorized, "Missing API key")
 			return
 		}
 
-		log.Println(apiKey)
-		if !apikeyValidation(apiKey) {
+		valid := false
+		switch {
+		case admin:
+			valid = utils.SecureCompareString(apiKey, params.AdminApiKey)
+		case params.JWT != nil && isJWT(apiKey):
+			subject, tier, err := params.JWT.authenticate(apiKey)
+			if err != nil {
+				logutils.FromContext(ctx).Warnf(ctx, "Invalid JWT provided: %v", err)
+				response.WriteError(w, http.StatusUnauthorized, "Invalid token")
+				return
+			}
+			r, valid = withIdentity(r, JWTIdentityPrefix+subject, tier), true
+		case len(params.Clients) > 0:
+			var client Client
+			client, valid = authenticate(params.Clients, apiKey)
+			if valid && !client.ExpiresAt.IsZero() && time.Now().After(client.ExpiresAt) {
+				logutils.FromContext(ctx).Warnf(ctx, "Expired API key of client %s provided", client.Name)
+				response.WriteError(w, http.StatusUnauthorized, "Expired API key")
+				return
+			}
+			if valid {
+				r = withIdentity(r, client.Name, client.Tier)
+			}
+		case params.JWT != nil:
+			// Clients authenticating with JWTs never share the backend's key
+		default:
+			valid = params.AuthValidation(apiKey)
+		}
+		if !valid {
 			logutils.FromContext(ctx).Warn(ctx, "Invalid API Key provided")
-			http.Error(w, "Invalid API key", http.StatusForbidden)
+			response.WriteError(w, http.StatusForbidden, "Invalid API key")
 			return
 		}
 
@@ -33,3 +114,13 @@ func withApiKeyAuth(next http.Handler, apikey string, apikeyValidation func(apik
 
 	})
 }
+
+// withIdentity adds the name and tier of the authenticated client to the
+// request's context, and to the request log
+func withIdentity(r *http.Request, client, tier string) *http.Request {
+	ctx := contextutils.WithTier(contextutils.WithClient(r.Context(), client), tier)
+	if slot, ok := ctx.Value(identitySlotKey{}).(*identity); ok {
+		slot.client, slot.tier = client, tier
+	}
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/logger/loggertest"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	bobHash, err := HashKey("sk-bob")
+	if err != nil {
+		t.Fatalf("HashKey: %v", err)
+	}
+	clients := []Client{
+		{Name: "alice", Key: "sk-alice", Tier: "pro"},
+		{Name: "bob", KeyHash: bobHash},
+		{Name: "carol", Key: "sk-carol", ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	shared := func(key string) bool { return key == "sk-shared" }
+	jwtAuth, jwtKey := newTestJWTAuth(t, JWT{})
+	token := signToken(t, jwtKey, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "tier": "free"})
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+
+	for _, tc := range []struct {
+		name   string
+		params Params
+		path   string
+		header http.Header
+		cert   *x509.Certificate
+		// wantStatus is the status of the response, 200 if the request was
+		// let through
+		wantStatus int
+		wantClient string
+		wantTier   string
+	}{
+		{
+			name:       "no authentication",
+			params:     Params{},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "public path",
+			params:     Params{ApiKey: "sk-shared", AuthValidation: shared, PublicPaths: []string{"/healthz"}},
+			path:       "/healthz",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "missing key",
+			params:     Params{ApiKey: "sk-shared", AuthValidation: shared},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "shared key",
+			params:     Params{ApiKey: "sk-shared", AuthValidation: shared},
+			header:     http.Header{"Authorization": {"Bearer sk-shared"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "shared key in X-Api-Key",
+			params:     Params{ApiKey: "sk-shared", AuthValidation: shared},
+			header:     http.Header{"X-Api-Key": {"sk-shared"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid shared key",
+			params:     Params{ApiKey: "sk-shared", AuthValidation: shared},
+			header:     http.Header{"Authorization": {"Bearer sk-other"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "client key",
+			params:     Params{Clients: clients},
+			header:     http.Header{"Authorization": {"Bearer sk-alice"}},
+			wantStatus: http.StatusOK,
+			wantClient: "alice",
+			wantTier:   "pro",
+		},
+		{
+			name:       "hashed client key",
+			params:     Params{Clients: clients},
+			header:     http.Header{"Authorization": {"Bearer sk-bob"}},
+			wantStatus: http.StatusOK,
+			wantClient: "bob",
+		},
+		{
+			name:       "expired client key",
+			params:     Params{Clients: clients},
+			header:     http.Header{"Authorization": {"Bearer sk-carol"}},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "shared key with clients",
+			params:     Params{ApiKey: "sk-shared", AuthValidation: shared, Clients: clients},
+			header:     http.Header{"Authorization": {"Bearer sk-shared"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin key",
+			params:     Params{Clients: clients, AdminApiKey: "sk-admin"},
+			path:       "/admin/config",
+			header:     http.Header{"Authorization": {"Bearer sk-admin"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "client key on admin path",
+			params:     Params{Clients: clients, AdminApiKey: "sk-admin"},
+			path:       "/admin/config",
+			header:     http.Header{"Authorization": {"Bearer sk-alice"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "admin key on client path",
+			params:     Params{Clients: clients, AdminApiKey: "sk-admin"},
+			header:     http.Header{"Authorization": {"Bearer sk-admin"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "client key on admin path without admin key",
+			params:     Params{Clients: clients},
+			path:       "/admin/config",
+			header:     http.Header{"Authorization": {"Bearer sk-alice"}},
+			wantStatus: http.StatusOK,
+			wantClient: "alice",
+			wantTier:   "pro",
+		},
+		{
+			name:       "JWT",
+			params:     Params{Clients: clients, JWT: jwtAuth},
+			header:     http.Header{"Authorization": {"Bearer " + token}},
+			wantStatus: http.StatusOK,
+			wantClient: JWTIdentityPrefix + "alice",
+			wantTier:   "free",
+		},
+		{
+			name:       "invalid JWT",
+			params:     Params{JWT: jwtAuth},
+			header:     http.Header{"Authorization": {"Bearer " + token[:len(token)-4] + "AAAA"}},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "shared key with JWT",
+			params:     Params{ApiKey: "sk-shared", AuthValidation: shared, JWT: jwtAuth},
+			header:     http.Header{"Authorization": {"Bearer sk-shared"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "client certificate",
+			params:     Params{Clients: clients, ClientCerts: true},
+			cert:       cert,
+			wantStatus: http.StatusOK,
+			wantClient: CertIdentityPrefix + "alice",
+		},
+		{
+			name:       "client certificate on admin path",
+			params:     Params{Clients: clients, ClientCerts: true, AdminApiKey: "sk-admin"},
+			path:       "/admin/config",
+			cert:       cert,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "client certificate not trusted for identity",
+			params:     Params{Clients: clients},
+			cert:       cert,
+			wantStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var client, tier string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				client = contextutils.GetClient(r.Context())
+				tier = contextutils.GetTier(r.Context())
+			})
+			path := tc.path
+			if path == "" {
+				path = "/v1/chat/completions"
+			}
+			r := httptest.NewRequestWithContext(loggertest.Context(), http.MethodPost, path, nil)
+			for name, values := range tc.header {
+				r.Header[name] = values
+			}
+			if tc.cert != nil {
+				r.TLS = verified(tc.cert)
+			}
+			rec := httptest.NewRecorder()
+			withApiKeyAuth(next, tc.params).ServeHTTP(rec, r)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.wantStatus)
+			}
+			if client != tc.wantClient || tier != tc.wantTier {
+				t.Errorf("identity = %q, %q, want %q, %q", client, tier, tc.wantClient, tc.wantTier)
+			}
+		})
+	}
+}
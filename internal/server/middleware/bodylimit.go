@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+// withBodyLimit rejects requests whose body is larger than maxSize bytes.
+// Bodies of unknown length are buffered to measure them, so that every
+// handler sees the whole body or none of it.
+func withBodyLimit(next http.Handler, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		tooLarge := r.ContentLength > maxSize
+		if !tooLarge && r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+			r.Body.Close()
+			if err != nil {
+				logutils.FromContext(ctx).Warnf(ctx, "Error reading request body: %v", err)
+				response.WriteError(w, http.StatusBadRequest, "Error reading request body")
+				return
+			}
+			tooLarge = int64(len(body)) > maxSize
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+		if tooLarge {
+			logutils.FromContext(ctx).Warnf(ctx, "Rejecting request body larger than %d bytes", maxSize)
+			response.WriteErrorResponse(w, http.StatusRequestEntityTooLarge, openai.Error{
+				Message: fmt.Sprintf("Request body exceeds the maximum size of %d bytes", maxSize),
+				Code:    "request_too_large",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// ChaosHeader names the fault injected into a response
+const ChaosHeader = "X-Proxy-Chaos"
+
+// Faults injected by Chaos
+const (
+	FaultError      = "error"
+	FaultSlow       = "slow"
+	FaultDisconnect = "disconnect"
+	FaultMalformed  = "malformed"
+)
+
+// errDisconnected is returned by the writes of a response whose connection
+// was dropped
+var errDisconnected = errors.New("connection dropped by fault injection")
+
+// Chaos injects faults into a percentage of the responses to clients, to
+// verify how they behave when providers misbehave. At most one fault is
+// injected into each response.
+type Chaos struct {
+	// ErrorPercent of the requests fail with ErrorStatus, 500 if unset,
+	// without being served
+	ErrorPercent float64
+	ErrorStatus  int
+	// SlowPercent of the responses are held for SlowDelay before their first
+	// byte
+	SlowPercent float64
+	SlowDelay   time.Duration
+	// DisconnectPercent of the responses have their connection dropped
+	// partway through
+	DisconnectPercent float64
+	// MalformedPercent of the responses have a truncated chunk, or body
+	MalformedPercent float64
+}
+
+// Enabled is whether any fault is injected
+func (c Chaos) Enabled() bool {
+	return c.ErrorPercent > 0 || c.SlowPercent > 0 || c.DisconnectPercent > 0 || c.MalformedPercent > 0
+}
+
+// Validate returns an error if the percentages don't add up to at most 100 or
+// a fault injected lacks its settings
+func (c Chaos) Validate() error {
+	for _, p := range []float64{c.ErrorPercent, c.SlowPercent, c.DisconnectPercent, c.MalformedPercent} {
+		if p < 0 || p > 100 {
+			return errors.Errorf("fault percentages must be between 0 and 100, got %v", p)
+		}
+	}
+	if total := c.ErrorPercent + c.SlowPercent + c.DisconnectPercent + c.MalformedPercent; total > 100 {
+		return errors.Errorf("fault percentages add up to %v, more than 100", total)
+	}
+	if c.ErrorStatus != 0 && (c.ErrorStatus < 400 || c.ErrorStatus > 599) {
+		return errors.Errorf("error status must be between 400 and 599, got %d", c.ErrorStatus)
+	}
+	if c.SlowPercent > 0 && c.SlowDelay <= 0 {
+		return errors.New("slow delay is required when slow percent is set")
+	}
+	return nil
+}
+
+// fault picks the fault to inject into a response, if any
+func (c Chaos) fault() string {
+	roll := rand.Float64() * 100
+	for _, f := range []struct {
+		name    string
+		percent float64
+	}{
+		{FaultError, c.ErrorPercent},
+		{FaultSlow, c.SlowPercent},
+		{FaultDisconnect, c.DisconnectPercent},
+		{FaultMalformed, c.MalformedPercent},
+	} {
+		if roll < f.percent {
+			return f.name
+		}
+		roll -= f.percent
+	}
+	return ""
+}
+
+// withChaos injects the faults of chaos into the responses to clients. The
+// admin API and the public paths are left alone.
+func withChaos(next http.Handler, chaos Chaos, publicPaths []string) http.Handler {
+	public := make(map[string]bool, len(publicPaths))
+	for _, p := range publicPaths {
+		public[p] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public[r.URL.Path] || strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fault := chaos.fault()
+		if fault == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		logutils.FromContext(ctx).Infof(ctx, "Injecting %s fault", fault)
+		w.Header().Set(ChaosHeader, fault)
+		if fault == FaultError {
+			status := chaos.ErrorStatus
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			response.WriteErrorResponse(w, status, openai.Error{
+				Message: fmt.Sprintf("Injected %d %s", status, http.StatusText(status)),
+				Code:    "chaos_injected",
+			})
+			return
+		}
+		next.ServeHTTP(&chaosWriter{ResponseWriter: w, ctx: ctx, fault: fault, delay: chaos.SlowDelay}, r)
+	})
+}
+
+// chaosWriter injects a fault into the response written through it
+type chaosWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	fault string
+	delay time.Duration
+
+	// started is whether the response was started, after any delay
+	started bool
+	// events are the stream events written
+	events int
+	// injected is whether the fault was injected, after which the rest of
+	// a malformed body is dropped
+	injected bool
+}
+
+// start holds the response for the delay of slow responses, and drops the
+// length of those whose body is cut short
+func (w *chaosWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	switch w.fault {
+	case FaultSlow:
+		timer := time.NewTimer(w.delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+		}
+	case FaultDisconnect, FaultMalformed:
+		w.Header().Del("Content-Length")
+	}
+}
+
+func (w *chaosWriter) WriteHeader(status int) {
+	w.start()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *chaosWriter) Write(b []byte) (int, error) {
+	w.start()
+	if w.fault != FaultDisconnect && w.fault != FaultMalformed {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.injected {
+		if w.fault == FaultDisconnect {
+			return 0, errDisconnected
+		}
+		if !w.streaming() {
+			return len(b), nil
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	// Streams are cut after their first event, so that clients have started
+	// reading them, and other bodies halfway through
+	if w.streaming() {
+		if bytes.Contains(b, []byte("data:")) {
+			w.events++
+		}
+		if w.events < 2 {
+			return w.ResponseWriter.Write(b)
+		}
+	}
+	w.injected = true
+	if w.fault == FaultDisconnect {
+		w.ResponseWriter.Write(b[:len(b)/2])
+		w.disconnect()
+		return 0, errDisconnected
+	}
+	if w.streaming() {
+		// The event is kept terminated, so that clients parse its data
+		data := bytes.TrimRight(b, "\n")
+		if _, err := w.ResponseWriter.Write(append(data[:len(data)/2:len(data)/2], "\n\n"...)); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if _, err := w.ResponseWriter.Write(b[:len(b)/2]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// streaming is whether the response is an event stream
+func (w *chaosWriter) streaming() bool {
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// disconnect drops the connection of the response once what was written is
+// sent. HTTP/2 connections are shared, so only the response's stream is reset.
+func (w *chaosWriter) disconnect() {
+	rc := http.NewResponseController(w.ResponseWriter)
+	rc.Flush()
+	if conn, _, err := rc.Hijack(); err == nil {
+		conn.Close()
+		return
+	}
+	// Passing the write deadline resets HTTP/2 streams
+	rc.SetWriteDeadline(time.Now().Add(-time.Second))
+}
+
+func (w *chaosWriter) Flush() {
+	if w.injected && w.fault == FaultDisconnect {
+		return
+	}
+	w.start()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *chaosWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// CertIdentityPrefix prefixes the names of client certificates to identify
+// their clients, so that a certificate never takes the name of a configured
+// client, along with its upstream, rate limit and usage
+const CertIdentityPrefix = "cert:"
+
+// certIdentity returns the identity of the client certificate the request was
+// made with, once verified: its common name, or else its first DNS name or
+// email address, prefixed by CertIdentityPrefix
+func certIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return CertIdentityPrefix + cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return CertIdentityPrefix + cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return CertIdentityPrefix + cert.EmailAddresses[0]
+	}
+	return ""
+}
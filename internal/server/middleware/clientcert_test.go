@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCertIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		state *tls.ConnectionState
+		want  string
+	}{
+		{name: "no TLS"},
+		{name: "unverified", state: &tls.ConnectionState{}},
+		{name: "empty chain", state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}},
+		{
+			name:  "common name",
+			state: verified(&x509.Certificate{Subject: pkix.Name{CommonName: "build-bot"}, DNSNames: []string{"bot.example.com"}}),
+			want:  "cert:build-bot",
+		},
+		{
+			name:  "DNS name",
+			state: verified(&x509.Certificate{DNSNames: []string{"bot.example.com", "other.example.com"}, EmailAddresses: []string{"bot@example.com"}}),
+			want:  "cert:bot.example.com",
+		},
+		{
+			name:  "email address",
+			state: verified(&x509.Certificate{EmailAddresses: []string{"bot@example.com"}}),
+			want:  "cert:bot@example.com",
+		},
+		{name: "no name", state: verified(&x509.Certificate{})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/models", nil)
+			r.TLS = tc.state
+			if got := certIdentity(r); got != tc.want {
+				t.Errorf("certIdentity() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// verified returns the state of a connection made with the certificate,
+// verified
+func verified(cert *x509.Certificate) *tls.ConnectionState {
+	return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Compression compresses the JSON responses of clients which accept it
+type Compression struct {
+	Enabled bool
+	// MinSize is the size below which responses are sent uncompressed, in
+	// bytes
+	MinSize int
+}
+
+// Encodings the responses are compressed with, in order of preference
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+		return w
+	}}
+	brotliWriters = sync.Pool{New: func() any {
+		return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+	}}
+)
+
+// withCompression compresses the non-streaming JSON responses of at least
+// minSize bytes with the encoding the client prefers among brotli and gzip.
+// Streams are sent as they are, so that their events aren't held back.
+func withCompression(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the encoding of those the proxy compresses with
+// which the Accept-Encoding header gives the highest quality, preferring
+// brotli on ties, or empty if it accepts none of them
+func negotiateEncoding(accept string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		qualities[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{encodingBrotli, encodingGzip} {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of a response until it knows whether it
+// is to be compressed: it must be JSON, not already encoded, and at least
+// minSize bytes long
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status int
+	buf    []byte
+	// decided is whether the response was started, compressed if enc is set
+	decided bool
+	enc     interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	// Informational responses precede the response itself
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	if !w.compressible() {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if !w.compressible() {
+			w.decide(false)
+		} else {
+			w.buf = append(w.buf, b...)
+			if len(w.buf) >= w.minSize {
+				if err := w.decide(true); err != nil {
+					return 0, err
+				}
+			}
+			return len(b), nil
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// compressible is whether the response, as far as its status and headers
+// tell, may be compressed
+func (w *compressWriter) compressible() bool {
+	switch w.status {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// decide starts the response, compressed or not, writing what was buffered
+func (w *compressWriter) decide(compress bool) error {
+	w.decided = true
+	if w.compressible() {
+		// Whether the response is compressed depends on the request's
+		// Accept-Encoding, even if it isn't this time
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if compress {
+		w.Header().Set("Content-Encoding", w.encoding)
+		w.Header().Del("Content-Length")
+		switch w.encoding {
+		case encodingBrotli:
+			enc := brotliWriters.Get().(*brotli.Writer)
+			enc.Reset(w.ResponseWriter)
+			w.enc = enc
+		default:
+			enc := gzipWriters.Get().(*gzip.Writer)
+			enc.Reset(w.ResponseWriter)
+			w.enc = enc
+		}
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	buf := w.buf
+	w.buf = nil
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what was written so far, leaving responses shorter than the
+// minimum size uncompressed
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close ends the response once the handler returns, returning the encoder to
+// its pool
+func (w *compressWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	switch enc := w.enc.(type) {
+	case *brotli.Writer:
+		enc.Reset(io.Discard)
+		brotliWriters.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(io.Discard)
+		gzipWriters.Put(enc)
+	}
+	w.enc = nil
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
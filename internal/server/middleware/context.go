@@ -3,18 +3,16 @@ package middleware
 import (
 	"context"
 	"net/http"
-	"time"
 
 	"github.com/danilofalcao/cursor-deepseek/internal/utils"
 	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
 )
 
-// withContext takes the server's context including its logger, injects a request ID and
-// timeout, and sets it as the request's context.
-func withContext(ctx context.Context, next http.Handler, timeout time.Duration) http.Handler {
+// withContext takes the server's context including its logger, injects a request ID,
+// and sets it as the request's context.
+func withContext(ctx context.Context, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// set timeout
-		ctx, _ = context.WithTimeout(r.Context(), timeout)
+		ctx := r.Context()
 
 		// Generate request ID
 		requestID := r.Header.Get("X-Request-ID")
@@ -2,17 +2,38 @@ package middleware
 
 import (
 	"net/http"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
 )
 
-func withCors(next http.Handler) http.Handler {
+// withCors allows browsers to call the proxy from any origin. Preflight
+// requests carry no credentials, so they are answered before authentication,
+// with the methods of their path's routes if routeMethods is set.
+func withCors(next http.Handler, routeMethods func(*http.Request) []string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Api-Key, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Upstream-Request-ID, X-Upstream-Cost")
 
 		// Stop execution and return if OPTIONS request
 		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
+			if routeMethods != nil {
+				methods := routeMethods(r)
+				if len(methods) == 0 {
+					response.WriteErrorResponse(w, http.StatusNotFound, openai.Error{
+						Message: "Invalid URL (OPTIONS " + r.URL.Path + ")",
+						Code:    "not_found",
+					})
+					return
+				}
+				allow := strings.Join(append(methods, http.MethodOptions), ", ")
+				w.Header().Set("Allow", allow)
+				w.Header().Set("Access-Control-Allow-Methods", allow)
+			}
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Deadlines bound the reads and writes of a request's connection
+type Deadlines struct {
+	// ReadBody bounds reading the request body
+	ReadBody time.Duration
+	// Write bounds each write of the response, rather than the whole of it,
+	// so that streams of any length are served to clients reading them
+	Write time.Duration
+}
+
+// withDeadlines sets the read deadline of the request's connection until its
+// body is read, and bounds each write of the response, so that slow clients
+// don't hold connections
+func withDeadlines(next http.Handler, deadlines Deadlines) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		// The connection is read in the background once the body is, to
+		// detect clients going away, so the deadline is only set until then
+		if deadlines.ReadBody > 0 && r.Body != nil && r.Body != http.NoBody {
+			if rc.SetReadDeadline(time.Now().Add(deadlines.ReadBody)) == nil {
+				r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc, remaining: r.ContentLength}
+			}
+		}
+		if deadlines.Write > 0 {
+			dw := &deadlineWriter{ResponseWriter: w, rc: rc, timeout: deadlines.Write}
+			w = dw
+			// The response is flushed after the handler returns
+			defer dw.bound()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadlineBody clears the read deadline once the body is read. It is kept
+// when reading fails, so that the server gives up on the rest of the body too.
+type deadlineBody struct {
+	io.ReadCloser
+	rc *http.ResponseController
+	// remaining is the length of the body left to read, negative if unknown,
+	// as decoders stop reading before the end of the body
+	remaining int64
+	cleared   bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if !b.cleared && (err == io.EOF || (err == nil && b.remaining == 0)) {
+		b.cleared = true
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// deadlineWriter sets the write deadline for the duration of each write. It
+// is cleared in between, as HTTP/2 resets streams when it passes, even while
+// the handler is waiting on the upstream.
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// bound sets the write deadline, returning a func clearing it
+func (w *deadlineWriter) bound() func() {
+	w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+	return func() {
+		w.rc.SetWriteDeadline(time.Time{})
+	}
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	defer w.bound()()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *deadlineWriter) Flush() {
+	defer w.bound()()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
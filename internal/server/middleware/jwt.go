@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// defaultTierClaim is the claim holding the tier of a client
+const defaultTierClaim = "tier"
+
+// JWTIdentityPrefix prefixes the subjects of JWTs to identify their clients,
+// so that a subject never takes the name of a configured client, along with
+// its upstream, rate limit and usage
+const JWTIdentityPrefix = "jwt:"
+
+// JWT configures the authentication of clients with JWTs, whose subject
+// identifies the client
+type JWT struct {
+	// JWKSURL is where the keys the tokens are signed with are fetched from
+	JWKSURL string
+	// Issuer and Audience, if set, are required of the tokens
+	Issuer   string
+	Audience string
+	// TierClaim is the claim holding the client's tier, tier by default
+	TierClaim string
+}
+
+// JWTAuth validates JWTs with the keys of a JWKS, which it keeps refreshed
+type JWTAuth struct {
+	keyfunc   keyfunc.Keyfunc
+	parser    *jwt.Parser
+	tierClaim string
+}
+
+// NewJWTAuth fetches the JWKS, refreshing it in the background until ctx is
+// done
+func NewJWTAuth(ctx context.Context, cfg JWT) (*JWTAuth, error) {
+	if cfg.JWKSURL == "" {
+		return nil, errors.New("JWT authentication requires a JWKS URL")
+	}
+	kf, err := keyfunc.NewDefaultCtx(ctx, []string{cfg.JWKSURL})
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching JWKS")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	tierClaim := cfg.TierClaim
+	if tierClaim == "" {
+		tierClaim = defaultTierClaim
+	}
+	return &JWTAuth{
+		keyfunc:   kf,
+		parser:    jwt.NewParser(opts...),
+		tierClaim: tierClaim,
+	}, nil
+}
+
+// authenticate validates a token, returning its subject and tier
+func (a *JWTAuth) authenticate(token string) (subject, tier string, err error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keyfunc.Keyfunc); err != nil {
+		return "", "", errors.Wrap(err, "invalid JWT")
+	}
+	subject, _ = claims.GetSubject()
+	if subject == "" {
+		return "", "", errors.New("JWT has no subject")
+	}
+	tier, _ = claims[a.tierClaim].(string)
+	return subject, tier, nil
+}
+
+// isJWT is whether a bearer token is a JWT rather than an API key
+func isJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
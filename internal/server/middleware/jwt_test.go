@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeyID identifies the key of the JWKS newTestJWTAuth serves
+const testKeyID = "test"
+
+// newTestJWTAuth creates a JWTAuth with the JWKS of a new key, which is
+// returned for signing tokens
+func newTestJWTAuth(t *testing.T, cfg JWT) (*JWTAuth, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	jwks, err := json.Marshal(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"kid": testKeyID,
+			"alg": "EdDSA",
+			"use": "sig",
+			"x":   base64.RawURLEncoding.EncodeToString(public),
+		}},
+	})
+	if err != nil {
+		t.Fatalf("error encoding JWKS: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg.JWKSURL = srv.URL
+	auth, err := NewJWTAuth(t.Context(), cfg)
+	if err != nil {
+		t.Fatalf("NewJWTAuth: %v", err)
+	}
+	return auth, private
+}
+
+// signToken signs a JWT with the claims
+func signToken(t *testing.T, key ed25519.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = testKeyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+	return signed
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	auth, key := newTestJWTAuth(t, JWT{Issuer: "https://issuer", Audience: "proxy", TierClaim: "plan"})
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := jwt.MapClaims{"sub": "alice", "iss": "https://issuer", "aud": "proxy", "exp": exp, "plan": "pro"}
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for name, value := range valid {
+			claims[name] = value
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+				continue
+			}
+			claims[name] = value
+		}
+		return claims
+	}
+
+	for _, tc := range []struct {
+		name        string
+		token       string
+		wantSubject string
+		wantTier    string
+		wantErr     bool
+	}{
+		{name: "valid", token: signToken(t, key, valid), wantSubject: "alice", wantTier: "pro"},
+		{name: "no tier", token: signToken(t, key, with(jwt.MapClaims{"plan": nil})), wantSubject: "alice"},
+		{name: "tier in another claim", token: signToken(t, key, with(jwt.MapClaims{"plan": nil, "tier": "pro"})), wantSubject: "alice"},
+		{name: "no subject", token: signToken(t, key, with(jwt.MapClaims{"sub": nil})), wantErr: true},
+		{name: "expired", token: signToken(t, key, with(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), wantErr: true},
+		{name: "no expiry", token: signToken(t, key, with(jwt.MapClaims{"exp": nil})), wantErr: true},
+		{name: "other issuer", token: signToken(t, key, with(jwt.MapClaims{"iss": "https://other"})), wantErr: true},
+		{name: "other audience", token: signToken(t, key, with(jwt.MapClaims{"aud": "other"})), wantErr: true},
+		{name: "other key", token: signToken(t, otherKey, valid), wantErr: true},
+		{name: "symmetric", token: func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, valid)
+			token.Header["kid"] = testKeyID
+			signed, _ := token.SignedString([]byte("secret"))
+			return signed
+		}(), wantErr: true},
+		{name: "malformed", token: "eyJ.a.b", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			subject, tier, err := auth.authenticate(tc.token)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("authenticate() error = %v, want error %v", err, tc.wantErr)
+			}
+			if subject != tc.wantSubject || tier != tc.wantTier {
+				t.Errorf("authenticate() = %q, %q, want %q, %q", subject, tier, tc.wantSubject, tc.wantTier)
+			}
+		})
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	for _, tc := range []struct {
+		token string
+		want  bool
+	}{
+		{token: "eyJhbGciOiJFZERTQSJ9.eyJzdWIiOiJhbGljZSJ9.c2ln", want: true},
+		{token: "sk-alice"},
+		{token: "eyJhbGciOiJFZERTQSJ9.eyJzdWIiOiJhbGljZSJ9"},
+		{token: "abc.def.ghi"},
+		{token: ""},
+	} {
+		if got := isJWT(tc.token); got != tc.want {
+			t.Errorf("isJWT(%q) = %v, want %v", tc.token, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// keyHashScheme prefixes the hashes of client API keys
+const keyHashScheme = "sha256"
+
+// HashKey hashes a client API key with a random salt, as sha256:salt:hash, so
+// the key needn't be stored in the config. API keys are random enough that a
+// fast hash suffices.
+func HashKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.Wrap(err, "error generating salt")
+	}
+	return keyHashScheme + ":" + hex.EncodeToString(salt) + ":" + hex.EncodeToString(saltedHash(salt, key)), nil
+}
+
+// ValidateKeyHash checks that a key hash is in the format HashKey creates
+func ValidateKeyHash(hash string) error {
+	if _, _, err := parseKeyHash(hash); err != nil {
+		return err
+	}
+	return nil
+}
+
+// matchesKeyHash is whether key is the key hashed by hash
+func matchesKeyHash(hash, key string) bool {
+	salt, sum, err := parseKeyHash(hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(saltedHash(salt, key), sum) == 1
+}
+
+func parseKeyHash(hash string) (salt, sum []byte, err error) {
+	parts := strings.Split(hash, ":")
+	if len(parts) != 3 || parts[0] != keyHashScheme {
+		return nil, nil, errors.Errorf("key hash must be formatted as %s:salt:hash", keyHashScheme)
+	}
+	if salt, err = hex.DecodeString(parts[1]); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid key hash salt")
+	}
+	if sum, err = hex.DecodeString(parts[2]); err != nil || len(sum) != sha256.Size {
+		return nil, nil, errors.New("invalid key hash")
+	}
+	return salt, sum, nil
+}
+
+func saltedHash(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	hash, err := HashKey("sk-alice")
+	if err != nil {
+		t.Fatalf("HashKey: %v", err)
+	}
+	if err := ValidateKeyHash(hash); err != nil {
+		t.Errorf("ValidateKeyHash(%q): %v", hash, err)
+	}
+	if other, _ := HashKey("sk-alice"); other == hash {
+		t.Error("hashes of the same key share their salt")
+	}
+
+	for _, tc := range []struct {
+		key  string
+		want bool
+	}{
+		{key: "sk-alice", want: true},
+		{key: "sk-bob"},
+		{key: "sk-alic"},
+		{key: ""},
+	} {
+		if got := matchesKeyHash(hash, tc.key); got != tc.want {
+			t.Errorf("matchesKeyHash(%q) = %v, want %v", tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestValidateKeyHash(t *testing.T) {
+	valid, err := HashKey("sk-alice")
+	if err != nil {
+		t.Fatalf("HashKey: %v", err)
+	}
+	parts := strings.Split(valid, ":")
+
+	for _, tc := range []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{name: "valid", hash: valid},
+		{name: "empty", hash: "", wantErr: true},
+		{name: "plain key", hash: "sk-alice", wantErr: true},
+		{name: "unknown scheme", hash: "md5:" + parts[1] + ":" + parts[2], wantErr: true},
+		{name: "missing salt", hash: "sha256:" + parts[2], wantErr: true},
+		{name: "invalid salt", hash: "sha256:xyz:" + parts[2], wantErr: true},
+		{name: "invalid hash", hash: "sha256:" + parts[1] + ":xyz", wantErr: true},
+		{name: "short hash", hash: "sha256:" + parts[1] + ":" + parts[2][:32], wantErr: true},
+		{name: "extra part", hash: valid + ":00", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateKeyHash(tc.hash)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ValidateKeyHash(%q) = %v, want error %v", tc.hash, err, tc.wantErr)
+			}
+			if tc.wantErr && matchesKeyHash(tc.hash, "sk-alice") {
+				t.Errorf("invalid hash %q matched a key", tc.hash)
+			}
+		})
+	}
+}
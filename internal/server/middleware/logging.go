@@ -1,18 +1,32 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/danilofalcao/cursor-deepseek/internal/telemetry"
 	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// identitySlotKey holds where the identity of the authenticated client is
+// stored, for logging the request
+type identitySlotKey struct{}
+
+type identity struct {
+	client string
+	tier   string
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	http.Flusher
 	status        int
 	size          int
 	headerWritten bool
+	phases        *telemetry.Phases
 }
 
 func (rw *responseWriter) WriteHeader(status int) {
@@ -29,22 +43,37 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	if !rw.headerWritten {
 		rw.status = http.StatusOK
 	}
+	if rw.size == 0 {
+		rw.phases.Mark(telemetry.PhaseFirstByte)
+	}
 	size, err := rw.ResponseWriter.Write(b)
 	rw.size += size
 	return size, err
 }
 
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // LoggingMiddleware logs request and response details
 func withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		lgr := logutils.FromContext(r.Context())
 		start := time.Now()
 
+		// Record the phases of the request, to break its latency down
+		ctx, phases := telemetry.WithPhases(r.Context())
+		// Authentication, which runs after, fills in the client
+		client := &identity{}
+		ctx = context.WithValue(ctx, identitySlotKey{}, client)
+		r = r.WithContext(ctx)
+
 		// Create wrapped response writer to capture status and size
 		wrapped := &responseWriter{
 			ResponseWriter: w,
 			Flusher:        w.(http.Flusher),
 			status:         http.StatusInternalServerError,
+			phases:         phases,
 		}
 
 		// Call next handler
@@ -52,9 +81,35 @@ func withLogging(next http.Handler) http.Handler {
 
 		// Log response
 		duration := time.Since(start)
-		lgr.Infof(r.Context(), "Request: %s, %s // Response: %d %s %d bytes %v",
+		phases.Mark(telemetry.PhaseLastByte)
+		breakdown := phases.Breakdown()
+		trace.SpanFromContext(ctx).SetAttributes(breakdown.Attributes()...)
+		if client.client != "" {
+			lgr = lgr.With("client", client.client)
+		}
+		if client.tier != "" {
+			lgr = lgr.With("tier", client.tier)
+		}
+		// The route's pattern is only set if no middleware copied the request,
+		// and starts with its method
+		_, path, _ := strings.Cut(r.Pattern, " ")
+		if path == "" {
+			path = r.URL.Path
+		}
+		lgr.With(
+			"method", r.Method,
+			"path", path,
+			"status", wrapped.status,
+			"bytes", wrapped.size,
+			"duration", duration,
+			"proxy_ms", breakdown.Proxy,
+			"connect_ms", breakdown.Connect,
+			"upstream_ms", breakdown.Upstream,
+			"first_byte_ms", breakdown.FirstByte,
+			"stream_ms", breakdown.Stream,
+		).Infof(r.Context(), "Request: %s, %s // Response: %d %s %d bytes %v",
 			r.Method,
-			r.Pattern,
+			path,
 			wrapped.status,
 			http.StatusText(wrapped.status),
 			wrapped.size,
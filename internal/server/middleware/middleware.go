@@ -3,25 +3,86 @@ package middleware
 import (
 	"context"
 	"net/http"
-	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/store"
+	"github.com/danilofalcao/cursor-deepseek/internal/telemetry"
 )
 
 type ApiKeyValidationFunc func(string) bool
 type Params struct {
-	ApiKey         string
+	ApiKey string
+	// AdminApiKey, if set, is required by the /admin/ paths instead of a
+	// client API key
+	AdminApiKey    string
 	AuthValidation ApiKeyValidationFunc
-	Timeout        time.Duration
+	// PublicPaths are served without API key authentication
+	PublicPaths []string
+	// Clients, if set, are the API keys clients authenticate with instead of
+	// the backend's
+	Clients []Client
+	// JWT, if set, authenticates clients presenting JWTs
+	JWT *JWTAuth
+	// AccessControl, if set, restricts which networks may call the proxy
+	AccessControl *AccessControl
+	// ClientCerts authenticates clients by their verified TLS certificates,
+	// identified by their common name
+	ClientCerts bool
+	// RateLimit limits each client API key, unless its client or tier has its
+	// own
+	RateLimit RateLimit
+	// TierRateLimits are the rate limits of the clients of each tier
+	TierRateLimits map[string]RateLimit
+	// TierMaxTokens are the completion token caps of the clients of each
+	// tier, which bound the tokens their requests are estimated to use
+	TierMaxTokens map[string]int
+	// Store holds the rate limits' token buckets
+	Store store.Store
+	// MaxBodySize, if set, is the largest request body accepted, in bytes
+	MaxBodySize int64
+	// Deadlines bound reading requests and writing responses
+	Deadlines Deadlines
+	// Chaos injects faults into the responses to clients
+	Chaos Chaos
+	// Compression compresses the JSON responses of clients which accept it
+	Compression Compression
+	// RouteMethods, if set, returns the methods routes are registered for at
+	// the path of a request, for answering CORS preflight requests
+	RouteMethods func(*http.Request) []string
 }
 
 func Wrap(ctx context.Context, handler http.Handler, params Params) http.Handler {
 	// These middlewares will be executed in the reverse order of their
 	// wrapping. i.e. the last wrap operation will be the first one executed
 	// on a request.
-	if params.ApiKey != "" {
-		handler = withApiKeyAuth(handler, params.ApiKey, params.AuthValidation)
+	// Faults are injected into the responses of requests which were
+	// authenticated and passed their rate limits
+	if params.Chaos.Enabled() {
+		handler = withChaos(handler, params.Chaos, params.PublicPaths)
+	}
+	// Rate limiting runs after authentication, to limit clients by name
+	handler = withRateLimit(handler, params)
+	if params.ApiKey != "" || params.AdminApiKey != "" || len(params.Clients) > 0 || params.JWT != nil || params.ClientCerts {
+		handler = withApiKeyAuth(handler, params)
+	}
+	// Oversized bodies are rejected before they are authenticated or read
+	if params.MaxBodySize > 0 {
+		handler = withBodyLimit(handler, params.MaxBodySize)
+	}
+	if params.AccessControl != nil {
+		handler = withAccessControl(handler, params.AccessControl)
+	}
+	handler = withCors(handler, params.RouteMethods)
+	// Responses are logged with the size sent to clients
+	if params.Compression.Enabled {
+		handler = withCompression(handler, params.Compression.MinSize)
 	}
-	handler = withCors(handler)
 	handler = withLogging(handler)
-	handler = withContext(ctx, handler, params.Timeout)
+	handler = telemetry.Handler(handler)
+	handler = withContext(ctx, handler)
+	// Deadlines are set on the connection, which only the outermost writer
+	// can reach
+	if params.Deadlines.ReadBody > 0 || params.Deadlines.Write > 0 {
+		handler = withDeadlines(handler, params.Deadlines)
+	}
 	return handler
 }
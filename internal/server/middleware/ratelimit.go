@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/store"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// RateLimit limits the requests and tokens a client API key may use per
+// minute. Zero is unlimited.
+type RateLimit struct {
+	RequestsPerMinute int
+	TokensPerMinute   int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.RequestsPerMinute > 0 || l.TokensPerMinute > 0
+}
+
+// or returns the limit, with the unset fields taken from fallback
+func (l RateLimit) or(fallback RateLimit) RateLimit {
+	if l.RequestsPerMinute == 0 {
+		l.RequestsPerMinute = fallback.RequestsPerMinute
+	}
+	if l.TokensPerMinute == 0 {
+		l.TokensPerMinute = fallback.TokensPerMinute
+	}
+	return l
+}
+
+// rateLimiter limits client API keys with token buckets in the store
+type rateLimiter struct {
+	store   store.Store
+	global  RateLimit
+	clients map[string]RateLimit
+	tiers   map[string]RateLimit
+	// maxTokens are the completion token caps of the tiers
+	maxTokens map[string]int
+}
+
+func newRateLimiter(params Params) *rateLimiter {
+	tiers := make(map[string]RateLimit, len(params.TierRateLimits))
+	for tier, limit := range params.TierRateLimits {
+		tiers[tier] = limit.or(params.RateLimit)
+	}
+	clients := make(map[string]RateLimit, len(params.Clients))
+	for _, client := range params.Clients {
+		fallback, ok := tiers[client.Tier]
+		if !ok {
+			fallback = params.RateLimit
+		}
+		clients[client.Name] = client.RateLimit.or(fallback)
+	}
+	return &rateLimiter{
+		store:     params.Store,
+		global:    params.RateLimit,
+		clients:   clients,
+		tiers:     tiers,
+		maxTokens: params.TierMaxTokens,
+	}
+}
+
+// enabled is whether any client API key is limited
+func (rl *rateLimiter) enabled() bool {
+	if rl.global.enabled() {
+		return true
+	}
+	for _, limits := range []map[string]RateLimit{rl.clients, rl.tiers} {
+		for _, limit := range limits {
+			if limit.enabled() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// limit returns the limit of a client, or of its tier, or else the global one
+func (rl *rateLimiter) limit(client, tier string) RateLimit {
+	if limit, ok := rl.clients[client]; ok {
+		return limit
+	}
+	if limit, ok := rl.tiers[tier]; ok {
+		return limit
+	}
+	return rl.global
+}
+
+// take takes a request and its estimated tokens from the buckets of key,
+// returning how long to wait instead if either lacks them, along with the
+// buckets' remaining capacity
+func (rl *rateLimiter) take(ctx context.Context, key string, limit RateLimit, tokens int) (time.Duration, RateLimit, error) {
+	var remaining RateLimit
+	if limit.RequestsPerMinute > 0 {
+		wait, left, err := rl.store.Take(ctx, "ratelimit:requests:"+key, float64(limit.RequestsPerMinute), time.Minute, 1)
+		if err != nil || wait > 0 {
+			return wait, remaining, err
+		}
+		remaining.RequestsPerMinute = max(0, int(left))
+	}
+	if limit.TokensPerMinute > 0 {
+		wait, left, err := rl.store.Take(ctx, "ratelimit:tokens:"+key, float64(limit.TokensPerMinute), time.Minute, float64(tokens))
+		if err != nil || wait > 0 {
+			// Give the request back, as it isn't served
+			if limit.RequestsPerMinute > 0 {
+				rl.store.Take(ctx, "ratelimit:requests:"+key, float64(limit.RequestsPerMinute), time.Minute, -1)
+			}
+			return wait, remaining, err
+		}
+		remaining.TokensPerMinute = max(0, int(left))
+	}
+	return 0, remaining, nil
+}
+
+// refund returns tokens to the tokens bucket of key, or takes more from it, if
+// it holds them, when tokens is negative
+func (rl *rateLimiter) refund(ctx context.Context, key string, limit RateLimit, tokens int) error {
+	_, _, err := rl.store.Take(ctx, "ratelimit:tokens:"+key, float64(limit.TokensPerMinute), time.Minute, -float64(tokens))
+	return err
+}
+
+// setRateLimitHeaders sets the OpenAI rate limit headers of the limits
+func setRateLimitHeaders(h http.Header, limit, remaining RateLimit) {
+	if limit.RequestsPerMinute > 0 {
+		h.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(limit.RequestsPerMinute))
+		h.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(remaining.RequestsPerMinute))
+	}
+	if limit.TokensPerMinute > 0 {
+		h.Set("X-Ratelimit-Limit-Tokens", strconv.Itoa(limit.TokensPerMinute))
+		h.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(remaining.TokensPerMinute))
+	}
+}
+
+// estimateTokens estimates the tokens a request will use from the size of its
+// body, at four characters per token, and the completion tokens it allows, at
+// most maxTokens if set. The body is restored for the next handler.
+func estimateTokens(r *http.Request, maxTokens int) int {
+	if r.Body == nil || r.Body == http.NoBody {
+		return 0
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 0
+	}
+
+	var limits struct {
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"`
+	}
+	json.Unmarshal(body, &limits)
+	completion := max(limits.MaxTokens, limits.MaxCompletionTokens)
+	if maxTokens > 0 {
+		completion = min(completion, maxTokens)
+	}
+	return (len(body)+3)/4 + completion
+}
+
+// withRateLimit limits the requests and tokens of each client API key with
+// token buckets. The tokens of a request are estimated up front, and corrected
+// once the usage of its completion is reported.
+func withRateLimit(next http.Handler, params Params) http.Handler {
+	rl := newRateLimiter(params)
+	if !rl.enabled() {
+		return next
+	}
+	public := make(map[string]bool, len(params.PublicPaths))
+	for _, p := range params.PublicPaths {
+		public[p] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if public[r.URL.Path] || strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Clients are limited by name, other API keys by their hash, so they
+		// aren't stored
+		client := contextutils.GetClient(ctx)
+		key, name := "client:"+client, client
+		if client == "" {
+			apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if apiKey == "" {
+				apiKey = r.Header.Get("X-Api-Key")
+			}
+			hash := sha256.Sum256([]byte(apiKey))
+			key, name = "key:"+hex.EncodeToString(hash[:]), logger.MaskSecret(apiKey)
+		}
+		tier := contextutils.GetTier(ctx)
+		limit := rl.limit(client, tier)
+		if !limit.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tokens := 0
+		if limit.TokensPerMinute > 0 {
+			tokens = estimateTokens(r, rl.maxTokens[tier])
+		}
+		lgr := logutils.FromContext(ctx)
+		wait, remaining, err := rl.take(ctx, key, limit, tokens)
+		if err != nil {
+			// Requests are served rather than failed while the store is down
+			lgr.Error(ctx, errors.Wrap(err, "error rate limiting").Error())
+			next.ServeHTTP(w, r)
+			return
+		}
+		setRateLimitHeaders(w.Header(), limit, remaining)
+		if wait > 0 {
+			lgr.Warnf(ctx, "Rate limiting %s for %v", name, wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			response.WriteErrorResponse(w, http.StatusTooManyRequests, openai.Error{
+				Message: fmt.Sprintf("Rate limit reached, please try again in %.1fs", wait.Seconds()),
+				Type:    response.ErrorTypeRateLimit,
+				Code:    "rate_limit_exceeded",
+			})
+			return
+		}
+
+		if tokens > 0 {
+			// Replace the estimate by the tokens the completion used
+			var once sync.Once
+			ctx = contextutils.WithTokensReporter(ctx, func(used int) {
+				once.Do(func() {
+					if err := rl.refund(context.WithoutCancel(ctx), key, limit, tokens-used); err != nil {
+						lgr.Error(ctx, errors.Wrap(err, "error rate limiting").Error())
+					}
+				})
+			})
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	ollama "github.com/danilofalcao/cursor-deepseek/internal/api/ollama/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// ollamaChatRequest is a request to /api/chat. Unlike the requests the proxy
+// sends to Ollama, streaming is the default when stream is omitted.
+type ollamaChatRequest struct {
+	ollama.Request
+	Stream *bool `json:"stream,omitempty"`
+}
+
+// handleOllamaChat serves Ollama's chat API by translating requests into chat
+// completion requests and the chat completions back into Ollama responses
+func (s *Server) handleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	// Parse request
+	var req ollamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = errors.Wrap(err, "error parsing request")
+		lgr.Error(ctx, err.Error())
+		writeOllamaError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	streaming := req.Stream == nil || *req.Stream
+
+	chatReq := ollamaToChat(&req.Request, streaming)
+
+	// Backends which proxy the request path must see a chat completion
+	r = r.Clone(ctx)
+	r.URL.Path = "/v1/chat/completions"
+
+	if streaming {
+		s.streamOllamaChat(ctx, w, r, req.Model, chatReq)
+		return
+	}
+
+	rec := response.NewRecorder()
+	s.backend.HandleChatCompletion(ctx, rec, r, chatReq)
+	if rec.Status != http.StatusOK {
+		rec.WriteTo(w, ollamaError(rec.Status, rec.Body.Bytes()))
+		return
+	}
+
+	var chatResp openai.ChatCompletionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &chatResp); err != nil || len(chatResp.Choices) == 0 {
+		lgr.Errorf(ctx, "error parsing chat completion response: %s", rec.Body.String())
+		writeOllamaError(w, http.StatusBadGateway, "Error parsing chat completion response")
+		return
+	}
+
+	choice := chatResp.Choices[0]
+	resp := ollama.Response{
+		Model:     req.Model,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Message: ollama.Message{
+			Role:      "assistant",
+			Content:   choice.Message.GetContentString(),
+			Thinking:  choice.Message.ReasoningContent,
+			ToolCalls: ollamaToolCalls(choice.Message.ToolCalls),
+		},
+		Done:            true,
+		DoneReason:      ollamaDoneReason(choice.FinishReason),
+		PromptEvalCount: chatResp.Usage.PromptTokens,
+		EvalCount:       chatResp.Usage.CompletionTokens,
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		lgr.Error(ctx, err.Error())
+		writeOllamaError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	rec.WriteTo(w, body)
+}
+
+// streamOllamaChat relays the streamed chat completion of chatReq as Ollama's
+// newline-delimited JSON stream
+func (s *Server) streamOllamaChat(ctx context.Context, w http.ResponseWriter, r *http.Request, model string, chatReq *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		lgr.Error(ctx, "streaming unsupported")
+		writeOllamaError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	pipe, ok := s.pipeChatCompletion(ctx, w, r, chatReq, ollamaError)
+	if !ok {
+		return
+	}
+	// Stops the backend if the client goes away before the stream ends
+	defer pipe.CloseRead()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	chunks, errs := stream.ReadOpenAI(ctx, pipe, stream.ReadOptions{})
+
+	enc := json.NewEncoder(w)
+	write := func(v any) bool {
+		if err := enc.Encode(v); err != nil {
+			lgr.Error(ctx, errors.Wrap(err, "error writing response").Error())
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	message := func(msg ollama.Message) ollama.Response {
+		return ollama.Response{
+			Model:     model,
+			CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+			Message:   msg,
+		}
+	}
+
+	// Ollama streams whole tool calls, so their fragments are collected and
+	// sent once the completion is done
+	var toolCalls []openai.ToolCall
+	var finishReason string
+	var usage openai.Usage
+	for {
+		select {
+		case <-ctx.Done():
+			lgr.Info(ctx, "Context cancelled, ending stream")
+			return
+		case chunk, ok := <-chunks:
+			if !ok {
+				select {
+				case err, ok := <-errs:
+					if ok {
+						lgr.Error(ctx, err.Error())
+						write(ollama.ErrorResponse{Error: err.Error()})
+						return
+					}
+				default:
+				}
+
+				if len(toolCalls) > 0 {
+					if !write(message(ollama.Message{Role: "assistant", ToolCalls: ollamaToolCalls(toolCalls)})) {
+						return
+					}
+				}
+				done := message(ollama.Message{Role: "assistant"})
+				done.Done = true
+				done.DoneReason = ollamaDoneReason(finishReason)
+				done.PromptEvalCount = usage.PromptTokens
+				done.EvalCount = usage.CompletionTokens
+				if write(done) {
+					lgr.Info(ctx, "streaming response handler completed")
+				}
+				return
+			}
+
+			if chunk.Usage != nil {
+				usage = *chunk.Usage
+			}
+			for _, choice := range chunk.Choices {
+				if choice.Index != 0 {
+					continue
+				}
+				if choice.FinishReason != "" {
+					finishReason = choice.FinishReason
+				}
+				for _, call := range choice.Delta.ToolCalls {
+					for len(toolCalls) <= call.Index {
+						toolCalls = append(toolCalls, openai.ToolCall{Type: "function"})
+					}
+					tc := &toolCalls[call.Index]
+					if call.ID != "" {
+						tc.ID = call.ID
+					}
+					tc.Function.Name += call.Function.Name
+					tc.Function.Arguments += call.Function.Arguments
+				}
+
+				var content string
+				if text, ok := choice.Delta.Content.(openai.Content_String); ok {
+					content = text.Content
+				}
+				if content == "" && choice.Delta.ReasoningContent == "" {
+					continue
+				}
+				if !write(message(ollama.Message{
+					Role:     "assistant",
+					Content:  content,
+					Thinking: choice.Delta.ReasoningContent,
+				})) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleOllamaTags lists the models of the backend in the format of Ollama's
+// /api/tags
+func (s *Server) handleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	models, err := s.backend.ListModels(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "error listing models")
+		lgr.Error(ctx, err.Error())
+		writeOllamaError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	resp := ollama.TagsResponse{Models: make([]ollama.ModelTag, 0, len(models))}
+	for _, model := range models {
+		resp.Models = append(resp.Models, ollama.ModelTag{
+			Name:       model.ID,
+			Model:      model.ID,
+			ModifiedAt: time.Unix(model.Created, 0).UTC().Format(time.RFC3339),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		lgr.Error(ctx, err.Error())
+	}
+}
+
+// ollamaToChat translates an Ollama chat request into a chat request
+func ollamaToChat(req *ollama.Request, streaming bool) *openai.ChatCompletionRequest {
+	chatReq := &openai.ChatCompletionRequest{
+		Model:  req.Model,
+		Stream: streaming,
+	}
+	if streaming {
+		// The token counts are reported on the final message
+		chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	if opts := req.Options; opts != nil {
+		chatReq.Temperature = opts.Temperature
+		chatReq.MaxTokens = opts.NumPredict
+		chatReq.TopP = opts.TopP
+		chatReq.Stop = opts.Stop
+		chatReq.Seed = opts.Seed
+		chatReq.FrequencyPenalty = opts.FrequencyPenalty
+		chatReq.PresencePenalty = opts.PresencePenalty
+	}
+
+	switch format := req.Format.(type) {
+	case nil:
+	case string:
+		if format == "json" {
+			chatReq.ResponseFormat = &openai.ResponseFormat{Type: openai.ResponseFormatJSONObject}
+		}
+	default:
+		chatReq.ResponseFormat = &openai.ResponseFormat{
+			Type:       openai.ResponseFormatJSONSchema,
+			JSONSchema: &openai.JSONSchema{Name: "response", Schema: format},
+		}
+	}
+
+	// Ollama identifies tool results by name rather than by call ID, so each
+	// result answers the earliest unanswered call of the same name
+	var pending []openai.ToolCall
+	for _, msg := range req.Messages {
+		out := openai.Message{
+			Role:    msg.Role,
+			Content: openai.Content_String{Content: msg.Content},
+		}
+		switch msg.Role {
+		case "assistant":
+			pending = pending[:0]
+			for _, call := range msg.ToolCalls {
+				tc := openai.ToolCall{
+					ID:   call.ID,
+					Type: "function",
+					Function: openai.ToolCallFunction{
+						Name:      call.Function.Name,
+						Arguments: ollamaArguments(call.Function.Arguments),
+					},
+				}
+				if tc.ID == "" {
+					tc.ID = utils.GenerateToolCallID()
+				}
+				out.ToolCalls = append(out.ToolCalls, tc)
+				pending = append(pending, tc)
+			}
+		case "tool":
+			out.Name = msg.ToolName
+			for i, call := range pending {
+				if msg.ToolName == "" || call.Function.Name == msg.ToolName {
+					out.ToolCallID = call.ID
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
+			}
+		}
+		chatReq.Messages = append(chatReq.Messages, out)
+	}
+
+	for _, tool := range req.Tools {
+		chatReq.Tools = append(chatReq.Tools, openai.Tool{
+			Type: "function",
+			Function: openai.Function{
+				Name:        tool.Function.Name,
+				Description: tool.Function.Description,
+				Parameters:  tool.Function.Parameters,
+			},
+		})
+	}
+
+	return chatReq
+}
+
+// ollamaArguments encodes the object arguments of an Ollama tool call into
+// OpenAI's JSON string
+func ollamaArguments(arguments any) string {
+	if s, ok := arguments.(string); ok {
+		return s
+	}
+	if arguments == nil {
+		return "{}"
+	}
+	b, err := json.Marshal(arguments)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// ollamaToolCalls converts chat tool calls into Ollama tool calls, whose
+// arguments are objects
+func ollamaToolCalls(toolCalls []openai.ToolCall) []ollama.ToolCall {
+	var converted []ollama.ToolCall
+	for _, call := range toolCalls {
+		converted = append(converted, ollama.ToolCall{
+			ID: call.ID,
+			Function: ollama.ToolCallFunction{
+				Name:      call.Function.Name,
+				Arguments: toolInput(call.Function.Arguments),
+			},
+		})
+	}
+	return converted
+}
+
+// ollamaDoneReason converts a chat completion finish reason into Ollama's
+// done_reason, which is either "stop" or "length"
+func ollamaDoneReason(finishReason string) string {
+	if finishReason == openai.FinishReasonLength {
+		return "length"
+	}
+	return "stop"
+}
+
+// ollamaError converts an OpenAI-format error body into an Ollama-format one
+func ollamaError(status int, body []byte) []byte {
+	var e openai.ErrorResponse
+	message := strings.TrimSpace(string(body))
+	if err := json.Unmarshal(body, &e); err == nil && e.Error.Message != "" {
+		message = e.Error.Message
+	}
+	converted, _ := json.Marshal(ollama.ErrorResponse{Error: message})
+	return converted
+}
+
+func writeOllamaError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ollama.ErrorResponse{Error: message})
+}
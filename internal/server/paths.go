@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withPathAliases routes requests for paths which have no routes to the /v1
+// route they alias, for clients whose base URL omits /v1 or places it
+// under another prefix. Paths such as /chat/completions gain the /v1 prefix,
+// and any of prefixes, such as /openai in /openai/v1/chat/completions, is
+// stripped first. The requests are then served by next, which serves them
+// with mux.
+func withPathAliases(mux *http.ServeMux, next http.Handler, prefixes []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, aliasRequest(mux, r, prefixes))
+	})
+}
+
+// aliasRequest returns r for the /v1 route its path aliases, or r if its path
+// has routes or aliases none. Paths with routes for other methods aren't
+// aliased, so that they are rejected with a 405.
+func aliasRequest(mux *http.ServeMux, r *http.Request, prefixes []string) *http.Request {
+	if len(allowedMethods(mux, r)) > 0 {
+		return r
+	}
+	if path, ok := aliasPath(r.URL.Path, prefixes); ok {
+		aliased := r.Clone(r.Context())
+		aliased.URL.Path = path
+		aliased.URL.RawPath = ""
+		if len(allowedMethods(mux, aliased)) > 0 {
+			return aliased
+		}
+	}
+	return r
+}
+
+// aliasPath returns the /v1 path which path aliases, and whether it differs
+func aliasPath(path string, prefixes []string) (string, bool) {
+	aliased := path
+	for _, prefix := range prefixes {
+		prefix = "/" + strings.Trim(prefix, "/")
+		if prefix != "/" && strings.HasPrefix(aliased, prefix+"/") {
+			aliased = strings.TrimPrefix(aliased, prefix)
+			break
+		}
+	}
+	if !strings.HasPrefix(aliased, "/v1/") {
+		aliased = "/v1" + aliased
+	}
+	return aliased, aliased != path
+}
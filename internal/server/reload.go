@@ -0,0 +1,95 @@
+package server
+
+import (
+	"maps"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+// Reload applies the backend, API keys, clients, rate limits, tiers, faults
+// injected and log levels of opts while serving. New requests are sent to the new backend, while
+// those in flight, including streams, finish on the previous one, and the
+// backend and default model switched to through the admin API are kept. The
+// other options only take effect when the server is restarted.
+func (s *Server) Reload(opts Options) error {
+	if opts.Backend == nil {
+		return errors.New("backend is required")
+	}
+	if err := validateClients(opts.Clients); err != nil {
+		return err
+	}
+	if err := opts.Chaos.Validate(); err != nil {
+		return errors.Wrap(err, "invalid chaos options")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.opts
+	s.opts.Backend = opts.Backend
+	s.opts.ApiKey = opts.ApiKey
+	s.opts.Clients = opts.Clients
+	s.opts.RateLimit = opts.RateLimit
+	s.opts.TierRateLimits = opts.TierRateLimits
+	s.opts.Tiers = opts.Tiers
+	s.opts.Chaos = opts.Chaos
+	s.opts.LogLevel = opts.LogLevel
+	s.opts.LogLevels = opts.LogLevels
+	s.apikey = opts.ApiKey
+
+	s.keepSwitch(prev.Backend, opts.Backend)
+	s.upstream.Swap(opts.Backend)
+	s.tiers.Set(opts.Tiers)
+	routes := s.handler()
+	s.routes.Store(&routes)
+	s.reloadLogLevels(prev)
+
+	logutils.FromContext(s.ctx).Infof(s.ctx, "Reloaded backend %s with %d clients", opts.Backend.Name(), len(opts.Clients))
+	return nil
+}
+
+// keepSwitch switches the new backend to the backend and default model the
+// previous one was switched to through the admin API, unless the backend
+// switched to is no longer configured
+func (s *Server) keepSwitch(prev, next backend.Backend) {
+	prevSwitcher, ok := prev.(backend.Switcher)
+	if !ok {
+		return
+	}
+	nextSwitcher, ok := next.(backend.Switcher)
+	if !ok {
+		return
+	}
+	name, defaultModel := prevSwitcher.Switched()
+	if name == "" && defaultModel == "" {
+		return
+	}
+	if err := nextSwitcher.Switch(name, defaultModel); err != nil {
+		logutils.FromContext(s.ctx).Warnf(s.ctx, "Not keeping the switch to backend %s: %v", name, err)
+	}
+}
+
+// reloadLogLevels applies the log levels which changed since the previous
+// options, so that levels changed through the admin API are kept otherwise
+func (s *Server) reloadLogLevels(prev Options) {
+	root := logutils.FromContext(s.ctx)
+	if s.opts.LogLevel != prev.LogLevel {
+		root.SetLevel(logger.LevelFromString(s.opts.LogLevel))
+	}
+	for module := range prev.LogLevels {
+		if _, ok := s.opts.LogLevels[module]; !ok {
+			root.ResetModuleLevel(module)
+		}
+	}
+	for module, level := range s.opts.LogLevels {
+		if prevLevel, ok := prev.LogLevels[module]; !ok || prevLevel != level {
+			root.SetModuleLevel(module, logger.LevelFromString(level))
+		}
+	}
+	if !maps.Equal(prev.LogLevels, s.opts.LogLevels) || prev.LogLevel != s.opts.LogLevel {
+		level, modules := root.Levels()
+		logutils.FromContext(s.ctx).Infof(s.ctx, "Changed log level to %s with module levels %v", level, modules)
+	}
+}
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/stream"
+	"github.com/danilofalcao/cursor-deepseek/internal/sse"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// handleResponses serves the Responses API by translating requests into chat
+// completion requests and the chat completions back into responses
+func (s *Server) handleResponses(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	// Parse request
+	var req openai.ResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		err = errors.Wrap(err, "error parsing request")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chatReq, invalid := responseToChat(&req)
+	if invalid != nil {
+		lgr.Infof(ctx, "Rejecting response request: %s", invalid.Message)
+		response.WriteErrorResponse(w, http.StatusBadRequest, *invalid)
+		return
+	}
+
+	// Backends which proxy the request path must see a chat completion
+	r = r.Clone(ctx)
+	r.URL.Path = "/v1/chat/completions"
+
+	if req.Stream {
+		s.streamResponse(ctx, w, r, &req, chatReq)
+		return
+	}
+
+	rec := response.NewRecorder()
+	s.backend.HandleChatCompletion(ctx, rec, r, chatReq)
+	if rec.Status != http.StatusOK {
+		rec.WriteTo(w, nil)
+		return
+	}
+
+	var chatResp openai.ChatCompletionResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &chatResp); err != nil || len(chatResp.Choices) == 0 {
+		lgr.Errorf(ctx, "error parsing chat completion response: %s", rec.Body.String())
+		response.WriteError(w, http.StatusBadGateway, "Error parsing chat completion response")
+		return
+	}
+
+	resp := newResponse(&req)
+	resp.Output = responseOutput(chatResp.Choices[0])
+	resp.Status, resp.IncompleteDetails = responseStatus(chatResp.Choices[0].FinishReason)
+	resp.Usage = &openai.ResponseUsage{
+		InputTokens:  chatResp.Usage.PromptTokens,
+		OutputTokens: chatResp.Usage.CompletionTokens,
+		TotalTokens:  chatResp.Usage.TotalTokens,
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	rec.WriteTo(w, body)
+}
+
+// streamResponse relays the streamed chat completion of chatReq as the events
+// of a streamed response
+func (s *Server) streamResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ResponseRequest, chatReq *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		lgr.Error(ctx, "streaming unsupported")
+		response.WriteError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	pipe, ok := s.pipeChatCompletion(ctx, w, r, chatReq, nil)
+	if !ok {
+		return
+	}
+	// Stops the backend if the client goes away before the stream ends
+	defer pipe.CloseRead()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Heartbeats of the backend are relayed while the model is busy
+	keepAlive := make(chan struct{}, 1)
+	chunks, errs := stream.ReadOpenAI(ctx, pipe, stream.ReadOptions{
+		OnComment: func(string) {
+			select {
+			case keepAlive <- struct{}{}:
+			default:
+			}
+		},
+	})
+
+	rs := &responseStream{
+		w:       w,
+		flusher: flusher,
+		resp:    newResponse(req),
+		open:    -1,
+	}
+	rs.start()
+
+	for rs.err == nil {
+		select {
+		case <-ctx.Done():
+			lgr.Info(ctx, "Context cancelled, ending stream")
+			return
+		case <-keepAlive:
+			rs.heartbeat()
+		case chunk, ok := <-chunks:
+			if !ok {
+				// Report an error the stream may have ended with
+				var err error
+				select {
+				case streamErr, ok := <-errs:
+					if ok {
+						err = streamErr
+						lgr.Error(ctx, err.Error())
+					}
+				default:
+				}
+				rs.finish(err)
+				if rs.err == nil {
+					lgr.Info(ctx, "streaming response handler completed")
+				}
+				return
+			}
+			rs.chunk(chunk)
+		}
+	}
+	lgr.Error(ctx, errors.Wrap(rs.err, "error writing response").Error())
+}
+
+// responseToChat translates a response request into a chat request, returning
+// an error for the features which can't be translated
+func responseToChat(req *openai.ResponseRequest) (*openai.ChatCompletionRequest, *openai.Error) {
+	if req.PreviousResponseID != "" {
+		return nil, &openai.Error{
+			Message: "previous_response_id is not supported since responses are not stored; send the whole conversation as input instead",
+			Param:   "previous_response_id",
+		}
+	}
+
+	chatReq := &openai.ChatCompletionRequest{
+		Model:               req.Model,
+		Stream:              req.Stream,
+		Temperature:         req.Temperature,
+		TopP:                req.TopP,
+		MaxCompletionTokens: req.MaxOutputTokens,
+		ParallelToolCalls:   req.ParallelToolCalls,
+		ToolChoice:          responseToolChoice(req.ToolChoice),
+	}
+	if req.Stream {
+		// The usage is reported when the response completes
+		chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
+	if req.Instructions != "" {
+		chatReq.Messages = append(chatReq.Messages, openai.Message{
+			Role:    openai.RoleSystem,
+			Content: openai.Content_String{Content: req.Instructions},
+		})
+	}
+	for _, item := range req.Input {
+		switch item.Type {
+		case "", openai.ResponseItemMessage:
+			chatReq.Messages = append(chatReq.Messages, openai.Message{
+				Role:    item.Role,
+				Content: openai.Content_String{Content: responseText(item.Content)},
+			})
+		case openai.ResponseItemFunctionCall:
+			call := openai.ToolCall{
+				ID:   item.CallID,
+				Type: "function",
+				Function: openai.ToolCallFunction{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			}
+			// Calls following each other or assistant text form a single message
+			if n := len(chatReq.Messages); n > 0 && chatReq.Messages[n-1].Role == "assistant" {
+				chatReq.Messages[n-1].ToolCalls = append(chatReq.Messages[n-1].ToolCalls, call)
+				continue
+			}
+			chatReq.Messages = append(chatReq.Messages, openai.Message{
+				Role:      "assistant",
+				Content:   openai.Content_String{},
+				ToolCalls: []openai.ToolCall{call},
+			})
+		case openai.ResponseItemFunctionCallOutput:
+			chatReq.Messages = append(chatReq.Messages, openai.Message{
+				Role:       "tool",
+				ToolCallID: item.CallID,
+				Content:    openai.Content_String{Content: functionCallOutput(item.Output)},
+			})
+		case openai.ResponseItemReasoning:
+			// Reasoning must not be sent back upstream
+		default:
+			return nil, &openai.Error{
+				Message: fmt.Sprintf("Input items of type %q are not supported", item.Type),
+				Param:   "input",
+			}
+		}
+	}
+
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			return nil, &openai.Error{
+				Message: fmt.Sprintf("Tools of type %q are not supported", tool.Type),
+				Param:   "tools",
+			}
+		}
+		chatReq.Tools = append(chatReq.Tools, openai.Tool{
+			Type: "function",
+			Function: openai.Function{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	if req.Text != nil && req.Text.Format != nil {
+		switch format := req.Text.Format; format.Type {
+		case openai.ResponseFormatJSONObject:
+			chatReq.ResponseFormat = &openai.ResponseFormat{Type: openai.ResponseFormatJSONObject}
+		case openai.ResponseFormatJSONSchema:
+			chatReq.ResponseFormat = &openai.ResponseFormat{
+				Type: openai.ResponseFormatJSONSchema,
+				JSONSchema: &openai.JSONSchema{
+					Name:        format.Name,
+					Description: format.Description,
+					Schema:      format.Schema,
+					Strict:      format.Strict,
+				},
+			}
+		}
+	}
+
+	return chatReq, nil
+}
+
+// responseToolChoice converts a tool choice naming a function into the nested
+// chat completion form
+func responseToolChoice(choice any) any {
+	named, ok := choice.(map[string]any)
+	if !ok || named["type"] != "function" {
+		return choice
+	}
+	return map[string]any{
+		"type":     "function",
+		"function": map[string]any{"name": named["name"]},
+	}
+}
+
+// responseText joins the text parts of message content
+func responseText(content openai.ResponseContent) string {
+	var text string
+	for _, part := range content {
+		text += part.Text
+	}
+	return text
+}
+
+// functionCallOutput returns the output of a function call as text
+func functionCallOutput(output any) string {
+	if text, ok := output.(string); ok {
+		return text
+	}
+	b, _ := json.Marshal(output)
+	return string(b)
+}
+
+// newResponse creates an in-progress response to req
+func newResponse(req *openai.ResponseRequest) openai.Response {
+	return openai.Response{
+		ID:           utils.GenerateID("resp_"),
+		Object:       "response",
+		CreatedAt:    time.Now().Unix(),
+		Status:       openai.ResponseStatusInProgress,
+		Model:        req.Model,
+		Output:       []openai.ResponseItem{},
+		Instructions: req.Instructions,
+		Metadata:     req.Metadata,
+	}
+}
+
+// responseOutput converts a chat completion choice into output items
+func responseOutput(choice openai.Choice) []openai.ResponseItem {
+	output := []openai.ResponseItem{}
+	if reasoning := choice.Message.ReasoningContent; reasoning != "" {
+		output = append(output, openai.ResponseItem{
+			Type:    openai.ResponseItemReasoning,
+			ID:      utils.GenerateID("rs_"),
+			Summary: []openai.ResponseContentPart{{Type: "summary_text", Text: reasoning}},
+		})
+	}
+	if text := choice.Message.GetContentString(); text != "" {
+		output = append(output, openai.ResponseItem{
+			Type:    openai.ResponseItemMessage,
+			ID:      utils.GenerateID("msg_"),
+			Status:  openai.ResponseStatusCompleted,
+			Role:    "assistant",
+			Content: openai.ResponseContent{{Type: "output_text", Text: text}},
+		})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		output = append(output, openai.ResponseItem{
+			Type:      openai.ResponseItemFunctionCall,
+			ID:        utils.GenerateID("fc_"),
+			Status:    openai.ResponseStatusCompleted,
+			CallID:    call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return output
+}
+
+// responseStatus returns the status of a response whose generation finished
+// with finishReason
+func responseStatus(finishReason string) (string, *openai.ResponseIncompleteDetails) {
+	switch finishReason {
+	case openai.FinishReasonLength:
+		return openai.ResponseStatusIncomplete, &openai.ResponseIncompleteDetails{Reason: "max_output_tokens"}
+	case openai.FinishReasonContentFilter:
+		return openai.ResponseStatusIncomplete, &openai.ResponseIncompleteDetails{Reason: "content_filter"}
+	}
+	return openai.ResponseStatusCompleted, nil
+}
+
+// responseStream converts the chunks of a chat completion stream into the
+// events of a streamed response. Only the first choice is streamed.
+type responseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	seq     int
+	// err is the first error writing to w, after which nothing is written
+	err error
+
+	resp openai.Response
+	// open is the output index of the item being streamed, or -1
+	open int
+	// toolIndex is the chat tool call index of an open function call
+	toolIndex    int
+	finishReason string
+}
+
+// emit writes event with the next sequence number
+func (rs *responseStream) emit(event openai.ResponseStreamEvent) {
+	if rs.err != nil {
+		return
+	}
+	event.SequenceNumber = rs.seq
+	rs.seq++
+	data, err := json.Marshal(event)
+	if err == nil {
+		err = sse.Encode(rs.w, sse.Event{Type: event.Type, Data: string(data)})
+	}
+	if err != nil {
+		rs.err = err
+		return
+	}
+	rs.flusher.Flush()
+}
+
+func (rs *responseStream) heartbeat() {
+	if rs.err != nil {
+		return
+	}
+	if rs.err = sse.Encode(rs.w, sse.Event{Comment: "heartbeat"}); rs.err == nil {
+		rs.flusher.Flush()
+	}
+}
+
+// snapshot returns a copy of the response in its current state
+func (rs *responseStream) snapshot() *openai.Response {
+	resp := rs.resp
+	resp.Output = append([]openai.ResponseItem{}, rs.resp.Output...)
+	return &resp
+}
+
+func (rs *responseStream) start() {
+	rs.emit(openai.ResponseStreamEvent{Type: "response.created", Response: rs.snapshot()})
+	rs.emit(openai.ResponseStreamEvent{Type: "response.in_progress", Response: rs.snapshot()})
+}
+
+func (rs *responseStream) chunk(chunk openai.ChatCompletionStreamResponse) {
+	if chunk.Usage != nil {
+		rs.resp.Usage = &openai.ResponseUsage{
+			InputTokens:  chunk.Usage.PromptTokens,
+			OutputTokens: chunk.Usage.CompletionTokens,
+			TotalTokens:  chunk.Usage.TotalTokens,
+		}
+	}
+
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+
+		if reasoning := choice.Delta.ReasoningContent; reasoning != "" {
+			if !rs.isOpen(openai.ResponseItemReasoning) {
+				rs.openItem(openai.ResponseItem{
+					Type:    openai.ResponseItemReasoning,
+					ID:      utils.GenerateID("rs_"),
+					Summary: []openai.ResponseContentPart{{Type: "summary_text"}},
+				})
+			}
+			item := &rs.resp.Output[rs.open]
+			item.Summary[0].Text += reasoning
+			rs.emit(openai.ResponseStreamEvent{
+				Type:         "response.reasoning_summary_text.delta",
+				ItemID:       item.ID,
+				OutputIndex:  &rs.open,
+				SummaryIndex: new(int),
+				Delta:        reasoning,
+			})
+		}
+
+		if content, ok := choice.Delta.Content.(openai.Content_String); ok && content.Content != "" {
+			if !rs.isOpen(openai.ResponseItemMessage) {
+				rs.openItem(openai.ResponseItem{
+					Type:    openai.ResponseItemMessage,
+					ID:      utils.GenerateID("msg_"),
+					Status:  openai.ResponseStatusInProgress,
+					Role:    "assistant",
+					Content: openai.ResponseContent{{Type: "output_text"}},
+				})
+			}
+			item := &rs.resp.Output[rs.open]
+			item.Content[0].Text += content.Content
+			rs.emit(openai.ResponseStreamEvent{
+				Type:         "response.output_text.delta",
+				ItemID:       item.ID,
+				OutputIndex:  &rs.open,
+				ContentIndex: new(int),
+				Delta:        content.Content,
+			})
+		}
+
+		for _, call := range choice.Delta.ToolCalls {
+			if !rs.isOpen(openai.ResponseItemFunctionCall) || rs.toolIndex != call.Index {
+				callID := call.ID
+				if callID == "" {
+					callID = utils.GenerateToolCallID()
+				}
+				rs.toolIndex = call.Index
+				rs.openItem(openai.ResponseItem{
+					Type:   openai.ResponseItemFunctionCall,
+					ID:     utils.GenerateID("fc_"),
+					Status: openai.ResponseStatusInProgress,
+					CallID: callID,
+					Name:   call.Function.Name,
+				})
+			}
+			if call.Function.Arguments == "" {
+				continue
+			}
+			item := &rs.resp.Output[rs.open]
+			item.Arguments += call.Function.Arguments
+			rs.emit(openai.ResponseStreamEvent{
+				Type:        "response.function_call_arguments.delta",
+				ItemID:      item.ID,
+				OutputIndex: &rs.open,
+				Delta:       call.Function.Arguments,
+			})
+		}
+
+		if choice.FinishReason != "" {
+			rs.finishReason = choice.FinishReason
+		}
+	}
+}
+
+func (rs *responseStream) isOpen(itemType string) bool {
+	return rs.open >= 0 && rs.resp.Output[rs.open].Type == itemType
+}
+
+// openItem closes the open item, if any, and starts streaming item
+func (rs *responseStream) openItem(item openai.ResponseItem) {
+	rs.closeItem()
+	rs.resp.Output = append(rs.resp.Output, item)
+	rs.open = len(rs.resp.Output) - 1
+
+	// Parts are announced separately, so the item starts without them
+	added := item
+	added.Content, added.Summary = nil, nil
+	rs.emit(openai.ResponseStreamEvent{Type: "response.output_item.added", OutputIndex: &rs.open, Item: &added})
+
+	switch item.Type {
+	case openai.ResponseItemMessage:
+		rs.emit(openai.ResponseStreamEvent{
+			Type:         "response.content_part.added",
+			ItemID:       item.ID,
+			OutputIndex:  &rs.open,
+			ContentIndex: new(int),
+			Part:         &item.Content[0],
+		})
+	case openai.ResponseItemReasoning:
+		rs.emit(openai.ResponseStreamEvent{
+			Type:         "response.reasoning_summary_part.added",
+			ItemID:       item.ID,
+			OutputIndex:  &rs.open,
+			SummaryIndex: new(int),
+			Part:         &item.Summary[0],
+		})
+	}
+}
+
+// closeItem finishes streaming the open item, if any
+func (rs *responseStream) closeItem() {
+	if rs.open < 0 {
+		return
+	}
+	item := &rs.resp.Output[rs.open]
+
+	switch item.Type {
+	case openai.ResponseItemMessage:
+		part := item.Content[0]
+		rs.emit(openai.ResponseStreamEvent{
+			Type:         "response.output_text.done",
+			ItemID:       item.ID,
+			OutputIndex:  &rs.open,
+			ContentIndex: new(int),
+			Text:         &part.Text,
+		})
+		rs.emit(openai.ResponseStreamEvent{
+			Type:         "response.content_part.done",
+			ItemID:       item.ID,
+			OutputIndex:  &rs.open,
+			ContentIndex: new(int),
+			Part:         &part,
+		})
+		item.Status = openai.ResponseStatusCompleted
+	case openai.ResponseItemReasoning:
+		part := item.Summary[0]
+		rs.emit(openai.ResponseStreamEvent{
+			Type:         "response.reasoning_summary_text.done",
+			ItemID:       item.ID,
+			OutputIndex:  &rs.open,
+			SummaryIndex: new(int),
+			Text:         &part.Text,
+		})
+		rs.emit(openai.ResponseStreamEvent{
+			Type:         "response.reasoning_summary_part.done",
+			ItemID:       item.ID,
+			OutputIndex:  &rs.open,
+			SummaryIndex: new(int),
+			Part:         &part,
+		})
+	case openai.ResponseItemFunctionCall:
+		rs.emit(openai.ResponseStreamEvent{
+			Type:        "response.function_call_arguments.done",
+			ItemID:      item.ID,
+			OutputIndex: &rs.open,
+			Arguments:   &item.Arguments,
+		})
+		item.Status = openai.ResponseStatusCompleted
+	}
+
+	done := *item
+	rs.emit(openai.ResponseStreamEvent{Type: "response.output_item.done", OutputIndex: &rs.open, Item: &done})
+	rs.open = -1
+}
+
+// finish closes the open item and ends the stream with the final state of
+// the response, or with an error if the stream failed
+func (rs *responseStream) finish(err error) {
+	rs.closeItem()
+
+	if err != nil {
+		rs.emit(openai.ResponseStreamEvent{Type: "error", Code: "server_error", Message: err.Error()})
+		rs.resp.Status = openai.ResponseStatusFailed
+		rs.resp.Error = &openai.Error{Message: err.Error(), Type: response.ErrorTypeServer, Code: "server_error"}
+		rs.emit(openai.ResponseStreamEvent{Type: "response.failed", Response: rs.snapshot()})
+		return
+	}
+
+	rs.resp.Status, rs.resp.IncompleteDetails = responseStatus(rs.finishReason)
+	eventType := "response.completed"
+	if rs.resp.Status == openai.ResponseStatusIncomplete {
+		eventType = "response.incomplete"
+	}
+	rs.emit(openai.ResponseStreamEvent{Type: eventType, Response: rs.snapshot()})
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+// routeMethods are the methods routes may be registered for, in the order
+// they are listed in Allow headers
+var routeMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// allowedMethods returns the methods routes are registered for at the path
+// of r, none if there is no route at the path
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	probe := r.WithContext(r.Context())
+	for _, method := range routeMethods {
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != "" {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// withRouteErrors serves requests with next if a route matches them.
+// Otherwise, they are rejected with a 404, or with a 405 listing the allowed
+// methods if routes are registered at their path for other methods, in the
+// error format of the API of the path.
+func withRouteErrors(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		allowed := allowedMethods(mux, r)
+		if len(allowed) == 0 {
+			logutils.FromContext(ctx).Infof(ctx, "No route for %s %s", r.Method, r.URL.Path)
+			writeRouteError(w, r, http.StatusNotFound, fmt.Sprintf("Invalid URL (%s %s)", r.Method, r.URL.Path))
+			return
+		}
+		logutils.FromContext(ctx).Infof(ctx, "Invalid method %s", r.Method)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeRouteError(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("Method %s not allowed, expected %s", r.Method, strings.Join(allowed, " or ")))
+	})
+}
+
+// writeRouteError writes an error in the format of the API the path of r
+// belongs to, the Anthropic, Ollama or OpenAI API
+func writeRouteError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/messages"):
+		writeAnthropicError(w, status, message)
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		writeOllamaError(w, status, message)
+	default:
+		code := "not_found"
+		if status == http.StatusMethodNotAllowed {
+			code = "method_not_allowed"
+		}
+		response.WriteErrorResponse(w, status, openai.Error{Message: message, Code: code})
+	}
+}
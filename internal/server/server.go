@@ -2,119 +2,759 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"io"
+	"io/fs"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/audit"
 	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/batch"
+	"github.com/danilofalcao/cursor-deepseek/internal/cache"
+	"github.com/danilofalcao/cursor-deepseek/internal/contentfilter"
+	"github.com/danilofalcao/cursor-deepseek/internal/dashboard"
+	"github.com/danilofalcao/cursor-deepseek/internal/dedup"
+	"github.com/danilofalcao/cursor-deepseek/internal/health"
 	"github.com/danilofalcao/cursor-deepseek/internal/logger"
 	"github.com/danilofalcao/cursor-deepseek/internal/server/middleware"
+	"github.com/danilofalcao/cursor-deepseek/internal/store"
+	"github.com/danilofalcao/cursor-deepseek/internal/tiers"
+	"github.com/danilofalcao/cursor-deepseek/internal/transform"
+	"github.com/danilofalcao/cursor-deepseek/internal/usage"
 	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/danilofalcao/cursor-deepseek/internal/webhook"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/http2"
 )
 
+// DefaultMaxRequestBodySize is the largest request body accepted unless
+// configured otherwise, which leaves room for images and batch files
+const DefaultMaxRequestBodySize = 32 << 20
+
+// DefaultHTTPLimits are the limits of HTTPLimits which aren't configured
+var DefaultHTTPLimits = HTTPLimits{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadBodyTimeout:   2 * time.Minute,
+	WriteTimeout:      2 * time.Minute,
+	IdleTimeout:       2 * time.Minute,
+	MaxHeaderBytes:    64 << 10,
+}
+
+// HTTPLimits protect the server from slow clients and oversized headers.
+// Zero values are replaced by those of DefaultHTTPLimits, and negative ones
+// disable a limit.
+type HTTPLimits struct {
+	// ReadHeaderTimeout bounds reading the request headers
+	ReadHeaderTimeout time.Duration
+	// ReadBodyTimeout bounds reading the request body
+	ReadBodyTimeout time.Duration
+	// WriteTimeout bounds each write of the response, rather than the whole
+	// of it, so that long streams are served
+	WriteTimeout time.Duration
+	// IdleTimeout bounds the wait for the next request of a kept-alive
+	// connection
+	IdleTimeout time.Duration
+	// MaxHeaderBytes is the largest size of the request headers
+	MaxHeaderBytes int
+}
+
+// withDefaults replaces the limits which are unset by the defaults, and
+// those which are disabled by zero
+func (l HTTPLimits) withDefaults() HTTPLimits {
+	duration := func(d, def time.Duration) time.Duration {
+		switch {
+		case d < 0:
+			return 0
+		case d == 0:
+			return def
+		default:
+			return d
+		}
+	}
+	l.ReadHeaderTimeout = duration(l.ReadHeaderTimeout, DefaultHTTPLimits.ReadHeaderTimeout)
+	l.ReadBodyTimeout = duration(l.ReadBodyTimeout, DefaultHTTPLimits.ReadBodyTimeout)
+	l.WriteTimeout = duration(l.WriteTimeout, DefaultHTTPLimits.WriteTimeout)
+	l.IdleTimeout = duration(l.IdleTimeout, DefaultHTTPLimits.IdleTimeout)
+	switch {
+	case l.MaxHeaderBytes < 0:
+		// The headers can't be unlimited, so Go's default of 1 MiB applies
+		l.MaxHeaderBytes = 0
+	case l.MaxHeaderBytes == 0:
+		l.MaxHeaderBytes = DefaultHTTPLimits.MaxHeaderBytes
+	}
+	return l
+}
+
 // Options configures the server
 type Options struct {
-	Port     string
+	Port string
+	// Host is the address of the interface listened on, all of them if unset
+	Host     string
 	Backend  backend.Backend
 	LogLevel string
+	// LogFormat is text, the default, or json
+	LogFormat string
+	// LogLevels overrides LogLevel for the named modules, such as a backend
+	LogLevels map[string]string
+	// LogSinks are where the default logger writes, stdout if none are set
+	LogSinks []logger.Sink
 	ApiKey   string
-	Timeout  string
-	ExitCh   chan string
+	// Clients, if set, are the named API keys clients authenticate with,
+	// instead of ApiKey
+	Clients []middleware.Client
+	// RateLimit limits the requests and tokens per minute of each client API
+	// key, unless its client has its own
+	RateLimit middleware.RateLimit
+	// TierRateLimits are the rate limits of the clients of each tier, which
+	// JWTs carry
+	TierRateLimits map[string]middleware.RateLimit
+	// Tiers restrict the models, and cap the tokens, of the clients of each
+	// tier, by name
+	Tiers map[string]tiers.Tier
+	// JWT, if its JWKS URL is set, authenticates clients presenting JWTs,
+	// identified by their subject
+	JWT middleware.JWT
+	// AdminApiKey, if set, is required by the /admin endpoints instead of a
+	// client API key
+	AdminApiKey string
+	Timeout     string
+	ExitCh      chan string
+	// HealthCheckInterval is how often the backend is probed. Zero disables
+	// health checking.
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// Listener, if set, is served on instead of listening on Port
+	Listener net.Listener
+	// Addresses, if set, are listened on instead of Host and Port, as
+	// host:port or unix: followed by the path of a Unix socket
+	Addresses []string
+	// SocketMode is the permissions of Unix sockets, DefaultSocketMode if
+	// unset
+	SocketMode fs.FileMode
+	// HTTPLimits protect the server from slow clients and oversized headers
+	HTTPLimits HTTPLimits
+	// ShutdownTimeout is how long the requests in flight, such as long
+	// streams, are waited for when shutting down
+	ShutdownTimeout time.Duration
+	// ReusePort sets SO_REUSEPORT on the TCP addresses listened on, so that
+	// a new proxy can listen on them before this one is shut down
+	ReusePort bool
+	// Logger, if set, is used instead of creating a logger from LogLevel
+	Logger *logger.Logger
+	// PathPrefixes are stripped from request paths which don't match a route,
+	// such as /openai in /openai/v1/chat/completions
+	PathPrefixes []string
+	// BatchDir, if set, enables the files and batches endpoints, which
+	// persist their state in the directory
+	BatchDir string
+	// BatchConcurrency is the number of requests of a batch executed at once
+	BatchConcurrency int
+	// AuditPath, if set, enables the audit log, which records every request
+	// and response to the file
+	AuditPath string
+	// AuditRedact are regular expressions masked in audit records
+	AuditRedact []string
+	// UsageDB, if set, enables usage accounting, which persists daily
+	// aggregates to the SQLite database
+	UsageDB string
+	// UsagePricing maps upstream models to their price
+	UsagePricing map[string]usage.Price
+	// UsageBudgets limit the usage of client API keys
+	UsageBudgets []usage.Budget
+	// SystemPrepend and SystemAppend, if set, are system instructions sent
+	// before and after the client's system prompts, which SystemRules rewrite
+	// or drop
+	SystemPrepend string
+	SystemAppend  string
+	SystemRules   []transform.SystemRule
+	// PromptVariables are expanded in the {{name}} placeholders of the system
+	// instructions and rules, along with built-in variables such as {{date}}
+	PromptVariables map[string]string
+	// ContentFilterRules, if set, block or redact their matches in prompts,
+	// and in responses if ContentFilterResponses is set
+	ContentFilterRules     []contentfilter.Rule
+	ContentFilterResponses bool
+	// ContentFilterBlockWith is how blocked prompts are answered, with an
+	// error or a content_filter finish reason
+	ContentFilterBlockWith string
+	// Chaos injects faults into a percentage of the responses to clients
+	Chaos middleware.Chaos
+	// Compression compresses the non-streaming JSON responses of clients
+	// which accept gzip or brotli
+	Compression middleware.Compression
+	// Deduplicate collapses identical non-streaming chat completions of a
+	// client in flight into a single upstream request
+	Deduplicate bool
+	// CacheTTL, if set, caches the responses to non-streaming chat
+	// completions for this long, in Redis if RedisURL is set, and serves
+	// identical requests from the cache
+	CacheTTL time.Duration
+	// SemanticCache, if its Embedder is set, also serves requests whose final
+	// user message is similar to that of a cached request from the cache
+	SemanticCache cache.SemanticOptions
+	// Webhooks receive events about requests, budgets and the backend's
+	// health
+	Webhooks []webhook.Hook
+	// TLSCertFile and TLSKeyFile, if set, serve HTTPS with the certificate,
+	// which is reloaded when the files change
+	TLSCertFile string
+	TLSKeyFile  string
+	// ACMEHosts, if set, serve HTTPS with certificates for the hosts obtained
+	// from Let's Encrypt, cached in ACMECacheDir
+	ACMEHosts    []string
+	ACMEEmail    string
+	ACMECacheDir string
+	// TLSClientCAFile, if set, requires clients to present a certificate
+	// signed by the CA, whose common name, or else its first DNS or email
+	// SAN, identifies the client instead of an API key
+	TLSClientCAFile string
+	// Networks restricts which source networks may call the proxy and its
+	// admin API
+	Networks middleware.Networks
+	// RedisURL, if set, is the Redis database rate limits and budgets are
+	// shared through by the replicas of the proxy. They are kept in memory,
+	// and budgets in UsageDB, otherwise.
+	RedisURL string
+	// RedisPrefix is prepended to the proxy's Redis keys
+	RedisPrefix string
+	// DebugEndpoints enables the pprof profiles and expvar variables under
+	// /admin/debug, which are only served with an AdminApiKey
+	DebugEndpoints bool
+	// MaxRequestBodySize is the largest request body accepted, in bytes.
+	// Zero uses DefaultMaxRequestBodySize, and a negative size disables the
+	// limit.
+	MaxRequestBodySize int64
+	// Middleware wraps the routes, innermost first, after the built-in
+	// middleware has populated the request context and authenticated it
+	Middleware []func(http.Handler) http.Handler
 }
 
 // Server represents the API server
 type Server struct {
 	ctx     context.Context
 	port    string
+	host    string
 	backend backend.Backend
-	apikey  string
-	timeout time.Duration
-	exitCh  chan string
+	// upstream is the backend the server's features are layered over, which
+	// is swapped when the config is reloaded
+	upstream *backend.Swappable
+	apikey   string
+	timeout  time.Duration
+	exitCh   chan string
+	health   *health.Checker
+	batches  *batch.Manager
+	audit    *audit.Log
+	usage    *usage.Tracker
+	tiers    *tiers.Enforcer
+	webhooks *webhook.Dispatcher
+	store    store.Store
+	jwt      *middleware.JWTAuth
+	access   *middleware.AccessControl
+	active   *activeRequests
+	// opts are the options the server was created with, or last reloaded,
+	// for the admin API
+	opts Options
+	// mu guards opts and apikey, which are reloaded
+	mu sync.RWMutex
+	// routes is the handler requests are served with, which is rebuilt when
+	// the clients and rate limits are reloaded
+	routes atomic.Pointer[http.Handler]
+
+	listener     net.Listener
+	addresses    []string
+	socketMode   fs.FileMode
+	reusePort    bool
+	middleware   []func(http.Handler) http.Handler
+	pathPrefixes []string
+	srv          *http.Server
+	// logOutput is closed on shutdown if the server opened its own log sinks
+	logOutput io.Closer
 }
 
 // New creates a new server instance
 func New(ctx context.Context, opts Options) (*Server, error) {
 	// set up the server's logger
-	lgr := logger.New(
-		ctx,
-		"server",
-		logger.LevelFromString(opts.LogLevel),
-		opts.ExitCh,
-	)
+	lgr := opts.Logger
+	var logOutput io.WriteCloser
+	if lgr == nil {
+		var err error
+		logOutput, err = logger.OpenSinks(opts.LogSinks)
+		if err != nil {
+			return nil, errors.Wrap(err, "error opening log sinks")
+		}
+		moduleLevels := make(map[string]logger.LogLevel, len(opts.LogLevels))
+		for module, level := range opts.LogLevels {
+			moduleLevels[module] = logger.LevelFromString(level)
+		}
+		lgr = logger.NewWithOptions(ctx, logger.Options{
+			Name:         "server",
+			Level:        logger.LevelFromString(opts.LogLevel),
+			ModuleLevels: moduleLevels,
+			Format:       opts.LogFormat,
+			Output:       logOutput,
+			ExitCh:       opts.ExitCh,
+		})
+	}
 	ctx = logutils.ContextWithLogger(ctx, lgr)
 
 	timeout, err := time.ParseDuration(opts.Timeout)
-	if err != nil || opts.Timeout == "" {
+	if err != nil || timeout <= 0 {
 		timeout = time.Second * 30
 	}
 
-	if opts.Port == "" {
-		return nil, errors.New("port is required")
+	if opts.Port == "" && opts.Listener == nil && len(opts.Addresses) == 0 {
+		closeLogOutput(logOutput)
+		return nil, errors.New("port, addresses or listener is required")
 	}
 	if opts.Backend == nil {
+		closeLogOutput(logOutput)
 		return nil, errors.New("backend is required")
 	}
 
-	return &Server{
-		ctx:     ctx,
-		port:    opts.Port,
-		backend: opts.Backend,
-		apikey:  opts.ApiKey,
-		timeout: timeout,
-		exitCh:  opts.ExitCh,
-	}, nil
+	opts.HTTPLimits = opts.HTTPLimits.withDefaults()
+	if err := validateClients(opts.Clients); err != nil {
+		closeLogOutput(logOutput)
+		return nil, err
+	}
+	if err := opts.Chaos.Validate(); err != nil {
+		closeLogOutput(logOutput)
+		return nil, errors.Wrap(err, "invalid chaos options")
+	}
+
+	tlsCfg, err := tlsConfig(ctx, opts)
+	if err != nil {
+		closeLogOutput(logOutput)
+		return nil, err
+	}
+
+	var access *middleware.AccessControl
+	if len(opts.Networks.Allowed) > 0 || len(opts.Networks.Admin) > 0 {
+		access, err = middleware.NewAccessControl(opts.Networks)
+		if err != nil {
+			closeLogOutput(logOutput)
+			return nil, err
+		}
+	}
+
+	var jwtAuth *middleware.JWTAuth
+	if opts.JWT.JWKSURL != "" {
+		jwtAuth, err = middleware.NewJWTAuth(ctx, opts.JWT)
+		if err != nil {
+			closeLogOutput(logOutput)
+			return nil, errors.Wrap(err, "error creating JWT authentication")
+		}
+	}
+
+	st, err := store.New(ctx, store.Options{
+		RedisURL: opts.RedisURL,
+		Prefix:   opts.RedisPrefix,
+	})
+	if err != nil {
+		closeLogOutput(logOutput)
+		return nil, errors.Wrap(err, "error creating store")
+	}
+
+	var webhooks *webhook.Dispatcher
+	if len(opts.Webhooks) > 0 {
+		webhooks, err = webhook.New(opts.Webhooks)
+		if err != nil {
+			st.Close()
+			closeLogOutput(logOutput)
+			return nil, errors.Wrap(err, "error creating webhooks")
+		}
+	}
+
+	upstream := backend.NewSwappable(opts.Backend)
+	s := &Server{
+		ctx:          ctx,
+		port:         opts.Port,
+		host:         opts.Host,
+		backend:      upstream,
+		upstream:     upstream,
+		apikey:       opts.ApiKey,
+		timeout:      timeout,
+		exitCh:       opts.ExitCh,
+		listener:     opts.Listener,
+		addresses:    opts.Addresses,
+		socketMode:   opts.SocketMode,
+		reusePort:    opts.ReusePort,
+		middleware:   opts.Middleware,
+		pathPrefixes: opts.PathPrefixes,
+		logOutput:    logOutput,
+		webhooks:     webhooks,
+		store:        st,
+		jwt:          jwtAuth,
+		access:       access,
+		active:       newActiveRequests(),
+		opts:         opts,
+	}
+	s.health = health.New(health.Options{
+		Backend:  s.upstream,
+		Interval: opts.HealthCheckInterval,
+		Timeout:  opts.HealthCheckTimeout,
+		OnChange: s.healthChanged,
+	})
+	if webhooks.Wants(webhook.EventRequestStarted) {
+		s.active.onStart = s.requestStarted
+	}
+	if webhooks.Wants(webhook.EventRequestCompleted) || webhooks.Wants(webhook.EventRequestFailed) {
+		s.active.onDone = s.requestDone
+	}
+	if opts.SystemPrepend != "" || opts.SystemAppend != "" || len(opts.SystemRules) > 0 {
+		transformer, err := transform.New(transform.Options{
+			Backend:       s.backend,
+			SystemPrepend: opts.SystemPrepend,
+			SystemAppend:  opts.SystemAppend,
+			SystemRules:   opts.SystemRules,
+			Variables:     opts.PromptVariables,
+		})
+		if err != nil {
+			s.close()
+			return nil, errors.Wrap(err, "error creating request transformer")
+		}
+		s.backend = transformer
+	}
+	if len(opts.ContentFilterRules) > 0 {
+		filter, err := contentfilter.New(contentfilter.Options{
+			Backend:   s.backend,
+			Rules:     opts.ContentFilterRules,
+			Responses: opts.ContentFilterResponses,
+			BlockWith: opts.ContentFilterBlockWith,
+		})
+		if err != nil {
+			s.close()
+			return nil, errors.Wrap(err, "error creating content filter")
+		}
+		s.backend = filter
+	}
+	if opts.UsageDB != "" {
+		s.usage, err = usage.New(usage.Options{
+			Path:    opts.UsageDB,
+			Pricing: opts.UsagePricing,
+			Budgets: opts.UsageBudgets,
+			OnAlert: s.budgetAlert,
+			Store:   shared(st),
+		})
+		if err != nil {
+			s.close()
+			return nil, errors.Wrap(err, "error creating usage tracker")
+		}
+		s.backend = usage.NewMeter(s.backend, s.usage)
+	}
+	if opts.Deduplicate {
+		// Responses shared with identical requests bypass usage accounting,
+		// as they cost nothing more
+		s.backend = dedup.New(s.backend)
+	}
+	if opts.CacheTTL > 0 {
+		// Responses from the cache bypass usage accounting, as they cost
+		// nothing
+		s.backend = cache.New(cache.Options{
+			Backend:  s.backend,
+			Store:    st,
+			TTL:      opts.CacheTTL,
+			Semantic: opts.SemanticCache,
+		})
+	}
+	// Tiers are enforced before the cache, so that clients are never served
+	// responses to requests their tier doesn't allow
+	s.tiers = tiers.New(s.backend, opts.Tiers)
+	s.backend = s.tiers
+	if opts.BatchDir != "" {
+		s.batches, err = batch.New(batch.Options{
+			Dir:         opts.BatchDir,
+			Backend:     s.backend,
+			Concurrency: opts.BatchConcurrency,
+		})
+		if err != nil {
+			s.close()
+			return nil, errors.Wrap(err, "error creating batch manager")
+		}
+	}
+	if opts.AuditPath != "" {
+		s.audit, err = audit.New(audit.Options{
+			Path:   opts.AuditPath,
+			Redact: opts.AuditRedact,
+		})
+		if err != nil {
+			s.close()
+			return nil, errors.Wrap(err, "error creating audit log")
+		}
+	}
+	routes := s.handler()
+	s.routes.Store(&routes)
+	s.srv = &http.Server{
+		Addr:    net.JoinHostPort(s.host, s.port),
+		Handler: http.HandlerFunc(s.serveHTTP),
+		// Requests in flight aren't cancelled along with the server, so that
+		// they finish while it shuts down
+		BaseContext: func(l net.Listener) context.Context { return context.WithoutCancel(s.ctx) },
+		TLSConfig:   tlsCfg,
+		// Reading bodies and writing responses are bounded per request, as
+		// the server's timeouts would cut streams short
+		ReadHeaderTimeout: opts.HTTPLimits.ReadHeaderTimeout,
+		IdleTimeout:       opts.HTTPLimits.IdleTimeout,
+		MaxHeaderBytes:    opts.HTTPLimits.MaxHeaderBytes,
+	}
+	return s, nil
 }
 
 // Start starts the HTTP server
 func (s *Server) Start() error {
+	// Enable HTTP/2 support, which sets a TLS config even if TLS isn't
+	// configured
+	serveTLS := s.srv.TLSConfig != nil
+	if err := http2.ConfigureServer(s.srv, nil); err != nil {
+		return errors.Wrap(err, "error configuring HTTP/2")
+	}
+	if len(s.opts.ACMEHosts) > 0 {
+		// Connections of the TLS-ALPN challenge are closed once their
+		// handshake completes, rather than served as HTTP/1.1
+		s.srv.TLSNextProto[acme.ALPNProto] = func(*http.Server, *tls.Conn, http.Handler) {}
+	}
+
+	// Start probing the backend in the background
+	go s.health.Run(s.ctx)
+	if s.batches != nil {
+		s.batches.Start(s.ctx)
+	}
+	if s.webhooks != nil {
+		s.webhooks.Start(s.ctx)
+	}
+
+	listeners := []net.Listener{s.listener}
+	if s.listener == nil {
+		// Sockets passed by systemd replace the configured addresses
+		var err error
+		if listeners, err = systemdListeners(); err != nil {
+			return err
+		}
+		if len(listeners) == 0 {
+			addrs := s.addresses
+			if len(addrs) == 0 {
+				addrs = []string{s.srv.Addr}
+			}
+			if listeners, err = listen(addrs, s.socketMode, s.reusePort); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Every listener is served until the server is shut down, which closes
+	// them, or one fails
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		logutils.FromContext(s.ctx).Infof(s.ctx, "Serving backend %s on %s", s.backend.Name(), l.Addr())
+		go func() {
+			// The certificates are in the TLS config
+			if serveTLS {
+				errCh <- s.srv.ServeTLS(l, "", "")
+			} else {
+				errCh <- s.srv.Serve(l)
+			}
+		}()
+	}
+	return <-errCh
+}
+
+// Shutdown gracefully shuts down the HTTP server, closing the connections of
+// the requests which haven't finished when ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.srv.Shutdown(ctx)
+	if err != nil {
+		s.srv.Close()
+	}
+	s.close()
+	return err
+}
+
+// close releases the files and databases opened by the server
+func (s *Server) close() {
+	if s.usage != nil {
+		s.usage.Close()
+	}
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	if s.webhooks != nil {
+		s.webhooks.Close()
+	}
+	s.store.Close()
+	closeLogOutput(s.logOutput)
+}
+
+// serveHTTP serves the request with the current routes
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.routes.Load()).ServeHTTP(w, r)
+}
+
+// validateClients checks that every client has a name and a valid key
+func validateClients(clients []middleware.Client) error {
+	for i, client := range clients {
+		if client.Name == "" || (client.Key == "" && client.KeyHash == "") {
+			return errors.Errorf("client %d requires a name and a key or key hash", i)
+		}
+		if client.KeyHash != "" {
+			if err := middleware.ValidateKeyHash(client.KeyHash); err != nil {
+				return errors.Wrapf(err, "client %s", client.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// shared returns the store if it is shared between replicas, or else nil
+func shared(st store.Store) store.Store {
+	if store.Shared(st) {
+		return st
+	}
+	return nil
+}
+
+func closeLogOutput(c io.Closer) {
+	if c != nil {
+		c.Close()
+	}
+}
+
+// maxRequestBodySize returns the configured body size limit, 0 if disabled
+func (s *Server) maxRequestBodySize() int64 {
+	switch {
+	case s.opts.MaxRequestBodySize < 0:
+		return 0
+	case s.opts.MaxRequestBodySize == 0:
+		return DefaultMaxRequestBodySize
+	default:
+		return s.opts.MaxRequestBodySize
+	}
+}
+
+// handler registers the routes and wraps them with middleware
+func (s *Server) handler() http.Handler {
 	mux := http.NewServeMux()
 
-	// Register routes
-	mux.HandleFunc("/v1/chat/completions", s.handleChatCompletions)
-	mux.HandleFunc("/v1/models", s.handleModels)
+	// Register routes. GET routes serve HEAD requests too, and requests with
+	// other methods are rejected by withRouteErrors.
+	mux.HandleFunc("POST /v1/chat/completions", s.handleChatCompletions)
+	mux.HandleFunc("POST /v1/completions", s.handleCompletions)
+	mux.HandleFunc("POST /v1/responses", s.handleResponses)
+	mux.HandleFunc("POST /v1/messages", s.handleMessages)
+	mux.HandleFunc("GET /v1/models", s.handleModels)
+	mux.HandleFunc("GET /v1/models/{model...}", s.handleModel)
+	mux.HandleFunc("POST /api/chat", s.handleOllamaChat)
+	mux.HandleFunc("GET /api/tags", s.handleOllamaTags)
+	if s.batches != nil {
+		mux.HandleFunc("POST /v1/files", s.handleFiles)
+		mux.HandleFunc("GET /v1/files/{id}", s.handleFile)
+		mux.HandleFunc("GET /v1/files/{id}/content", s.handleFileContent)
+		mux.HandleFunc("POST /v1/batches", s.handleCreateBatch)
+		mux.HandleFunc("GET /v1/batches", s.handleListBatches)
+		mux.HandleFunc("GET /v1/batches/{id}", s.handleBatch)
+		mux.HandleFunc("POST /v1/batches/{id}/cancel", s.handleCancelBatch)
+	}
+	mux.HandleFunc("GET /admin/backends", s.handleBackendStats)
+	mux.HandleFunc("GET /admin/config", s.handleConfig)
+	mux.HandleFunc("GET /admin/log-level", s.handleLogLevel)
+	// Changing the live behaviour of the proxy requires the admin API key,
+	// which client keys can't stand in for
+	admin := s.opts.AdminApiKey != ""
+	if admin {
+		mux.HandleFunc("PUT /admin/log-level", s.handleSetLogLevel)
+	}
+	if _, ok := s.switcher(); ok {
+		mux.HandleFunc("GET /admin/switch", s.handleSwitch)
+		if admin {
+			mux.HandleFunc("PUT /admin/switch", s.handleSetSwitch)
+		}
+	}
+	mux.HandleFunc("GET /admin/requests", s.handleActiveRequests)
+	mux.HandleFunc("GET /admin/requests/recent", s.handleRecentRequests)
+	mux.Handle("GET /admin/dashboard", dashboard.Handler())
+	// The profiles expose the command line and memory of the proxy, so they
+	// require the admin API key too
+	if s.opts.DebugEndpoints && admin {
+		// pprof accepts POST requests for symbols
+		mux.Handle("/admin/debug/", debugHandler())
+	}
+	if s.usage != nil {
+		mux.HandleFunc("GET /admin/usage", s.handleUsage)
+	}
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+
+	// Apply caller-provided middleware
+	var handler http.Handler = withPathAliases(mux, withRouteErrors(mux, withTimeout(mux, s.timeout)), s.pathPrefixes)
+	if s.audit != nil {
+		handler = s.audit.Middleware(handler)
+	}
+	handler = s.active.middleware(handler)
+	for _, mw := range s.middleware {
+		handler = mw(handler)
+	}
 
 	// Create server with middleware
-	handler := middleware.Wrap(s.ctx, mux, middleware.Params{
+	return middleware.Wrap(s.ctx, handler, middleware.Params{
 		ApiKey:         s.apikey,
+		AdminApiKey:    s.opts.AdminApiKey,
+		Clients:        s.opts.Clients,
+		RateLimit:      s.opts.RateLimit,
+		TierRateLimits: s.opts.TierRateLimits,
+		TierMaxTokens:  tierMaxTokens(s.opts.Tiers),
+		Chaos:          s.opts.Chaos,
+		Compression:    s.opts.Compression,
+		JWT:            s.jwt,
+		AccessControl:  s.access,
+		ClientCerts:    s.opts.TLSClientCAFile != "",
+		Store:          s.store,
+		MaxBodySize:    s.maxRequestBodySize(),
+		RouteMethods: func(r *http.Request) []string {
+			return allowedMethods(mux, aliasRequest(mux, r, s.pathPrefixes))
+		},
+		Deadlines: middleware.Deadlines{
+			ReadBody: s.opts.HTTPLimits.ReadBodyTimeout,
+			Write:    s.opts.HTTPLimits.WriteTimeout,
+		},
 		AuthValidation: s.backend.ValidateAPIKey,
-		Timeout:        s.timeout,
+		// The dashboard page holds no data, it asks for the admin API key to
+		// query the admin endpoints
+		PublicPaths: []string{"/healthz", "/readyz", "/admin/dashboard"},
 	})
+}
 
-	srv := &http.Server{
-		Addr:        ":" + s.port,
-		Handler:     handler,
-		BaseContext: func(l net.Listener) context.Context { return s.ctx },
-	}
-
-	// Enable HTTP/2 support
-	if err := http2.ConfigureServer(srv, nil); err != nil {
-		return errors.Wrap(err, "error configuring HTTP/2")
+// tierMaxTokens returns the completion token caps of the tiers which have one
+func tierMaxTokens(tiers map[string]tiers.Tier) map[string]int {
+	caps := make(map[string]int, len(tiers))
+	for name, tier := range tiers {
+		if tier.MaxTokens > 0 {
+			caps[name] = tier.MaxTokens
+		}
 	}
-
-	logutils.FromContext(s.ctx).Infof(s.ctx, "Serving backend %s on port %s", s.backend.Name(), s.port)
-	return srv.ListenAndServe()
+	return caps
 }
 
 func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	lgr := logutils.FromContext(ctx)
-	// Validate request method
-	if r.Method != "POST" {
-		lgr.Infof(ctx, "Invalid method %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
 
 	// Parse request
 	var req openai.ChatCompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		err = errors.Wrap(err, "error parsing request")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		response.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if e := validateChatCompletion(&req); e != nil {
+		lgr.Infof(ctx, "Invalid request: %s", e.Message)
+		response.WriteErrorResponse(w, http.StatusBadRequest, *e)
 		return
 	}
 
@@ -125,19 +765,13 @@ func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	lgr := logutils.FromContext(ctx)
-	// Validate request method
-	if r.Method != "GET" {
-		lgr.Infof(ctx, "Invalid method %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
 
 	// Get models
 	models, err := s.backend.ListModels(ctx)
 	if err != nil {
 		err = errors.Wrap(err, "error listing models")
 		lgr.Error(ctx, err.Error())
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		response.WriteError(w, http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
@@ -151,3 +785,73 @@ func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
 		lgr.Error(ctx, err.Error())
 	}
 }
+
+// handleModel retrieves a single model of the backend. Model IDs may contain
+// slashes, as OpenRouter's do.
+func (s *Server) handleModel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	id := r.PathValue("model")
+	models, err := s.backend.ListModels(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "error listing models")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	for _, model := range models {
+		if model.ID != id {
+			continue
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(model); err != nil {
+			err = errors.Wrap(err, "error encoding response")
+			lgr.Error(ctx, err.Error())
+		}
+		return
+	}
+
+	lgr.Infof(ctx, "Model %s not found", id)
+	backend.WriteModelNotFound(w, id)
+}
+
+func (s *Server) handleBackendStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	resp := map[string]interface{}{
+		"backend": s.backend.Name(),
+		"health":  s.health.Status(),
+	}
+	if provider, ok := s.backend.(backend.StatsProvider); ok {
+		resp["stats"] = provider.Stats()
+	}
+
+	// Return response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		lgr.Error(ctx, err.Error())
+	}
+}
+
+// handleHealthz reports that the proxy process is alive
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the backend is healthy enough to serve requests
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := s.health.Status()
+	w.Header().Set("Content-Type", "application/json")
+	if !s.health.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		err = errors.Wrap(err, "error encoding response")
+		logutils.FromContext(r.Context()).Error(r.Context(), err.Error())
+	}
+}
@@ -0,0 +1,185 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/sse"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// copyBufferSize is the size of the buffers upstream streams are copied
+// through, which bounds how much is read before it is flushed to the client
+const copyBufferSize = 32 * 1024
+
+// copyBuffers are the buffers of passthrough streams, reused across streams
+var copyBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// read is what a single read of the upstream stream returned. buf is handed
+// over to whoever receives it, and must be returned to copyBuffers.
+type read struct {
+	buf *[]byte
+	n   int
+	err error
+}
+
+// Passthrough copies an upstream server-sent event stream to the client as it
+// is, without decoding its events, flushing after every read of the upstream
+// so that events are relayed as soon as they arrive. It is only suitable for
+// streams which need no transformation. Heartbeat comments are sent while the
+// stream is idle, but only between events, and any bytes read from the
+// upstream, comments included, restart the idle timeout. If the upstream fails
+// midway or idles for too long, the stream is terminated with an error event
+// and [DONE] when that is possible without breaking an event; otherwise it
+// ends as the upstream sent it.
+func Passthrough(ctx context.Context, w http.ResponseWriter, body io.Reader, opts Options) {
+	lgr := logutils.FromContext(ctx)
+
+	flusher, ok := start(ctx, w)
+	if !ok {
+		return
+	}
+
+	span := trace.SpanFromContext(ctx)
+	started := false
+
+	// tail holds the last bytes written, to tell whether the stream is
+	// between two events
+	var tail []byte
+	write := func(p []byte) bool {
+		if _, err := w.Write(p); err != nil {
+			err = errors.Wrap(err, "error writing response")
+			lgr.Error(ctx, err.Error())
+			return false
+		}
+		flusher.Flush()
+		tail = append(tail, p[max(0, len(p)-4):]...)
+		tail = tail[max(0, len(tail)-4):]
+		return true
+	}
+	betweenEvents := func() bool {
+		return len(tail) == 0 || bytes.HasSuffix(tail, []byte("\n\n")) ||
+			bytes.HasSuffix(tail, []byte("\r\r")) || bytes.HasSuffix(tail, []byte("\r\n\r\n"))
+	}
+	heartbeat := func() bool {
+		if !betweenEvents() {
+			return true
+		}
+		return write([]byte(": heartbeat\n\n"))
+	}
+
+	// The reader stops once the stream is relayed and the body is closed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	reads := make(chan read)
+	go func() {
+		defer close(reads)
+		for {
+			buf := copyBuffers.Get().(*[]byte)
+			n, err := body.Read(*buf)
+			select {
+			case reads <- read{buf: buf, n: n, err: err}:
+			case <-ctx.Done():
+				copyBuffers.Put(buf)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var ticker <-chan time.Time
+	if opts.Heartbeat > 0 {
+		t := time.NewTicker(opts.Heartbeat)
+		defer t.Stop()
+		ticker = t.C
+	}
+	idle := newIdleTimer(opts)
+	defer idle.stop()
+
+	// fail reports err in an error event followed by [DONE], unless that
+	// would break the event being relayed
+	fail := func(err error) {
+		lgr.Error(ctx, err.Error())
+		span.RecordError(err)
+		if !betweenEvents() {
+			return
+		}
+		data, _ := json.Marshal(openai.ErrorResponse{
+			Error: openai.Error{
+				Message: err.Error(),
+				Type:    "server_error",
+			},
+		})
+		if sse.EncodeData(w, data) == nil && sse.Encode(w, sse.Event{Data: Done}) == nil {
+			flusher.Flush()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := deadlineErr(ctx); err != nil {
+				fail(err)
+				return
+			}
+			lgr.Info(ctx, "Context cancelled, ending stream")
+			return
+		case <-idle.C:
+			fail(idle.err())
+			return
+		case <-ticker:
+			if !heartbeat() {
+				return
+			}
+		case <-opts.KeepAlive:
+			if !heartbeat() {
+				return
+			}
+		case r, ok := <-reads:
+			if !ok {
+				return
+			}
+			if r.n > 0 {
+				idle.reset()
+				data := (*r.buf)[:r.n]
+				lgr.Tracef(ctx, "Relaying: %s", data)
+				written := write(data)
+				copyBuffers.Put(r.buf)
+				if !written {
+					return
+				}
+				if !started {
+					started = true
+					span.AddEvent("stream.first_chunk")
+				}
+			} else {
+				copyBuffers.Put(r.buf)
+			}
+
+			if r.err == io.EOF {
+				span.AddEvent("stream.completed")
+				lgr.Info(ctx, "streaming response handler completed")
+				return
+			}
+			if r.err != nil {
+				fail(errors.Wrap(r.err, "error reading from upstream server stream"))
+				return
+			}
+		}
+	}
+}
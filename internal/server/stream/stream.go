@@ -0,0 +1,502 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/sse"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Done is the data of the event which terminates an OpenAI stream
+const Done = "[DONE]"
+
+// DefaultHeartbeatInterval is the interval at which heartbeat comments are
+// sent to keep idle connections open
+const DefaultHeartbeatInterval = 15 * time.Second
+
+// Options configures Write
+type Options struct {
+	// Heartbeat is the interval between heartbeat comments. Zero disables heartbeats.
+	Heartbeat time.Duration
+	// KeepAlive, if set, sends a heartbeat comment whenever it receives, such
+	// as when the upstream sends a keep-alive of its own
+	KeepAlive <-chan struct{}
+	// IdleTimeout aborts the stream with an error event when no chunk has
+	// arrived for this long, such as when the upstream hangs midway.
+	// Heartbeats and keep-alives don't count. Zero disables the timeout.
+	IdleTimeout time.Duration
+	// FirstTokenTimeout replaces IdleTimeout until the first chunk has
+	// arrived, as models may think for long before they answer. Zero applies
+	// IdleTimeout from the start.
+	FirstTokenTimeout time.Duration
+}
+
+// HeartbeatInterval resolves a configured heartbeat interval, where zero means
+// DefaultHeartbeatInterval and a negative interval disables heartbeats
+func HeartbeatInterval(interval time.Duration) time.Duration {
+	switch {
+	case interval == 0:
+		return DefaultHeartbeatInterval
+	case interval < 0:
+		return 0
+	default:
+		return interval
+	}
+}
+
+// idleTimer fires once a stream has been idle for its timeout, or has had no
+// first chunk within its first token timeout. Its channel is nil, and never
+// fires, while the timeout is disabled.
+type idleTimer struct {
+	timeout time.Duration
+	idle    time.Duration
+	started bool
+	timer   *time.Timer
+	C       <-chan time.Time
+}
+
+func newIdleTimer(opts Options) *idleTimer {
+	t := &idleTimer{timeout: opts.IdleTimeout, idle: opts.IdleTimeout}
+	if opts.FirstTokenTimeout > 0 {
+		t.timeout = opts.FirstTokenTimeout
+	}
+	if t.timeout > 0 {
+		t.timer = time.NewTimer(t.timeout)
+		t.C = t.timer.C
+	}
+	return t
+}
+
+// reset restarts the timeout, as a chunk has arrived
+func (t *idleTimer) reset() {
+	t.started = true
+	t.timeout = t.idle
+	if t.timer == nil {
+		return
+	}
+	if t.idle <= 0 {
+		t.timer.Stop()
+		t.C = nil
+		return
+	}
+	t.timer.Reset(t.idle)
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// err is the error a stream idle for too long is aborted with
+func (t *idleTimer) err() error {
+	if !t.started {
+		return errors.Errorf("upstream sent no chunk within %s", t.timeout)
+	}
+	return errors.Errorf("upstream sent nothing for %s", t.timeout)
+}
+
+// deadlineErr returns the cause of the context's deadline if it was exceeded,
+// such as the maximum duration of the stream, and nil if it was cancelled
+func deadlineErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// ReadOptions configures ReadOpenAI
+type ReadOptions struct {
+	// OnComment, if set, is called with every comment in the stream, such as
+	// the keep-alives OpenRouter sends while a request is queued
+	OnComment func(comment string)
+	// Strict fails the stream on chunks which can't be decoded, rather than
+	// skipping them
+	Strict bool
+}
+
+// Write relays chunks to the client as server-sent events until the chunks
+// channel is closed, an error is received, or the context is done. Each chunk
+// is flushed as soon as it is written and heartbeat comments are sent while
+// the stream is idle. Unless the context is done, the stream is always
+// terminated with [DONE], after an error event if the stream failed. Chunks
+// are usually chat completion chunks, but may be any JSON-encodable type.
+func Write[T any](ctx context.Context, w http.ResponseWriter, chunks <-chan T, errs <-chan error, opts Options) {
+	lgr := logutils.FromContext(ctx)
+
+	flusher, ok := start(ctx, w)
+	if !ok {
+		return
+	}
+
+	// Stream progress is recorded on the request's span
+	span := trace.SpanFromContext(ctx)
+	started := false
+
+	send := func(event sse.Event) bool {
+		if err := sse.Encode(w, event); err != nil {
+			err = errors.Wrap(err, "error writing response")
+			lgr.Error(ctx, err.Error())
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	// finish reports err, if any, in an error event and then ends the stream
+	finish := func(err error) {
+		if err != nil {
+			lgr.Error(ctx, err.Error())
+			span.RecordError(err)
+			data, _ := json.Marshal(openai.ErrorResponse{
+				Error: openai.Error{
+					Message: err.Error(),
+					Type:    "server_error",
+				},
+			})
+			if !send(sse.Event{Data: string(data)}) {
+				return
+			}
+		}
+		if send(sse.Event{Data: Done}) {
+			span.AddEvent("stream.completed")
+			lgr.Info(ctx, "streaming response handler completed")
+		}
+	}
+
+	var heartbeat <-chan time.Time
+	if opts.Heartbeat > 0 {
+		ticker := time.NewTicker(opts.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	idle := newIdleTimer(opts)
+	defer idle.stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := deadlineErr(ctx); err != nil {
+				finish(err)
+				return
+			}
+			lgr.Info(ctx, "Context cancelled, ending stream")
+			return
+		case <-idle.C:
+			finish(idle.err())
+			return
+		case <-heartbeat:
+			if !send(sse.Event{Comment: "heartbeat"}) {
+				return
+			}
+		case <-opts.KeepAlive:
+			if !send(sse.Event{Comment: "heartbeat"}) {
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				// no more errors can arrive; stop selecting on the channel
+				errs = nil
+				continue
+			}
+			finish(err)
+			return
+		case chunk, ok := <-chunks:
+			if !ok {
+				// Report an error the stream may have ended with
+				select {
+				case err, ok := <-errs:
+					if ok {
+						finish(err)
+						return
+					}
+				default:
+				}
+				finish(nil)
+				return
+			}
+			idle.reset()
+
+			// Chunks are encoded into pooled buffers, which the encoder's
+			// trailing newline is trimmed from
+			buf := sse.GetBuffer()
+			if err := json.NewEncoder(buf).Encode(chunk); err != nil {
+				sse.PutBuffer(buf)
+				finish(errors.Wrap(err, "error marshaling stream chunk"))
+				return
+			}
+			data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+			lgr.Tracef(ctx, "data: %s", data)
+			err := sse.EncodeData(w, data)
+			sse.PutBuffer(buf)
+			if err != nil {
+				lgr.Error(ctx, errors.Wrap(err, "error writing response").Error())
+				return
+			}
+			flusher.Flush()
+			if !started {
+				started = true
+				span.AddEvent("stream.first_chunk")
+			}
+		}
+	}
+}
+
+// start writes the headers of an event stream, returning false if w can't
+// stream, in which case an error response has been written
+func start(ctx context.Context, w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logutils.FromContext(ctx).Error(ctx, "streaming unsupported")
+		response.WriteError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return nil, false
+	}
+
+	// Set headers for streaming response
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, true
+}
+
+// ReadOpenAI reads an OpenAI-compatible server-sent event stream from body,
+// decoding each data event into a chunk. Comments are only passed to the
+// OnComment option, if set, and never forwarded. Both returned
+// channels are closed once the stream ends, the [DONE] event is read, or the
+// context is done. Any error is sent before the channels are closed.
+func ReadOpenAI(ctx context.Context, body io.Reader, opts ReadOptions) (<-chan openai.ChatCompletionStreamResponse, <-chan error) {
+	return ReadEvents[openai.ChatCompletionStreamResponse](ctx, body, opts)
+}
+
+// ReadEvents is like ReadOpenAI, but decodes each data event into T, such as
+// the chunks of a legacy completion stream
+func ReadEvents[T any](ctx context.Context, body io.Reader, opts ReadOptions) (<-chan T, <-chan error) {
+	lgr := logutils.FromContext(ctx)
+	chunks := make(chan T)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(chunks)
+		defer close(errs)
+
+		reader := sse.NewReader(body)
+		defer reader.Close()
+		for {
+			event, err := reader.Next()
+			if err != nil {
+				if err != io.EOF {
+					errs <- errors.Wrap(err, "error reading from upstream server stream")
+				}
+				return
+			}
+			if event.IsComment() {
+				lgr.Tracef(ctx, "Received comment: %s", event.Comment)
+				if opts.OnComment != nil {
+					opts.OnComment(event.Comment)
+				}
+				continue
+			}
+			if event.Data == "" {
+				continue
+			}
+			lgr.Tracef(ctx, "Received event: %s", event.Data)
+
+			if event.Data == Done {
+				return
+			}
+
+			// Streams which fail midway end with an error event
+			data := []byte(event.Data)
+			var failure struct {
+				Error *struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			if json.Unmarshal(data, &failure) == nil && failure.Error != nil {
+				errs <- errors.Errorf("upstream stream failed: %s", failure.Error.Message)
+				return
+			}
+
+			var chunk T
+			if err := json.Unmarshal(data, &chunk); err != nil {
+				err = errors.Wrapf(err, "error unmarshaling stream chunk %s", event.Data)
+				if opts.Strict {
+					errs <- err
+					return
+				}
+				lgr.Error(ctx, err.Error())
+				continue
+			}
+
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return chunks, errs
+}
+
+// Transform applies fn to every chunk read from in. The returned channel is
+// closed once in is closed or the context is done.
+func Transform(ctx context.Context, in <-chan openai.ChatCompletionStreamResponse, fn func(*openai.ChatCompletionStreamResponse)) <-chan openai.ChatCompletionStreamResponse {
+	out := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		for chunk := range in {
+			fn(&chunk)
+			select {
+			case out <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Merge relays the chunks of several streams onto a single stream, in the
+// order they arrive. errs must hold one error channel per chunks channel, and
+// each error channel must be closed once its chunks channel is. Both returned
+// channels are closed once every stream has ended or the context is done, and
+// only the first error is relayed.
+func Merge(ctx context.Context, chunks []<-chan openai.ChatCompletionStreamResponse, errs []<-chan error) (<-chan openai.ChatCompletionStreamResponse, <-chan error) {
+	out := make(chan openai.ChatCompletionStreamResponse)
+	outErrs := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks[i] {
+				select {
+				case out <- chunk:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err, ok := <-errs[i]; ok && err != nil {
+				select {
+				case outErrs <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(outErrs)
+		close(out)
+	}()
+
+	return out, outErrs
+}
+
+// Stabilize gives every chunk the ID and created timestamp of the first
+// chunk, as OpenAI does, generating an ID if the upstream doesn't send one
+func Stabilize(ctx context.Context, in <-chan openai.ChatCompletionStreamResponse) <-chan openai.ChatCompletionStreamResponse {
+	var id string
+	var created int64
+	return Transform(ctx, in, func(chunk *openai.ChatCompletionStreamResponse) {
+		if id == "" {
+			id = chunk.ID
+			if id == "" {
+				id = utils.GenerateResponseID()
+			}
+			created = chunk.Created
+			if created == 0 {
+				created = time.Now().Unix()
+			}
+		}
+		chunk.ID = id
+		chunk.Created = created
+	})
+}
+
+// RewriteModel sets the model of every chunk to the model the client requested
+func RewriteModel(ctx context.Context, in <-chan openai.ChatCompletionStreamResponse, model string) <-chan openai.ChatCompletionStreamResponse {
+	return Transform(ctx, in, func(chunk *openai.ChatCompletionStreamResponse) {
+		chunk.Model = model
+	})
+}
+
+// Usage normalizes how token usage is reported in a stream. Usage is stripped
+// from every chunk, and chunks left with no choices are dropped. If include is
+// set, the last usage seen is emitted in a final chunk with an empty choices
+// array, as OpenAI does for stream_options.include_usage.
+func Usage(ctx context.Context, in <-chan openai.ChatCompletionStreamResponse, include bool) <-chan openai.ChatCompletionStreamResponse {
+	out := make(chan openai.ChatCompletionStreamResponse)
+	go func() {
+		defer close(out)
+		var last openai.ChatCompletionStreamResponse
+		var usage *openai.Usage
+		for chunk := range in {
+			last = chunk
+			if chunk.Usage != nil {
+				usage = chunk.Usage
+				chunk.Usage = nil
+			}
+			if len(chunk.Choices) == 0 {
+				continue
+			}
+			select {
+			case out <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if !include || usage == nil {
+			return
+		}
+		select {
+		case out <- UsageChunk(last, *usage):
+		case <-ctx.Done():
+		}
+	}()
+	return out
+}
+
+// FinishReasons normalizes the finish reason of every choice, accounting for
+// tool calls streamed earlier in the same choice
+func FinishReasons(ctx context.Context, in <-chan openai.ChatCompletionStreamResponse) <-chan openai.ChatCompletionStreamResponse {
+	toolCalls := map[int]bool{}
+	return Transform(ctx, in, func(chunk *openai.ChatCompletionStreamResponse) {
+		for i := range chunk.Choices {
+			choice := &chunk.Choices[i]
+			if len(choice.Delta.ToolCalls) > 0 {
+				toolCalls[choice.Index] = true
+			}
+			choice.FinishReason = openai.NormalizeFinishReason(choice.FinishReason, toolCalls[choice.Index])
+		}
+	})
+}
+
+// UsageChunk builds a usage-only chunk for the same response as chunk
+func UsageChunk(chunk openai.ChatCompletionStreamResponse, usage openai.Usage) openai.ChatCompletionStreamResponse {
+	return openai.ChatCompletionStreamResponse{
+		ID:      chunk.ID,
+		Object:  "chat.completion.chunk",
+		Created: chunk.Created,
+		Model:   chunk.Model,
+		Choices: []openai.StreamChoice{},
+		Usage:   &usage,
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// backendRoutes are the routes served by the backend, which bounds their
+// requests by the timeouts of streaming and non-streaming requests
+var backendRoutes = map[string]bool{
+	"POST /v1/chat/completions": true,
+	"POST /v1/completions":      true,
+	"POST /v1/responses":        true,
+	"POST /v1/messages":         true,
+	"POST /api/chat":            true,
+}
+
+// withTimeout serves requests with mux, bounding those of every route but the
+// backend's by timeout
+func withTimeout(mux *http.ServeMux, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); !backendRoutes[pattern] {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, during handshakes
+const certCheckInterval = 10 * time.Second
+
+// tlsConfig creates the TLS config serving the certificate files, or the
+// certificates obtained from Let's Encrypt, requiring client certificates
+// signed by the CA if configured. It is nil if TLS isn't configured.
+func tlsConfig(ctx context.Context, opts Options) (*tls.Config, error) {
+	var cfg *tls.Config
+	switch {
+	case len(opts.ACMEHosts) > 0:
+		if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+			return nil, errors.New("TLS certificate files and ACME are mutually exclusive")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(opts.ACMEHosts...),
+			Email:      opts.ACMEEmail,
+		}
+		if opts.ACMECacheDir != "" {
+			manager.Cache = autocert.DirCache(opts.ACMECacheDir)
+		}
+		cfg = manager.TLSConfig()
+	case opts.TLSCertFile != "" || opts.TLSKeyFile != "":
+		if opts.TLSCertFile == "" || opts.TLSKeyFile == "" {
+			return nil, errors.New("TLS requires both a certificate and a key")
+		}
+		reloader := &certReloader{
+			ctx:      ctx,
+			certFile: opts.TLSCertFile,
+			keyFile:  opts.TLSKeyFile,
+		}
+		if err := reloader.load(); err != nil {
+			return nil, err
+		}
+		cfg = &tls.Config{
+			GetCertificate: reloader.getCertificate,
+		}
+	default:
+		if opts.TLSClientCAFile != "" {
+			return nil, errors.New("client certificates require TLS")
+		}
+		return nil, nil
+	}
+	cfg.MinVersion = tls.VersionTLS12
+
+	if opts.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(opts.TLSClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading client CA")
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in client CA %s", opts.TLSClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(opts.ACMEHosts) > 0 {
+			// Let's Encrypt presents no client certificate in the TLS-ALPN
+			// challenge, whose connections are never served
+			challenge := cfg.Clone()
+			challenge.ClientAuth = tls.NoClientCert
+			challenge.ClientCAs = nil
+			cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if isACMEChallenge(hello) {
+					return challenge, nil
+				}
+				return nil, nil
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// isACMEChallenge is whether a handshake is that of the TLS-ALPN challenge,
+// which offers no protocol but the challenge's
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// certReloader serves the certificate of its files, reloading them once they
+// change, such as when they are renewed
+type certReloader struct {
+	ctx      context.Context
+	certFile string
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// modTime is when the files were last modified as of the last load
+	modTime time.Time
+	checked time.Time
+}
+
+// load reads the certificate files
+func (c *certReloader) load() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "error loading TLS certificate")
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	return nil
+}
+
+// latestModTime returns when either of the files was last modified
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "error reading TLS certificate")
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// getCertificate returns the certificate, reloading it first if its files
+// changed. The previous certificate is kept if they can't be loaded.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+
+	lgr := logutils.FromContext(c.ctx)
+	if modTime, err := c.latestModTime(); err != nil || modTime.Equal(c.modTime) {
+		if err != nil {
+			lgr.Error(c.ctx, err.Error())
+		}
+		return c.cert, nil
+	}
+	if err := c.load(); err != nil {
+		lgr.Error(c.ctx, err.Error())
+		return c.cert, nil
+	}
+	lgr.Infof(c.ctx, "Reloaded TLS certificate %s", c.certFile)
+	return c.cert, nil
+}
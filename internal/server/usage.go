@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/usage"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+	"github.com/pkg/errors"
+)
+
+// handleUsage reports the daily usage aggregates, filtered by the from, to,
+// api_key, tier and model query parameters, along with their total
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	lgr := logutils.FromContext(ctx)
+
+	query := r.URL.Query()
+	aggregates, err := s.usage.Aggregates(ctx, usage.Filter{
+		From:   query.Get("from"),
+		To:     query.Get("to"),
+		APIKey: query.Get("api_key"),
+		Tier:   query.Get("tier"),
+		Model:  query.Get("model"),
+	})
+	if err != nil {
+		err = errors.Wrap(err, "error reading usage")
+		lgr.Error(ctx, err.Error())
+		response.WriteError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	writeJSON(w, map[string]any{
+		"object": "list",
+		"data":   aggregates,
+		"total":  usage.Total(aggregates),
+	})
+}
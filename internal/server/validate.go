@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+// functionName matches the names OpenAI accepts for functions
+var functionName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// knownRoles are the roles messages may have
+var knownRoles = map[string]bool{
+	openai.RoleSystem:    true,
+	openai.RoleDeveloper: true,
+	openai.RoleUser:      true,
+	openai.RoleAssistant: true,
+	openai.RoleTool:      true,
+	openai.RoleFunction:  true,
+}
+
+// validateChatCompletion checks a chat completion request for mistakes the
+// upstream would reject, or choke on, returning the error describing the
+// first found
+func validateChatCompletion(req *openai.ChatCompletionRequest) *openai.Error {
+	if len(req.Messages) == 0 {
+		return invalidParam("messages", "messages must not be empty")
+	}
+	for i, msg := range req.Messages {
+		if !knownRoles[msg.Role] {
+			return invalidParam(fmt.Sprintf("messages[%d].role", i), fmt.Sprintf("unknown role %q", msg.Role))
+		}
+		if msg.Role == openai.RoleTool && msg.ToolCallID == "" {
+			return invalidParam(fmt.Sprintf("messages[%d].tool_call_id", i), "tool messages require a tool_call_id")
+		}
+	}
+
+	for i, tool := range req.Tools {
+		if tool.Type != "function" {
+			return invalidParam(fmt.Sprintf("tools[%d].type", i), fmt.Sprintf("unsupported tool type %q", tool.Type))
+		}
+		if e := validateFunction(fmt.Sprintf("tools[%d].function", i), tool.Function); e != nil {
+			return e
+		}
+	}
+	for i, function := range req.Functions {
+		if e := validateFunction(fmt.Sprintf("functions[%d]", i), function); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// validateFunction checks a function's name, and that its parameters are a
+// JSON schema object
+func validateFunction(param string, function openai.Function) *openai.Error {
+	if !functionName.MatchString(function.Name) {
+		return invalidParam(param+".name", fmt.Sprintf("invalid function name %q, which must be 1 to 64 letters, digits, underscores or dashes", function.Name))
+	}
+	if function.Parameters == nil {
+		return nil
+	}
+	if _, ok := function.Parameters.(map[string]any); !ok {
+		return invalidParam(param+".parameters", "function parameters must be a JSON schema object")
+	}
+	return nil
+}
+
+func invalidParam(param, message string) *openai.Error {
+	return &openai.Error{
+		Message: message,
+		Type:    response.ErrorTypeInvalidRequest,
+		Param:   param,
+		Code:    "invalid_value",
+	}
+}
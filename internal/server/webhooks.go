@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/health"
+	"github.com/danilofalcao/cursor-deepseek/internal/usage"
+	"github.com/danilofalcao/cursor-deepseek/internal/webhook"
+)
+
+// requestStarted sends the request.started event
+func (s *Server) requestStarted(ctx context.Context, req ActiveRequest) {
+	s.webhooks.Send(ctx, webhook.EventRequestStarted, req)
+}
+
+// requestDone sends the request.completed event, or request.failed if the
+// response is an error
+func (s *Server) requestDone(ctx context.Context, req ActiveRequest) {
+	event := webhook.EventRequestCompleted
+	if req.Status >= http.StatusBadRequest {
+		event = webhook.EventRequestFailed
+	}
+	if s.webhooks.Wants(event) {
+		s.webhooks.Send(ctx, event, req)
+	}
+}
+
+// budgetAlert sends the budget.threshold event
+func (s *Server) budgetAlert(ctx context.Context, alert usage.Alert) {
+	s.webhooks.Send(ctx, webhook.EventBudgetThreshold, map[string]any{
+		"api_key":    alert.APIKey,
+		"period":     alert.Budget.Period,
+		"threshold":  alert.Threshold,
+		"tokens":     alert.Tokens,
+		"cost":       alert.Cost,
+		"max_tokens": alert.Budget.MaxTokens,
+		"max_cost":   alert.Budget.MaxCost,
+	})
+}
+
+// healthChanged sends the backend.unhealthy or backend.healthy event
+func (s *Server) healthChanged(ctx context.Context, status health.Status) {
+	event := webhook.EventBackendHealthy
+	if !status.Healthy {
+		event = webhook.EventBackendUnhealthy
+	}
+	s.webhooks.Send(ctx, event, map[string]any{
+		"backend":      s.backend.Name(),
+		"healthy":      status.Healthy,
+		"error":        status.Error,
+		"last_checked": status.LastChecked,
+	})
+}
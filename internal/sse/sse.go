@@ -0,0 +1,238 @@
+// Package sse reads and writes server-sent event streams as described by the
+// HTML Living Standard.
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	initialBufferSize = 64 * 1024
+	// maxLineSize bounds a single line, which for chat completions can hold a
+	// whole chunk of tool call arguments
+	maxLineSize = 8 * 1024 * 1024
+	// maxPooledSize bounds the buffers returned to the pools, so that a single
+	// huge event doesn't stay allocated
+	maxPooledSize = 1024 * 1024
+)
+
+// scanBuffers are the initial buffers of readers, reused across streams
+var scanBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, initialBufferSize)
+		return &b
+	},
+}
+
+// encodeBuffers are the buffers events are encoded into before being written
+var encodeBuffers = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// GetBuffer returns an empty buffer from the pool shared with Encode. It
+// should be returned with PutBuffer once it is no longer used.
+func GetBuffer() *bytes.Buffer {
+	b := encodeBuffers.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// PutBuffer returns a buffer obtained from GetBuffer to the pool
+func PutBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledSize {
+		encodeBuffers.Put(b)
+	}
+}
+
+// Event is a single server-sent event. An event with only a comment is how
+// comment lines, often used as keep-alives, are read and written.
+type Event struct {
+	// Type is the event field, which is "message" when unset
+	Type string
+	ID   string
+	// Data holds the data fields of the event joined by newlines
+	Data string
+	// Retry is the reconnection time requested by the server
+	Retry time.Duration
+	// Comment holds comment lines, without their leading colon
+	Comment string
+}
+
+// IsComment returns whether the event only carries a comment
+func (e Event) IsComment() bool {
+	return e.Comment != "" && e.Type == "" && e.ID == "" && e.Data == "" && e.Retry == 0
+}
+
+// Reader reads events from a server-sent event stream
+type Reader struct {
+	scanner *bufio.Scanner
+	buf     *[]byte
+}
+
+// NewReader creates a new Reader. Its buffer is taken from a pool, to which
+// Close returns it.
+func NewReader(r io.Reader) *Reader {
+	buf := scanBuffers.Get().(*[]byte)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(*buf, maxLineSize)
+	scanner.Split(scanLines)
+	return &Reader{scanner: scanner, buf: buf}
+}
+
+// Close releases the buffer of the reader, which must not be used afterwards
+func (r *Reader) Close() {
+	if r.buf != nil {
+		scanBuffers.Put(r.buf)
+		r.buf = nil
+	}
+}
+
+// Next returns the next event or comment in the stream. Lines may end in
+// CRLF, LF or CR, and multi-line data fields are joined. An event left
+// unterminated when the stream ends is still returned, since some servers
+// don't send the final blank line. io.EOF is returned once the stream ends.
+func (r *Reader) Next() (Event, error) {
+	var event Event
+	var data strings.Builder
+	var hasData, pending bool
+
+	dispatch := func() Event {
+		if hasData {
+			event.Data = strings.TrimSuffix(data.String(), "\n")
+		}
+		return event
+	}
+
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+
+		// A blank line terminates the event
+		if line == "" {
+			if pending {
+				return dispatch(), nil
+			}
+			continue
+		}
+
+		// Each comment is returned on its own so that it can be relayed as
+		// soon as it arrives
+		if comment, ok := strings.CutPrefix(line, ":"); ok {
+			if pending {
+				// Comments within an event are ignored
+				continue
+			}
+			return Event{Comment: strings.TrimPrefix(comment, " ")}, nil
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		pending = true
+		switch field {
+		case "data":
+			hasData = true
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "event":
+			event.Type = value
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				event.ID = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				event.Retry = time.Duration(ms) * time.Millisecond
+			}
+		default:
+			// Unknown fields are ignored
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Event{}, errors.Wrap(err, "error reading event stream")
+	}
+	if pending {
+		return dispatch(), nil
+	}
+	return Event{}, io.EOF
+}
+
+// scanLines splits a stream into lines ending in CRLF, LF or CR
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\r' {
+			if i+1 == len(data) && !atEOF {
+				// Wait to find out whether this is a CRLF
+				return 0, nil, nil
+			}
+			if i+1 < len(data) && data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+		}
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Encode writes event to w in the wire format, splitting multi-line data
+// and comments across several fields, and terminating it with a blank line
+func Encode(w io.Writer, event Event) error {
+	b := GetBuffer()
+	defer PutBuffer(b)
+	if event.Comment != "" {
+		for _, line := range splitLines(event.Comment) {
+			b.WriteString(": " + line + "\n")
+		}
+	}
+	if event.Type != "" {
+		b.WriteString("event: " + event.Type + "\n")
+	}
+	if event.ID != "" {
+		b.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	if event.Data != "" || !event.IsComment() {
+		for _, line := range splitLines(event.Data) {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteByte('\n')
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// EncodeData writes an event holding only data, which must be a single line
+// such as compact JSON, without copying it into a string first
+func EncodeData(w io.Writer, data []byte) error {
+	b := GetBuffer()
+	defer PutBuffer(b)
+	b.Grow(len(data) + len("data: \n\n"))
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
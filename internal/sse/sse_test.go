@@ -0,0 +1,182 @@
+package sse
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// readAll reads every event of the stream
+func readAll(t *testing.T, r io.Reader) []Event {
+	t.Helper()
+	reader := NewReader(r)
+	defer reader.Close()
+	var events []Event
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, event)
+	}
+}
+
+func TestReader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		stream string
+		want   []Event
+	}{
+		{name: "empty"},
+		{
+			name:   "data",
+			stream: "data: {\"id\":1}\n\ndata: [DONE]\n\n",
+			want:   []Event{{Data: `{"id":1}`}, {Data: "[DONE]"}},
+		},
+		{
+			name:   "multi-line data",
+			stream: "data: first\ndata: second\ndata:\n\n",
+			want:   []Event{{Data: "first\nsecond\n"}},
+		},
+		{
+			name:   "fields",
+			stream: "event: ping\nid: 42\nretry: 1500\ndata: x\n\n",
+			want:   []Event{{Type: "ping", ID: "42", Retry: 1500 * time.Millisecond, Data: "x"}},
+		},
+		{
+			name:   "only one leading space is stripped",
+			stream: "data:  indented\n\ndata:unspaced\n\n",
+			want:   []Event{{Data: " indented"}, {Data: "unspaced"}},
+		},
+		{
+			name:   "CRLF",
+			stream: "data: a\r\ndata: b\r\n\r\ndata: c\r\n\r\n",
+			want:   []Event{{Data: "a\nb"}, {Data: "c"}},
+		},
+		{
+			name:   "CR",
+			stream: "data: a\rdata: b\r\rdata: c\r\r",
+			want:   []Event{{Data: "a\nb"}, {Data: "c"}},
+		},
+		{
+			name:   "comments",
+			stream: ": keep-alive\n\n:no space\ndata: x\n: ignored within an event\n\n",
+			want:   []Event{{Comment: "keep-alive"}, {Comment: "no space"}, {Data: "x"}},
+		},
+		{
+			name:   "unterminated event",
+			stream: "data: a\n\ndata: last",
+			want:   []Event{{Data: "a"}, {Data: "last"}},
+		},
+		{
+			name:   "blank lines between events",
+			stream: "\n\n\ndata: a\n\n\n\ndata: b\n\n",
+			want:   []Event{{Data: "a"}, {Data: "b"}},
+		},
+		{
+			name:   "unknown and invalid fields",
+			stream: "foo: bar\nretry: soon\nid: a\x00b\ndata: x\n\n",
+			want:   []Event{{Data: "x"}},
+		},
+		{
+			name:   "field without data",
+			stream: "event: end\n\n",
+			want:   []Event{{Type: "end"}},
+		},
+		{
+			name:   "field without a colon",
+			stream: "data\n\n",
+			want:   []Event{{Data: ""}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := readAll(t, strings.NewReader(tc.stream)); !slices.Equal(got, tc.want) {
+				t.Errorf("read %+v, want %+v", got, tc.want)
+			}
+			// Lines may end across reads, such as a CR and the LF following
+			// it
+			if got := readAll(t, iotest.OneByteReader(strings.NewReader(tc.stream))); !slices.Equal(got, tc.want) {
+				t.Errorf("read byte by byte %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReaderLongLine(t *testing.T) {
+	data := strings.Repeat("x", 2*initialBufferSize)
+	got := readAll(t, strings.NewReader("data: "+data+"\n\n"))
+	if len(got) != 1 || got[0].Data != data {
+		t.Errorf("long line wasn't read as a single event")
+	}
+
+	reader := NewReader(strings.NewReader("data: " + strings.Repeat("x", maxLineSize) + "\n\n"))
+	defer reader.Close()
+	if _, err := reader.Next(); err == nil || err == io.EOF {
+		t.Errorf("Next() = %v for a line beyond the maximum, want an error", err)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		event Event
+		want  string
+	}{
+		{name: "data", event: Event{Data: `{"id":1}`}, want: "data: {\"id\":1}\n\n"},
+		{name: "multi-line data", event: Event{Data: "a\nb\r\nc"}, want: "data: a\ndata: b\ndata: c\n\n"},
+		{
+			name:  "fields",
+			event: Event{Type: "ping", ID: "42", Retry: 1500 * time.Millisecond, Data: "x"},
+			want:  "event: ping\nid: 42\nretry: 1500\ndata: x\n\n",
+		},
+		{name: "comment", event: Event{Comment: "keep-alive"}, want: ": keep-alive\n\n"},
+		{name: "multi-line comment", event: Event{Comment: "a\nb"}, want: ": a\n: b\n\n"},
+		{name: "empty", event: Event{}, want: "data: \n\n"},
+		{name: "type without data", event: Event{Type: "end"}, want: "event: end\ndata: \n\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := Encode(&b, tc.event); err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if b.String() != tc.want {
+				t.Errorf("Encode() wrote %q, want %q", b.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestEncodeData(t *testing.T) {
+	var b bytes.Buffer
+	if err := EncodeData(&b, []byte(`{"id":1}`)); err != nil {
+		t.Fatalf("EncodeData: %v", err)
+	}
+	if want := "data: {\"id\":1}\n\n"; b.String() != want {
+		t.Errorf("EncodeData() wrote %q, want %q", b.String(), want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	events := []Event{
+		{Comment: "keep-alive"},
+		{Data: `{"choices":[]}`},
+		{Type: "message_start", ID: "1", Data: "line one\nline two"},
+		{Retry: 3 * time.Second, Data: "x"},
+	}
+	var b bytes.Buffer
+	for _, event := range events {
+		if err := Encode(&b, event); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+	if got := readAll(t, &b); !slices.Equal(got, events) {
+		t.Errorf("read back %+v, want %+v", got, events)
+	}
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often expired entries are dropped from memory
+const sweepInterval = time.Minute
+
+var _ Store = &Memory{}
+
+// Memory is a Store for a single replica
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+	swept   time.Time
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time
+	// bucket is set for the entries of token buckets
+	bucket *bucket
+}
+
+type bucket struct {
+	available float64
+	updated   time.Time
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		entries: map[string]*entry{},
+	}
+}
+
+// get returns the entry at key, if it hasn't expired, dropping the expired
+// entries every so often
+func (m *Memory) get(key string, now time.Time) *entry {
+	if now.Sub(m.swept) > sweepInterval {
+		for k, e := range m.entries {
+			if !e.expires.After(now) {
+				delete(m.entries, k)
+			}
+		}
+		m.swept = now
+	}
+	e, ok := m.entries[key]
+	if !ok || !e.expires.After(now) {
+		return nil
+	}
+	return e
+}
+
+func (m *Memory) Take(ctx context.Context, key string, capacity float64, refill time.Duration, n float64) (time.Duration, float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+
+	e := m.get(key, now)
+	if e == nil || e.bucket == nil {
+		e = &entry{bucket: &bucket{available: capacity, updated: now}}
+		m.entries[key] = e
+	}
+	b := e.bucket
+	b.available = min(capacity, b.available+float64(now.Sub(b.updated))/float64(refill)*capacity)
+	b.updated = now
+
+	if missing := min(n, capacity) - b.available; n > 0 && missing > 0 {
+		return time.Duration(missing / capacity * float64(refill)), b.available, nil
+	}
+	b.available = min(capacity, b.available-n)
+	// The bucket is dropped once it has refilled
+	e.expires = now.Add(time.Duration((capacity-b.available)/capacity*float64(refill)) + time.Second)
+	return 0, b.available, nil
+}
+
+func (m *Memory) Add(ctx context.Context, key string, delta float64, ttl time.Duration) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+
+	var value float64
+	e := m.get(key, now)
+	if e != nil {
+		value, _ = strconv.ParseFloat(string(e.value), 64)
+	} else {
+		e = &entry{expires: now.Add(ttl)}
+		m.entries[key] = e
+	}
+	value += delta
+	e.value = []byte(strconv.FormatFloat(value, 'f', -1, 64))
+	return value, nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.get(key, time.Now()); e != nil {
+		return e.value, nil
+	}
+	return nil, nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = &entry{
+		value:   value,
+		expires: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
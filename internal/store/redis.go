@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// takeScript refills the token bucket at KEYS[1] by the time since it was
+// last updated, by Redis' clock so replicas needn't agree on it, and takes
+// ARGV[3] from it if it holds them. The bucket expires once it has refilled.
+var takeScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local refill = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = time[1] * 1000 + time[2] / 1000
+
+local state = redis.call('HMGET', KEYS[1], 'available', 'updated')
+local available = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+available = math.min(capacity, available + (now - updated) / refill * capacity)
+
+local missing = math.min(n, capacity) - available
+if n > 0 and missing > 0 then
+	return {tostring(missing / capacity * refill), tostring(available)}
+end
+available = math.min(capacity, available - n)
+redis.call('HSET', KEYS[1], 'available', tostring(available), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - available) / capacity * refill) + 1000)
+return {'0', tostring(available)}
+`)
+
+// addScript adds ARGV[1] to the counter at KEYS[1], setting its expiry in
+// milliseconds to ARGV[2] when it is created
+var addScript = redis.NewScript(`
+local value = redis.call('INCRBYFLOAT', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value
+`)
+
+var _ Store = &Redis{}
+
+// Redis is a Store shared by the replicas connected to the same database
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedis connects to the Redis database at url, such as
+// redis://:password@localhost:6379/0
+func NewRedis(ctx context.Context, url, prefix string) (*Redis, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing Redis URL")
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "error connecting to Redis")
+	}
+	return &Redis{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+func (r *Redis) Take(ctx context.Context, key string, capacity float64, refill time.Duration, n float64) (time.Duration, float64, error) {
+	result, err := takeScript.Run(ctx, r.client, []string{r.prefix + key},
+		capacity, refill.Milliseconds(), n).StringSlice()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error taking from Redis token bucket")
+	}
+	waitMs, _ := strconv.ParseFloat(result[0], 64)
+	remaining, _ := strconv.ParseFloat(result[1], 64)
+	return time.Duration(waitMs * float64(time.Millisecond)), remaining, nil
+}
+
+func (r *Redis) Add(ctx context.Context, key string, delta float64, ttl time.Duration) (float64, error) {
+	value, err := addScript.Run(ctx, r.client, []string{r.prefix + key}, delta, ttl.Milliseconds()).Text()
+	if err != nil {
+		return 0, errors.Wrap(err, "error adding to Redis counter")
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	return n, errors.Wrap(err, "error parsing Redis counter")
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return value, errors.Wrap(err, "error reading from Redis")
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return errors.Wrap(r.client.Set(ctx, r.prefix+key, value, ttl).Err(), "error writing to Redis")
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,65 @@
+// Package store holds state shared between the replicas of the proxy, such as
+// rate limits and budget counters, in Redis, or in memory for a single
+// replica
+package store
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Store is state which expires, shared between the replicas of the proxy
+type Store interface {
+	// Take takes n from the token bucket at key, which holds up to capacity
+	// and refills completely over refill, returning how long to wait instead
+	// if it lacks them, along with what remains. More than the capacity is
+	// taken once the bucket is full, overdrawing it. A negative n returns to
+	// the bucket.
+	Take(ctx context.Context, key string, capacity float64, refill time.Duration, n float64) (wait time.Duration, remaining float64, err error)
+	// Add adds delta to the counter at key, which expires after ttl, returning
+	// its new value
+	Add(ctx context.Context, key string, delta float64, ttl time.Duration) (float64, error)
+	// Get returns the value at key, or nil if there is none
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set sets the value at key, which expires after ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Close() error
+}
+
+// Options configures the store
+type Options struct {
+	// RedisURL, such as redis://localhost:6379/0, selects a Redis store. The
+	// store is in memory if it isn't set.
+	RedisURL string
+	// Prefix is prepended to the Redis keys, so several deployments can share
+	// a database
+	Prefix string
+}
+
+// New creates the store selected by the options
+func New(ctx context.Context, opts Options) (Store, error) {
+	if opts.RedisURL == "" {
+		return NewMemory(), nil
+	}
+	return NewRedis(ctx, opts.RedisURL, opts.Prefix)
+}
+
+// Shared is whether the store is shared between replicas, rather than in
+// memory
+func Shared(s Store) bool {
+	_, ok := s.(*Redis)
+	return ok
+}
+
+// Counter returns the value of the counter at key, or 0 if there is none
+func Counter(ctx context.Context, s Store, key string) (float64, error) {
+	value, err := s.Get(ctx, key)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	n, err := strconv.ParseFloat(string(value), 64)
+	return n, errors.Wrapf(err, "error parsing counter %s", key)
+}
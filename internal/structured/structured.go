@@ -0,0 +1,215 @@
+// Package structured emulates OpenAI structured outputs (response_format
+// json_schema with strict set) for backends which don't support them natively.
+package structured
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/jsonschema"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+const defaultMaxAttempts = 3
+
+var _ backend.Backend = &Emulator{}
+
+// Options configures an Emulator
+type Options struct {
+	Backend backend.Backend
+	// MaxAttempts is the number of times the model is asked for output before
+	// giving up on producing JSON which matches the schema
+	MaxAttempts int
+}
+
+// Emulator is a backend which emulates strict structured outputs by injecting
+// the schema into the system prompt, validating the model output against the
+// schema, repairing it where possible, and retrying when it is invalid.
+type Emulator struct {
+	backend.Backend
+	maxAttempts int
+}
+
+// New creates a new Emulator
+func New(opts Options) *Emulator {
+	maxAttempts := opts.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	return &Emulator{
+		Backend:     opts.Backend,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// Stats returns the statistics of the wrapped backend, if any
+func (e *Emulator) Stats() any {
+	if provider, ok := e.Backend.(backend.StatsProvider); ok {
+		return provider.Stats()
+	}
+	return nil
+}
+
+// HandleChatCompletion emulates structured outputs for strict json_schema
+// requests and passes every other request straight through.
+func (e *Emulator) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	format := req.ResponseFormat
+	if format == nil || format.Type != openai.ResponseFormatJSONSchema || format.JSONSchema == nil ||
+		format.JSONSchema.Strict == nil || !*format.JSONSchema.Strict {
+		e.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	lgr := logutils.FromContext(ctx)
+	schema := format.JSONSchema.Schema
+
+	instructions, err := schemaInstructions(format.JSONSchema)
+	if err != nil {
+		lgr.Errorf(ctx, "error rendering schema instructions: %s", err.Error())
+		e.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	// Ask for JSON mode with the schema in the system prompt instead
+	emulated := *req
+	emulated.ResponseFormat = &openai.ResponseFormat{Type: openai.ResponseFormatJSONObject}
+	emulated.Messages = append([]openai.Message{{
+		Role:    "system",
+		Content: openai.Content_String{Content: instructions},
+	}}, req.Messages...)
+
+	// The output must be validated as a whole, so streams are only prompted
+	if req.Stream {
+		lgr.Debug(ctx, "Structured outputs for streaming requests are prompted but not validated")
+		e.Backend.HandleChatCompletion(ctx, w, r, &emulated)
+		return
+	}
+
+	var rec *response.Recorder
+	var problems []string
+	for attempt := 1; attempt <= e.maxAttempts; attempt++ {
+		attemptReq := emulated
+		rec = response.NewRecorder()
+		e.Backend.HandleChatCompletion(ctx, rec, r, &attemptReq)
+		if rec.Status != http.StatusOK {
+			rec.WriteTo(w, nil)
+			return
+		}
+
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Choices) == 0 {
+			lgr.Warn(ctx, "Unable to parse backend response for structured output validation")
+			rec.WriteTo(w, nil)
+			return
+		}
+
+		// Every choice must match when several were requested
+		invalid := -1
+		for i := range resp.Choices {
+			var output string
+			output, problems = repairAndValidate(resp.Choices[i].Message.GetContentString(), schema)
+			if len(problems) > 0 {
+				invalid = i
+				break
+			}
+			resp.Choices[i].Message.Content = openai.Content_String{Content: output}
+		}
+		if invalid < 0 {
+			body, err := json.Marshal(resp)
+			if err != nil {
+				rec.WriteTo(w, nil)
+				return
+			}
+			rec.WriteTo(w, body)
+			return
+		}
+
+		lgr.Infof(ctx, "Structured output attempt %d/%d did not match schema: %s", attempt, e.maxAttempts, strings.Join(problems, "; "))
+
+		// Show the model its mistake and ask again
+		emulated.Messages = append(emulated.Messages,
+			resp.Choices[invalid].Message,
+			openai.Message{
+				Role: "user",
+				Content: openai.Content_String{Content: fmt.Sprintf(
+					"Your previous response did not match the required JSON schema: %s. Respond again with only valid JSON that matches the schema.",
+					strings.Join(problems, "; "),
+				)},
+			},
+		)
+	}
+
+	response.WriteErrorResponse(w, http.StatusBadGateway, openai.Error{
+		Message: fmt.Sprintf("The model output did not match the requested schema after %d attempts: %s", e.maxAttempts, strings.Join(problems, "; ")),
+		Type:    response.ErrorTypeServer,
+		Code:    "structured_output_invalid",
+	})
+}
+
+func schemaInstructions(schema *openai.JSONSchema) (string, error) {
+	schemaJSON, err := json.Marshal(schema.Schema)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("You must respond with only a single JSON value which conforms exactly to the following JSON schema. ")
+	b.WriteString("Do not wrap it in markdown or include any other text.\n")
+	if schema.Description != "" {
+		fmt.Fprintf(&b, "Description: %s\n", schema.Description)
+	}
+	fmt.Fprintf(&b, "Schema (%s):\n%s", schema.Name, schemaJSON)
+	return b.String(), nil
+}
+
+// repairAndValidate extracts JSON from the model output, tolerating markdown
+// fences and surrounding prose, and validates it against the schema.
+func repairAndValidate(output string, schema any) (string, []string) {
+	candidate := extractJSON(output)
+	var value any
+	if err := json.Unmarshal([]byte(candidate), &value); err != nil {
+		return output, []string{"output is not valid JSON: " + err.Error()}
+	}
+	if problems := jsonschema.Validate(schema, value); len(problems) > 0 {
+		return output, problems
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(candidate)); err != nil {
+		return candidate, nil
+	}
+	return compact.String(), nil
+}
+
+func extractJSON(output string) string {
+	s := strings.TrimSpace(output)
+	if strings.HasPrefix(s, "```") {
+		s = strings.TrimPrefix(s, "```json")
+		s = strings.TrimPrefix(s, "```")
+		s = strings.TrimSuffix(strings.TrimSpace(s), "```")
+		s = strings.TrimSpace(s)
+	}
+	if json.Valid([]byte(s)) {
+		return s
+	}
+
+	start := strings.IndexAny(s, "{[")
+	if start < 0 {
+		return s
+	}
+	closer := "}"
+	if s[start] == '[' {
+		closer = "]"
+	}
+	end := strings.LastIndex(s, closer)
+	if end <= start {
+		return s
+	}
+	return s[start : end+1]
+}
@@ -0,0 +1,221 @@
+package structured
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger/loggertest"
+)
+
+// scriptedBackend answers each attempt with the next of its outputs, and
+// records the requests it receives
+type scriptedBackend struct {
+	backend.Backend
+	outputs  []string
+	status   int
+	requests []openai.ChatCompletionRequest
+}
+
+func (b *scriptedBackend) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	b.requests = append(b.requests, *req)
+	if b.status != 0 {
+		w.WriteHeader(b.status)
+		w.Write([]byte(`{"error":{"message":"upstream error"}}`))
+		return
+	}
+	output := b.outputs[min(len(b.requests), len(b.outputs))-1]
+	json.NewEncoder(w).Encode(map[string]any{
+		"id":     "chatcmpl-1",
+		"object": "chat.completion",
+		"model":  req.Model,
+		"choices": []map[string]any{{
+			"index":         0,
+			"message":       map[string]any{"role": "assistant", "content": output},
+			"finish_reason": "stop",
+		}},
+	})
+}
+
+func TestHandleChatCompletion(t *testing.T) {
+	var schema any
+	json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {"answer": {"type": "integer"}},
+		"required": ["answer"],
+		"additionalProperties": false
+	}`), &schema)
+	strict, lax := true, false
+	format := func(strict *bool) *openai.ResponseFormat {
+		return &openai.ResponseFormat{
+			Type:       openai.ResponseFormatJSONSchema,
+			JSONSchema: &openai.JSONSchema{Name: "answer", Schema: schema, Strict: strict},
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		format  *openai.ResponseFormat
+		stream  bool
+		outputs []string
+		status  int
+		// wantStatus and wantContent are those of the response, and
+		// wantAttempts the number of requests sent to the backend
+		wantStatus   int
+		wantContent  string
+		wantAttempts int
+		// wantEmulated is whether the requests asked for JSON mode with the
+		// schema in the system prompt
+		wantEmulated bool
+	}{
+		{
+			name:         "no response format",
+			outputs:      []string{"hello"},
+			wantStatus:   http.StatusOK,
+			wantContent:  "hello",
+			wantAttempts: 1,
+		},
+		{
+			name:         "schema without strict",
+			format:       format(&lax),
+			outputs:      []string{"not json"},
+			wantStatus:   http.StatusOK,
+			wantContent:  "not json",
+			wantAttempts: 1,
+		},
+		{
+			name:         "valid",
+			format:       format(&strict),
+			outputs:      []string{`{"answer": 42}`},
+			wantStatus:   http.StatusOK,
+			wantContent:  `{"answer":42}`,
+			wantAttempts: 1,
+			wantEmulated: true,
+		},
+		{
+			name:         "repaired",
+			format:       format(&strict),
+			outputs:      []string{"Here you go:\n```json\n{\"answer\": 42}\n```"},
+			wantStatus:   http.StatusOK,
+			wantContent:  `{"answer":42}`,
+			wantAttempts: 1,
+			wantEmulated: true,
+		},
+		{
+			name:         "retried",
+			format:       format(&strict),
+			outputs:      []string{`{"answer": "forty-two"}`, `{"answer": 42}`},
+			wantStatus:   http.StatusOK,
+			wantContent:  `{"answer":42}`,
+			wantAttempts: 2,
+			wantEmulated: true,
+		},
+		{
+			name:         "attempts exhausted",
+			format:       format(&strict),
+			outputs:      []string{"no JSON here"},
+			wantStatus:   http.StatusBadGateway,
+			wantAttempts: defaultMaxAttempts,
+			wantEmulated: true,
+		},
+		{
+			name:         "backend error",
+			format:       format(&strict),
+			status:       http.StatusTooManyRequests,
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 1,
+			wantEmulated: true,
+		},
+		{
+			name:         "stream",
+			format:       format(&strict),
+			stream:       true,
+			outputs:      []string{"not validated"},
+			wantStatus:   http.StatusOK,
+			wantContent:  "not validated",
+			wantAttempts: 1,
+			wantEmulated: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be := &scriptedBackend{outputs: tc.outputs, status: tc.status}
+			req := &openai.ChatCompletionRequest{
+				Model:          "model",
+				Messages:       []openai.Message{{Role: "user", Content: openai.Content_String{Content: "What is the answer?"}}},
+				Stream:         tc.stream,
+				ResponseFormat: tc.format,
+			}
+			rec := httptest.NewRecorder()
+			New(Options{Backend: be}).HandleChatCompletion(loggertest.Context(), rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), req)
+
+			if rec.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.wantStatus, rec.Body)
+			}
+			if len(be.requests) != tc.wantAttempts {
+				t.Errorf("%d requests sent to the backend, want %d", len(be.requests), tc.wantAttempts)
+			}
+			if tc.wantContent != "" {
+				var resp openai.ChatCompletionResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("invalid response %s: %v", rec.Body, err)
+				}
+				if got := resp.Choices[0].Message.GetContentString(); got != tc.wantContent {
+					t.Errorf("content = %q, want %q", got, tc.wantContent)
+				}
+			}
+
+			for i, sent := range be.requests {
+				emulated := sent.ResponseFormat != nil && sent.ResponseFormat.Type == openai.ResponseFormatJSONObject &&
+					sent.Messages[0].Role == "system" && strings.Contains(sent.Messages[0].GetContentString(), `"answer"`)
+				if emulated != tc.wantEmulated {
+					t.Errorf("request %d emulated = %v, want %v", i, emulated, tc.wantEmulated)
+				}
+				// Each retry shows the model its previous output and mistake
+				if want := 2 + 2*i; tc.wantEmulated && len(sent.Messages) != want {
+					t.Errorf("request %d has %d messages, want %d", i, len(sent.Messages), want)
+				}
+			}
+			if len(req.Messages) != 1 || req.ResponseFormat != tc.format {
+				t.Error("the client's request was modified")
+			}
+		})
+	}
+}
+
+func TestRepairAndValidate(t *testing.T) {
+	schema := map[string]any{
+		"type":     "object",
+		"required": []any{"answer"},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		output    string
+		want      string
+		wantValid bool
+	}{
+		{name: "compacted", output: "{\n  \"answer\": 42\n}", want: `{"answer":42}`, wantValid: true},
+		{name: "fenced", output: "```json\n{\"answer\": 42}\n```", want: `{"answer":42}`, wantValid: true},
+		{name: "bare fence", output: "```\n{\"answer\": 42}\n```", want: `{"answer":42}`, wantValid: true},
+		{name: "surrounded by prose", output: `The answer is {"answer": 42}. Hope that helps!`, want: `{"answer":42}`, wantValid: true},
+		{name: "not JSON", output: "forty-two", want: "forty-two"},
+		{name: "truncated", output: `{"answer": 4`, want: `{"answer": 4`},
+		{name: "schema mismatch", output: `{"result": 42}`, want: `{"result": 42}`},
+		{name: "array instead of object", output: `[{"answer": 42}]`, want: `[{"answer": 42}]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, problems := repairAndValidate(tc.output, schema)
+			if (len(problems) == 0) != tc.wantValid {
+				t.Fatalf("problems = %q, want valid %v", problems, tc.wantValid)
+			}
+			if got != tc.want {
+				t.Errorf("output = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
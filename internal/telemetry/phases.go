@@ -0,0 +1,162 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Phases of a request's lifecycle, in the order they are reached
+const (
+	// PhaseUpstreamStart is when the first upstream request is sent, so
+	// everything before it was spent in the proxy authenticating, parsing and
+	// queueing the request
+	PhaseUpstreamStart = "upstream_start"
+	// PhaseUpstreamConnected is when a connection to the upstream was dialed,
+	// or reused
+	PhaseUpstreamConnected = "upstream_connected"
+	// PhaseUpstreamFirstByte is when the first byte of the upstream's response
+	// was read
+	PhaseUpstreamFirstByte = "upstream_first_byte"
+	// PhaseFirstByte is when the first byte of the response was written to
+	// the client, which is the time to first token of streams
+	PhaseFirstByte = "first_byte"
+	// PhaseLastByte is when the response was complete
+	PhaseLastByte = "last_byte"
+)
+
+type phasesKey struct{}
+
+// Phases records when a request reached each phase of its lifecycle
+type Phases struct {
+	start time.Time
+
+	mu    sync.Mutex
+	marks map[string]time.Duration
+}
+
+// Breakdown is how long a request spent in each part of its lifecycle, in
+// milliseconds. Parts which weren't reached are zero.
+type Breakdown struct {
+	// Proxy is the time until the upstream request was sent
+	Proxy float64 `json:"proxy_ms"`
+	// Connect is the time to dial, or reuse, a connection to the upstream
+	Connect float64 `json:"connect_ms"`
+	// Upstream is the time from connecting until the upstream responded
+	Upstream float64 `json:"upstream_ms"`
+	// FirstByte is the time until the first byte of the response
+	FirstByte float64 `json:"first_byte_ms"`
+	// Stream is the time from the first to the last byte of the response
+	Stream float64 `json:"stream_ms"`
+	// Total is the time until the last byte of the response
+	Total float64 `json:"total_ms"`
+}
+
+// WithPhases starts recording the phases of a request in the context
+func WithPhases(ctx context.Context) (context.Context, *Phases) {
+	phases := &Phases{
+		start: time.Now(),
+		marks: map[string]time.Duration{},
+	}
+	return ContextWithPhases(ctx, phases), phases
+}
+
+// ContextWithPhases adds the phases recorded for a request to the context
+func ContextWithPhases(ctx context.Context, phases *Phases) context.Context {
+	return context.WithValue(ctx, phasesKey{}, phases)
+}
+
+// PhasesFromContext returns the phases recorded for the request, which is nil
+// if they aren't being recorded
+func PhasesFromContext(ctx context.Context) *Phases {
+	phases, _ := ctx.Value(phasesKey{}).(*Phases)
+	return phases
+}
+
+// Mark records that the request reached the phase, unless it already had
+func (p *Phases) Mark(phase string) {
+	if p == nil {
+		return
+	}
+	elapsed := time.Since(p.start)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.marks[phase]; !ok {
+		p.marks[phase] = elapsed
+	}
+}
+
+// Breakdown returns the time spent in each part of the request's lifecycle.
+// If the request hasn't completed, its parts are measured until now.
+func (p *Phases) Breakdown() Breakdown {
+	now := time.Since(p.start)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mark := func(phase string) (time.Duration, bool) {
+		d, ok := p.marks[phase]
+		return d, ok
+	}
+	ms := func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+
+	var b Breakdown
+	end, ok := mark(PhaseLastByte)
+	if !ok {
+		end = now
+	}
+	b.Total = ms(end)
+	if start, ok := mark(PhaseUpstreamStart); ok {
+		b.Proxy = ms(start)
+		if connected, ok := mark(PhaseUpstreamConnected); ok {
+			b.Connect = ms(connected - start)
+			if firstByte, ok := mark(PhaseUpstreamFirstByte); ok {
+				b.Upstream = ms(firstByte - connected)
+			}
+		}
+	}
+	if firstByte, ok := mark(PhaseFirstByte); ok {
+		b.FirstByte = ms(firstByte)
+		b.Stream = ms(end - firstByte)
+	}
+	return b
+}
+
+// Attributes returns the breakdown as span attributes
+func (b Breakdown) Attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Float64("phase.proxy_ms", b.Proxy),
+		attribute.Float64("phase.connect_ms", b.Connect),
+		attribute.Float64("phase.upstream_ms", b.Upstream),
+		attribute.Float64("phase.first_byte_ms", b.FirstByte),
+		attribute.Float64("phase.stream_ms", b.Stream),
+		attribute.Float64("phase.total_ms", b.Total),
+	}
+}
+
+// phasesTransport marks the upstream phases of the request being served
+type phasesTransport struct {
+	http.RoundTripper
+}
+
+func (t phasesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	phases := PhasesFromContext(req.Context())
+	if phases == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	phases.Mark(PhaseUpstreamStart)
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			phases.Mark(PhaseUpstreamConnected)
+		},
+		GotFirstResponseByte: func() {
+			phases.Mark(PhaseUpstreamFirstByte)
+		},
+	})
+	return t.RoundTripper.RoundTrip(req.WithContext(ctx))
+}
@@ -0,0 +1,85 @@
+package telemetry
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const defaultServiceName = "cursor-deepseek"
+
+// Options configures tracing
+type Options struct {
+	// Endpoint is the URL of the OTLP/HTTP collector spans are exported to,
+	// such as http://localhost:4318. Tracing is disabled if it is empty, but
+	// the W3C trace context of requests is still propagated upstream.
+	Endpoint    string
+	ServiceName string
+	// SampleRatio is the share of new traces which are sampled, from 0 to 1.
+	// Traces started by clients follow the client's sampling decision.
+	SampleRatio float64
+}
+
+// Setup installs the global W3C trace context propagator and, if an endpoint
+// is configured, a tracer provider exporting spans to it. The returned
+// function flushes and stops the exporter.
+func Setup(ctx context.Context, opts Options) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating OTLP exporter")
+	}
+
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	ratio := opts.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Handler starts a server span for every request, continuing the trace of the
+// request's traceparent header if it has one
+func Handler(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "proxy",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}),
+	)
+}
+
+// Transport starts a client span for every upstream request sent with rt,
+// propagates the trace to the upstream in the traceparent header, and marks
+// the upstream phases of the request being served
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(phasesTransport{rt})
+}
@@ -0,0 +1,124 @@
+// Package tiers restricts the models clients may request, and caps the tokens
+// they may generate, by the tier they belong to, such as free or priority
+package tiers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+)
+
+var _ backend.Backend = &Enforcer{}
+
+// Tier restricts the requests of the clients belonging to it
+type Tier struct {
+	// Models restricts the models the clients may request and list
+	Models backend.ModelFilter
+	// MaxTokens, if set, caps the tokens generated for each request, those
+	// which set no limit included
+	MaxTokens int
+	// Priority, if set, is the priority class of the requests, by which they
+	// are queued for backends with concurrency limits
+	Priority string
+}
+
+// Enforcer is a backend which enforces the tier of the client of each request
+// before passing it to the backend it wraps. The requests of clients without
+// a configured tier are passed on as they are.
+type Enforcer struct {
+	backend.Backend
+	tiers atomic.Pointer[map[string]Tier]
+
+	rejected atomic.Int64
+	capped   atomic.Int64
+}
+
+// New creates an Enforcer of the tiers, by name
+func New(be backend.Backend, tiers map[string]Tier) *Enforcer {
+	e := &Enforcer{Backend: be}
+	e.Set(tiers)
+	return e
+}
+
+// Set replaces the tiers, such as when the config is reloaded
+func (e *Enforcer) Set(tiers map[string]Tier) {
+	e.tiers.Store(&tiers)
+}
+
+// tier returns the tier of the client of the request, if it is configured
+func (e *Enforcer) tier(ctx context.Context) (Tier, bool) {
+	tier, ok := (*e.tiers.Load())[contextutils.GetTier(ctx)]
+	return tier, ok
+}
+
+// HandleChatCompletion rejects the models the client's tier doesn't allow,
+// and caps the tokens and sets the priority of the request, before passing it
+// on
+func (e *Enforcer) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	tier, ok := e.tier(ctx)
+	if !ok {
+		e.Backend.HandleChatCompletion(ctx, w, r, req)
+		return
+	}
+
+	lgr := logutils.FromContext(ctx)
+	if tier.Priority != "" {
+		ctx = contextutils.WithPriority(ctx, tier.Priority)
+	}
+	if !tier.Models.Allowed(req.Model) {
+		e.rejected.Add(1)
+		lgr.Infof(ctx, "Rejecting request for model %s, which tier %s doesn't allow", req.Model, contextutils.GetTier(ctx))
+		backend.WriteModelNotFound(w, req.Model)
+		contextutils.ReportTokens(ctx, 0)
+		return
+	}
+	if tier.MaxTokens > 0 {
+		if limit := req.CompletionTokenLimit(); limit == nil || *limit > tier.MaxTokens {
+			lgr.Debugf(ctx, "Capping the tokens of the request at %d for tier %s", tier.MaxTokens, contextutils.GetTier(ctx))
+			e.capped.Add(1)
+			maxTokens := tier.MaxTokens
+			req.MaxTokens, req.MaxCompletionTokens = &maxTokens, nil
+		}
+	}
+	e.Backend.HandleChatCompletion(ctx, w, r, req)
+}
+
+// ListModels returns the models of the wrapped backend which the client's
+// tier allows
+func (e *Enforcer) ListModels(ctx context.Context) ([]openai.Model, error) {
+	models, err := e.Backend.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tier, ok := e.tier(ctx); ok {
+		models = tier.Models.FilterModels(models)
+	}
+	return models, nil
+}
+
+// Stats describes the requests the tiers rejected or capped
+type Stats struct {
+	Tiers    int   `json:"tiers"`
+	Rejected int64 `json:"rejected"`
+	Capped   int64 `json:"capped"`
+	Backend  any   `json:"backend,omitempty"`
+}
+
+// Stats returns the requests rejected and capped along with the statistics
+// of the wrapped backend, if any
+func (e *Enforcer) Stats() any {
+	stats := Stats{
+		Tiers:    len(*e.tiers.Load()),
+		Rejected: e.rejected.Load(),
+		Capped:   e.capped.Load(),
+	}
+	if provider, ok := e.Backend.(backend.StatsProvider); ok {
+		stats.Backend = provider.Stats()
+	}
+	return stats
+}
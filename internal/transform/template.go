@@ -0,0 +1,70 @@
+package transform
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+)
+
+// placeholder matches the {{name}} placeholders of templates
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// Built-in template variables, which the variables configured can't replace
+const (
+	// VarDate is the current date, such as 2025-01-31
+	VarDate = "date"
+	// VarTime is the current time in RFC 3339 format
+	VarTime = "time"
+	// VarBackend is the name of the backend serving the request
+	VarBackend = "backend"
+	// VarModel is the model requested by the client
+	VarModel = "model"
+	// VarClient is the name of the client, if it authenticated with a named
+	// key or a JWT
+	VarClient = "client"
+)
+
+// variables returns the values of the template variables for a request
+func (t *Transformer) variables(ctx context.Context, req *openai.ChatCompletionRequest) map[string]string {
+	now := time.Now()
+	vars := make(map[string]string, len(t.vars)+5)
+	for name, value := range t.vars {
+		vars[name] = value
+	}
+	vars[VarDate] = now.Format(time.DateOnly)
+	vars[VarTime] = now.Format(time.RFC3339)
+	vars[VarBackend] = t.Backend.Name()
+	vars[VarModel] = req.Model
+	vars[VarClient] = contextutils.GetClient(ctx)
+	return vars
+}
+
+// expand replaces the placeholders of the variables in text by their
+// values. Names are matched case-insensitively, and placeholders of unknown
+// variables are left as they are.
+func expand(text string, vars map[string]string) string {
+	if !strings.Contains(text, "{{") {
+		return text
+	}
+	return placeholder.ReplaceAllStringFunc(text, func(match string) string {
+		name := placeholder.FindStringSubmatch(match)[1]
+		if value, ok := vars[strings.ToLower(name)]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// expandReplacement expands a rule's replacement, escaping the values so
+// that they aren't read as references to submatches
+func expandReplacement(replacement string, vars map[string]string) string {
+	escaped := make(map[string]string, len(vars))
+	for name, value := range vars {
+		escaped[name] = strings.ReplaceAll(value, "$", "$$")
+	}
+	return expand(replacement, escaped)
+}
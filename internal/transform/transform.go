@@ -0,0 +1,187 @@
+// Package transform rewrites chat completion requests before they are
+// converted for the backend, such as to enforce organization-wide system
+// instructions.
+package transform
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+// Rule actions
+const (
+	ActionRewrite = "rewrite"
+	ActionDrop    = "drop"
+)
+
+var _ backend.Backend = &Transformer{}
+
+// SystemRule rewrites or drops the client's system prompts which match it
+type SystemRule struct {
+	// Pattern is a regular expression
+	Pattern string
+	// Action is ActionRewrite, the default, or ActionDrop
+	Action string
+	// Replacement replaces the matches of rewrite rules, and may refer to
+	// their submatches as $1
+	Replacement string
+}
+
+// Options configures a Transformer
+type Options struct {
+	Backend backend.Backend
+	// SystemPrepend and SystemAppend are system instructions sent before and
+	// after the client's system prompts
+	SystemPrepend string
+	SystemAppend  string
+	// SystemRules are applied in order to the client's system prompts
+	SystemRules []SystemRule
+	// Variables are expanded, along with the built-in variables, in the
+	// {{name}} placeholders of the instructions and replacements
+	Variables map[string]string
+}
+
+type systemRule struct {
+	re          *regexp.Regexp
+	drop        bool
+	replacement string
+}
+
+// Transformer is a backend which rewrites the requests of the backend it
+// wraps. The client's system prompts are rewritten or dropped by the rules
+// they match, and the organization's instructions are added around them.
+type Transformer struct {
+	backend.Backend
+	prepend string
+	append  string
+	rules   []systemRule
+	vars    map[string]string
+}
+
+// New compiles the rules of a Transformer
+func New(opts Options) (*Transformer, error) {
+	t := &Transformer{
+		Backend: opts.Backend,
+		prepend: opts.SystemPrepend,
+		append:  opts.SystemAppend,
+		vars:    make(map[string]string, len(opts.Variables)),
+	}
+	for name, value := range opts.Variables {
+		t.vars[strings.ToLower(name)] = value
+	}
+	for i, r := range opts.SystemRules {
+		if r.Pattern == "" {
+			return nil, errors.Errorf("system prompt rule %d requires a pattern", i)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid system prompt rule %d", i)
+		}
+		compiled := systemRule{re: re, replacement: r.Replacement}
+		switch r.Action {
+		case "", ActionRewrite:
+		case ActionDrop:
+			compiled.drop = true
+		default:
+			return nil, errors.Errorf("system prompt rule %d has unknown action %q", i, r.Action)
+		}
+		t.rules = append(t.rules, compiled)
+	}
+	return t, nil
+}
+
+// Stats returns the statistics of the wrapped backend, if any
+func (t *Transformer) Stats() any {
+	if provider, ok := t.Backend.(backend.StatsProvider); ok {
+		return provider.Stats()
+	}
+	return nil
+}
+
+// HandleChatCompletion transforms the request before forwarding it
+func (t *Transformer) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+	vars := t.variables(ctx, req)
+
+	transformed := *req
+	transformed.Messages = make([]openai.Message, 0, len(req.Messages)+2)
+	for i, msg := range req.Messages {
+		if openai.NormalizeRole(msg.Role) != openai.RoleSystem || len(t.rules) == 0 {
+			transformed.Messages = append(transformed.Messages, msg)
+			continue
+		}
+		msg, keep := t.rewrite(msg, vars)
+		if !keep {
+			lgr.Debugf(ctx, "Dropping system prompt %d, which matches a system prompt rule", i)
+			continue
+		}
+		transformed.Messages = append(transformed.Messages, msg)
+	}
+	transformed.Messages = t.inject(transformed.Messages, vars)
+	t.Backend.HandleChatCompletion(ctx, w, r, &transformed)
+}
+
+// rewrite applies the rules to a system prompt, returning false if it is
+// dropped by a rule or left empty
+func (t *Transformer) rewrite(msg openai.Message, vars map[string]string) (openai.Message, bool) {
+	apply := func(text string) (string, bool) {
+		for _, rule := range t.rules {
+			if !rule.re.MatchString(text) {
+				continue
+			}
+			if rule.drop {
+				return "", false
+			}
+			text = rule.re.ReplaceAllString(text, expandReplacement(rule.replacement, vars))
+		}
+		return text, strings.TrimSpace(text) != ""
+	}
+
+	switch content := msg.Content.(type) {
+	case openai.Content_String:
+		text, keep := apply(content.Content)
+		msg.Content = openai.Content_String{Content: text}
+		return msg, keep
+	case openai.Content_Array:
+		parts := make(openai.Content_Array, 0, len(content))
+		for _, part := range content {
+			if text, ok := part.(openai.ContentPart_Text); ok {
+				var keep bool
+				if text.Text, keep = apply(text.Text); !keep {
+					continue
+				}
+				part = text
+			}
+			parts = append(parts, part)
+		}
+		msg.Content = parts
+		return msg, len(parts) > 0
+	}
+	return msg, true
+}
+
+// inject adds the organization's instructions before the leading system
+// prompts and after them
+func (t *Transformer) inject(messages []openai.Message, vars map[string]string) []openai.Message {
+	system := func(text string) openai.Message {
+		return openai.Message{Role: openai.RoleSystem, Content: openai.Content_String{Content: expand(text, vars)}}
+	}
+	if t.append != "" {
+		end := 0
+		for end < len(messages) && openai.NormalizeRole(messages[end].Role) == openai.RoleSystem {
+			end++
+		}
+		messages = append(messages[:end], append([]openai.Message{system(t.append)}, messages[end:]...)...)
+	}
+	if t.prepend != "" {
+		messages = append([]openai.Message{system(t.prepend)}, messages...)
+	}
+	return messages
+}
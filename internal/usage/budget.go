@@ -0,0 +1,175 @@
+package usage
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/store"
+	"github.com/pkg/errors"
+)
+
+// Budget periods
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// Budget limits the usage of a client API key over a period. Once either
+// limit is reached, requests are rejected until the next period.
+type Budget struct {
+	// APIKey is the client API key the budget applies to. Budgets without one,
+	// or a Client, apply to each API key separately.
+	APIKey string
+	// Client is the name of the client the budget applies to
+	Client string
+	// Period is PeriodDaily or PeriodMonthly, in UTC
+	Period string
+	// MaxTokens limits the prompt and completion tokens, if set
+	MaxTokens int
+	// MaxCost limits the cost in USD, if set
+	MaxCost float64
+	// AlertThresholds are the fractions of the budget, such as 0.8, at which
+	// an alert is raised
+	AlertThresholds []float64
+}
+
+// Alert is raised when the usage of an API key crosses a threshold of its
+// budget
+type Alert struct {
+	APIKey    string
+	Budget    Budget
+	Threshold float64
+	Tokens    int
+	Cost      float64
+}
+
+// budgetStatus is the usage of an API key against a budget in its current
+// period
+type budgetStatus struct {
+	Budget
+	tokens int
+	cost   float64
+}
+
+// fraction returns the share of the budget used, by whichever limit is
+// closest to being reached
+func (s budgetStatus) fraction(tokens int, cost float64) float64 {
+	var fraction float64
+	if s.MaxTokens > 0 {
+		fraction = float64(tokens) / float64(s.MaxTokens)
+	}
+	if s.MaxCost > 0 {
+		fraction = max(fraction, cost/s.MaxCost)
+	}
+	return fraction
+}
+
+func (s budgetStatus) exceeded() bool {
+	return s.fraction(s.tokens, s.cost) >= 1
+}
+
+// alerts returns the alerts for the thresholds crossed by adding the usage
+// of an entry
+func (s budgetStatus) alerts(apiKey string, tokens int, cost float64) []Alert {
+	before := s.fraction(s.tokens, s.cost)
+	after := s.fraction(s.tokens+tokens, s.cost+cost)
+	var alerts []Alert
+	for _, threshold := range s.AlertThresholds {
+		if before < threshold && after >= threshold {
+			alerts = append(alerts, Alert{
+				APIKey:    apiKey,
+				Budget:    s.Budget,
+				Threshold: threshold,
+				Tokens:    s.tokens + tokens,
+				Cost:      s.cost + cost,
+			})
+		}
+	}
+	return alerts
+}
+
+// budgets returns the status of the budgets which apply to the client or masked
+// API key
+func (t *Tracker) budgets(ctx context.Context, apiKey string, now time.Time) ([]budgetStatus, error) {
+	var statuses []budgetStatus
+	for _, budget := range t.budgetList {
+		if budget.APIKey != "" && logger.MaskSecret(budget.APIKey) != apiKey {
+			continue
+		}
+		if budget.Client != "" && budget.Client != apiKey {
+			continue
+		}
+		tokens, cost, err := t.spent(ctx, apiKey, budget.Period, periodStart(budget.Period, now))
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, budgetStatus{
+			Budget: budget,
+			tokens: tokens,
+			cost:   cost,
+		})
+	}
+	return statuses, nil
+}
+
+// spent sums the usage of the masked API key in the budget period starting on
+// the day
+func (t *Tracker) spent(ctx context.Context, apiKey, period, since string) (int, float64, error) {
+	if t.store != nil {
+		key := counterKey(apiKey, period, since)
+		tokens, err := store.Counter(ctx, t.store, key+":tokens")
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "error reading budget usage")
+		}
+		cost, err := store.Counter(ctx, t.store, key+":cost")
+		return int(tokens), cost, errors.Wrap(err, "error reading budget usage")
+	}
+
+	var tokens int
+	var cost float64
+	err := t.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(prompt_tokens + completion_tokens), 0), COALESCE(SUM(cost), 0)
+		FROM usage WHERE api_key = ? AND day >= ?`,
+		apiKey, since,
+	).Scan(&tokens, &cost)
+	return tokens, cost, errors.Wrap(err, "error reading budget usage")
+}
+
+// count adds the usage of an entry to the counters of its budget periods in
+// the store, if any
+func (t *Tracker) count(ctx context.Context, entry Entry) error {
+	if t.store == nil || len(t.budgetList) == 0 {
+		return nil
+	}
+	periods := map[string]time.Duration{
+		PeriodDaily:   48 * time.Hour,
+		PeriodMonthly: 32 * 24 * time.Hour,
+	}
+	for period, ttl := range periods {
+		key := counterKey(entry.APIKey, period, periodStart(period, entry.Time))
+		if _, err := t.store.Add(ctx, key+":tokens", float64(entry.PromptTokens+entry.CompletionTokens), ttl); err != nil {
+			return errors.Wrap(err, "error counting budget usage")
+		}
+		if _, err := t.store.Add(ctx, key+":cost", t.Cost(entry), ttl); err != nil {
+			return errors.Wrap(err, "error counting budget usage")
+		}
+	}
+	return nil
+}
+
+// counterKey is the key of the store's counters of the usage of the masked
+// API key in the budget period starting on the day
+func counterKey(apiKey, period, since string) string {
+	return "usage:" + strings.ToLower(period) + ":" + since + ":" + apiKey
+}
+
+// periodStart returns the first day of the budget period containing now
+func periodStart(period string, now time.Time) string {
+	now = now.UTC()
+	if strings.EqualFold(period, PeriodMonthly) {
+		now = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return now.Format(dayFormat)
+}
@@ -0,0 +1,288 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	contextutils "github.com/danilofalcao/cursor-deepseek/internal/utils/context"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/utils/response"
+)
+
+// maxBodySize caps how much of a non-streaming response is buffered to read
+// its usage
+const maxBodySize = 10 << 20
+
+var _ backend.Backend = &Meter{}
+
+// Meter is a backend which records the usage of every chat completion served
+// by the backend it wraps
+type Meter struct {
+	backend.Backend
+	tracker *Tracker
+}
+
+// NewMeter creates a Meter recording to tracker
+func NewMeter(be backend.Backend, tracker *Tracker) *Meter {
+	return &Meter{
+		Backend: be,
+		tracker: tracker,
+	}
+}
+
+// Stats returns the statistics of the wrapped backend, if any
+func (m *Meter) Stats() any {
+	if provider, ok := m.Backend.(backend.StatsProvider); ok {
+		return provider.Stats()
+	}
+	return nil
+}
+
+// HandleChatCompletion serves the request with the wrapped backend, reading
+// the usage reported in its response. Streams which don't report usage have
+// their tokens estimated.
+func (m *Meter) HandleChatCompletion(ctx context.Context, w http.ResponseWriter, r *http.Request, req *openai.ChatCompletionRequest) {
+	lgr := logutils.FromContext(ctx)
+	start := time.Now()
+	key := apiKey(ctx, r)
+
+	// Reject clients which have exhausted their budget. Budgets are not
+	// enforced if their usage can't be read.
+	budgets, err := m.tracker.budgets(ctx, key, start)
+	if err != nil {
+		lgr.Error(ctx, err.Error())
+	}
+	for _, budget := range budgets {
+		if budget.exceeded() {
+			lgr.Warnf(ctx, "Rejecting request of %s, which has exhausted its %s budget", key, budget.Period)
+			response.WriteErrorResponse(w, http.StatusTooManyRequests, openai.Error{
+				Message: fmt.Sprintf("The %s budget of this API key is exhausted", budget.Period),
+				Type:    "insufficient_quota",
+				Code:    "budget_exceeded",
+			})
+			contextutils.ReportTokens(ctx, 0)
+			return
+		}
+	}
+
+	promptTokens := estimatePrompt(req)
+	uw := &usageWriter{ResponseWriter: w, status: http.StatusOK}
+	m.Backend.HandleChatCompletion(ctx, uw, r, req)
+	uw.finish()
+
+	if uw.status >= http.StatusBadRequest {
+		// Failed completions don't count towards rate limits
+		contextutils.ReportTokens(ctx, 0)
+		return
+	}
+	entry := Entry{
+		Time:   start,
+		APIKey: key,
+		Tier:   contextutils.GetTier(ctx),
+		// Backends map the model of the request in place, so it is now the
+		// upstream model the request was priced by
+		Model: req.Model,
+	}
+	if uw.usage != nil {
+		entry.PromptTokens = uw.usage.PromptTokens
+		entry.CompletionTokens = uw.usage.CompletionTokens
+		entry.UpstreamCost = uw.usage.Cost
+	} else {
+		entry.PromptTokens = promptTokens
+		entry.CompletionTokens = estimateTokens(uw.streamed.String())
+		entry.Estimated = true
+	}
+
+	contextutils.ReportTokens(ctx, entry.PromptTokens+entry.CompletionTokens)
+
+	cost := m.tracker.Cost(entry)
+	usageLgr := lgr.With(
+		"model", entry.Model,
+		"prompt_tokens", entry.PromptTokens,
+		"completion_tokens", entry.CompletionTokens,
+		"cost", cost,
+	)
+	// Reasoning tokens are counted, and priced, as completion tokens
+	if uw.usage != nil && uw.usage.ReasoningTokens() > 0 {
+		usageLgr = usageLgr.With("reasoning_tokens", uw.usage.ReasoningTokens())
+	}
+	usageLgr.Infof(ctx, "Usage: %d prompt and %d completion tokens of %s costing $%.6f",
+		entry.PromptTokens, entry.CompletionTokens, entry.Model, cost)
+	if err := m.tracker.Record(context.WithoutCancel(ctx), entry); err != nil {
+		lgr.Error(ctx, err.Error())
+	}
+
+	for _, budget := range budgets {
+		for _, alert := range budget.alerts(key, entry.PromptTokens+entry.CompletionTokens, cost) {
+			lgr.Warnf(ctx, "%s has used %.0f%% of its %s budget: %d tokens costing $%.2f",
+				key, alert.Threshold*100, budget.Period, alert.Tokens, alert.Cost)
+			if m.tracker.onAlert != nil {
+				m.tracker.onAlert(context.WithoutCancel(ctx), alert)
+			}
+		}
+	}
+}
+
+// apiKey returns the name of the client which authenticated, or else the
+// masked API key it authenticated with
+func apiKey(ctx context.Context, r *http.Request) string {
+	if client := contextutils.GetClient(ctx); client != "" {
+		return client
+	}
+	if r == nil {
+		return ""
+	}
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		key = r.Header.Get("X-Api-Key")
+	}
+	if key == "" {
+		return ""
+	}
+	return logger.MaskSecret(key)
+}
+
+// usageWriter reads the usage and content of a response as it is written,
+// both from JSON bodies and from server-sent event streams
+type usageWriter struct {
+	http.ResponseWriter
+	status        int
+	headerWritten bool
+
+	stream  *bool
+	pending []byte
+	usage   *openai.Usage
+	// streamed is the text of a streamed response, for estimating its tokens
+	streamed strings.Builder
+}
+
+// usageEvent holds the fields of responses and stream chunks which are read
+type usageEvent struct {
+	Usage   *openai.Usage `json:"usage"`
+	Choices []struct {
+		Delta struct {
+			Content          any    `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+func (u *usageWriter) WriteHeader(status int) {
+	if !u.headerWritten {
+		u.status = status
+		u.headerWritten = true
+	}
+	u.ResponseWriter.WriteHeader(status)
+}
+
+func (u *usageWriter) Write(b []byte) (int, error) {
+	u.headerWritten = true
+	if u.stream == nil {
+		mediaType, _, _ := mime.ParseMediaType(u.Header().Get("Content-Type"))
+		stream := mediaType == "text/event-stream"
+		u.stream = &stream
+	}
+
+	if *u.stream {
+		u.pending = append(u.pending, b...)
+		for {
+			line, rest, ok := bytes.Cut(u.pending, []byte("\n"))
+			if !ok {
+				break
+			}
+			u.readLine(line)
+			u.pending = rest
+		}
+	} else if len(u.pending)+len(b) <= maxBodySize {
+		u.pending = append(u.pending, b...)
+	}
+	return u.ResponseWriter.Write(b)
+}
+
+func (u *usageWriter) Flush() {
+	if flusher, ok := u.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (u *usageWriter) Unwrap() http.ResponseWriter {
+	return u.ResponseWriter
+}
+
+// finish reads the usage of a non-streaming response once it is complete
+func (u *usageWriter) finish() {
+	if u.stream != nil && *u.stream {
+		u.readLine(u.pending)
+		return
+	}
+	var event usageEvent
+	if json.Unmarshal(u.pending, &event) == nil {
+		u.usage = event.Usage
+	}
+}
+
+// readLine reads a data line of a stream
+func (u *usageWriter) readLine(line []byte) {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	var event usageEvent
+	if json.Unmarshal(bytes.TrimSpace(data), &event) != nil {
+		return
+	}
+	if event.Usage != nil {
+		u.usage = event.Usage
+	}
+	for _, choice := range event.Choices {
+		if content, ok := choice.Delta.Content.(string); ok {
+			u.streamed.WriteString(content)
+		}
+		u.streamed.WriteString(choice.Delta.ReasoningContent)
+		for _, tc := range choice.Delta.ToolCalls {
+			u.streamed.WriteString(tc.Function.Name)
+			u.streamed.WriteString(tc.Function.Arguments)
+		}
+	}
+}
+
+// estimatePrompt estimates the tokens of a request's messages
+func estimatePrompt(req *openai.ChatCompletionRequest) int {
+	var text strings.Builder
+	for _, msg := range req.Messages {
+		text.WriteString(msg.Role)
+		text.WriteString(msg.GetContentString())
+		for _, part := range msg.GetContentArray() {
+			if p, ok := part.(openai.ContentPart_Text); ok {
+				text.WriteString(p.Text)
+			}
+		}
+		for _, tc := range msg.ToolCalls {
+			text.WriteString(tc.Function.Name)
+			text.WriteString(tc.Function.Arguments)
+		}
+	}
+	return estimateTokens(text.String())
+}
+
+// estimateTokens estimates the tokens of text at four characters per token,
+// which is typical of the tokenizers of English text and code
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
@@ -0,0 +1,305 @@
+// Package usage accounts for the tokens used by each request, prices them with
+// a per-model pricing table, and persists daily aggregates per API key and
+// model to SQLite
+package usage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/store"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// dayFormat is how days are stored, which sorts in time order
+const dayFormat = "2006-01-02"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS usage (
+	day                TEXT    NOT NULL,
+	api_key            TEXT    NOT NULL,
+	tier               TEXT    NOT NULL DEFAULT '',
+	model              TEXT    NOT NULL,
+	requests           INTEGER NOT NULL,
+	estimated_requests INTEGER NOT NULL,
+	prompt_tokens      INTEGER NOT NULL,
+	completion_tokens  INTEGER NOT NULL,
+	cost               REAL    NOT NULL,
+	PRIMARY KEY (day, api_key, model)
+)`
+
+// columns are the columns added to the usage table since it was created, which
+// databases created before them are migrated to
+var columns = map[string]string{
+	"tier": "TEXT NOT NULL DEFAULT ''",
+}
+
+// Price is the cost of a model's tokens in USD per million tokens
+type Price struct {
+	Prompt     float64
+	Completion float64
+}
+
+// Cost returns the cost in USD of the tokens
+func (p Price) Cost(promptTokens, completionTokens int) float64 {
+	return (float64(promptTokens)*p.Prompt + float64(completionTokens)*p.Completion) / 1e6
+}
+
+// Options configures a Tracker
+type Options struct {
+	// Path is the SQLite database aggregates are persisted to
+	Path string
+	// Pricing maps upstream model names to their price. Models without a
+	// price are accounted at no cost.
+	Pricing map[string]Price
+	// Budgets limit the usage of client API keys
+	Budgets []Budget
+	// OnAlert, if set, is called when the usage of an API key crosses an
+	// alert threshold of its budget
+	OnAlert func(context.Context, Alert)
+	// Store, if set, counts the usage budgets are enforced by instead of the
+	// database, so replicas of the proxy share it
+	Store store.Store
+}
+
+// Entry is the usage of a single request
+type Entry struct {
+	Time time.Time
+	// APIKey identifies the client by its name, if it authenticated with a
+	// named API key, or else by its masked API key
+	APIKey string
+	// Tier is the tier of the client, if it belongs to one
+	Tier             string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	// Estimated is whether the upstream didn't report usage, so the tokens
+	// were estimated from the text of the request and response
+	Estimated bool
+	// UpstreamCost is what the upstream charged for the request, if it
+	// reported it, which is recorded instead of the pricing's cost
+	UpstreamCost *float64
+}
+
+// Aggregate is the usage of an API key and model on a day, along with the
+// tier the API key's client last belonged to that day
+type Aggregate struct {
+	Day               string  `json:"day"`
+	APIKey            string  `json:"api_key"`
+	Tier              string  `json:"tier,omitempty"`
+	Model             string  `json:"model"`
+	Requests          int     `json:"requests"`
+	EstimatedRequests int     `json:"estimated_requests"`
+	PromptTokens      int     `json:"prompt_tokens"`
+	CompletionTokens  int     `json:"completion_tokens"`
+	Cost              float64 `json:"cost"`
+}
+
+// Filter selects aggregates. Empty fields match everything.
+type Filter struct {
+	// From and To are inclusive days formatted as 2006-01-02
+	From   string
+	To     string
+	APIKey string
+	Tier   string
+	Model  string
+}
+
+// Tracker records the usage of requests
+type Tracker struct {
+	db         *sql.DB
+	pricing    map[string]Price
+	budgetList []Budget
+	onAlert    func(context.Context, Alert)
+	store      store.Store
+}
+
+// New opens the usage database, creating it if needed
+func New(opts Options) (*Tracker, error) {
+	for _, budget := range opts.Budgets {
+		if !strings.EqualFold(budget.Period, PeriodDaily) && !strings.EqualFold(budget.Period, PeriodMonthly) {
+			return nil, errors.Errorf("invalid budget period %q, must be daily or monthly", budget.Period)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0o755); err != nil {
+		return nil, errors.Wrap(err, "error creating usage database directory")
+	}
+	db, err := sql.Open("sqlite", opts.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening usage database")
+	}
+	// SQLite only supports a single writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error creating usage table")
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Tracker{
+		db:         db,
+		pricing:    opts.Pricing,
+		budgetList: opts.Budgets,
+		onAlert:    opts.OnAlert,
+		store:      opts.Store,
+	}, nil
+}
+
+// migrate adds the columns the usage table lacks
+func migrate(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('usage')`)
+	if err != nil {
+		return errors.Wrap(err, "error reading usage table")
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "error reading usage table")
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error reading usage table")
+	}
+
+	for column, definition := range columns {
+		if existing[column] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE usage ADD COLUMN %s %s", column, definition)); err != nil {
+			return errors.Wrapf(err, "error adding column %s to usage table", column)
+		}
+	}
+	return nil
+}
+
+// Close closes the usage database
+func (t *Tracker) Close() error {
+	return t.db.Close()
+}
+
+// Cost returns the cost in USD of an entry, as the upstream reported it or
+// else priced by its tokens
+func (t *Tracker) Cost(entry Entry) float64 {
+	if entry.UpstreamCost != nil {
+		return *entry.UpstreamCost
+	}
+	return t.pricing[entry.Model].Cost(entry.PromptTokens, entry.CompletionTokens)
+}
+
+// Record adds an entry to the aggregates of its day, API key and model
+func (t *Tracker) Record(ctx context.Context, entry Entry) error {
+	estimated := 0
+	if entry.Estimated {
+		estimated = 1
+	}
+	_, err := t.db.ExecContext(ctx, `
+		INSERT INTO usage (day, api_key, tier, model, requests, estimated_requests, prompt_tokens, completion_tokens, cost)
+		VALUES (?, ?, ?, ?, 1, ?, ?, ?, ?)
+		ON CONFLICT (day, api_key, model) DO UPDATE SET
+			tier = excluded.tier,
+			requests = requests + 1,
+			estimated_requests = estimated_requests + excluded.estimated_requests,
+			prompt_tokens = prompt_tokens + excluded.prompt_tokens,
+			completion_tokens = completion_tokens + excluded.completion_tokens,
+			cost = cost + excluded.cost`,
+		entry.Time.UTC().Format(dayFormat),
+		entry.APIKey,
+		entry.Tier,
+		entry.Model,
+		estimated,
+		entry.PromptTokens,
+		entry.CompletionTokens,
+		t.Cost(entry),
+	)
+	if err != nil {
+		return errors.Wrap(err, "error recording usage")
+	}
+	return t.count(ctx, entry)
+}
+
+// Aggregates returns the aggregates matching the filter, by day and then by
+// API key and model
+func (t *Tracker) Aggregates(ctx context.Context, filter Filter) ([]Aggregate, error) {
+	query := `SELECT day, api_key, tier, model, requests, estimated_requests, prompt_tokens, completion_tokens, cost
+		FROM usage WHERE 1 = 1`
+	var args []any
+	if filter.From != "" {
+		query += " AND day >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.To != "" {
+		query += " AND day <= ?"
+		args = append(args, filter.To)
+	}
+	if filter.APIKey != "" {
+		query += " AND api_key = ?"
+		args = append(args, filter.APIKey)
+	}
+	if filter.Tier != "" {
+		query += " AND tier = ?"
+		args = append(args, filter.Tier)
+	}
+	if filter.Model != "" {
+		query += " AND model = ?"
+		args = append(args, filter.Model)
+	}
+	query += " ORDER BY day, api_key, model"
+
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying usage")
+	}
+	defer rows.Close()
+
+	aggregates := []Aggregate{}
+	for rows.Next() {
+		var a Aggregate
+		if err := rows.Scan(&a.Day, &a.APIKey, &a.Tier, &a.Model, &a.Requests, &a.EstimatedRequests,
+			&a.PromptTokens, &a.CompletionTokens, &a.Cost); err != nil {
+			return nil, errors.Wrap(err, "error reading usage")
+		}
+		aggregates = append(aggregates, a)
+	}
+	return aggregates, errors.Wrap(rows.Err(), "error reading usage")
+}
+
+// Total sums aggregates, leaving the fields they differ in empty
+func Total(aggregates []Aggregate) Aggregate {
+	var total Aggregate
+	for i, a := range aggregates {
+		if i == 0 {
+			total.Day, total.APIKey, total.Tier, total.Model = a.Day, a.APIKey, a.Tier, a.Model
+		}
+		if total.Day != a.Day {
+			total.Day = ""
+		}
+		if total.APIKey != a.APIKey {
+			total.APIKey = ""
+		}
+		if total.Tier != a.Tier {
+			total.Tier = ""
+		}
+		if total.Model != a.Model {
+			total.Model = ""
+		}
+		total.Requests += a.Requests
+		total.EstimatedRequests += a.EstimatedRequests
+		total.PromptTokens += a.PromptTokens
+		total.CompletionTokens += a.CompletionTokens
+		total.Cost += a.Cost
+	}
+	return total
+}
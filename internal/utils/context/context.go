@@ -18,3 +18,94 @@ func GetRequestID(ctx context.Context) string {
 func WithRequestID(ctx context.Context, requestID string) context.Context {
 	return context.WithValue(ctx, constants.RequestIDKey, requestID)
 }
+
+// GetModelOverride retrieves the upstream model override from the context
+func GetModelOverride(ctx context.Context) string {
+	if model, ok := ctx.Value(constants.ModelOverrideKey).(string); ok {
+		return model
+	}
+	return ""
+}
+
+// WithModelOverride adds an upstream model override to the context. Backends
+// use it in place of their configured model mapping.
+func WithModelOverride(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, constants.ModelOverrideKey, model)
+}
+
+// GetDefaultModel retrieves the default model override from the context
+func GetDefaultModel(ctx context.Context) string {
+	if model, ok := ctx.Value(constants.DefaultModelKey).(string); ok {
+		return model
+	}
+	return ""
+}
+
+// WithDefaultModel adds a default model override to the context. Backends use
+// it in place of their configured default model, for the models they don't
+// map.
+func WithDefaultModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, constants.DefaultModelKey, model)
+}
+
+// GetClient retrieves the name of the client which authenticated the request
+func GetClient(ctx context.Context) string {
+	if name, ok := ctx.Value(constants.ClientKey).(string); ok {
+		return name
+	}
+	return ""
+}
+
+// WithClient adds the name of the client which authenticated the request to
+// the context
+func WithClient(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, constants.ClientKey, name)
+}
+
+// ScopeKey scopes a key to the client which authenticated the request, so the
+// requests of different clients never share what is stored under it
+func ScopeKey(ctx context.Context, key string) string {
+	return GetClient(ctx) + ":" + key
+}
+
+// GetTier retrieves the tier of the client which authenticated the request
+func GetTier(ctx context.Context) string {
+	if tier, ok := ctx.Value(constants.TierKey).(string); ok {
+		return tier
+	}
+	return ""
+}
+
+// WithTier adds the tier of the client which authenticated the request to the
+// context
+func WithTier(ctx context.Context, tier string) context.Context {
+	return context.WithValue(ctx, constants.TierKey, tier)
+}
+
+// GetPriority retrieves the priority class of the request, by which it is
+// queued for a backend
+func GetPriority(ctx context.Context) string {
+	if priority, ok := ctx.Value(constants.PriorityKey).(string); ok {
+		return priority
+	}
+	return ""
+}
+
+// WithPriority adds the priority class of the request to the context
+func WithPriority(ctx context.Context, priority string) context.Context {
+	return context.WithValue(ctx, constants.PriorityKey, priority)
+}
+
+// ReportTokens reports the tokens a completion used to the reporter in the
+// context, if any
+func ReportTokens(ctx context.Context, tokens int) {
+	if report, ok := ctx.Value(constants.TokensReporterKey).(func(int)); ok {
+		report(tokens)
+	}
+}
+
+// WithTokensReporter adds a function reporting the tokens a completion used to
+// the context, for rate limiting
+func WithTokensReporter(ctx context.Context, report func(int)) context.Context {
+	return context.WithValue(ctx, constants.TokensReporterKey, report)
+}
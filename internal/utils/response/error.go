@@ -0,0 +1,135 @@
+package response
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/api/openai/v1"
+)
+
+// OpenAI error types
+const (
+	ErrorTypeInvalidRequest    = "invalid_request_error"
+	ErrorTypeAuthentication    = "authentication_error"
+	ErrorTypePermission        = "permission_error"
+	ErrorTypeNotFound          = "not_found_error"
+	ErrorTypeRateLimit         = "rate_limit_error"
+	ErrorTypeInsufficientQuota = "insufficient_quota"
+	ErrorTypeServer            = "server_error"
+)
+
+// ErrorType returns the OpenAI error type matching an HTTP status code
+func ErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return ErrorTypeAuthentication
+	case status == http.StatusForbidden:
+		return ErrorTypePermission
+	case status == http.StatusNotFound:
+		return ErrorTypeNotFound
+	case status == http.StatusTooManyRequests:
+		return ErrorTypeRateLimit
+	case status >= http.StatusInternalServerError:
+		return ErrorTypeServer
+	default:
+		return ErrorTypeInvalidRequest
+	}
+}
+
+// WriteError writes an OpenAI-format error with the type matching status
+func WriteError(w http.ResponseWriter, status int, message string) {
+	WriteErrorResponse(w, status, openai.Error{
+		Message: message,
+		Type:    ErrorType(status),
+	})
+}
+
+// WriteErrorResponse writes an OpenAI-format error with the given status
+func WriteErrorResponse(w http.ResponseWriter, status int, e openai.Error) {
+	if e.Type == "" {
+		e.Type = ErrorType(status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(openai.ErrorResponse{Error: e})
+}
+
+// WriteUpstreamError converts an upstream error response, whose body has
+// already been read, into an OpenAI-format error and writes it. The
+// Retry-After and rate limit headers of the upstream response are preserved so
+// that clients back off.
+func WriteUpstreamError(w http.ResponseWriter, resp *http.Response, body []byte) {
+	CopyRateLimitHeaders(w.Header(), resp.Header)
+	status, e := UpstreamError(resp.StatusCode, body)
+	WriteErrorResponse(w, status, e)
+}
+
+// CopyRateLimitHeaders copies the Retry-After and x-ratelimit-* headers
+func CopyRateLimitHeaders(dst, src http.Header) {
+	for name, values := range src {
+		if name == "Retry-After" || name == "Retry-After-Ms" || strings.HasPrefix(name, "X-Ratelimit-") {
+			dst[name] = slices.Clone(values)
+		}
+	}
+}
+
+// UpstreamError converts the status and body of an upstream error response
+// into the equivalent OpenAI status and error. It understands the OpenAI-style
+// errors of DeepSeek and OpenRouter, where OpenRouter uses numeric codes, as
+// well as the plain string errors of Ollama.
+func UpstreamError(upstreamStatus int, body []byte) (int, openai.Error) {
+	status := upstreamStatus
+	var e openai.Error
+	var upstream struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &upstream); err == nil && len(upstream.Error) > 0 {
+		var detail struct {
+			Message string `json:"message"`
+			Param   any    `json:"param"`
+			Code    any    `json:"code"`
+		}
+		if err := json.Unmarshal(upstream.Error, &detail); err == nil {
+			e.Message = detail.Message
+			e.Param, _ = detail.Param.(string)
+			e.Code, _ = detail.Code.(string)
+		} else {
+			json.Unmarshal(upstream.Error, &e.Message)
+		}
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	switch status {
+	case http.StatusPaymentRequired:
+		// DeepSeek and OpenRouter report exhausted balances with 402, which
+		// OpenAI reports as a 429
+		status = http.StatusTooManyRequests
+		e.Type = ErrorTypeInsufficientQuota
+		e.Code = ErrorTypeInsufficientQuota
+	case http.StatusTooManyRequests:
+		e.Type = ErrorTypeRateLimit
+		if e.Code == "" || e.Code == ErrorTypeRateLimit {
+			e.Code = "rate_limit_exceeded"
+		}
+	case http.StatusUnprocessableEntity:
+		status = http.StatusBadRequest
+	case http.StatusRequestTimeout:
+		status = http.StatusGatewayTimeout
+	}
+	if e.Code == "" && status == http.StatusNotFound && strings.Contains(e.Message, "model") {
+		e.Type = ErrorTypeInvalidRequest
+		e.Code = "model_not_found"
+	}
+	if e.Type == "" {
+		e.Type = ErrorType(status)
+	}
+	if e.Message == "" {
+		e.Message = "upstream returned " + strconv.Itoa(upstreamStatus) + " " + http.StatusText(upstreamStatus)
+	}
+	return status, e
+}
@@ -0,0 +1,77 @@
+package response
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Pipe is an http.ResponseWriter which streams the response body to a reader
+// as it is written, so that a streaming response can be consumed and rewritten
+// while the handler is still producing it.
+type Pipe struct {
+	header  http.Header
+	status  int
+	started chan struct{}
+	once    sync.Once
+
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+// NewPipe creates a new Pipe
+func NewPipe() *Pipe {
+	reader, writer := io.Pipe()
+	return &Pipe{
+		header:  http.Header{},
+		status:  http.StatusOK,
+		started: make(chan struct{}),
+		reader:  reader,
+		writer:  writer,
+	}
+}
+
+func (p *Pipe) Header() http.Header {
+	return p.header
+}
+
+func (p *Pipe) WriteHeader(status int) {
+	p.once.Do(func() {
+		p.status = status
+		close(p.started)
+	})
+}
+
+func (p *Pipe) Write(b []byte) (int, error) {
+	p.WriteHeader(http.StatusOK)
+	return p.writer.Write(b)
+}
+
+// Flush is a no-op since every write is passed straight to the reader
+func (p *Pipe) Flush() {}
+
+// Close ends the response body. It must be called once the handler returns.
+func (p *Pipe) Close() error {
+	p.WriteHeader(http.StatusOK)
+	return p.writer.Close()
+}
+
+// Started is closed once the status code has been written
+func (p *Pipe) Started() <-chan struct{} {
+	return p.started
+}
+
+// Status returns the status code. It is only valid once Started is closed.
+func (p *Pipe) Status() int {
+	return p.status
+}
+
+// Read reads the response body
+func (p *Pipe) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+// CloseRead stops reading the response body, failing any further writes
+func (p *Pipe) CloseRead() error {
+	return p.reader.Close()
+}
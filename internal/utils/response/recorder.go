@@ -0,0 +1,49 @@
+package response
+
+import (
+	"bytes"
+	"maps"
+	"net/http"
+)
+
+// Recorder is an http.ResponseWriter which buffers the response in memory so
+// that it can be inspected or rewritten before being sent to the client.
+type Recorder struct {
+	header http.Header
+	Status int
+	Body   bytes.Buffer
+}
+
+// NewRecorder creates a new Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		header: http.Header{},
+		Status: http.StatusOK,
+	}
+}
+
+func (r *Recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *Recorder) WriteHeader(status int) {
+	r.Status = status
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	return r.Body.Write(b)
+}
+
+// Flush is a no-op which allows the Recorder to be used by streaming handlers
+func (r *Recorder) Flush() {}
+
+// WriteTo copies the recorded response, with body replaced if non-nil, to w
+func (r *Recorder) WriteTo(w http.ResponseWriter, body []byte) {
+	if body == nil {
+		body = r.Body.Bytes()
+	}
+	maps.Copy(w.Header(), r.header)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(r.Status)
+	w.Write(body)
+}
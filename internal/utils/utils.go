@@ -7,7 +7,26 @@ import (
 
 // GenerateRequestID creates a new random request ID
 func GenerateRequestID() string {
-	b := make([]byte, 8)
+	return randomHex(8)
+}
+
+// GenerateResponseID creates a new random chat completion ID
+func GenerateResponseID() string {
+	return "chatcmpl-" + randomHex(12)
+}
+
+// GenerateToolCallID creates a new random tool call ID
+func GenerateToolCallID() string {
+	return "call_" + randomHex(12)
+}
+
+// GenerateID creates a new random ID with the given prefix, such as "resp_"
+func GenerateID(prefix string) string {
+	return prefix + randomHex(12)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
 	rand.Read(b)
 	return hex.EncodeToString(b)
 }
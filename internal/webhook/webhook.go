@@ -0,0 +1,299 @@
+// Package webhook delivers events about the proxy's traffic to user-defined
+// URLs, signed with HMAC and retried on failure, for external alerting and
+// analytics
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/utils"
+	logutils "github.com/danilofalcao/cursor-deepseek/internal/utils/logger"
+	"github.com/pkg/errors"
+)
+
+// Event types
+const (
+	EventRequestStarted   = "request.started"
+	EventRequestCompleted = "request.completed"
+	EventRequestFailed    = "request.failed"
+	EventBudgetThreshold  = "budget.threshold"
+	EventBackendUnhealthy = "backend.unhealthy"
+	EventBackendHealthy   = "backend.healthy"
+)
+
+// EventTypes are every type of event which can be subscribed to
+var EventTypes = []string{
+	EventRequestStarted,
+	EventRequestCompleted,
+	EventRequestFailed,
+	EventBudgetThreshold,
+	EventBackendUnhealthy,
+	EventBackendHealthy,
+}
+
+// Headers of deliveries
+const (
+	IDHeader        = "X-Webhook-ID"
+	EventHeader     = "X-Webhook-Event"
+	TimestampHeader = "X-Webhook-Timestamp"
+	// SignatureHeader is sha256= followed by the hex HMAC-SHA256, keyed by the
+	// hook's secret, of the timestamp header, a period and the body
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultTimeout    = 10 * time.Second
+	// queueSize is how many events can wait to be delivered to a hook before
+	// new ones are dropped
+	queueSize = 1000
+	// retryBackoff is the delay before the first retry, doubling on each one
+	retryBackoff = time.Second
+)
+
+// Hook is a URL events are POSTed to
+type Hook struct {
+	URL string
+	// Secret, if set, signs deliveries in the X-Webhook-Signature header
+	Secret string
+	// Events are the types of events delivered, every type if empty
+	Events []string
+	// MaxRetries is how many times a failed delivery is retried, 3 if unset
+	MaxRetries int
+	// Timeout of a single delivery attempt, 10s if unset
+	Timeout time.Duration
+}
+
+// Event is the body of a delivery
+type Event struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    any    `json:"data"`
+}
+
+// Dispatcher delivers events to hooks in the background, so that sending an
+// event never blocks the request it is about
+type Dispatcher struct {
+	hooks  []*hook
+	client *http.Client
+	done   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+type hook struct {
+	Hook
+	queue chan Event
+}
+
+// New validates the hooks and creates a Dispatcher for them
+func New(hooks []Hook) (*Dispatcher, error) {
+	d := &Dispatcher{
+		client: &http.Client{},
+		done:   make(chan struct{}),
+	}
+	for _, h := range hooks {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("invalid webhook URL %s, must be an http or https URL", h.Redacted())
+		}
+		for _, event := range h.Events {
+			if !slices.Contains(EventTypes, event) {
+				return nil, errors.Errorf("invalid webhook event %q, must be one of %v", event, EventTypes)
+			}
+		}
+		if h.MaxRetries <= 0 {
+			h.MaxRetries = defaultMaxRetries
+		}
+		if h.Timeout <= 0 {
+			h.Timeout = defaultTimeout
+		}
+		d.hooks = append(d.hooks, &hook{
+			Hook:  h,
+			queue: make(chan Event, queueSize),
+		})
+	}
+	return d, nil
+}
+
+// Start delivers the queued events in the background until Close is called
+func (d *Dispatcher) Start(ctx context.Context) {
+	for _, h := range d.hooks {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.run(ctx, h)
+		}()
+	}
+}
+
+// Close stops delivering events, abandoning those still queued
+func (d *Dispatcher) Close() {
+	d.once.Do(func() {
+		close(d.done)
+	})
+	d.wg.Wait()
+}
+
+// Wants returns whether any hook is subscribed to the type of event, to skip
+// building events nobody receives
+func (d *Dispatcher) Wants(eventType string) bool {
+	if d == nil {
+		return false
+	}
+	for _, h := range d.hooks {
+		if h.wants(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send queues an event for delivery to the hooks subscribed to its type. If
+// a hook's queue is full, the event is dropped for it.
+func (d *Dispatcher) Send(ctx context.Context, eventType string, data any) {
+	if d == nil {
+		return
+	}
+	event := Event{
+		ID:      "evt_" + utils.GenerateRequestID(),
+		Type:    eventType,
+		Created: time.Now().Unix(),
+		Data:    data,
+	}
+	for _, h := range d.hooks {
+		if !h.wants(eventType) {
+			continue
+		}
+		select {
+		case h.queue <- event:
+		default:
+			logutils.FromContext(ctx).Warnf(ctx, "Dropping %s event %s for webhook %s, its queue is full", eventType, event.ID, h.Redacted())
+		}
+	}
+}
+
+// Redacted returns the hook's URL without its path and query, which often
+// hold a secret token, for logging
+func (h Hook) Redacted() string {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return "invalid URL"
+	}
+	if u.Path == "" && u.RawQuery == "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return u.Scheme + "://" + u.Host + "/***"
+}
+
+func (h *hook) wants(eventType string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, eventType)
+}
+
+func (d *Dispatcher) run(ctx context.Context, h *hook) {
+	for {
+		select {
+		case event := <-h.queue:
+			d.deliver(ctx, h, event)
+		case <-ctx.Done():
+			return
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// deliver POSTs the event to the hook, retrying with exponential backoff
+// while it fails with an error, 429 or 5xx
+func (d *Dispatcher) deliver(ctx context.Context, h *hook, event Event) {
+	lgr := logutils.FromContext(ctx)
+	body, err := json.Marshal(event)
+	if err != nil {
+		err = errors.Wrapf(err, "error encoding %s event", event.Type)
+		lgr.Error(ctx, err.Error())
+		return
+	}
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := d.post(ctx, h, event, body)
+		if err == nil {
+			lgr.Debugf(ctx, "Delivered %s event %s to webhook %s", event.Type, event.ID, h.Redacted())
+			return
+		}
+		if !retry || attempt >= h.MaxRetries {
+			lgr.Errorf(ctx, "Failed to deliver %s event %s to webhook %s: %s", event.Type, event.ID, h.Redacted(), err.Error())
+			return
+		}
+		lgr.Warnf(ctx, "Retrying %s event %s to webhook %s in %v: %s", event.Type, event.ID, h.Redacted(), backoff, err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		case <-d.done:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt, returning whether a failure should
+// be retried
+func (d *Dispatcher) post(ctx context.Context, h *hook, event Event, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "error creating request")
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cursor-deepseek-webhook")
+	req.Header.Set(IDHeader, event.ID)
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(TimestampHeader, timestamp)
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, timestamp, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		// Leave out the URL, which may hold a secret
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, errors.Wrap(err, "error sending request")
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true, errors.Errorf("unexpected status %s", resp.Status)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return false, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
+
+// Sign returns the signature of a delivery, for receivers to verify the
+// X-Webhook-Signature header with
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,599 @@
+// Package proxy exposes the OpenAI API proxy server as an embeddable library.
+//
+//	p, err := proxy.New(ctx,
+//		proxy.WithBackend(proxy.NewOllamaBackend(proxy.OllamaOptions{
+//			Endpoint:     "http://127.0.0.1:11434/api",
+//			DefaultModel: "llama3",
+//		})),
+//		proxy.WithPort("9000"),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	return p.Run(ctx)
+package proxy
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/danilofalcao/cursor-deepseek/internal/backend"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend/deepseek"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend/ollama"
+	"github.com/danilofalcao/cursor-deepseek/internal/backend/openrouter"
+	"github.com/danilofalcao/cursor-deepseek/internal/balancer"
+	"github.com/danilofalcao/cursor-deepseek/internal/cache"
+	"github.com/danilofalcao/cursor-deepseek/internal/contentfilter"
+	"github.com/danilofalcao/cursor-deepseek/internal/logger"
+	"github.com/danilofalcao/cursor-deepseek/internal/server"
+	"github.com/danilofalcao/cursor-deepseek/internal/server/middleware"
+	"github.com/danilofalcao/cursor-deepseek/internal/tiers"
+	"github.com/danilofalcao/cursor-deepseek/internal/transform"
+	"github.com/danilofalcao/cursor-deepseek/internal/usage"
+	"github.com/danilofalcao/cursor-deepseek/internal/webhook"
+	"github.com/pkg/errors"
+)
+
+// DefaultHTTPLimits are the limits of the proxy's connections which aren't
+// configured
+var DefaultHTTPLimits = server.DefaultHTTPLimits
+
+// DefaultShutdownTimeout is how long the requests in flight are waited for
+// when the proxy shuts down, unless configured otherwise
+const DefaultShutdownTimeout = 10 * time.Second
+
+type (
+	// Backend is an LLM backend requests are proxied to
+	Backend = backend.Backend
+	// Logger is the proxy's logger
+	Logger = logger.Logger
+	// LogSink is a destination the proxy's default logger writes to
+	LogSink = logger.Sink
+	// Price is the cost of a model's tokens in USD per million tokens
+	Price = usage.Price
+	// Budget limits the usage of a client API key over a day or month
+	Budget = usage.Budget
+	// Client is a named API key clients authenticate with
+	Client = middleware.Client
+	// RateLimit limits the requests and tokens per minute of a client API key
+	RateLimit = middleware.RateLimit
+	// Tier restricts the models, and caps the tokens, of the clients of a
+	// tier
+	Tier = tiers.Tier
+	// Chaos injects faults into the responses to clients
+	Chaos = middleware.Chaos
+	// Compression compresses the JSON responses of clients which accept it
+	Compression = middleware.Compression
+	// JWT configures the authentication of clients with JWTs
+	JWT = middleware.JWT
+	// Networks configures which source networks may call the proxy
+	Networks = middleware.Networks
+	// HTTPLimits protect the proxy from slow clients and oversized headers
+	HTTPLimits = server.HTTPLimits
+	// ContentFilterRule matches content to block or redact
+	ContentFilterRule = contentfilter.Rule
+	// SystemPromptRule rewrites or drops the client's system prompts
+	SystemPromptRule = transform.SystemRule
+	// Webhook is a URL events about the proxy's traffic are POSTed to
+	Webhook = webhook.Hook
+	// Middleware wraps the proxy's routes
+	Middleware = func(http.Handler) http.Handler
+
+	// Target is a weighted upstream endpoint of a backend
+	Target = balancer.Target
+	// ModelFilter restricts which models a backend will serve
+	ModelFilter = backend.ModelFilter
+	// Transport configures how a backend connects to its upstream
+	Transport = backend.Transport
+	// ConnPool configures the connections a backend keeps to its upstream
+	ConnPool = backend.ConnPool
+	// Retry configures how a backend retries requests failing transiently
+	Retry = backend.Retry
+	// Timeouts bound a backend's requests by whether they stream
+	Timeouts = backend.Timeouts
+	// Embedder is a backend which can embed text
+	Embedder = backend.Embedder
+
+	DeepseekOptions   = deepseek.Options
+	OpenrouterOptions = openrouter.Options
+	OllamaOptions     = ollama.Options
+)
+
+// NewDeepseekBackend creates a backend proxying to the DeepSeek API
+func NewDeepseekBackend(opts DeepseekOptions) Backend {
+	return deepseek.NewDeepseekBackend(opts)
+}
+
+// NewOpenrouterBackend creates a backend proxying to the OpenRouter API
+func NewOpenrouterBackend(opts OpenrouterOptions) Backend {
+	return openrouter.NewOpenrouterBackend(opts)
+}
+
+// NewOllamaBackend creates a backend proxying to an Ollama server
+func NewOllamaBackend(opts OllamaOptions) Backend {
+	return ollama.NewOllamaBackend(opts)
+}
+
+// NewLogger creates a logger with the given name and level, which is one of
+// trace, debug, info, warn, error or fatal.
+func NewLogger(ctx context.Context, name, level string) *Logger {
+	return logger.New(ctx, name, logger.LevelFromString(level), make(chan string, 1))
+}
+
+// Option configures a Proxy
+type Option func(*server.Options)
+
+// WithBackend sets the backend requests are proxied to. It is required.
+func WithBackend(be Backend) Option {
+	return func(o *server.Options) {
+		o.Backend = be
+	}
+}
+
+// WithListener serves the proxy on the given listener instead of a port
+func WithListener(l net.Listener) Option {
+	return func(o *server.Options) {
+		o.Listener = l
+	}
+}
+
+// WithPort serves the proxy on the given port, on all interfaces unless
+// WithHost is set
+func WithPort(port string) Option {
+	return func(o *server.Options) {
+		o.Port = port
+	}
+}
+
+// WithHost serves the proxy on the interface with the given address, such as
+// 127.0.0.1 to only accept local connections
+func WithHost(host string) Option {
+	return func(o *server.Options) {
+		o.Host = host
+	}
+}
+
+// WithAddresses serves the proxy on each of the addresses instead of the host
+// and port, as host:port or unix: followed by the path of a Unix socket, such
+// as unix:/run/cursor-deepseek/proxy.sock
+func WithAddresses(addrs ...string) Option {
+	return func(o *server.Options) {
+		o.Addresses = addrs
+	}
+}
+
+// WithSocketMode sets the permissions of the Unix sockets served on, which are
+// 0600 by default
+func WithSocketMode(mode fs.FileMode) Option {
+	return func(o *server.Options) {
+		o.SocketMode = mode
+	}
+}
+
+// WithHTTPLimits bounds how long clients may take to send requests and read
+// responses, and the size of their headers. The limits which are unset are
+// those of DefaultHTTPLimits.
+func WithHTTPLimits(limits HTTPLimits) Option {
+	return func(o *server.Options) {
+		o.HTTPLimits = limits
+	}
+}
+
+// WithReusePort sets SO_REUSEPORT on the TCP addresses the proxy listens on,
+// so that its replacement can listen on them before it is shut down, which is
+// supported on Linux, macOS and the BSDs
+func WithReusePort(reuse bool) Option {
+	return func(o *server.Options) {
+		o.ReusePort = reuse
+	}
+}
+
+// WithShutdownTimeout sets how long the requests in flight, such as long
+// streams, are waited for when the proxy shuts down, DefaultShutdownTimeout
+// by default
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(o *server.Options) {
+		if timeout > 0 {
+			o.ShutdownTimeout = timeout
+		}
+	}
+}
+
+// WithLogger sets the logger used by the proxy
+func WithLogger(lgr *Logger) Option {
+	return func(o *server.Options) {
+		o.Logger = lgr
+	}
+}
+
+// WithLogLevel sets the level of the proxy's default logger
+func WithLogLevel(level string) Option {
+	return func(o *server.Options) {
+		o.LogLevel = level
+	}
+}
+
+// WithLogFormat sets the format of the proxy's default logger, which is text
+// or json
+func WithLogFormat(format string) Option {
+	return func(o *server.Options) {
+		o.LogFormat = format
+	}
+}
+
+// WithModuleLogLevels overrides the level of the proxy's default logger for
+// the named modules, such as "deepseek" for the deepseek backend
+func WithModuleLogLevels(levels map[string]string) Option {
+	return func(o *server.Options) {
+		o.LogLevels = levels
+	}
+}
+
+// WithLogSinks sets where the proxy's default logger writes, which is stdout
+// if no sinks are set
+func WithLogSinks(sinks ...LogSink) Option {
+	return func(o *server.Options) {
+		o.LogSinks = append(o.LogSinks, sinks...)
+	}
+}
+
+// WithMiddleware wraps the proxy's routes with the given middleware. It runs
+// after the request has been assigned an ID and authenticated.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(o *server.Options) {
+		o.Middleware = append(o.Middleware, mw...)
+	}
+}
+
+// WithAPIKey requires clients to authenticate with an API key which is valid
+// for the backend
+func WithAPIKey(apikey string) Option {
+	return func(o *server.Options) {
+		o.ApiKey = apikey
+	}
+}
+
+// WithClients authenticates clients with their own named API keys instead of
+// the backend's. The name of the client identifies it in logs and usage
+// accounting.
+func WithClients(clients ...Client) Option {
+	return func(o *server.Options) {
+		o.Clients = append(o.Clients, clients...)
+	}
+}
+
+// WithRateLimit limits the requests and tokens per minute of each client API
+// key, unless its client has its own limit. Clients exceeding it are answered
+// with a 429 and a Retry-After header.
+func WithRateLimit(limit RateLimit) Option {
+	return func(o *server.Options) {
+		o.RateLimit = limit
+	}
+}
+
+// HashKey hashes a client API key with a random salt, for the KeyHash of a
+// Client, so the key needn't be stored in the config
+func HashKey(key string) (string, error) {
+	return middleware.HashKey(key)
+}
+
+// WithTierRateLimits limits the requests and tokens per minute of the clients
+// of each tier, which clients and JWTs carry, unless the client has its own
+// limit
+func WithTierRateLimits(limits map[string]RateLimit) Option {
+	return func(o *server.Options) {
+		o.TierRateLimits = limits
+	}
+}
+
+// WithTiers restricts the models the clients of each tier may request, and
+// caps the tokens they may generate. The requests of clients of other tiers
+// are unrestricted.
+func WithTiers(tiers map[string]Tier) Option {
+	return func(o *server.Options) {
+		o.Tiers = tiers
+	}
+}
+
+// WithJWT authenticates clients presenting JWTs signed with the keys of the
+// JWKS. The subject of a token identifies its client in logs, usage accounting
+// and rate limits. API keys are only accepted alongside if WithClients is set.
+func WithJWT(jwt JWT) Option {
+	return func(o *server.Options) {
+		o.JWT = jwt
+	}
+}
+
+// WithTLS serves HTTPS with the certificate and key files, which are reloaded
+// when they change, such as when they are renewed
+func WithTLS(certFile, keyFile string) Option {
+	return func(o *server.Options) {
+		o.TLSCertFile = certFile
+		o.TLSKeyFile = keyFile
+	}
+}
+
+// WithACME serves HTTPS with certificates for the hosts obtained from Let's
+// Encrypt, whose terms of service are accepted on behalf of the email. They
+// are cached in cacheDir if set. The TLS-ALPN challenge requires the proxy to
+// be reachable on port 443.
+func WithACME(cacheDir, email string, hosts ...string) Option {
+	return func(o *server.Options) {
+		o.ACMECacheDir = cacheDir
+		o.ACMEEmail = email
+		o.ACMEHosts = append(o.ACMEHosts, hosts...)
+	}
+}
+
+// WithClientCA requires clients to present a certificate signed by the CA
+// file, which identifies them by its common name, or else its first DNS or
+// email SAN, instead of an API key. It requires WithTLS.
+func WithClientCA(caFile string) Option {
+	return func(o *server.Options) {
+		o.TLSClientCAFile = caFile
+	}
+}
+
+// WithNetworks restricts which source networks may call the proxy, and
+// separately its admin API. Requests from other networks are rejected with a
+// 403.
+func WithNetworks(networks Networks) Option {
+	return func(o *server.Options) {
+		o.Networks = networks
+	}
+}
+
+// WithAdminAPIKey requires the key, instead of a client API key, for the
+// /admin endpoints
+func WithAdminAPIKey(apikey string) Option {
+	return func(o *server.Options) {
+		o.AdminApiKey = apikey
+	}
+}
+
+// WithMaxRequestBodySize rejects request bodies larger than size bytes with a
+// 413, instead of the default of 32 MiB. A negative size disables the
+// limit.
+func WithMaxRequestBodySize(size int64) Option {
+	return func(o *server.Options) {
+		o.MaxRequestBodySize = size
+	}
+}
+
+// WithDebugEndpoints serves the pprof profiles and expvar variables under
+// /admin/debug, behind the admin authentication
+func WithDebugEndpoints(enabled bool) Option {
+	return func(o *server.Options) {
+		o.DebugEndpoints = enabled
+	}
+}
+
+// WithTimeout sets the timeout of the requests which aren't served by the
+// backend, whose requests are bounded by its own Timeouts
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *server.Options) {
+		o.Timeout = timeout.String()
+	}
+}
+
+// WithHealthCheck sets how often, and with what timeout, the backend is
+// probed. A zero interval disables health checking.
+func WithHealthCheck(interval, timeout time.Duration) Option {
+	return func(o *server.Options) {
+		o.HealthCheckInterval = interval
+		o.HealthCheckTimeout = timeout
+	}
+}
+
+// WithPathPrefixes sets prefixes which are stripped from request paths that
+// don't match a route, such as /openai in /openai/v1/chat/completions. Paths
+// without the /v1 prefix are always routed to their /v1 route.
+func WithPathPrefixes(prefixes ...string) Option {
+	return func(o *server.Options) {
+		o.PathPrefixes = append(o.PathPrefixes, prefixes...)
+	}
+}
+
+// WithBatches enables the files and batches endpoints, persisting their state
+// in dir and executing up to concurrency requests of a batch at once
+func WithBatches(dir string, concurrency int) Option {
+	return func(o *server.Options) {
+		o.BatchDir = dir
+		o.BatchConcurrency = concurrency
+	}
+}
+
+// WithAudit records every request and response, with streamed responses
+// reassembled, to a JSON lines file at path. Authorization headers are always
+// redacted, as are the matches of the redact regular expressions in bodies.
+func WithAudit(path string, redact ...string) Option {
+	return func(o *server.Options) {
+		o.AuditPath = path
+		o.AuditRedact = append(o.AuditRedact, redact...)
+	}
+}
+
+// WithUsage enables usage accounting, persisting the tokens and cost of
+// requests per day, API key and model to the SQLite database at path. Costs
+// are priced by upstream model, and totals are served on /admin/usage.
+func WithUsage(path string, pricing map[string]Price) Option {
+	return func(o *server.Options) {
+		o.UsageDB = path
+		o.UsagePricing = pricing
+	}
+}
+
+// WithBudgets limits the usage of client API keys. Clients which exhaust a
+// budget are rejected until its next period. It requires WithUsage.
+func WithBudgets(budgets ...Budget) Option {
+	return func(o *server.Options) {
+		o.UsageBudgets = append(o.UsageBudgets, budgets...)
+	}
+}
+
+// WithSystemPrompt sends the system instructions before and after the
+// client's system prompts, which the rules rewrite or drop
+func WithSystemPrompt(before, after string, rules ...SystemPromptRule) Option {
+	return func(o *server.Options) {
+		o.SystemPrepend = before
+		o.SystemAppend = after
+		o.SystemRules = append(o.SystemRules, rules...)
+	}
+}
+
+// WithPromptVariables sets the variables expanded in the {{name}}
+// placeholders of the system instructions and the replacements of their
+// rules, along with the built-in {{date}}, {{time}}, {{backend}}, {{model}}
+// and {{client}}
+func WithPromptVariables(vars map[string]string) Option {
+	return func(o *server.Options) {
+		o.PromptVariables = vars
+	}
+}
+
+// WithContentFilter blocks or redacts the matches of the rules in prompts
+// before they are forwarded, and in responses if responses is set. Blocked
+// prompts are answered as blockWith says, with an "error", the default, or a
+// "finish_reason" of content_filter.
+func WithContentFilter(blockWith string, responses bool, rules ...ContentFilterRule) Option {
+	return func(o *server.Options) {
+		o.ContentFilterRules = append(o.ContentFilterRules, rules...)
+		o.ContentFilterResponses = responses
+		o.ContentFilterBlockWith = blockWith
+	}
+}
+
+// WithChaos injects faults into a percentage of the responses to clients,
+// such as errors and dropped connections, to verify how they behave when
+// providers misbehave
+func WithChaos(chaos Chaos) Option {
+	return func(o *server.Options) {
+		o.Chaos = chaos
+	}
+}
+
+// WithCompression, if enabled, compresses the non-streaming JSON responses of
+// at least its minimum size with gzip or brotli, for clients which accept them
+func WithCompression(compression Compression) Option {
+	return func(o *server.Options) {
+		o.Compression = compression
+	}
+}
+
+// WithDeduplication, if enabled, collapses the identical non-streaming chat
+// completions a client has in flight into a single upstream request, whose
+// response is served to all of them
+func WithDeduplication(enabled bool) Option {
+	return func(o *server.Options) {
+		o.Deduplicate = enabled
+	}
+}
+
+// WithCache caches the responses to non-streaming chat completions for ttl,
+// serving identical requests, streaming or not, from the cache. The cache is
+// shared through Redis if WithRedis is set.
+func WithCache(ttl time.Duration) Option {
+	return func(o *server.Options) {
+		o.CacheTTL = ttl
+	}
+}
+
+// WithSemanticCache also serves requests from the cache set by WithCache when
+// the embedding of their final user message with model has a cosine
+// similarity of at least threshold to that of a cached request, which differs
+// from them by that message alone. The most recent maxEntries responses are
+// indexed, in memory.
+func WithSemanticCache(embedder Embedder, model string, threshold float64, maxEntries int) Option {
+	return func(o *server.Options) {
+		o.SemanticCache = cache.SemanticOptions{
+			Embedder:   embedder,
+			Model:      model,
+			Threshold:  threshold,
+			MaxEntries: maxEntries,
+		}
+	}
+}
+
+// WithRedis shares the rate limits and budgets between the replicas of the
+// proxy through the Redis database at url, such as redis://localhost:6379/0.
+// Its keys are prefixed by prefix.
+func WithRedis(url, prefix string) Option {
+	return func(o *server.Options) {
+		o.RedisURL = url
+		o.RedisPrefix = prefix
+	}
+}
+
+// WithWebhooks POSTs events about requests, budget thresholds and the
+// backend's health to the hooks
+func WithWebhooks(hooks ...Webhook) Option {
+	return func(o *server.Options) {
+		o.Webhooks = append(o.Webhooks, hooks...)
+	}
+}
+
+// Proxy is an embeddable instance of the proxy server
+type Proxy struct {
+	server          *server.Server
+	exitCh          chan string
+	shutdownTimeout time.Duration
+}
+
+// New creates a new Proxy
+func New(ctx context.Context, opts ...Option) (*Proxy, error) {
+	exitCh := make(chan string, 1)
+	serverOpts := server.Options{
+		ExitCh:              exitCh,
+		HealthCheckInterval: 30 * time.Second,
+		ShutdownTimeout:     DefaultShutdownTimeout,
+	}
+	for _, opt := range opts {
+		opt(&serverOpts)
+	}
+
+	svr, err := server.New(ctx, serverOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating server")
+	}
+	return &Proxy{
+		server:          svr,
+		exitCh:          exitCh,
+		shutdownTimeout: serverOpts.ShutdownTimeout,
+	}, nil
+}
+
+// Reload applies the backend, API keys, clients, rate limits and log levels
+// of the options to the running proxy. New requests are served by the new
+// backend, while those in flight finish on the previous one. The other
+// options are ignored until the proxy is restarted.
+func (p *Proxy) Reload(opts ...Option) error {
+	var serverOpts server.Options
+	for _, opt := range opts {
+		opt(&serverOpts)
+	}
+	return p.server.Reload(serverOpts)
+}
+
+// Run serves the proxy until the context is cancelled, at which point it is
+// gracefully shut down, waiting up to the shutdown timeout for the requests in
+// flight, or until the server fails.
+func (p *Proxy) Run(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.server.Start()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case s := <-p.exitCh:
+		return errors.Errorf("killed with message %s", s)
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), p.shutdownTimeout)
+		defer cancel()
+		return p.server.Shutdown(shutdownCtx)
+	}
+}